@@ -0,0 +1,284 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package natsexport publishes committed state events to a NATS (JetStream) subject.
+//
+// The package doesn't depend on the NATS client library: the messages are published via
+// the Publisher interface, which is a thin adapter over the JetStream client, e.g.:
+//
+//	type jsPublisher struct{ js jetstream.JetStream }
+//
+//	func (p jsPublisher) Publish(ctx context.Context, msg natsexport.Message) error {
+//		_, err := p.js.PublishMsg(ctx, &nats.Msg{Subject: msg.Subject, Data: msg.Data, Header: nats.Header(msg.Header)})
+//
+//		return err
+//	}
+package natsexport
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"go.uber.org/zap"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+const (
+	// BookmarkHeader is the message header carrying the hex-encoded event bookmark.
+	BookmarkHeader = "Cosi-Bookmark"
+
+	// MsgIDHeader is the JetStream message deduplication header.
+	//
+	// It is set to the bookmark, so that events re-published after a restart are deduplicated by JetStream.
+	MsgIDHeader = "Nats-Msg-Id"
+)
+
+// Message is a message to publish.
+type Message struct {
+	Header  http.Header
+	Subject string
+	Data    []byte
+}
+
+// Publisher publishes messages to NATS.
+//
+// Publish should return only after the message is persisted (i.e. acknowledged by JetStream).
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Options configures the Exporter.
+type Options struct {
+	// Logger is the logger to use for logging.
+	Logger *zap.Logger
+
+	// StartFromBookmark resumes the export after the given bookmark.
+	//
+	// Default is to export the events happening after the exporter is started.
+	StartFromBookmark state.Bookmark
+
+	// IdleInterval is the interval of advancing the bookmarks of the kinds without events (see LastBookmark).
+	//
+	// Default is 1 minute.
+	IdleInterval time.Duration
+}
+
+// Exporter publishes the events of the configured resource kinds to a NATS subject.
+//
+// The event is encoded with State.MarshalEventJSON (masking the specs of the redacted kinds), the bookmark is passed in the message headers.
+// Events of a single kind are published in order, events of different kinds might interleave.
+type Exporter struct {
+	st        *sqlite.State
+	publisher Publisher
+	bookmarks map[kindKey]state.Bookmark
+	options   Options
+	subject   string
+	kinds     []resource.Kind
+	mu        sync.Mutex
+}
+
+type kindKey struct {
+	ns  resource.Namespace
+	typ resource.Type
+}
+
+func keyOf(kind resource.Kind) kindKey {
+	return kindKey{ns: kind.Namespace(), typ: kind.Type()}
+}
+
+// NewExporter creates a new Exporter.
+func NewExporter(st *sqlite.State, publisher Publisher, subject string, kinds []resource.Kind, options Options) *Exporter {
+	if options.Logger == nil {
+		options.Logger = zap.NewNop()
+	}
+
+	if options.IdleInterval <= 0 {
+		options.IdleInterval = time.Minute
+	}
+
+	bookmarks := make(map[kindKey]state.Bookmark, len(kinds))
+
+	for _, kind := range kinds {
+		bookmarks[keyOf(kind)] = options.StartFromBookmark
+	}
+
+	return &Exporter{
+		st:        st,
+		publisher: publisher,
+		bookmarks: bookmarks,
+		options:   options,
+		subject:   subject,
+		kinds:     kinds,
+	}
+}
+
+// LastBookmark returns the bookmark the export can be resumed from without gaps.
+//
+// It can be persisted and passed as Options.StartFromBookmark to resume the export.
+// As kinds are watched independently, some events after the bookmark might have been published already;
+// JetStream deduplicates such events by the message ID.
+// The bookmarks of the kinds without events are advanced every Options.IdleInterval, so an idle kind
+// doesn't hold the bookmark back behind the compaction.
+// LastBookmark returns nil if the export hasn't started yet.
+func (e *Exporter) LastBookmark() state.Bookmark {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var result state.Bookmark
+
+	for _, bookmark := range e.bookmarks {
+		if bookmark == nil {
+			return nil
+		}
+
+		if cmp, err := sqlite.CompareBookmarks(bookmark, result); result == nil || (err == nil && cmp < 0) {
+			result = bookmark
+		}
+	}
+
+	return result
+}
+
+// Run exports the events until the context is canceled or publishing fails.
+//
+// If Run fails, it can be called again to resume the export after the last published events.
+func (e *Exporter) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan state.Event)
+
+	for _, kind := range e.kinds {
+		e.mu.Lock()
+		bookmark := e.bookmarks[keyOf(kind)]
+		e.mu.Unlock()
+
+		// without a bookmark, the watch reports its starting position first
+		opt := state.WithBootstrapBookmark(true)
+		if bookmark != nil {
+			opt = state.WithKindStartFromBookmark(bookmark)
+		}
+
+		if err := e.st.WatchKind(ctx, kind, ch, opt); err != nil {
+			return fmt.Errorf("failed to watch %q: %w", kind, err)
+		}
+	}
+
+	ticker := time.NewTicker(e.options.IdleInterval)
+	defer ticker.Stop()
+
+	for {
+		var event state.Event
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			e.advanceIdleKinds(ctx)
+
+			continue
+		case event = <-ch:
+		}
+
+		switch event.Type {
+		case state.Errored:
+			return fmt.Errorf("watch failed: %w", event.Error)
+		case state.Bootstrapped:
+			continue
+		case state.Created, state.Updated, state.Destroyed, state.Noop:
+		}
+
+		if event.Resource == nil {
+			continue
+		}
+
+		if event.Type == state.Noop && resource.IsTombstone(event.Resource) {
+			e.setBookmark(event)
+
+			continue
+		}
+
+		if err := e.publish(ctx, event); err != nil {
+			return err
+		}
+
+		e.setBookmark(event)
+	}
+}
+
+// advanceIdleKinds moves the bookmarks of the kinds without events since their bookmark to the last event.
+//
+// The events of the kind are published by its watch in order, so if there are none after the bookmark,
+// the export of the kind can be resumed from the last event without gaps.
+func (e *Exporter) advanceIdleKinds(ctx context.Context) {
+	for _, kind := range e.kinds {
+		e.mu.Lock()
+		bookmark := e.bookmarks[keyOf(kind)]
+		e.mu.Unlock()
+
+		if bookmark == nil {
+			continue
+		}
+
+		changes, err := e.st.ListChangedSince(ctx, kind, bookmark)
+		if err != nil {
+			e.options.Logger.Debug("failed to check idle kind", zap.String("namespace", kind.Namespace()), zap.String("type", kind.Type()), zap.Error(err))
+
+			continue
+		}
+
+		if changes.Events > 0 {
+			// the watch publishes the events, and advances the bookmark
+			continue
+		}
+
+		e.mu.Lock()
+
+		// the watch might have published an event meanwhile
+		if cmp, err := sqlite.CompareBookmarks(changes.Bookmark, e.bookmarks[keyOf(kind)]); err == nil && cmp > 0 {
+			e.bookmarks[keyOf(kind)] = changes.Bookmark
+		}
+
+		e.mu.Unlock()
+	}
+}
+
+func (e *Exporter) setBookmark(event state.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.bookmarks[keyOf(event.Resource.Metadata())] = event.Bookmark
+}
+
+func (e *Exporter) publish(ctx context.Context, event state.Event) error {
+	data, err := e.st.MarshalEventJSON(event)
+	if err != nil {
+		return err
+	}
+
+	bookmark := hex.EncodeToString(event.Bookmark)
+
+	header := http.Header{}
+	header.Set(BookmarkHeader, bookmark)
+	header.Set(MsgIDHeader, bookmark)
+
+	if err = e.publisher.Publish(ctx, Message{
+		Subject: e.subject,
+		Data:    data,
+		Header:  header,
+	}); err != nil {
+		return fmt.Errorf("failed to publish event %s: %w", bookmark, err)
+	}
+
+	e.options.Logger.Debug("published event", zap.String("subject", e.subject), zap.String("bookmark", bookmark))
+
+	return nil
+}
@@ -0,0 +1,225 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natsexport_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap/zaptest"
+	zombiesqlite "zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/natsexport"
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+type mockPublisher struct {
+	err      error
+	messages []natsexport.Message
+	mu       sync.Mutex
+}
+
+func (p *mockPublisher) Publish(_ context.Context, msg natsexport.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+
+	p.messages = append(p.messages, msg)
+
+	return nil
+}
+
+func (p *mockPublisher) ids(t *testing.T) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([]string, 0, len(p.messages))
+
+	for _, msg := range p.messages {
+		var event map[string]any
+
+		require.NoError(t, json.Unmarshal(msg.Data, &event))
+
+		ids = append(ids, event["event"].(string)+":"+event["id"].(string)) //nolint:forcetypeassert
+	}
+
+	return ids
+}
+
+func newState(t *testing.T, opts ...sqlite.StateOption) *sqlite.State {
+	t.Helper()
+
+	pool, err := sqlitexx.NewPool("file:"+filepath.Join(t.TempDir(), "state.db"),
+		sqlitexx.PoolOptions{
+			Flags: zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenWAL | zombiesqlite.OpenURI,
+		},
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, pool.Close())
+	})
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{}, append([]sqlite.StateOption{sqlite.WithLogger(zaptest.NewLogger(t))}, opts...)...)
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	return st
+}
+
+func runExporter(t *testing.T, exporter *natsexport.Exporter) (context.CancelFunc, <-chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- exporter.Run(ctx)
+	}()
+
+	// wait for the exporter to start watching
+	require.Eventually(t, func() bool { return exporter.LastBookmark() != nil }, 5*time.Second, time.Millisecond)
+
+	return cancel, errCh
+}
+
+func TestExporter(t *testing.T) {
+	t.Parallel()
+
+	st := newState(t)
+	ctx := t.Context()
+
+	publisher := &mockPublisher{}
+	kinds := []resource.Kind{conformance.NewPathResource("ns1", "").Metadata()}
+
+	exporter := natsexport.NewExporter(st, publisher, "cosi.events", kinds, natsexport.Options{Logger: zaptest.NewLogger(t)})
+
+	cancel, errCh := runExporter(t, exporter)
+
+	res := conformance.NewPathResource("ns1", "a")
+
+	require.NoError(t, st.Create(ctx, res))
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "other")))
+	require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, []string{"created:a", "destroyed:a"}, publisher.ids(t))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-errCh)
+
+	bookmark := exporter.LastBookmark()
+
+	publisher.mu.Lock()
+	lastMsg := publisher.messages[len(publisher.messages)-1]
+	publisher.mu.Unlock()
+
+	assert.Equal(t, "cosi.events", lastMsg.Subject)
+	assert.Equal(t, hex.EncodeToString(bookmark), lastMsg.Header.Get(natsexport.BookmarkHeader))
+	assert.Equal(t, hex.EncodeToString(bookmark), lastMsg.Header.Get(natsexport.MsgIDHeader))
+
+	// events while the exporter is stopped are published on resume
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "b")))
+
+	resumed := &mockPublisher{}
+	exporter = natsexport.NewExporter(st, resumed, "cosi.events", kinds, natsexport.Options{StartFromBookmark: bookmark})
+
+	cancel, errCh = runExporter(t, exporter)
+	defer cancel()
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, []string{"created:b"}, resumed.ids(t))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// publishing errors stop the exporter
+	resumed.mu.Lock()
+	resumed.err = errors.New("nats unavailable")
+	resumed.mu.Unlock()
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "c")))
+
+	require.ErrorContains(t, <-errCh, "nats unavailable")
+}
+
+func TestExporterIdleKind(t *testing.T) {
+	t.Parallel()
+
+	st := newState(t,
+		sqlite.WithCompactKeepEvents(1),
+		sqlite.WithCompactMinAge(-time.Minute),
+		sqlite.WithCompactionInterval(0),
+	)
+	ctx := t.Context()
+
+	publisher := &mockPublisher{}
+	kinds := []resource.Kind{
+		conformance.NewPathResource("ns1", "").Metadata(),
+		conformance.NewPathResource("ns2", "").Metadata(),
+	}
+
+	exporter := natsexport.NewExporter(st, publisher, "cosi.events", kinds, natsexport.Options{IdleInterval: 10 * time.Millisecond})
+
+	cancel, errCh := runExporter(t, exporter)
+
+	// only the first kind has events
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", id)))
+	}
+
+	bounds, err := st.EventBounds(ctx)
+	require.NoError(t, err)
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, bounds.Newest, exporter.LastBookmark())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-errCh)
+
+	result, err := st.Compact(ctx)
+	require.NoError(t, err)
+	assert.Positive(t, result.EventsCompacted)
+
+	// the export resumes after the compaction, including the idle kind
+	resumed := &mockPublisher{}
+	exporter = natsexport.NewExporter(st, resumed, "cosi.events", kinds, natsexport.Options{StartFromBookmark: exporter.LastBookmark()})
+
+	cancel, errCh = runExporter(t, exporter)
+	defer cancel()
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "d")))
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, []string{"created:d"}, resumed.ids(t))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case err = <-errCh:
+		require.NoError(t, err)
+	default:
+	}
+}
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
@@ -0,0 +1,272 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// structField is a struct field mapped to a parameter or column name.
+type structField struct {
+	name  string
+	index []int
+}
+
+var structFieldsCache sync.Map // map[reflect.Type][]structField
+
+// structFields returns the fields of the struct type with the `sql` tag.
+func structFields(typ reflect.Type) []structField {
+	if fields, ok := structFieldsCache.Load(typ); ok {
+		return fields.([]structField) //nolint:forcetypeassert,errcheck
+	}
+
+	var fields []structField
+
+	for _, field := range reflect.VisibleFields(typ) {
+		name, _, _ := strings.Cut(field.Tag.Get("sql"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		fields = append(fields, structField{name: name, index: field.Index})
+	}
+
+	structFieldsCache.Store(typ, fields)
+
+	return fields
+}
+
+func structValue(v any) (reflect.Value, error) {
+	val := reflect.ValueOf(v)
+
+	for val.Kind() == reflect.Pointer {
+		if val.IsNil() {
+			return reflect.Value{}, fmt.Errorf("sqlitexx: nil %s", val.Type())
+		}
+
+		val = val.Elem()
+	}
+
+	if val.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("sqlitexx: %s is not a struct", val.Type())
+	}
+
+	return val, nil
+}
+
+// BindStruct binds the fields of the struct v (or a pointer to it) to the named parameters of the statement.
+//
+// The parameter name comes from the `sql` field tag: `sql:"namespace"` binds the $namespace, :namespace
+// or @namespace parameter. Fields without the tag and fields without the matching parameter are skipped,
+// so the same struct can be used with several statements and with ScanStruct.
+//
+// Supported field types are strings, []byte, bools, integers and floats, and pointers to them;
+// nil pointers and nil []byte are bound as NULL. Unsigned integers are bound as int64, so values
+// above math.MaxInt64 wrap around, as with BindUint64.
+func BindStruct(stmt *sqlite.Stmt, v any) error {
+	val, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	params := make(map[string]int, stmt.BindParamCount())
+
+	for i := 1; i <= stmt.BindParamCount(); i++ {
+		name := stmt.BindParamName(i)
+		if name != "" {
+			params[name[1:]] = i
+		}
+	}
+
+	for _, field := range structFields(val.Type()) {
+		param, ok := params[field.name]
+		if !ok {
+			continue
+		}
+
+		if err = bindValue(stmt, param, val.FieldByIndex(field.index)); err != nil {
+			return fmt.Errorf("sqlitexx: field %q: %w", field.name, err)
+		}
+	}
+
+	return nil
+}
+
+func bindValue(stmt *sqlite.Stmt, param int, val reflect.Value) error {
+	switch val.Kind() { //nolint:exhaustive
+	case reflect.Pointer:
+		if val.IsNil() {
+			stmt.BindNull(param)
+
+			return nil
+		}
+
+		return bindValue(stmt, param, val.Elem())
+	case reflect.String:
+		stmt.BindText(param, val.String())
+	case reflect.Bool:
+		stmt.BindBool(param, val.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		stmt.BindInt64(param, val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		stmt.BindInt64(param, int64(val.Uint())) //nolint:gosec
+	case reflect.Float32, reflect.Float64:
+		stmt.BindFloat(param, val.Float())
+	case reflect.Slice:
+		if val.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %s", val.Type())
+		}
+
+		if val.IsNil() {
+			stmt.BindNull(param)
+		} else {
+			stmt.BindBytes(param, val.Bytes())
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", val.Type())
+	}
+
+	return nil
+}
+
+// BindStruct binds the fields of the struct v to the named parameters, see BindStruct.
+//
+// If the struct can't be bound, the error is returned when the query is executed.
+func (q *Query) BindStruct(v any) *Query {
+	if err := BindStruct(q.stmt, v); err != nil && q.err == nil {
+		q.err = err
+	}
+
+	if q.tracer != nil && q.err == nil {
+		q.recordStruct(v)
+	}
+
+	return q
+}
+
+// recordStruct records the fields bound by BindStruct for the tracer.
+func (q *Query) recordStruct(v any) {
+	val, err := structValue(v)
+	if err != nil {
+		return
+	}
+
+	for _, field := range structFields(val.Type()) {
+		for i := 1; i <= q.stmt.BindParamCount(); i++ {
+			name := q.stmt.BindParamName(i)
+			if name == "" || name[1:] != field.name {
+				continue
+			}
+
+			fieldVal := val.FieldByIndex(field.index)
+
+			for fieldVal.Kind() == reflect.Pointer && !fieldVal.IsNil() {
+				fieldVal = fieldVal.Elem()
+			}
+
+			var value any
+
+			if fieldVal.Kind() != reflect.Pointer && (fieldVal.Kind() != reflect.Slice || !fieldVal.IsNil()) {
+				value = fieldVal.Interface()
+			}
+
+			q.recordParam(name, value)
+		}
+	}
+}
+
+// ScanStruct sets the fields of the struct pointed to by v from the columns of the current row.
+//
+// The columns are matched to the fields by the `sql` field tag like in BindStruct,
+// the columns without the matching field are ignored, and NULL columns set the fields to their zero values.
+func ScanStruct(stmt *sqlite.Stmt, v any) error {
+	if reflect.ValueOf(v).Kind() != reflect.Pointer {
+		return fmt.Errorf("sqlitexx: ScanStruct: %T is not a pointer", v)
+	}
+
+	val, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range structFields(val.Type()) {
+		col := stmt.ColumnIndex(field.name)
+		if col < 0 {
+			continue
+		}
+
+		if err = scanValue(stmt, col, val.FieldByIndex(field.index)); err != nil {
+			return fmt.Errorf("sqlitexx: column %q: %w", field.name, err)
+		}
+	}
+
+	return nil
+}
+
+func scanValue(stmt *sqlite.Stmt, col int, val reflect.Value) error {
+	if stmt.ColumnIsNull(col) {
+		val.SetZero()
+
+		return nil
+	}
+
+	switch val.Kind() { //nolint:exhaustive
+	case reflect.Pointer:
+		elem := reflect.New(val.Type().Elem())
+
+		if err := scanValue(stmt, col, elem.Elem()); err != nil {
+			return err
+		}
+
+		val.Set(elem)
+	case reflect.String:
+		val.SetString(stmt.ColumnText(col))
+	case reflect.Bool:
+		val.SetBool(stmt.ColumnBool(col))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val.SetInt(stmt.ColumnInt64(col))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val.SetUint(uint64(stmt.ColumnInt64(col))) //nolint:gosec
+	case reflect.Float32, reflect.Float64:
+		val.SetFloat(stmt.ColumnFloat(col))
+	case reflect.Slice:
+		if val.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %s", val.Type())
+		}
+
+		buf := make([]byte, stmt.ColumnLen(col))
+		stmt.ColumnBytes(col, buf)
+
+		val.SetBytes(buf)
+	default:
+		return fmt.Errorf("unsupported type %s", val.Type())
+	}
+
+	return nil
+}
+
+// ScanRows returns a ResultFunc which scans each row into a new T (see ScanStruct) and passes it to fn.
+//
+//	err = q.QueryAll(sqlitexx.ScanRows(func(r row) error {
+//		rows = append(rows, r)
+//
+//		return nil
+//	}))
+func ScanRows[T any](fn func(T) error) ResultFunc {
+	return func(stmt *sqlite.Stmt) error {
+		var row T
+
+		if err := ScanStruct(stmt, &row); err != nil {
+			return err
+		}
+
+		return fn(row)
+	}
+}
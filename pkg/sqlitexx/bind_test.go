@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+type testRow struct {
+	ID      string  `sql:"id"`
+	Version uint64  `sql:"version"`
+	Phase   int     `sql:"phase"`
+	Spec    []byte  `sql:"spec"`
+	Owner   *string `sql:"owner"`
+	Deleted bool    `sql:"deleted"`
+	Score   float64 `sql:"score"`
+
+	Ignored string
+}
+
+func TestBindStruct(t *testing.T) {
+	t.Parallel()
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{LowWatermark: 1, HighWatermark: 1})
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn,
+		`CREATE TABLE t (id TEXT NOT NULL, version INTEGER NOT NULL, phase INTEGER NOT NULL, spec BLOB, owner TEXT, deleted INTEGER NOT NULL, score REAL NOT NULL)`, nil))
+
+	owner := "ctrl"
+
+	rows := []testRow{
+		{ID: "a", Version: 1, Phase: 2, Spec: []byte("spec"), Owner: &owner, Deleted: true, Score: 0.5},
+		{ID: "b", Version: 3},
+	}
+
+	for _, row := range rows {
+		q, err := sqlitexx.NewQuery(conn,
+			`INSERT INTO t (id, version, phase, spec, owner, deleted, score) VALUES ($id, $version, :phase, @spec, $owner, $deleted, $score)`)
+		require.NoError(t, err)
+
+		require.NoError(t, q.BindStruct(row).Exec())
+	}
+
+	var scanned []testRow
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT *, 'extra' AS extra FROM t WHERE version >= $version ORDER BY id`)
+	require.NoError(t, err)
+
+	require.NoError(t, q.BindStruct(&testRow{Version: 1}).QueryAll(sqlitexx.ScanRows(func(row testRow) error {
+		scanned = append(scanned, row)
+
+		return nil
+	})))
+
+	assert.Equal(t, rows, scanned)
+
+	// unsupported field types are reported on execution
+	q, err = sqlitexx.NewQuery(conn, `SELECT id FROM t WHERE id = $id`)
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, q.BindStruct(struct {
+		ID []string `sql:"id"`
+	}{}).QueryAll(func(*zombiesqlite.Stmt) error { return nil }), `field "id": unsupported type []string`)
+
+	q, err = sqlitexx.NewQuery(conn, `SELECT id FROM t WHERE id = $id`)
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, q.BindStruct(42).Exec(), "int is not a struct")
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// BindZeroBlob binds a blob of size zero bytes, which reserves the space to be filled with WriteBlob.
+func (q *Query) BindZeroBlob(name string, size int64) *Query {
+	q.stmt.SetZeroBlob(name, size)
+
+	return q
+}
+
+// ReadBlob reads the blob in the column of the row of the table of the main database, appending it to buf[:0].
+//
+// The blob is read incrementally into buf, so the buffer can be reused between the calls to avoid allocations.
+func ReadBlob(conn *sqlite.Conn, table, column string, rowid int64, buf []byte) ([]byte, error) {
+	blob, err := conn.OpenBlob("main", table, column, rowid, false)
+	if err != nil {
+		return buf[:0], err
+	}
+
+	defer blob.Close() //nolint:errcheck
+
+	buf = slices.Grow(buf[:0], int(blob.Size()))[:blob.Size()]
+
+	if _, err = io.ReadFull(blob, buf); err != nil {
+		return buf[:0], err
+	}
+
+	return buf, nil
+}
+
+// CopyBlob streams the blob in the column of the row of the table of the main database to w.
+//
+// It returns the number of bytes written.
+func CopyBlob(conn *sqlite.Conn, table, column string, rowid int64, w io.Writer) (int64, error) {
+	blob, err := conn.OpenBlob("main", table, column, rowid, false)
+	if err != nil {
+		return 0, err
+	}
+
+	defer blob.Close() //nolint:errcheck
+
+	return blob.WriteTo(w)
+}
+
+// WriteBlob streams r into the blob in the column of the row of the table of the main database.
+//
+// Incremental I/O can't change the size of the blob, so it should be reserved first with BindZeroBlob
+// (or zeroblob() in SQL). It returns the number of bytes written, and an error if r doesn't fit into the blob.
+func WriteBlob(conn *sqlite.Conn, table, column string, rowid int64, r io.Reader) (int64, error) {
+	blob, err := conn.OpenBlob("main", table, column, rowid, true)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := blob.ReadFrom(io.LimitReader(r, blob.Size()))
+	if err != nil {
+		blob.Close() //nolint:errcheck
+
+		return n, err
+	}
+
+	// check that the whole r fits into the blob
+	var extra [1]byte
+
+	if m, _ := io.ReadFull(r, extra[:]); m > 0 {
+		blob.Close() //nolint:errcheck
+
+		return n, fmt.Errorf("sqlitexx: data doesn't fit into the blob of %d bytes", blob.Size())
+	}
+
+	return n, blob.Close()
+}
@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+func TestBlob(t *testing.T) {
+	t.Parallel()
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{LowWatermark: 1, HighWatermark: 1})
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `CREATE TABLE t (id INTEGER PRIMARY KEY, data BLOB NOT NULL)`, nil))
+
+	data := strings.Repeat("0123456789", 10000)
+
+	q, err := sqlitexx.NewQuery(conn, `INSERT INTO t (id, data) VALUES (1, $data)`)
+	require.NoError(t, err)
+	require.NoError(t, q.BindZeroBlob("$data", int64(len(data))).Exec())
+
+	n, err := sqlitexx.WriteBlob(conn, "t", "data", 1, strings.NewReader(data))
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), n)
+
+	buf := make([]byte, 0, 16)
+
+	buf, err = sqlitexx.ReadBlob(conn, "t", "data", 1, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(buf))
+
+	// the buffer is reused
+	q, err = sqlitexx.NewQuery(conn, `INSERT INTO t (id, data) VALUES (2, $data)`)
+	require.NoError(t, err)
+	require.NoError(t, q.BindBytes("$data", []byte("short")).Exec())
+
+	short, err := sqlitexx.ReadBlob(conn, "t", "data", 2, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "short", string(short))
+	assert.Same(t, &buf[0], &short[0])
+
+	var out bytes.Buffer
+
+	n, err = sqlitexx.CopyBlob(conn, "t", "data", 1, &out)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), n)
+	assert.Equal(t, data, out.String())
+
+	_, err = sqlitexx.WriteBlob(conn, "t", "data", 2, strings.NewReader("too long"))
+	require.ErrorContains(t, err, "doesn't fit into the blob of 5 bytes")
+
+	_, err = sqlitexx.ReadBlob(conn, "t", "data", 3, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// connValues associates values with the connections (e.g. Faults).
+//
+// The statements look the values up on each run, so the lookup is skipped while no values are set.
+type connValues[T any] struct {
+	values sync.Map // map[*sqlite.Conn]T
+	count  atomic.Int64
+}
+
+func (c *connValues[T]) set(conn *sqlite.Conn, value T) {
+	if _, loaded := c.values.Swap(conn, value); !loaded {
+		c.count.Add(1)
+	}
+}
+
+func (c *connValues[T]) remove(conn *sqlite.Conn) {
+	if _, loaded := c.values.LoadAndDelete(conn); loaded {
+		c.count.Add(-1)
+	}
+}
+
+func (c *connValues[T]) get(conn *sqlite.Conn) (T, bool) {
+	var zero T
+
+	if c.count.Load() == 0 {
+		return zero, false
+	}
+
+	value, ok := c.values.Load(conn)
+	if !ok {
+		return zero, false
+	}
+
+	return value.(T), true //nolint:forcetypeassert,errcheck
+}
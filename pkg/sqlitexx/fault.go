@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"zombiezen.com/go/sqlite"
+)
+
+// CommitStatement is the statement passed to Faults when a transaction started with Begin is committed.
+const CommitStatement = "COMMIT"
+
+// Faults injects errors into the statements run on a connection, see SetFaults.
+//
+// It is meant for tests exercising the handling of the storage errors.
+type Faults interface {
+	// BeforeStatement is called before the statement is run.
+	//
+	// If it returns an error, the statement fails with it without being run.
+	BeforeStatement(query string) error
+
+	// AfterStatement is called after the statement run by Exec succeeds.
+	//
+	// If it returns an error, Exec fails with it although the statement was run,
+	// so the write outside of a transaction is done, while the caller sees it failed.
+	AfterStatement(query string) error
+}
+
+var connFaults connValues[Faults]
+
+// SetFaults makes the statements run with Query on the connection, and the commits done with Begin,
+// go through the faults. Nil faults remove the faults set before.
+func SetFaults(conn *sqlite.Conn, faults Faults) {
+	if faults == nil {
+		connFaults.remove(conn)
+
+		return
+	}
+
+	connFaults.set(conn, faults)
+}
+
+// faultsFor returns the faults set for the connection, or nil.
+func faultsFor(conn *sqlite.Conn) Faults {
+	faults, _ := connFaults.get(conn)
+
+	return faults
+}
+
+func (q *Query) beforeStatement() error {
+	if faults := faultsFor(q.conn); faults != nil {
+		return faults.BeforeStatement(q.query)
+	}
+
+	return nil
+}
+
+func (q *Query) afterStatement() error {
+	if faults := faultsFor(q.conn); faults != nil {
+		return faults.AfterStatement(q.query)
+	}
+
+	return nil
+}
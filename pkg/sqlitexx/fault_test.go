@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+type testFaults struct {
+	before, after string
+	err           error
+}
+
+func (f testFaults) BeforeStatement(query string) error {
+	if f.before != "" && strings.Contains(query, f.before) {
+		return f.err
+	}
+
+	return nil
+}
+
+func (f testFaults) AfterStatement(query string) error {
+	if f.after != "" && strings.Contains(query, f.after) {
+		return f.err
+	}
+
+	return nil
+}
+
+func TestFaults(t *testing.T) {
+	t.Parallel()
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{LowWatermark: 1, HighWatermark: 1})
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `CREATE TABLE t (v INTEGER NOT NULL)`, nil))
+
+	insert := func(v int) error {
+		q, err := sqlitexx.NewQuery(conn, `INSERT INTO t (v) VALUES ($v)`)
+		if err != nil {
+			return err
+		}
+
+		return q.BindInt("$v", v).Exec()
+	}
+
+	count := func() int {
+		var result int
+
+		require.NoError(t, sqlitex.Execute(conn, `SELECT count(*) FROM t`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				result = stmt.ColumnInt(0)
+
+				return nil
+			},
+		}))
+
+		return result
+	}
+
+	errFault := errors.New("fault")
+
+	defer sqlitexx.SetFaults(conn, nil)
+
+	// the statement is not run
+	sqlitexx.SetFaults(conn, testFaults{before: "INSERT", err: zombiesqlite.ResultBusy.ToError()})
+
+	err = insert(1)
+	assert.True(t, sqlitexx.IsBusy(err), "unexpected error: %v", err)
+	assert.Equal(t, 0, count())
+
+	// the statement is run, but reported as failed
+	sqlitexx.SetFaults(conn, testFaults{after: "INSERT", err: errFault})
+
+	require.ErrorIs(t, insert(2), errFault)
+	assert.Equal(t, 1, count())
+
+	// the failed commit rolls back the transaction
+	sqlitexx.SetFaults(conn, testFaults{before: sqlitexx.CommitStatement, err: errFault})
+
+	require.ErrorIs(t, sqlitexx.WithTx(conn, func() error { return insert(3) }), errFault)
+	assert.True(t, conn.AutocommitEnabled())
+	assert.Equal(t, 1, count())
+
+	sqlitexx.SetFaults(conn, nil)
+
+	require.NoError(t, sqlitexx.WithTx(conn, func() error { return insert(4) }))
+	assert.Equal(t, 2, count())
+}
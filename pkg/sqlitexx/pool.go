@@ -6,11 +6,13 @@ package sqlitexx
 
 import (
 	"context"
+	"crypto/rand"
 	"expvar"
 	"fmt"
 	"sync"
 
 	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 var poolConnections expvar.Int
@@ -42,6 +44,20 @@ type PoolOptions struct {
 	//
 	// Default is 10. Must be >= LowWatermark.
 	HighWatermark int
+
+	// Pragmas are executed on each new connection before it is returned by Take,
+	// e.g. "PRAGMA busy_timeout = 5000".
+	//
+	// Default is none.
+	Pragmas []string
+
+	// HealthCheck validates an idle connection before it is returned by Take.
+	//
+	// If the check fails, the connection is closed and another one is taken instead.
+	// Idle connections left inside a transaction are always discarded, even without the check.
+	//
+	// Default is nil.
+	HealthCheck func(conn *sqlite.Conn) error
 }
 
 // Pool is a dynamically-sized pool of SQLite connections.
@@ -54,6 +70,8 @@ type Pool struct { //nolint:govet
 	flags         sqlite.OpenFlags
 	lowWatermark  int
 	highWatermark int
+	pragmas       []string
+	healthCheck   func(conn *sqlite.Conn) error
 
 	mu         sync.Mutex
 	free       []*sqlite.Conn
@@ -103,6 +121,8 @@ func NewPool(uri string, opts PoolOptions) (*Pool, error) {
 		flags:         flags,
 		lowWatermark:  lowWM,
 		highWatermark: highWM,
+		pragmas:       opts.Pragmas,
+		healthCheck:   opts.HealthCheck,
 		inUse:         make(map[*sqlite.Conn]context.CancelFunc),
 		closedChan:    make(chan struct{}),
 		avail:         make(chan struct{}),
@@ -111,6 +131,20 @@ func NewPool(uri string, opts PoolOptions) (*Pool, error) {
 	return p, nil
 }
 
+// NewMemoryPool opens a pool with a single connection to a new private in-memory database.
+//
+// The database is named randomly, so that each pool gets its own database, and it is kept
+// in the shared cache, so it lives until the pool is closed.
+// Connections to a shared-cache database lock whole tables without waiting for the busy timeout,
+// so the pool is limited to a single connection, and concurrent users wait for it in Take.
+func NewMemoryPool() (*Pool, error) {
+	return NewPool("file:"+rand.Text()+"?mode=memory&cache=shared", PoolOptions{
+		Flags:         sqlite.OpenReadWrite | sqlite.OpenCreate | sqlite.OpenURI,
+		LowWatermark:  1,
+		HighWatermark: 1,
+	})
+}
+
 // Take returns an SQLite connection from the Pool.
 //
 // If no connection is available and the high watermark has been reached,
@@ -143,6 +177,19 @@ func (p *Pool) Take(ctx context.Context) (*sqlite.Conn, error) {
 			ctx2, cancel := context.WithCancel(ctx)
 			conn.SetInterrupt(ctx2.Done())
 
+			if err := p.check(conn); err != nil {
+				// The connection is broken: close it and try again.
+				conn.SetInterrupt(nil)
+				cancel()
+				p.discard(conn)
+
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("get sqlite connection: %w", ctx.Err())
+				}
+
+				continue
+			}
+
 			// Re-acquire to register in inUse and check for concurrent Close.
 			p.mu.Lock()
 
@@ -188,6 +235,14 @@ func (p *Pool) Take(ctx context.Context) (*sqlite.Conn, error) {
 			ctx2, cancel := context.WithCancel(ctx)
 			conn.SetInterrupt(ctx2.Done())
 
+			if err = p.prepare(conn); err != nil {
+				conn.SetInterrupt(nil)
+				cancel()
+				p.discard(conn)
+
+				return nil, fmt.Errorf("get sqlite connection: %w", err)
+			}
+
 			p.mu.Lock()
 			p.inUse[conn] = cancel
 			p.mu.Unlock()
@@ -210,6 +265,42 @@ func (p *Pool) Take(ctx context.Context) (*sqlite.Conn, error) {
 	}
 }
 
+// prepare applies the pragmas to a new connection.
+func (p *Pool) prepare(conn *sqlite.Conn) error {
+	for _, pragma := range p.pragmas {
+		if err := sqlitex.ExecuteTransient(conn, pragma, nil); err != nil {
+			return fmt.Errorf("executing %q: %w", pragma, err)
+		}
+	}
+
+	return nil
+}
+
+// check validates an idle connection before it is reused.
+func (p *Pool) check(conn *sqlite.Conn) error {
+	if !conn.AutocommitEnabled() {
+		return fmt.Errorf("connection left inside a transaction")
+	}
+
+	if p.healthCheck != nil {
+		return p.healthCheck(conn)
+	}
+
+	return nil
+}
+
+// discard closes a connection which is not in use and is not cached.
+func (p *Pool) discard(conn *sqlite.Conn) {
+	p.mu.Lock()
+	p.totalConns--
+	p.mu.Unlock()
+
+	conn.Close() //nolint:errcheck
+	p.wg.Done()
+	poolConnections.Add(-1)
+	p.notify()
+}
+
 // Put returns a connection to the pool.
 //
 // Put panics if conn was not obtained from this pool.
@@ -15,6 +15,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 
 	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
 )
@@ -67,6 +68,40 @@ func TestPoolMemoryURIRejected(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestMemoryPool(t *testing.T) {
+	t.Parallel()
+
+	newMemoryPool := func() *sqlitexx.Pool {
+		pool, err := sqlitexx.NewMemoryPool()
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			require.NoError(t, pool.Close())
+		})
+
+		return pool
+	}
+
+	pool1, pool2 := newMemoryPool(), newMemoryPool()
+
+	conn, err := pool1.Take(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `CREATE TABLE t (x INTEGER)`, nil))
+	pool1.Put(conn)
+
+	// the database outlives the connection being returned to the pool
+	conn, err = pool1.Take(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `INSERT INTO t VALUES (1)`, nil))
+	pool1.Put(conn)
+
+	// each pool gets its own database
+	conn, err = pool2.Take(t.Context())
+	require.NoError(t, err)
+	require.Error(t, sqlitex.ExecuteTransient(conn, `SELECT * FROM t`, nil))
+	pool2.Put(conn)
+}
+
 func TestPoolLowWatermarkCaches(t *testing.T) {
 	t.Parallel()
 
@@ -438,6 +473,104 @@ func TestPoolTakeAfterClose(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestPoolPragmas(t *testing.T) {
+	t.Parallel()
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{
+		LowWatermark:  1,
+		HighWatermark: 2,
+		Pragmas:       []string{"PRAGMA busy_timeout = 1234", "PRAGMA cache_size = -4096"},
+	})
+
+	conn1, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn1)
+
+	conn2, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn2)
+
+	for _, conn := range []*zombiesqlite.Conn{conn1, conn2} {
+		for pragma, expected := range map[string]int64{"busy_timeout": 1234, "cache_size": -4096} {
+			var value int64
+
+			require.NoError(t, sqlitex.ExecuteTransient(conn, `PRAGMA `+pragma, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+					value = stmt.ColumnInt64(0)
+
+					return nil
+				},
+			}))
+
+			assert.Equal(t, expected, value, pragma)
+		}
+	}
+
+	invalid := newTestPool(t, sqlitexx.PoolOptions{Pragmas: []string{"PRAGMA"}})
+
+	_, err = invalid.Take(t.Context())
+	require.ErrorContains(t, err, `executing "PRAGMA"`)
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		broken *zombiesqlite.Conn
+	)
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{
+		LowWatermark:  1,
+		HighWatermark: 1,
+		HealthCheck: func(conn *zombiesqlite.Conn) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if conn == broken {
+				return assert.AnError
+			}
+
+			return nil
+		},
+	})
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	pool.Put(conn)
+
+	// healthy idle connection is reused
+	conn2, err := pool.Take(t.Context())
+	require.NoError(t, err)
+	assert.Same(t, conn, conn2)
+
+	pool.Put(conn2)
+
+	mu.Lock()
+	broken = conn
+	mu.Unlock()
+
+	// broken connection is replaced
+	conn3, err := pool.Take(t.Context())
+	require.NoError(t, err)
+	assert.NotSame(t, conn, conn3)
+
+	// connection left inside a transaction is replaced
+	require.NoError(t, sqlitex.ExecuteTransient(conn3, `BEGIN`, nil))
+
+	pool.Put(conn3)
+
+	conn4, err := pool.Take(t.Context())
+	require.NoError(t, err)
+	assert.NotSame(t, conn3, conn4)
+	assert.True(t, conn4.AutocommitEnabled())
+
+	pool.Put(conn4)
+}
+
 func TestMain(m *testing.M) {
 	goleak.VerifyTestMain(m)
 }
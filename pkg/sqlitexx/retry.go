@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	retryMinBackoff = time.Millisecond
+	retryMaxBackoff = 100 * time.Millisecond
+)
+
+// IsBusy returns true if the error is SQLITE_BUSY or SQLITE_LOCKED, i.e. the statement
+// failed because the database (or a table) is locked by another connection and might succeed if retried.
+//
+// SQLITE_BUSY_SNAPSHOT is not considered busy: it is returned when a read transaction
+// can't be upgraded to a write one, and retrying the statement in the same transaction never succeeds.
+func IsBusy(err error) bool {
+	code := sqlite.ErrCode(err)
+	if code == sqlite.ResultBusySnapshot {
+		return false
+	}
+
+	switch code.ToPrimary() { //nolint:exhaustive
+	case sqlite.ResultBusy, sqlite.ResultLocked:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry calls fn until it returns an error which is not busy (see IsBusy), backing off exponentially between the attempts.
+//
+// If the context is canceled while waiting, the last busy error is returned along with the context error.
+func retry(ctx context.Context, fn func() (retryable bool, err error)) error {
+	backoff := retryMinBackoff
+
+	for {
+		retryable, err := fn()
+		if err == nil || !retryable || !IsBusy(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return fmt.Errorf("%w: %w", err, context.Cause(ctx))
+		case <-timer.C:
+		}
+
+		backoff = min(backoff*2, retryMaxBackoff)
+	}
+}
+
+// ExecWithRetry executes the query like Exec, retrying it while it fails with SQLITE_BUSY or SQLITE_LOCKED.
+//
+// The retries are bounded by the context. The parameters stay bound between the attempts.
+// Retrying only makes sense outside of a transaction, or for the statement which starts it:
+// the locks held by the enclosing transaction are not released between the attempts.
+func (q *Query) ExecWithRetry(ctx context.Context) error {
+	return retry(ctx, func() (bool, error) {
+		return true, q.Exec()
+	})
+}
+
+// QueryWithRetry executes the query like QueryAll, retrying it while it fails with SQLITE_BUSY or SQLITE_LOCKED.
+//
+// The query is only retried if it fails before the first row is processed,
+// so resultFn never sees the same row twice. See ExecWithRetry for the rest.
+func (q *Query) QueryWithRetry(ctx context.Context, resultFn ResultFunc) error {
+	return retry(ctx, func() (bool, error) {
+		rows := 0
+
+		err := q.QueryAll(func(stmt *sqlite.Stmt) error {
+			rows++
+
+			return resultFn(stmt)
+		})
+
+		return rows == 0, err
+	})
+}
+
+// BeginWithRetry starts a transaction like Begin, retrying while the write lock is held by another connection
+// (see IsBusy), e.g. by another process sharing the database without a busy timeout.
+//
+// The retries are bounded by the context.
+func BeginWithRetry(ctx context.Context, conn *sqlite.Conn) (end func(errp *error), err error) {
+	err = retry(ctx, func() (bool, error) {
+		var beginErr error
+
+		end, beginErr = Begin(conn)
+
+		return true, beginErr
+	})
+
+	return end, err
+}
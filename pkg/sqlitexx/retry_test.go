@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	// no busy handler, so the locked database fails immediately
+	pool := newTestPool(t, sqlitexx.PoolOptions{
+		LowWatermark:  2,
+		HighWatermark: 2,
+		Pragmas:       []string{"PRAGMA busy_timeout = 0"},
+	})
+
+	writer, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(writer)
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.ExecuteTransient(writer, `CREATE TABLE t (v INTEGER NOT NULL)`, nil))
+
+	lock := func() {
+		require.NoError(t, sqlitex.ExecuteTransient(writer, `BEGIN IMMEDIATE`, nil))
+		require.NoError(t, sqlitex.ExecuteTransient(writer, `INSERT INTO t (v) VALUES (0)`, nil))
+	}
+
+	unlockLater := func() <-chan error {
+		errCh := make(chan error, 1)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+
+			errCh <- sqlitex.ExecuteTransient(writer, `COMMIT`, nil)
+		}()
+
+		return errCh
+	}
+
+	lock()
+
+	q, err := sqlitexx.NewQuery(conn, `INSERT INTO t (v) VALUES ($v)`)
+	require.NoError(t, err)
+
+	err = q.BindInt("$v", 1).Exec()
+	require.Error(t, err)
+	assert.True(t, sqlitexx.IsBusy(err))
+
+	// the retries are bounded by the context
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+
+	err = q.ExecWithRetry(ctx)
+	require.Error(t, err)
+	assert.True(t, sqlitexx.IsBusy(err))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	errCh := unlockLater()
+
+	require.NoError(t, q.ExecWithRetry(t.Context()))
+	require.NoError(t, <-errCh)
+
+	lock()
+
+	errCh = unlockLater()
+
+	var returned []int64
+
+	q, err = sqlitexx.NewQuery(conn, `INSERT INTO t (v) VALUES ($v) RETURNING v`)
+	require.NoError(t, err)
+
+	require.NoError(t, q.BindInt("$v", 2).QueryWithRetry(t.Context(), func(stmt *zombiesqlite.Stmt) error {
+		returned = append(returned, stmt.ColumnInt64(0))
+
+		return nil
+	}))
+	require.NoError(t, <-errCh)
+
+	assert.Equal(t, []int64{2}, returned)
+
+	var values []int64
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `SELECT v FROM t ORDER BY v`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			values = append(values, stmt.ColumnInt64(0))
+
+			return nil
+		},
+	}))
+
+	assert.Equal(t, []int64{0, 0, 1, 2}, values)
+
+	lock()
+
+	_, err = sqlitexx.Begin(conn)
+	require.Error(t, err)
+	assert.True(t, sqlitexx.IsBusy(err))
+
+	errCh = unlockLater()
+
+	end, err := sqlitexx.BeginWithRetry(t.Context(), conn)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+
+	err = sqlitex.ExecuteTransient(conn, `INSERT INTO t (v) VALUES (3)`, nil)
+	end(&err)
+	require.NoError(t, err)
+}
@@ -17,8 +17,12 @@ var ErrNoRows = errors.New("sqlitexx: no rows in result set")
 
 // Query represents a prepared SQL query.
 type Query struct {
-	conn *sqlite.Conn
-	stmt *sqlite.Stmt
+	conn   *sqlite.Conn
+	stmt   *sqlite.Stmt
+	err    error  // binding error, returned on execution
+	tracer Tracer // set if SetTracer is set on the connection
+	query  string
+	params []Param // recorded for the tracer only
 }
 
 // ResultFunc is a function that processes a row from a query result.
@@ -34,15 +38,20 @@ func NewQuery(conn *sqlite.Conn, query string) (*Query, error) {
 		return nil, err
 	}
 
+	tracer, _ := connTracers.get(conn)
+
 	return &Query{
-		conn: conn,
-		stmt: stmt,
+		conn:   conn,
+		stmt:   stmt,
+		query:  query,
+		tracer: tracer,
 	}, nil
 }
 
 // BindString binds a string parameter.
 func (q *Query) BindString(name, value string) *Query {
 	q.stmt.SetText(name, value)
+	q.recordParam(name, value)
 
 	return q
 }
@@ -51,6 +60,7 @@ func (q *Query) BindString(name, value string) *Query {
 func (q *Query) BindStringIfSet(name, value string) *Query {
 	if value != "" {
 		q.stmt.SetText(name, value)
+		q.recordParam(name, value)
 	}
 
 	return q
@@ -62,6 +72,7 @@ func (q *Query) BindStringIfSet(name, value string) *Query {
 func (q *Query) BindBytes(name string, value []byte) *Query {
 	if value != nil {
 		q.stmt.SetBytes(name, value)
+		q.recordParam(name, value)
 	}
 
 	return q
@@ -70,6 +81,7 @@ func (q *Query) BindBytes(name string, value []byte) *Query {
 // BindInt64 binds an int64 parameter.
 func (q *Query) BindInt64(name string, value int64) *Query {
 	q.stmt.SetInt64(name, value)
+	q.recordParam(name, value)
 
 	return q
 }
@@ -86,6 +98,10 @@ func (q *Query) BindUint64(name string, value uint64) *Query {
 
 // Exec executes the query without returning any rows.
 func (q *Query) Exec() (err error) {
+	if q.err != nil {
+		return q.err
+	}
+
 	defer func() {
 		resetErr := q.stmt.Reset()
 		if err == nil {
@@ -93,11 +109,21 @@ func (q *Query) Exec() (err error) {
 		}
 	}()
 
+	q.traceStatement()
+
+	if err = q.beforeStatement(); err != nil {
+		return err
+	}
+
 	hasRows, err := q.stmt.Step()
 	if err == nil && hasRows {
 		err = errors.New("sqlitexx: Exec: query returned rows")
 	}
 
+	if err == nil {
+		err = q.afterStatement()
+	}
+
 	return err
 }
 
@@ -105,6 +131,10 @@ func (q *Query) Exec() (err error) {
 //
 // If no rows are returned, ErrNoRows is returned.
 func (q *Query) QueryRow(resultFn ResultFunc) (err error) {
+	if q.err != nil {
+		return q.err
+	}
+
 	defer func() {
 		resetErr := q.stmt.Reset()
 		if err == nil {
@@ -112,6 +142,12 @@ func (q *Query) QueryRow(resultFn ResultFunc) (err error) {
 		}
 	}()
 
+	q.traceStatement()
+
+	if err = q.beforeStatement(); err != nil {
+		return err
+	}
+
 	hasRow, err := q.stmt.Step()
 	if err != nil {
 		return err
@@ -134,6 +170,10 @@ func (q *Query) QueryRow(resultFn ResultFunc) (err error) {
 
 // QueryAll executes the query and processes all returned rows.
 func (q *Query) QueryAll(resultFn ResultFunc) (err error) {
+	if q.err != nil {
+		return q.err
+	}
+
 	defer func() {
 		resetErr := q.stmt.Reset()
 		if err == nil {
@@ -141,6 +181,12 @@ func (q *Query) QueryAll(resultFn ResultFunc) (err error) {
 		}
 	}()
 
+	q.traceStatement()
+
+	if err = q.beforeStatement(); err != nil {
+		return err
+	}
+
 	for {
 		hasRow, err := q.stmt.Step()
 		if err != nil {
@@ -164,8 +210,22 @@ func (q *Query) QueryAll(resultFn ResultFunc) (err error) {
 // The statement is reset when the iteration completes or breaks early.
 func (q *Query) QueryIter() iter.Seq2[*sqlite.Stmt, error] {
 	return func(yield func(*sqlite.Stmt, error) bool) {
+		if q.err != nil {
+			yield(nil, q.err)
+
+			return
+		}
+
 		defer q.stmt.Reset() //nolint:errcheck
 
+		q.traceStatement()
+
+		if err := q.beforeStatement(); err != nil {
+			yield(nil, err)
+
+			return
+		}
+
 		for {
 			hasRow, err := q.stmt.Step()
 			if err != nil {
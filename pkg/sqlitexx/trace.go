@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"zombiezen.com/go/sqlite"
+)
+
+// Tracer is notified about the statements run on a connection, see SetTracer.
+//
+// It is meant for debugging, as recording the parameters slows the statements down.
+type Tracer interface {
+	// TraceStatement is called before the statement is run, with the parameters bound via Query in the binding order.
+	TraceStatement(query string, params []Param)
+}
+
+// Param is a named parameter bound to a statement.
+type Param struct {
+	// Value is a string, []byte, int64, float64 or bool, nil for NULL.
+	Value any
+
+	// Name is the parameter name with the prefix (e.g. "$namespace").
+	Name string
+}
+
+var connTracers connValues[Tracer]
+
+// SetTracer makes the statements run with Query on the connection go through the tracer.
+// Nil tracer removes the tracer set before.
+//
+// The tracer applies to the queries created after it is set.
+func SetTracer(conn *sqlite.Conn, tracer Tracer) {
+	if tracer == nil {
+		connTracers.remove(conn)
+
+		return
+	}
+
+	connTracers.set(conn, tracer)
+}
+
+// recordParam records the bound parameter for the tracer, if there is one.
+func (q *Query) recordParam(name string, value any) {
+	if q.tracer != nil {
+		q.params = append(q.params, Param{Name: name, Value: value})
+	}
+}
+
+func (q *Query) traceStatement() {
+	if q.tracer != nil {
+		q.tracer.TraceStatement(q.query, q.params)
+	}
+}
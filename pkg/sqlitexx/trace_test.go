@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+type tracedStatement struct {
+	query  string
+	params []sqlitexx.Param
+}
+
+type testTracer struct {
+	statements []tracedStatement
+}
+
+func (tr *testTracer) TraceStatement(query string, params []sqlitexx.Param) {
+	tr.statements = append(tr.statements, tracedStatement{query: query, params: params})
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{LowWatermark: 1, HighWatermark: 1})
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `CREATE TABLE t (k TEXT NOT NULL, v BLOB, n INTEGER)`, nil))
+
+	var tracer testTracer
+
+	sqlitexx.SetTracer(conn, &tracer)
+
+	q, err := sqlitexx.NewQuery(conn, `INSERT INTO t (k, v, n) VALUES ($k, $v, $n)`)
+	require.NoError(t, err)
+	require.NoError(t, q.BindString("$k", "a").BindBytes("$v", []byte("secret")).BindInt("$n", 1).Exec())
+
+	type row struct {
+		V []byte  `sql:"v"`
+		N *int64  `sql:"n"`
+		K string  `sql:"k"`
+		X float64 `sql:"x"`
+	}
+
+	q, err = sqlitexx.NewQuery(conn, `INSERT INTO t (k, v, n) VALUES ($k, $v, $n)`)
+	require.NoError(t, err)
+	require.NoError(t, q.BindStruct(row{K: "b"}).Exec())
+
+	sqlitexx.SetTracer(conn, nil)
+
+	q, err = sqlitexx.NewQuery(conn, `SELECT count(*) FROM t`)
+	require.NoError(t, err)
+	require.NoError(t, q.QueryRow(func(*zombiesqlite.Stmt) error { return nil }))
+
+	require.Len(t, tracer.statements, 2)
+	assert.Equal(t, `INSERT INTO t (k, v, n) VALUES ($k, $v, $n)`, tracer.statements[0].query)
+	assert.Equal(t, []sqlitexx.Param{
+		{Name: "$k", Value: "a"},
+		{Name: "$v", Value: []byte("secret")},
+		{Name: "$n", Value: int64(1)},
+	}, tracer.statements[0].params)
+	assert.Equal(t, []sqlitexx.Param{
+		{Name: "$v", Value: nil},
+		{Name: "$n", Value: nil},
+		{Name: "$k", Value: "b"},
+	}, tracer.statements[1].params)
+}
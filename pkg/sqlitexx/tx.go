@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx
+
+import (
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Begin starts an immediate transaction, which takes the write lock upfront.
+//
+// If the connection is already in a transaction, a savepoint is created instead, so the calls can be nested:
+// the nested transaction is rolled back alone on error, and committed with the outer one.
+//
+// The returned end function commits the transaction (or releases the savepoint) if *errp is nil,
+// and rolls it back otherwise, it should be deferred. A panic rolls back the transaction as well.
+func Begin(conn *sqlite.Conn) (end func(errp *error), err error) {
+	if !conn.AutocommitEnabled() {
+		return sqlitex.Save(conn), nil
+	}
+
+	commit, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	faults := faultsFor(conn)
+	if faults == nil {
+		return commit, nil
+	}
+
+	// the failed commit rolls the transaction back
+	return func(errp *error) {
+		// commit only sees the panic if it is deferred directly
+		if p := recover(); p != nil {
+			panicErr := fmt.Errorf("panic: %v", p)
+
+			commit(&panicErr)
+
+			panic(p)
+		}
+
+		if *errp == nil {
+			*errp = faults.BeforeStatement(CommitStatement)
+		}
+
+		commit(errp)
+	}, nil
+}
+
+// WithTx runs fn in a transaction started with Begin.
+//
+// The transaction is committed if fn returns nil, and rolled back otherwise.
+func WithTx(conn *sqlite.Conn, fn func() error) (err error) {
+	end, err := Begin(conn)
+	if err != nil {
+		return err
+	}
+
+	defer end(&err)
+
+	return fn()
+}
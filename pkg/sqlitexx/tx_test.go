@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlitexx_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+func TestWithTx(t *testing.T) {
+	t.Parallel()
+
+	pool := newTestPool(t, sqlitexx.PoolOptions{LowWatermark: 1, HighWatermark: 1})
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `CREATE TABLE t (v INTEGER NOT NULL)`, nil))
+
+	insert := func(v int) error {
+		q, err := sqlitexx.NewQuery(conn, `INSERT INTO t (v) VALUES ($v)`)
+		if err != nil {
+			return err
+		}
+
+		return q.BindInt("$v", v).Exec()
+	}
+
+	values := func() []int64 {
+		var result []int64
+
+		require.NoError(t, sqlitex.Execute(conn, `SELECT v FROM t ORDER BY v`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				result = append(result, stmt.ColumnInt64(0))
+
+				return nil
+			},
+		}))
+
+		return result
+	}
+
+	errFailed := errors.New("failed")
+
+	require.NoError(t, sqlitexx.WithTx(conn, func() error {
+		require.False(t, conn.AutocommitEnabled())
+
+		if err := insert(1); err != nil {
+			return err
+		}
+
+		// the nested transaction is rolled back alone
+		require.ErrorIs(t, sqlitexx.WithTx(conn, func() error {
+			if err := insert(2); err != nil {
+				return err
+			}
+
+			return errFailed
+		}), errFailed)
+
+		return sqlitexx.WithTx(conn, func() error {
+			return insert(3)
+		})
+	}))
+
+	assert.True(t, conn.AutocommitEnabled())
+	assert.Equal(t, []int64{1, 3}, values())
+
+	require.ErrorIs(t, sqlitexx.WithTx(conn, func() error {
+		if err := insert(4); err != nil {
+			return err
+		}
+
+		return errFailed
+	}), errFailed)
+
+	assert.Equal(t, []int64{1, 3}, values())
+
+	// panics roll back the transaction
+	assert.Panics(t, func() {
+		sqlitexx.WithTx(conn, func() error { //nolint:errcheck
+			if err := insert(5); err != nil {
+				return err
+			}
+
+			panic("boom")
+		})
+	})
+
+	assert.True(t, conn.AutocommitEnabled())
+	assert.Equal(t, []int64{1, 3}, values())
+}
@@ -0,0 +1,331 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// Apply creates the resource owned by owner, or updates it if it already exists.
+//
+// Apply replaces the Get followed by Create or Update done by the controllers writing their outputs:
+// the resource is written with a single upsert statement within one transaction. The operation done
+// is returned: OperationCreate, OperationUpdate, or zero if the stored resource is the same as res
+// apart from the version and timestamps, in which case nothing is written (as with SkipNoopUpdates).
+//
+// If the resource exists, it should be owned by owner, otherwise an error matching state.IsOwnerConflictError
+// is returned. If the version of res is set, it should match the stored version, otherwise an error matching
+// state.IsConflictError is returned; a resource with the undefined version overwrites the stored one.
+// The mutators, validators and post-commit hooks are run for the operation done.
+//
+// On success, the metadata of res is set to the metadata of the stored resource.
+//
+//nolint:gocognit,gocyclo,cyclop,maintidx
+func (st *State) Apply(ctx context.Context, res resource.Resource, owner resource.Owner) (_ Operation, err error) {
+	defer st.convertCanceled(ctx, &err)
+
+	if err := st.checkNamespace(res.Metadata().Namespace()); err != nil {
+		return 0, fmt.Errorf("failed to apply: %w", err)
+	}
+
+	unlock, err := st.lockKind(ctx, res.Metadata())
+	if err != nil {
+		return 0, fmt.Errorf("failed to apply: %w", err)
+	}
+
+	defer unlock()
+
+	resCopy := res.DeepCopy()
+	*resCopy.Metadata() = withOwner(resCopy.Metadata(), owner)
+
+	var (
+		result   = mutationResultFromContext(ctx)
+		op       Operation
+		stored   *resource.Metadata
+		rowBytes int64
+		eventID  int64
+	)
+
+	st.localEvents.Add(resCopy.Metadata(), 1)
+
+	err = func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for apply: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		doneFn, transErr := sqlitexx.BeginWithRetry(ctx, conn)
+		if transErr != nil {
+			return fmt.Errorf("starting transaction for apply: %w", transErr)
+		}
+		defer doneFn(&err)
+
+		if op, stored, rowBytes, err = st.applyConn(ctx, conn, res, resCopy, owner); err != nil || op == 0 {
+			return err
+		}
+
+		if result != nil {
+			eventID, err = st.lastEventID(conn)
+		}
+
+		return err
+	}()
+	if err != nil || op == 0 {
+		st.localEvents.Add(resCopy.Metadata(), -1)
+
+		if err != nil {
+			return 0, err
+		}
+
+		// This should be safe, because we don't allow to share metadata between goroutines even for read-only
+		// purposes.
+		*res.Metadata() = *stored
+
+		return 0, nil
+	}
+
+	if result != nil {
+		result.Bookmark = encodeBookmark(eventID)
+	}
+
+	st.recordWrite(op.String(), rowBytes, 2)
+
+	st.notify(ctx, resCopy.Metadata())
+
+	st.audit(op, resCopy.Metadata())
+
+	st.runPostCommitHooks(op, resCopy)
+
+	*res.Metadata() = *stored
+
+	return op, nil
+}
+
+// applyConn is Apply on the connection, within the transaction of the caller.
+//
+// The operation done, the metadata of the stored resource, and the bytes written are returned.
+//
+//nolint:gocognit,gocyclo,cyclop
+func (st *State) applyConn(
+	ctx context.Context, conn *sqlite.Conn, res, resCopy resource.Resource, owner resource.Owner,
+) (op Operation, stored *resource.Metadata, rowBytes int64, err error) {
+	var (
+		currentOwner string
+		currentVer   uint64
+		createdAt    int64
+		updatedAt    int64
+		currentSpec  []byte
+	)
+
+	// the stored spec holds the version and the timestamps, so they are read first
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT owner, version, created_at, updated_at, spec
+ 		FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id`,
+	)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("preparing query for current resource state: %w", err)
+	}
+
+	err = q.
+		BindString("$namespace", res.Metadata().Namespace()).
+		BindString("$type", res.Metadata().Type()).
+		BindString("$id", res.Metadata().ID()).
+		QueryRow(func(stmt *sqlite.Stmt) error {
+			currentOwner = stmt.GetText("owner")
+			currentVer = uint64(stmt.GetInt64("version"))
+			createdAt = stmt.GetInt64("created_at")
+			updatedAt = stmt.GetInt64("updated_at")
+			currentSpec = make([]byte, stmt.GetLen("spec"))
+			stmt.GetBytes("spec", currentSpec)
+
+			return nil
+		})
+
+	switch {
+	case errors.Is(err, sqlitexx.ErrNoRows):
+		op = OperationCreate
+	case err != nil:
+		return 0, nil, 0, fmt.Errorf("error querying current resource state: %w", err)
+	default:
+		op = OperationUpdate
+	}
+
+	now := time.Now()
+
+	if op == OperationCreate {
+		resCopy.Metadata().SetCreated(now)
+		resCopy.Metadata().SetVersion(resource.VersionUndefined.Next())
+	} else {
+		if currentOwner != owner {
+			return 0, nil, 0, fmt.Errorf("failed to apply: %w", ErrOwnerConflict(res.Metadata(), currentOwner))
+		}
+
+		if ver := res.Metadata().Version().Value(); ver != 0 && ver != currentVer {
+			return 0, nil, 0, fmt.Errorf("failed to apply: %w", ErrStoredVersionConflict(res.Metadata(), VersionConflict{
+				Updated:  time.Unix(updatedAt, 0),
+				Owner:    currentOwner,
+				Expected: ver,
+				Stored:   currentVer,
+			}))
+		}
+
+		version, _ := resource.ParseVersion(strconv.FormatUint(currentVer, 10)) //nolint:errcheck
+
+		resCopy.Metadata().SetCreated(time.Unix(createdAt, 0))
+		resCopy.Metadata().SetUpdated(now)
+		resCopy.Metadata().SetVersion(version.Next())
+	}
+
+	if err = st.mutate(ctx, op, resCopy); err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to apply: %w", err)
+	}
+
+	var generationDelta int
+
+	if op == OperationUpdate {
+		// the stored resource which can't be unmarshaled is considered changed
+		current, unmarshalErr := st.unmarshalResource(currentSpec, state.UnmarshalOptions{})
+		if unmarshalErr != nil {
+			current = nil
+		}
+
+		if current != nil {
+			currentMd := *current.Metadata()
+
+			if isNoopUpdate(current, resCopy) {
+				return 0, &currentMd, 0, nil
+			}
+		}
+
+		if current == nil || !specEqual(current, resCopy) {
+			generationDelta = 1
+		}
+	}
+
+	if err = st.validate(ctx, op, resCopy); err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to apply: %w", err)
+	}
+
+	m, err := st.marshalResource(resCopy)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+
+	if err = st.checkWrite(conn, len(m)); err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to apply: %w", err)
+	}
+
+	var labels []byte
+
+	if !resCopy.Metadata().Labels().Empty() {
+		labels, err = json.Marshal(resCopy.Metadata().Labels().Raw())
+		if err != nil {
+			return 0, nil, 0, fmt.Errorf("failed to marshal labels: %w", err)
+		}
+	}
+
+	var finalizers []byte
+
+	if !resCopy.Metadata().Finalizers().Empty() {
+		finalizers, err = json.Marshal(resCopy.Metadata().Finalizers())
+		if err != nil {
+			return 0, nil, 0, fmt.Errorf("failed to marshal finalizers: %w", err)
+		}
+	}
+
+	if op == OperationCreate {
+		// resource row and the create event
+		rowBytes = int64(2*len(m) + len(labels) + len(finalizers))
+	} else {
+		// resource row and the update event with the spec before and after
+		rowBytes = int64(3*len(m) + len(labels) + len(finalizers))
+
+		if err = st.archiveVersion(conn, res.Metadata()); err != nil {
+			return 0, nil, 0, fmt.Errorf("failed to apply: %w", err)
+		}
+	}
+
+	// the owner and the version are checked again by the upsert itself, so it never overwrites
+	// a resource it wasn't meant to
+	q, err = sqlitexx.NewQuery(
+		conn,
+		`INSERT INTO `+st.options.TablePrefix+`resources
+		(
+			namespace,
+			type,
+			id,
+			version,
+			created_at,
+			updated_at,
+			labels,
+			finalizers,
+			phase,
+			owner,
+			spec
+		)
+		VALUES
+		($namespace, $type, $id, $version, $created_at, $updated_at, jsonb($labels), jsonb($finalizers), $phase, $owner, $spec)
+		ON CONFLICT (namespace, type, id) DO UPDATE
+			SET
+				version = excluded.version,
+				updated_at = excluded.updated_at,
+				labels = excluded.labels,
+				finalizers = excluded.finalizers,
+				phase = excluded.phase,
+				spec = excluded.spec,
+				generation = generation + $generation_delta
+			WHERE
+				version = $version_old AND owner = excluded.owner`,
+	)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("preparing upsert statement: %w", err)
+	}
+
+	if err = q.
+		BindString("$namespace", resCopy.Metadata().Namespace()).
+		BindString("$type", resCopy.Metadata().Type()).
+		BindString("$id", resCopy.Metadata().ID()).
+		BindUint64("$version", resCopy.Metadata().Version().Value()).
+		BindInt64("$created_at", resCopy.Metadata().Created().Unix()).
+		BindInt64("$updated_at", resCopy.Metadata().Updated().Unix()).
+		BindBytes("$labels", labels).
+		BindBytes("$finalizers", finalizers).
+		BindInt("$phase", int(resCopy.Metadata().Phase())).
+		BindString("$owner", resCopy.Metadata().Owner()).
+		BindBytes("$spec", m).
+		BindInt("$generation_delta", generationDelta).
+		BindUint64("$version_old", currentVer).
+		Exec(); err != nil {
+		return 0, nil, 0, fmt.Errorf("error upserting resource in database: %w", err)
+	}
+
+	if conn.Changes() != 1 {
+		return 0, nil, 0, fmt.Errorf("failed to apply: %w", ErrStoredVersionConflict(res.Metadata(), VersionConflict{
+			Updated:  time.Unix(updatedAt, 0),
+			Owner:    currentOwner,
+			Expected: res.Metadata().Version().Value(),
+			Stored:   currentVer,
+		}))
+	}
+
+	return op, resCopy.Metadata(), rowBytes, nil
+}
@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	ctrlconformance "github.com/cosi-project/runtime/pkg/controller/conformance"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		ch := make(chan state.Event, 4)
+
+		require.NoError(t, st.WatchKind(ctx, ctrlconformance.NewIntResource("default", "", 0).Metadata(), ch))
+
+		res := ctrlconformance.NewIntResource("default", "int", 1)
+
+		op, err := st.Apply(ctx, res, "controller")
+		require.NoError(t, err)
+		assert.Equal(t, sqlite.OperationCreate, op)
+		assert.Equal(t, "controller", res.Metadata().Owner())
+		assert.EqualValues(t, 1, res.Metadata().Version().Value())
+
+		// the same resource built from scratch is not written again
+		op, err = st.Apply(ctx, ctrlconformance.NewIntResource("default", "int", 1), "controller")
+		require.NoError(t, err)
+		assert.Zero(t, op)
+
+		updated := ctrlconformance.NewIntResource("default", "int", 2)
+
+		op, err = st.Apply(ctx, updated, "controller")
+		require.NoError(t, err)
+		assert.Equal(t, sqlite.OperationUpdate, op)
+		assert.EqualValues(t, 2, updated.Metadata().Version().Value())
+		assert.Equal(t, res.Metadata().Created().Unix(), updated.Metadata().Created().Unix())
+
+		generation, err := st.GetGeneration(ctx, updated.Metadata())
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, generation)
+
+		for _, expected := range []state.EventType{state.Created, state.Updated} {
+			select {
+			case ev := <-ch:
+				require.Equal(t, expected, ev.Type)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+
+		// the stale version is rejected
+		res.SetValue(3)
+
+		_, err = st.Apply(ctx, res, "controller")
+		assert.True(t, state.IsConflictError(err), "unexpected error: %v", err)
+
+		_, err = st.Apply(ctx, ctrlconformance.NewIntResource("default", "int", 3), "other")
+		assert.True(t, state.IsOwnerConflictError(err), "unexpected error: %v", err)
+
+		stored, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, 2, stored.(*ctrlconformance.IntResource).Value()) //nolint:forcetypeassert,errcheck
+
+		select {
+		case ev := <-ch:
+			t.Fatalf("unexpected event: %v", ev)
+		default:
+		}
+	})
+}
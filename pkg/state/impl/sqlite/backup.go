@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// maxBackupProblems limits the number of problems reported by VerifyBackup, the counters are always complete.
+const maxBackupProblems = 100
+
+// BackupReport is the summary of the backup verification, see VerifyBackup.
+type BackupReport struct {
+	// Problems lists the issues found in the backup (up to 100), it is empty if the backup is restorable.
+	Problems []string
+
+	// SchemaVersion is the schema version recorded in the backup.
+	SchemaVersion int64
+
+	// Resources is the number of resources in the backup.
+	Resources int
+
+	// Undecodable is the number of resources which can't be unmarshaled.
+	Undecodable int
+
+	// Events is the number of events in the backup.
+	Events int
+}
+
+// OK returns true if no problems were found in the backup.
+func (r *BackupReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *BackupReport) addProblem(format string, args ...any) {
+	if len(r.Problems) < maxBackupProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// VerifyBackup checks that the backup of the database read from r can be restored and used by this State.
+//
+// The backup is a copy of the database file (e.g. made with BeginSnapshot), it is copied to a temporary
+// file and opened read-only. The verification runs the integrity check, validates the schema version
+// and the marshaler recorded in the backup, and unmarshals every resource with the state's table prefix
+// using the state's marshaler (and encryption keys).
+//
+// The problems found in the backup are reported in the returned summary,
+// the error is only returned if the verification itself fails (e.g. reading r fails).
+func (st *State) VerifyBackup(ctx context.Context, r io.Reader) (*BackupReport, error) {
+	dir, err := os.MkdirTemp("", "state-sqlite-backup-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary directory for backup verification: %w", err)
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	path := filepath.Join(dir, "backup.db")
+
+	if err = copyToFile(path, r); err != nil {
+		return nil, fmt.Errorf("copying backup: %w", err)
+	}
+
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("opening backup: %w", err)
+	}
+
+	defer conn.Close() //nolint:errcheck
+
+	conn.SetInterrupt(ctx.Done())
+
+	report := &BackupReport{}
+
+	if err = st.verifyBackup(conn, report); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func copyToFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close() //nolint:errcheck
+
+		return err
+	}
+
+	return f.Close()
+}
+
+//nolint:gocognit
+func (st *State) verifyBackup(conn *sqlite.Conn, report *BackupReport) error {
+	q, err := sqlitexx.NewQuery(conn, `PRAGMA integrity_check(100)`)
+	if err != nil {
+		// the file is not a database at all
+		report.addProblem("integrity check failed: %v", err)
+
+		return nil //nolint:nilerr
+	}
+
+	if err = q.QueryAll(func(stmt *sqlite.Stmt) error {
+		if result := stmt.ColumnText(0); result != "ok" {
+			report.addProblem("integrity check: %s", result)
+		}
+
+		return nil
+	}); err != nil {
+		if sqlite.ErrCode(err) == sqlite.ResultInterrupt {
+			return err
+		}
+
+		report.addProblem("integrity check failed: %v", err)
+
+		return nil
+	}
+
+	for _, table := range []string{"resources", "events"} {
+		var exists bool
+
+		q, err = sqlitexx.NewQuery(conn, `SELECT count(*) AS count FROM sqlite_schema WHERE type = 'table' AND name = $name`)
+		if err != nil {
+			return fmt.Errorf("preparing query for tables: %w", err)
+		}
+
+		if err = q.BindString("$name", st.options.TablePrefix+table).QueryRow(func(stmt *sqlite.Stmt) error {
+			exists = stmt.GetInt64("count") > 0
+
+			return nil
+		}); err != nil {
+			return fmt.Errorf("error querying tables: %w", err)
+		}
+
+		if !exists {
+			report.addProblem("table %q is missing", st.options.TablePrefix+table)
+		}
+	}
+
+	if !report.OK() {
+		return nil
+	}
+
+	if report.SchemaVersion, err = st.checkSchemaVersion(conn); err != nil {
+		if IsSchemaTooNewError(err) {
+			report.addProblem("%v", err)
+
+			return nil
+		}
+
+		return err
+	}
+
+	stored, err := st.storedMarshalerIdentity(conn)
+
+	switch {
+	case errors.Is(err, sqlitexx.ErrNoRows):
+	case err != nil:
+		// databases created before the meta table was introduced
+		if report.SchemaVersion != 0 {
+			return err
+		}
+	case stored != st.marshalerIdentity():
+		report.addProblem("%v", ErrMarshalerMismatch(stored, st.marshalerIdentity()))
+	}
+
+	q, err = sqlitexx.NewQuery(conn, `SELECT namespace, type, id, spec FROM `+st.options.TablePrefix+`resources`)
+	if err != nil {
+		return fmt.Errorf("preparing query for resources: %w", err)
+	}
+
+	if err = q.QueryAll(func(stmt *sqlite.Stmt) error {
+		report.Resources++
+
+		spec := make([]byte, stmt.GetLen("spec"))
+		stmt.GetBytes("spec", spec)
+
+		if _, unmarshalErr := st.unmarshalResource(spec, state.UnmarshalOptions{}); unmarshalErr != nil {
+			report.Undecodable++
+
+			report.addProblem("resource %s/%s/%s can't be unmarshaled: %v", stmt.GetText("namespace"), stmt.GetText("type"), stmt.GetText("id"), unmarshalErr)
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error querying resources: %w", err)
+	}
+
+	q, err = sqlitexx.NewQuery(conn, `SELECT count(*) AS count FROM `+st.options.TablePrefix+`events`)
+	if err != nil {
+		return fmt.Errorf("preparing query for events: %w", err)
+	}
+
+	if err = q.QueryRow(func(stmt *sqlite.Stmt) error {
+		report.Events = int(stmt.GetInt64("count"))
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error querying events: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	dir := t.TempDir()
+	pool := newSqlitePool(t, "file:"+filepath.Join(dir, "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithTablePrefix("test_"))
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	for i := range 10 {
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+	}
+
+	// backup makes a copy of the database, optionally modifying it
+	backup := func(name, modify string) []byte {
+		path := filepath.Join(dir, name)
+
+		conn, err := pool.Take(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, sqlitex.ExecuteTransient(conn, `VACUUM INTO $path`, &sqlitex.ExecOptions{
+			Named: map[string]any{"$path": path},
+		}))
+
+		pool.Put(conn)
+
+		if modify != "" {
+			backupConn, err := zombiesqlite.OpenConn(path)
+			require.NoError(t, err)
+
+			require.NoError(t, sqlitex.ExecuteTransient(backupConn, modify, nil))
+			require.NoError(t, backupConn.Close())
+		}
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		return data
+	}
+
+	report, err := st.VerifyBackup(ctx, bytes.NewReader(backup("ok.db", "")))
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "unexpected problems: %v", report.Problems)
+	assert.Equal(t, 10, report.Resources)
+	assert.Equal(t, 10, report.Events)
+	assert.Positive(t, report.SchemaVersion)
+
+	// copies of the live database files are in WAL mode
+	report, err = st.VerifyBackup(ctx, bytes.NewReader(backup("wal.db", `PRAGMA journal_mode = WAL`)))
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "unexpected problems: %v", report.Problems)
+
+	report, err = st.VerifyBackup(ctx, bytes.NewReader(backup("undecodable.db", `UPDATE test_resources SET spec = x'ff' WHERE id IN ('1', '2')`)))
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 10, report.Resources)
+	assert.Equal(t, 2, report.Undecodable)
+	assert.Len(t, report.Problems, 2)
+	assert.Contains(t, report.Problems[0], "can't be unmarshaled")
+
+	report, err = st.VerifyBackup(ctx, bytes.NewReader(backup("other.db", `DROP TABLE test_events`)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{`table "test_events" is missing`}, report.Problems)
+
+	report, err = st.VerifyBackup(ctx, bytes.NewReader([]byte("definitely not a database")))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Contains(t, report.Problems[0], "integrity check failed")
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+func encodeBookmark(revision int64) state.Bookmark {
+	return binary.BigEndian.AppendUint64(nil, uint64(revision))
+}
+
+func decodeBookmark(bookmark state.Bookmark) (int64, error) {
+	if len(bookmark) != 8 {
+		return 0, ErrInvalidWatchBookmark(fmt.Errorf("invalid bookmark length: %d", len(bookmark)))
+	}
+
+	return int64(binary.BigEndian.Uint64(bookmark)), nil
+}
+
+// CompareBookmarks compares two bookmarks produced by the sqlite state.
+//
+// The result is -1 if a points to an earlier event than b, 0 if they are equal, and +1 otherwise.
+// Empty bookmarks are considered to point before any event.
+func CompareBookmarks(a, b state.Bookmark) (int, error) {
+	idA, err := decodeBookmarkOrZero(a)
+	if err != nil {
+		return 0, err
+	}
+
+	idB, err := decodeBookmarkOrZero(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return cmp.Compare(idA, idB), nil
+}
+
+// IsZeroBookmark returns true if the bookmark is empty or points before any event.
+//
+// Invalid bookmarks are never zero.
+func IsZeroBookmark(bookmark state.Bookmark) bool {
+	id, err := decodeBookmarkOrZero(bookmark)
+
+	return err == nil && id == 0
+}
+
+func decodeBookmarkOrZero(bookmark state.Bookmark) (int64, error) {
+	if len(bookmark) == 0 {
+		return 0, nil
+	}
+
+	return decodeBookmark(bookmark)
+}
+
+// EventBounds are the bookmarks of the oldest and the newest events available in the event log, see EventBounds.
+type EventBounds struct {
+	// Oldest is the bookmark of the oldest event retained by the compaction, nil if there are no events.
+	Oldest state.Bookmark
+
+	// Newest is the bookmark of the latest event, nil if there are no events.
+	Newest state.Bookmark
+}
+
+// CanResume returns true if a watch can be started from the bookmark (see state.WithKindStartFromBookmark).
+//
+// A watch can be resumed from the bookmark of any available event, or from the bookmark right before the oldest one.
+func (b EventBounds) CanResume(bookmark state.Bookmark) bool {
+	if b.Oldest == nil {
+		return false
+	}
+
+	id, err := decodeBookmark(bookmark)
+	if err != nil {
+		return false
+	}
+
+	oldest, _ := decodeBookmark(b.Oldest) //nolint:errcheck
+	newest, _ := decodeBookmark(b.Newest) //nolint:errcheck
+
+	return id >= oldest-1 && id <= newest
+}
+
+// EventBounds returns the bookmarks of the oldest and the newest events available in the event log.
+//
+// The clients which persist the bookmarks can check whether resuming a watch is still possible
+// (i.e. the events after the bookmark were not compacted) before starting it, and list the resources otherwise.
+// The compaction might remove more events after the call, so the watch might still fail to resume.
+func (st *State) EventBounds(ctx context.Context) (EventBounds, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return EventBounds{}, fmt.Errorf("error taking connection for event bounds: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT coalesce(min(event_id), 0) AS min_event_id, coalesce(max(event_id), 0) AS max_event_id FROM `+st.options.TablePrefix+`events`,
+	)
+	if err != nil {
+		return EventBounds{}, fmt.Errorf("preparing query for event bounds: %w", err)
+	}
+
+	var bounds EventBounds
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			if maxEventID := stmt.GetInt64("max_event_id"); maxEventID > 0 {
+				bounds.Oldest = encodeBookmark(stmt.GetInt64("min_event_id"))
+				bounds.Newest = encodeBookmark(maxEventID)
+			}
+
+			return nil
+		},
+	); err != nil {
+		return EventBounds{}, fmt.Errorf("failed to get event bounds: %w", err)
+	}
+
+	return bounds, nil
+}
@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestCompareBookmarks(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		ch := make(chan state.Event)
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), ch, state.WithBootstrapBookmark(true)))
+
+		var bookmarks []state.Bookmark
+
+		for i := range 3 {
+			if i > 0 {
+				require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+			}
+
+			select {
+			case ev := <-ch:
+				bookmarks = append(bookmarks, ev.Bookmark)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+
+		assert.True(t, sqlite.IsZeroBookmark(bookmarks[0]))
+		assert.True(t, sqlite.IsZeroBookmark(nil))
+		assert.False(t, sqlite.IsZeroBookmark(bookmarks[1]))
+		assert.False(t, sqlite.IsZeroBookmark(state.Bookmark("invalid")))
+
+		for _, test := range []struct {
+			a, b     state.Bookmark
+			expected int
+		}{
+			{a: bookmarks[0], b: bookmarks[1], expected: -1},
+			{a: bookmarks[2], b: bookmarks[1], expected: 1},
+			{a: bookmarks[1], b: bookmarks[1], expected: 0},
+			{a: nil, b: bookmarks[0], expected: 0},
+			{a: nil, b: bookmarks[2], expected: -1},
+		} {
+			result, err := sqlite.CompareBookmarks(test.a, test.b)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, result)
+		}
+
+		_, err := sqlite.CompareBookmarks(state.Bookmark("invalid"), bookmarks[0])
+		require.Error(t, err)
+		assert.True(t, state.IsInvalidWatchBookmarkError(err))
+	})
+}
+
+func TestEventBounds(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		bounds, err := st.EventBounds(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, bounds.Oldest)
+		assert.Nil(t, bounds.Newest)
+
+		kind := conformance.NewPathResource("ns1", "").Metadata()
+		ch := make(chan state.Event, 32)
+
+		require.NoError(t, st.WatchKind(ctx, kind, ch))
+
+		var bookmarks []state.Bookmark
+
+		for i := range 20 {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+
+			select {
+			case ev := <-ch:
+				bookmarks = append(bookmarks, ev.Bookmark)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+
+		_, err = st.Compact(ctx)
+		require.NoError(t, err)
+
+		bounds, err = st.EventBounds(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, bookmarks[10], bounds.Oldest)
+		assert.Equal(t, bookmarks[19], bounds.Newest)
+
+		for i, expected := range map[int]bool{0: false, 8: false, 9: true, 10: true, 19: true} {
+			assert.Equal(t, expected, bounds.CanResume(bookmarks[i]), "bookmark %d", i)
+
+			err = st.WatchKind(ctx, kind, make(chan state.Event), state.WithKindStartFromBookmark(bookmarks[i]))
+			assert.Equal(t, expected, err == nil, "bookmark %d: %v", i, err)
+		}
+
+		assert.False(t, bounds.CanResume(state.Bookmark("invalid")))
+	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0))
+}
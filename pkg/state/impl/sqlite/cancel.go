@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// convertCanceled replaces the error of the write stopped by the context cancellation with ErrCanceled,
+// if CanceledErrors is set.
+//
+// The context interrupts the statements of the connection taken with it, so the cancellation surfaces
+// as the interrupted statement, or as the context error if it happens before the statement runs.
+// The errors returned after the context is canceled for other reasons (e.g. the resource conflicts) are kept.
+func (st *State) convertCanceled(ctx context.Context, errp *error) {
+	if !st.options.CanceledErrors || *errp == nil {
+		return
+	}
+
+	ctxErr := ctx.Err()
+	if ctxErr == nil {
+		return
+	}
+
+	if errors.Is(*errp, ctxErr) || sqlite.ErrCode(*errp) == sqlite.ResultInterrupt {
+		*errp = ErrCanceled(*errp, ctxErr)
+	}
+}
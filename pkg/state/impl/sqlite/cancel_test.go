@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+type cancelKey struct{}
+
+// cancelingValidator cancels the context of the write mid-transaction, right before the resource is stored.
+func cancelingValidator(ctx context.Context, _ sqlite.Operation, _ resource.Resource) error {
+	if cancel, ok := ctx.Value(cancelKey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+
+	return nil
+}
+
+func TestCanceledWrites(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name           string
+		canceledErrors bool
+	}{
+		{name: "storage errors"},
+		{name: "canceled errors", canceledErrors: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			withSqliteCore(t, func(st *sqlite.State) {
+				ctx := t.Context()
+
+				existing := conformance.NewPathResource("ns1", "existing")
+				require.NoError(t, st.Create(ctx, existing))
+
+				bounds, err := st.EventBounds(ctx)
+				require.NoError(t, err)
+
+				canceledCtx := func() context.Context {
+					cancelCtx, cancel := context.WithCancel(ctx)
+					t.Cleanup(cancel)
+
+					return context.WithValue(cancelCtx, cancelKey{}, cancel)
+				}
+
+				checkCanceled := func(err error) {
+					require.Error(t, err)
+					assert.Equal(t, test.canceledErrors, sqlite.IsCanceledError(err), "%v", err)
+
+					if test.canceledErrors {
+						assert.ErrorIs(t, err, context.Canceled)
+					}
+				}
+
+				checkCanceled(st.Create(canceledCtx(), conformance.NewPathResource("ns1", "created")))
+
+				updated := existing.DeepCopy()
+				updated.Metadata().Labels().Set("app", "foo")
+
+				checkCanceled(st.Update(canceledCtx(), updated))
+
+				_, err = st.Apply(canceledCtx(), conformance.NewPathResource("ns1", "applied"), "")
+				checkCanceled(err)
+
+				checkCanceled(st.Import(canceledCtx(), []resource.Resource{conformance.NewPathResource("ns1", "imported")}))
+
+				// nothing is written: neither the resources nor the events
+				_, err = st.Get(ctx, conformance.NewPathResource("ns1", "created").Metadata())
+				assert.True(t, state.IsNotFoundError(err))
+
+				_, err = st.Get(ctx, conformance.NewPathResource("ns1", "applied").Metadata())
+				assert.True(t, state.IsNotFoundError(err))
+
+				_, err = st.Get(ctx, conformance.NewPathResource("ns1", "imported").Metadata())
+				assert.True(t, state.IsNotFoundError(err))
+
+				stored, err := st.Get(ctx, existing.Metadata())
+				require.NoError(t, err)
+				assert.Equal(t, existing.Metadata().Version(), stored.Metadata().Version())
+				assert.True(t, stored.Metadata().Labels().Empty())
+
+				after, err := st.EventBounds(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, bounds.Newest, after.Newest)
+
+				// the interrupted connections are usable again
+				require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "created")))
+				require.NoError(t, st.Update(ctx, updated))
+			}, sqlite.WithValidator(cancelingValidator), sqlite.WithCanceledErrors(test.canceledErrors))
+		})
+	}
+}
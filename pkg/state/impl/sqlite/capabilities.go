@@ -0,0 +1,39 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+// Capabilities describes optional features supported by the state.
+//
+// Generic clients can use it to adapt to the state implementation instead of
+// handling ErrUnsupported errors at runtime.
+type Capabilities struct {
+	// TailEvents is true if watches can start with the last N events (state.WithTailEvents).
+	TailEvents bool
+
+	// Bookmarks is true if watches can be resumed from a bookmark (state.WithStartFromBookmark).
+	Bookmarks bool
+
+	// BookmarksWithBootstrap is true if watches can be resumed from a bookmark with bootstrap contents.
+	BookmarksWithBootstrap bool
+
+	// AggregatedWatch is true if WatchKindAggregated is supported.
+	AggregatedWatch bool
+
+	// History is true if the state keeps the history of events which can be replayed.
+	//
+	// The history is limited by compaction settings.
+	History bool
+}
+
+// Capabilities returns optional features supported by the state.
+func (st *State) Capabilities() Capabilities {
+	return Capabilities{
+		TailEvents:             false,
+		Bookmarks:              true,
+		BookmarksWithBootstrap: false,
+		AggregatedWatch:        true,
+		History:                true,
+	}
+}
@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestCapabilities(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		caps := st.Capabilities()
+		kind := conformance.NewPathResource("ns1", "").Metadata()
+
+		// capabilities should match the actual behavior
+		err := st.WatchKind(ctx, kind, make(chan state.Event), state.WithKindTailEvents(1))
+		assert.Equal(t, caps.TailEvents, !state.IsUnsupportedError(err))
+
+		err = st.WatchKind(ctx, kind, make(chan state.Event), state.WithBootstrapContents(true), state.WithKindStartFromBookmark(make(state.Bookmark, 8)))
+		assert.Equal(t, caps.BookmarksWithBootstrap, !state.IsUnsupportedError(err))
+
+		err = st.WatchKindAggregated(ctx, kind, make(chan []state.Event))
+		assert.Equal(t, caps.AggregatedWatch, err == nil)
+	})
+}
@@ -0,0 +1,247 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// ChangedResources are the resources changed since a bookmark, see ListChangedSince.
+//
+// Each resource is listed once, by the net effect of its changes: a resource created and then updated is
+// listed as created, a resource destroyed and then created again as updated, and a resource created
+// and then destroyed is not listed at all.
+type ChangedResources struct {
+	// Created are the resources which didn't exist at the bookmark.
+	Created []resource.Pointer
+
+	// Updated are the resources which existed at the bookmark and exist now.
+	Updated []resource.Pointer
+
+	// Destroyed are the resources which existed at the bookmark and don't exist now.
+	Destroyed []resource.Pointer
+
+	// Bookmark is the bookmark of the last event taken into account, it should be passed to the next call.
+	Bookmark state.Bookmark
+
+	// Events is the number of the events of the kind since the bookmark,
+	// including the events of the resources which are not listed (created and then destroyed).
+	Events int64
+}
+
+// ListChangedSince returns the resources of the kind changed since the bookmark.
+//
+// The changes are computed from the event log without reading or unmarshaling the resources, so periodic
+// reconcilers can skip the untouched resources without holding a watch open. The initial bookmark can be
+// taken with EventBounds before listing all the resources.
+//
+// If the events after the bookmark were compacted, an error matching state.IsInvalidWatchBookmarkError is returned;
+// if the resources of the kind were imported or their events pruned since the bookmark (see Import and PruneNamespaceEvents),
+// an error matching IsResyncRequiredError is returned. In both cases, the resources should be listed again.
+func (st *State) ListChangedSince(ctx context.Context, resourceKind resource.Kind, bookmark state.Bookmark) (ChangedResources, error) {
+	if err := st.checkNamespace(resourceKind.Namespace()); err != nil {
+		return ChangedResources{}, fmt.Errorf("failed to list changes: %w", err)
+	}
+
+	eventID, err := decodeBookmark(bookmark)
+	if err != nil {
+		return ChangedResources{}, fmt.Errorf("failed to list changes of %q: %w", resourceKind, err)
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return ChangedResources{}, fmt.Errorf("taking connection for list changes: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	type changeKey struct {
+		typ resource.Type
+		id  resource.ID
+	}
+
+	var (
+		changes   = netChanges[changeKey]{}
+		lastEvent = eventID
+		events    int64
+		resync    bool
+	)
+
+	err = func() (err error) {
+		defer sqlitex.Transaction(conn)(&err)
+
+		if err = st.verifyChangesBookmark(conn, eventID); err != nil {
+			return fmt.Errorf("failed to list changes of %q: %w", resourceKind, err)
+		}
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`SELECT type, id, event_type
+			FROM `+st.options.TablePrefix+`events
+			WHERE event_id > $event_id AND namespace = $namespace AND ($type = '' OR type = $type) AND event_type IN (1, 2, 3, $resync_event_type)
+			ORDER BY event_id ASC`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for changes of %q: %w", resourceKind, err)
+		}
+
+		if err = q.
+			BindInt64("$event_id", eventID).
+			BindString("$namespace", resourceKind.Namespace()).
+			BindString("$type", resourceKind.Type()).
+			BindInt("$resync_event_type", resyncEventType).
+			QueryAll(
+				func(stmt *sqlite.Stmt) error {
+					eventType := stmt.GetInt64("event_type")
+
+					if eventType == resyncEventType {
+						resync = true
+
+						return nil
+					}
+
+					events++
+
+					changes.add(changeKey{typ: stmt.GetText("type"), id: stmt.GetText("id")}, eventType)
+
+					return nil
+				},
+			); err != nil {
+			return fmt.Errorf("error querying changes of %q: %w", resourceKind, err)
+		}
+
+		q, err = sqlitexx.NewQuery(
+			conn,
+			`SELECT coalesce(max(event_id), 0) AS max_event_id FROM `+st.options.TablePrefix+`events`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for last event ID for list changes %q: %w", resourceKind, err)
+		}
+
+		return q.QueryRow(func(stmt *sqlite.Stmt) error {
+			lastEvent = max(lastEvent, stmt.GetInt64("max_event_id"))
+
+			return nil
+		})
+	}()
+	if err != nil {
+		return ChangedResources{}, err
+	}
+
+	if resync {
+		return ChangedResources{}, fmt.Errorf("failed to list changes of %q: %w", resourceKind, ErrResyncRequired(resourceKind))
+	}
+
+	result := ChangedResources{
+		Bookmark: encodeBookmark(lastEvent),
+		Events:   events,
+	}
+
+	for key, c := range changes {
+		md := resource.NewMetadata(resourceKind.Namespace(), key.typ, key.id, resource.VersionUndefined)
+
+		switch c.kind() {
+		case changeNone:
+			// the resource didn't exist at the bookmark, and doesn't exist now
+		case changeCreated:
+			result.Created = append(result.Created, &md)
+		case changeDestroyed:
+			result.Destroyed = append(result.Destroyed, &md)
+		case changeUpdated:
+			result.Updated = append(result.Updated, &md)
+		}
+	}
+
+	for _, ptrs := range [][]resource.Pointer{result.Created, result.Updated, result.Destroyed} {
+		slices.SortFunc(ptrs, func(a, b resource.Pointer) int {
+			return cmp.Or(cmp.Compare(a.Type(), b.Type()), cmp.Compare(a.ID(), b.ID()))
+		})
+	}
+
+	return result, nil
+}
+
+// verifyChangesBookmark checks that the events after the bookmark (the event ID) were not compacted,
+// so the changes since the bookmark can be computed from the event log.
+func (st *State) verifyChangesBookmark(conn *sqlite.Conn, eventID int64) error {
+	// a bookmark right before an existing event is valid as well (see MutationResult)
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT 1 FROM `+st.options.TablePrefix+`events
+		WHERE event_id IN ($event_id, $event_id + 1) LIMIT 1`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing query for bookmark: %w", err)
+	}
+
+	if err = q.
+		BindInt64("$event_id", eventID).
+		QueryRow(func(*sqlite.Stmt) error { return nil }); err != nil {
+		if errors.Is(err, sqlitexx.ErrNoRows) {
+			return ErrInvalidWatchBookmark(errors.New("bookmark refers to compacted event"))
+		}
+
+		return fmt.Errorf("verifying bookmark: %w", err)
+	}
+
+	return nil
+}
+
+// changeKind is the net effect of the changes of a resource, see netChange.
+type changeKind int
+
+const (
+	// changeNone is a resource created and then destroyed.
+	changeNone changeKind = iota
+	changeCreated
+	changeUpdated
+	changeDestroyed
+)
+
+// netChange is the first and the last event type of a resource.
+type netChange struct {
+	firstType int64
+	lastType  int64
+}
+
+// kind classifies the changes of the resource by their net effect.
+func (c *netChange) kind() changeKind {
+	created, destroyed := c.firstType == 1, c.lastType == 3
+
+	switch {
+	case created && destroyed:
+		return changeNone
+	case created:
+		return changeCreated
+	case destroyed:
+		return changeDestroyed
+	default:
+		return changeUpdated
+	}
+}
+
+// netChanges accumulates the changes of the resources by key, the events should be added in order.
+type netChanges[K comparable] map[K]*netChange
+
+func (n netChanges[K]) add(key K, eventType int64) {
+	c, ok := n[key]
+	if !ok {
+		c = &netChange{firstType: eventType}
+		n[key] = c
+	}
+
+	c.lastType = eventType
+}
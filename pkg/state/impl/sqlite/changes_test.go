@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/siderolabs/gen/xslices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestListChangedSince(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		ids := func(ptrs []resource.Pointer) []resource.ID {
+			return xslices.Map(ptrs, resource.Pointer.ID)
+		}
+
+		for _, id := range []string{"updated", "destroyed", "recreated", "untouched"} {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", id)))
+		}
+
+		bounds, err := st.EventBounds(ctx)
+		require.NoError(t, err)
+
+		changes, err := st.ListChangedSince(ctx, kind, bounds.Newest)
+		require.NoError(t, err)
+		assert.Empty(t, changes.Created)
+		assert.Empty(t, changes.Updated)
+		assert.Empty(t, changes.Destroyed)
+		assert.Zero(t, changes.Events)
+		assert.Equal(t, bounds.Newest, changes.Bookmark)
+
+		for range 2 {
+			res, err := st.Get(ctx, conformance.NewPathResource("default", "updated").Metadata())
+			require.NoError(t, err)
+
+			res.Metadata().Labels().Set("app", res.Metadata().Version().String())
+			require.NoError(t, st.Update(ctx, res))
+		}
+
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("default", "destroyed").Metadata()))
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("default", "recreated").Metadata()))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "recreated")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "created")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "transient")))
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("default", "transient").Metadata()))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("other", "created")))
+
+		changes, err = st.ListChangedSince(ctx, kind, bounds.Newest)
+		require.NoError(t, err)
+		assert.Equal(t, []resource.ID{"created"}, ids(changes.Created))
+		assert.Equal(t, []resource.ID{"recreated", "updated"}, ids(changes.Updated))
+		assert.Equal(t, []resource.ID{"destroyed"}, ids(changes.Destroyed))
+		assert.EqualValues(t, 8, changes.Events)
+
+		// nothing changed since the returned bookmark
+		changes, err = st.ListChangedSince(ctx, kind, changes.Bookmark)
+		require.NoError(t, err)
+		assert.Empty(t, changes.Created)
+		assert.Empty(t, changes.Updated)
+		assert.Empty(t, changes.Destroyed)
+		assert.Zero(t, changes.Events)
+
+		require.NoError(t, st.Import(ctx, []resource.Resource{conformance.NewPathResource("default", "imported")}))
+
+		_, err = st.ListChangedSince(ctx, kind, changes.Bookmark)
+		assert.True(t, sqlite.IsResyncRequiredError(err), "unexpected error: %v", err)
+
+		_, err = st.ListChangedSince(ctx, kind, []byte("invalid"))
+		assert.True(t, state.IsInvalidWatchBookmarkError(err), "unexpected error: %v", err)
+	})
+}
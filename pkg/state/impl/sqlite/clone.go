@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// CloneTo writes a consistent copy of the database to a new file at path (with VACUUM INTO),
+// so the analysis tools can open it read-only while the state keeps serving the requests.
+//
+// The copy is the point-in-time view of the database as of the start of the clone, it's written within
+// a single read transaction, so the writes are not blocked. The copy is independent of the database:
+// it has no WAL, and it's compacted (the free pages are left out).
+// The whole database is copied, including the tables with other prefixes, and the encrypted specs
+// stay encrypted (see WithEncryption).
+//
+// The file at path must not exist. The copy is written to a temporary file next to path first,
+// and it's linked to path only when complete, so a failed clone never leaves a partial file at path
+// (and never removes a file it didn't create).
+func (st *State) CloneTo(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("clone destination %q already exists", path)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error checking clone destination: %w", err)
+	}
+
+	// VACUUM INTO accepts an existing empty file
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".clone-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary clone file: %w", err)
+	}
+
+	tmpPath := tmp.Name()
+
+	defer os.Remove(tmpPath) //nolint:errcheck
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("creating temporary clone file: %w", err)
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for clone: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	start := time.Now()
+
+	q, err := sqlitexx.NewQuery(conn, `VACUUM INTO $path`)
+	if err != nil {
+		return fmt.Errorf("preparing clone statement: %w", err)
+	}
+
+	if err = q.BindString("$path", tmpPath).Exec(); err != nil {
+		return fmt.Errorf("error cloning database: %w", err)
+	}
+
+	// unlike rename, link fails if the destination was created in the meantime
+	if err = os.Link(tmpPath, path); err != nil {
+		return fmt.Errorf("error moving clone to destination: %w", err)
+	}
+
+	st.options.Logger.Info("database cloned", zap.String("path", path), zap.Duration("duration", time.Since(start)))
+
+	return nil
+}
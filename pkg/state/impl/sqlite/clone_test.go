@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestCloneTo(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for i := range 10 {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		dir := t.TempDir()
+		path := filepath.Join(dir, "clone.db")
+
+		require.NoError(t, st.CloneTo(ctx, path))
+
+		// the temporary file is gone
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "clone.db", entries[0].Name())
+
+		// the state keeps working, and the clone doesn't see the new writes
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "new")))
+
+		conn, err := zombiesqlite.OpenConn(path, zombiesqlite.OpenReadOnly)
+		require.NoError(t, err)
+
+		defer conn.Close() //nolint:errcheck
+
+		var resources, events int
+
+		require.NoError(t, sqlitex.ExecuteTransient(conn, `SELECT (SELECT count(*) FROM test_resources), (SELECT count(*) FROM test_events)`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				resources = stmt.ColumnInt(0)
+				events = stmt.ColumnInt(1)
+
+				return nil
+			},
+		}))
+
+		assert.Equal(t, 10, resources)
+		assert.Equal(t, 10, events)
+
+		assert.ErrorContains(t, st.CloneTo(ctx, path), "already exists")
+
+		// the failed clone leaves the existing file alone
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+
+		assert.Error(t, st.CloneTo(ctx, filepath.Join(t.TempDir(), "missing", "clone.db")))
+	})
+}
@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/siderolabs/gen/panicsafe"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// runColdStart builds the deferred indexes and warms up the cache, see DeferIndexes and WarmupCache.
+func (st *State) runColdStart() {
+	defer st.wg.Done()
+
+	for _, task := range []struct {
+		run     func(context.Context) error
+		name    string
+		enabled bool
+	}{
+		{name: "build deferred indexes", run: st.buildIndexes, enabled: st.options.DeferIndexes},
+		{name: "warm up cache", run: st.warmupCache, enabled: st.options.WarmupCache},
+	} {
+		if !task.enabled {
+			continue
+		}
+
+		if err := panicsafe.RunErrF(func() error {
+			return task.run(st.compactionCtx)
+		})(); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+
+			st.options.Logger.Error("failed to "+task.name, zap.Error(err))
+		}
+	}
+}
+
+// buildIndexes creates the secondary indexes which were left out of the schema migration.
+func (st *State) buildIndexes(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for indexes: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	start := time.Now()
+
+	if err = applyIndexes(conn, st.options.TablePrefix); err != nil {
+		return err
+	}
+
+	st.options.Logger.Info("deferred indexes built", zap.Duration("duration", time.Since(start)))
+
+	return nil
+}
+
+// warmupCache reads the whole resources table, so its pages are in the cache.
+func (st *State) warmupCache(ctx context.Context) error {
+	conn, err := st.readDB.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for cache warmup: %w", err)
+	}
+
+	defer st.readDB.Put(conn)
+
+	start := time.Now()
+
+	var resources, size int64
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT spec FROM `+st.options.TablePrefix+`resources`)
+	if err != nil {
+		return fmt.Errorf("preparing query for cache warmup: %w", err)
+	}
+
+	if err = q.QueryAll(func(stmt *sqlite.Stmt) error {
+		// reading the length loads the value, including the overflow pages
+		resources++
+		size += int64(stmt.GetLen("spec"))
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error reading resources for cache warmup: %w", err)
+	}
+
+	st.options.Logger.Info("cache warmed up",
+		zap.Duration("duration", time.Since(start)),
+		zap.Int64("resources", resources),
+		zap.Int64("size", size),
+	)
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestColdStart(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+	pool := newSqlitePool(t, path)
+
+	indexes := func() []string {
+		conn, err := pool.Take(t.Context())
+		require.NoError(t, err)
+
+		defer pool.Put(conn)
+
+		var names []string
+
+		require.NoError(t, sqlitex.Execute(conn, `SELECT name FROM sqlite_schema WHERE type = 'index' AND sql IS NOT NULL ORDER BY name`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				names = append(names, stmt.ColumnText(0))
+
+				return nil
+			},
+		}))
+
+		return names
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	st := newSqliteState(t, path, sqlite.WithDeferredIndexes(true), sqlite.WithCacheWarmup(true), sqlite.WithLogger(zap.New(core)))
+
+	opened := logs.FilterMessage("state opened").All()
+	require.Len(t, opened, 1)
+	assert.Contains(t, opened[0].ContextMap(), "migration")
+
+	require.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, 1, logs.FilterMessage("deferred indexes built").Len())
+		assert.Equal(collect, 1, logs.FilterMessage("cache warmed up").Len())
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []string{"resources_namespace_phase", "resources_owner", "resources_updated"}, indexes())
+
+	require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "a")))
+
+	_, err := st.FindStale(t.Context(), conformance.NewPathResource("ns1", "").Metadata(), time.Hour)
+	require.NoError(t, err)
+}
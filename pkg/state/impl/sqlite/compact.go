@@ -7,26 +7,206 @@ package sqlite
 import (
 	"context"
 	"fmt"
+	"math"
 	"time"
 
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/siderolabs/gen/panicsafe"
 	"go.uber.org/zap"
 	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 
 	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
 )
 
 // CompactionInfo holds information about a compaction operation.
 type CompactionInfo struct {
+	// EventsCompactedPerKind is the number of events removed per resource kind.
+	EventsCompactedPerKind map[CompactedKind]int64
+
+	// MinBookmark is the bookmark of the oldest event retained after compaction.
+	//
+	// It is nil if there are no events.
+	MinBookmark state.Bookmark
+
 	EventsCompacted int64
 	RemainingEvents int64
+
+	// KeepEvents is the number of events the compaction kept (unless they were older than CompactMinAge),
+	// it's CompactKeepEvents adjusted by the adaptive retention (see CompactRetention).
+	KeepEvents int64
+
+	// Incomplete is true if compaction stopped early because of the time budget (see CompactTimeBudget).
+	//
+	// The remaining events are compacted on the next run.
+	Incomplete bool
+
+	// Vacuumed is true if the database file was rebuilt after the compaction (see WithVacuum).
+	Vacuumed bool
+}
+
+// CompactedKind identifies a resource kind in the compaction report.
+type CompactedKind struct {
+	Namespace resource.Namespace
+	Type      resource.Type
+}
+
+// CompactOptions configures a compaction run, see Compact.
+type CompactOptions struct {
+	// Vacuum rebuilds the database file after the events are compacted.
+	//
+	// Deleted events leave free pages in the database file, VACUUM returns them to the file system.
+	// It rewrites the whole database and blocks the writers while it runs, so it's never done by the background compaction.
+	Vacuum bool
+}
+
+// CompactOption configures a compaction run.
+type CompactOption func(*CompactOptions)
+
+// WithVacuum rebuilds the database file after the compaction.
+func WithVacuum() CompactOption {
+	return func(opts *CompactOptions) {
+		opts.Vacuum = true
+	}
+}
+
+// CompactionStatus is the status of the compaction, see CompactionStatus.
+type CompactionStatus struct {
+	// Started is the time the running compaction started, zero if no compaction is running.
+	Started time.Time
+
+	// LastFinished is the time the last compaction finished.
+	LastFinished time.Time
+
+	// LastInfo is the result of the last successful compaction.
+	LastInfo *CompactionInfo
+
+	// LastError is the error of the last compaction, nil if it was successful.
+	LastError error
+
+	// Waiting is the number of Compact calls waiting for the running compaction to finish.
+	Waiting int
+}
+
+// Running returns true if a compaction is running.
+func (s CompactionStatus) Running() bool {
+	return !s.Started.IsZero()
+}
+
+// CompactionStatus returns the status of the background and manual compactions.
+func (st *State) CompactionStatus() CompactionStatus {
+	st.compactStatusMu.Lock()
+	defer st.compactStatusMu.Unlock()
+
+	return st.compactStatus
 }
 
 // Compact performs database compaction.
-func (st *State) Compact(ctx context.Context) (*CompactionInfo, error) {
-	st.compactMu.Lock()
-	defer st.compactMu.Unlock()
+//
+// Only one compaction runs at a time: if another one is running (e.g. the background compaction),
+// Compact waits for it to finish, and then runs the compaction with its own options.
+// The wait is aborted when ctx is canceled. See TryCompact for the non-blocking variant.
+//
+// Compaction is skipped while a snapshot is active (see BeginSnapshot).
+func (st *State) Compact(ctx context.Context, opts ...CompactOption) (*CompactionInfo, error) {
+	st.addCompactWaiting(1)
+
+	select {
+	case st.compactSem <- struct{}{}:
+		st.addCompactWaiting(-1)
+	case <-ctx.Done():
+		st.addCompactWaiting(-1)
+
+		return nil, fmt.Errorf("waiting for the running compaction: %w", ctx.Err())
+	}
+
+	return st.compact(ctx, opts)
+}
+
+// TryCompact performs database compaction, unless another compaction is running.
+//
+// If a compaction is already running, TryCompact returns immediately with an error matching IsCompactionInProgressError.
+func (st *State) TryCompact(ctx context.Context, opts ...CompactOption) (*CompactionInfo, error) {
+	select {
+	case st.compactSem <- struct{}{}:
+	default:
+		return nil, ErrCompactionInProgress()
+	}
+
+	return st.compact(ctx, opts)
+}
+
+func (st *State) addCompactWaiting(delta int) {
+	st.compactStatusMu.Lock()
+	st.compactStatus.Waiting += delta
+	st.compactStatusMu.Unlock()
+}
+
+// compact runs the compaction, compactSem should be acquired by the caller, it is released when done.
+func (st *State) compact(ctx context.Context, opts []CompactOption) (info *CompactionInfo, err error) {
+	defer func() { <-st.compactSem }()
+
+	var options CompactOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	st.compactStatusMu.Lock()
+	st.compactStatus.Started = time.Now()
+	st.compactStatusMu.Unlock()
+
+	defer func() {
+		st.compactStatusMu.Lock()
+		defer st.compactStatusMu.Unlock()
+
+		st.compactStatus.Started = time.Time{}
+		st.compactStatus.LastFinished = time.Now()
+		st.compactStatus.LastError = err
+
+		if err == nil {
+			st.compactStatus.LastInfo = info
+		}
+	}()
+
+	if st.snapshots > 0 {
+		// compaction is paused while the database files are being copied
+		st.options.Logger.Debug("database compaction skipped due to active snapshot")
+
+		return &CompactionInfo{}, nil
+	}
+
+	if info, err = st.compactEvents(ctx); err != nil || !options.Vacuum {
+		return info, err
+	}
+
+	if err = st.vacuum(ctx); err != nil {
+		return nil, err
+	}
+
+	info.Vacuumed = true
+
+	return info, nil
+}
+
+func (st *State) vacuum(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking connection for vacuum: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	if err = sqlitex.ExecuteTransient(conn, `VACUUM`, nil); err != nil {
+		return fmt.Errorf("error vacuuming database: %w", err)
+	}
 
+	return nil
+}
+
+// compactEvents deletes the old events.
+func (st *State) compactEvents(ctx context.Context) (*CompactionInfo, error) {
 	conn, err := st.db.Take(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error taking connection for compaction: %w", err)
@@ -66,14 +246,23 @@ func (st *State) Compact(ctx context.Context) (*CompactionInfo, error) {
 	// we estimate number of events by subtracting min from max
 	// this works well enough even with gaps in event IDs
 	info.RemainingEvents = maxEventID - minEventID + 1
+	info.MinBookmark = encodeBookmark(minEventID)
+
+	info.KeepEvents = int64(st.options.CompactKeepEvents)
+
+	if st.options.CompactRetention > 0 {
+		if info.KeepEvents, err = st.adaptiveKeepEvents(conn, minEventID, maxEventID); err != nil {
+			return nil, err
+		}
+	}
 
-	if info.RemainingEvents <= int64(st.options.CompactKeepEvents) {
+	if info.RemainingEvents <= info.KeepEvents {
 		// no need to compact
 		return &info, nil
 	}
 
-	// pick cutoff event ID based on min events to keep (don't drop more than CompactKeepEvents)
-	cutoffEventID := maxEventID - int64(st.options.CompactKeepEvents) + 1
+	// pick cutoff event ID based on min events to keep (don't drop more than KeepEvents)
+	cutoffEventID := maxEventID - info.KeepEvents + 1
 
 	// perform binary search on events table in the range [minEventID, cutoffEventID)
 	// to find the first event that is newer than min age
@@ -131,70 +320,208 @@ func (st *State) Compact(ctx context.Context) (*CompactionInfo, error) {
 		return &info, nil
 	}
 
-	cutoffEventID = left
+	// don't delete events which active watches haven't consumed yet
+	cutoffEventID, err = st.protectWatches(conn, left)
+	if err != nil {
+		return nil, err
+	}
 
 	// delete events older than cutoffEventID
-	// we will delete in batches of 1000 to avoid long transactions
+	// we will delete in batches to avoid long transactions, pausing between the batches
+	// to let the writers in
+	start := time.Now()
 
 	for {
 		q, err := sqlitexx.NewQuery(
 			conn,
-			`DELETE FROM `+st.options.TablePrefix+`events WHERE event_id IN (SELECT event_id FROM `+st.options.TablePrefix+`events WHERE event_id < $cutoff LIMIT 1000)`,
+			`DELETE FROM `+st.options.TablePrefix+`events WHERE event_id IN (SELECT event_id FROM `+st.options.TablePrefix+`events WHERE event_id < $cutoff LIMIT $batch_size)
+			RETURNING namespace, type`,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("preparing delete statement for compaction: %w", err)
 		}
 
+		var rowsAffected int
+
 		if err = q.
 			BindInt64("$cutoff", cutoffEventID).
-			Exec(); err != nil {
+			BindInt("$batch_size", st.options.CompactBatchSize).
+			QueryAll(
+				func(stmt *sqlite.Stmt) error {
+					if info.EventsCompactedPerKind == nil {
+						info.EventsCompactedPerKind = map[CompactedKind]int64{}
+					}
+
+					info.EventsCompactedPerKind[CompactedKind{
+						Namespace: stmt.GetText("namespace"),
+						Type:      stmt.GetText("type"),
+					}]++
+
+					rowsAffected++
+
+					return nil
+				},
+			); err != nil {
 			return nil, fmt.Errorf("failed to delete old events during compaction: %w", err)
 		}
 
-		rowsAffected := conn.Changes()
-
 		info.EventsCompacted += int64(rowsAffected)
 		info.RemainingEvents -= int64(rowsAffected)
 
-		if rowsAffected == 0 {
+		if rowsAffected == 0 || rowsAffected < st.options.CompactBatchSize {
 			// done
 			break
 		}
+
+		if st.options.CompactTimeBudget > 0 && time.Since(start) >= st.options.CompactTimeBudget {
+			info.Incomplete = true
+
+			break
+		}
+
+		if st.options.CompactBatchPause > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("compaction canceled: %w", ctx.Err())
+			case <-time.After(st.options.CompactBatchPause):
+			}
+		}
+	}
+
+	q, err = sqlitexx.NewQuery(
+		conn,
+		`SELECT coalesce(min(event_id), 0) AS min_event_id FROM `+st.options.TablePrefix+`events`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("preparing query for min event ID after compaction: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			minEventID = stmt.GetInt64("min_event_id")
+
+			return nil
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to get min event ID after compaction: %w", err)
 	}
 
+	info.MinBookmark = encodeBookmark(minEventID)
+
 	return &info, nil
 }
 
+// adaptiveKeepEvents returns the number of events to keep to cover CompactRetention at the insert rate
+// averaged over the events in the log, bounded by CompactKeepEvents and CompactMaxKeepEvents (CompactKeepEvents wins).
+func (st *State) adaptiveKeepEvents(conn *sqlite.Conn, minEventID, maxEventID int64) (int64, error) {
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT event_timestamp FROM `+st.options.TablePrefix+`events WHERE event_id = $event_id`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query for insert rate: %w", err)
+	}
+
+	var oldestTimestamp int64
+
+	if err = q.
+		BindInt64("$event_id", minEventID).
+		QueryRow(
+			func(stmt *sqlite.Stmt) error {
+				oldestTimestamp = stmt.GetInt64("event_timestamp")
+
+				return nil
+			},
+		); err != nil {
+		return 0, fmt.Errorf("failed to get oldest event timestamp for insert rate: %w", err)
+	}
+
+	// the timestamps have the second precision, so the span is at least a second
+	span := max(time.Now().Unix()-oldestTimestamp, 1)
+	rate := float64(maxEventID-minEventID+1) / float64(span)
+
+	keepEvents := int64(math.Ceil(rate * st.options.CompactRetention.Seconds()))
+
+	if st.options.CompactMaxKeepEvents > 0 {
+		keepEvents = min(keepEvents, int64(st.options.CompactMaxKeepEvents))
+	}
+
+	// the lower bound wins over the upper one
+	return max(keepEvents, int64(st.options.CompactKeepEvents)), nil
+}
+
+// TriggerCompaction requests the background compaction loop to run a compaction cycle now.
+//
+// TriggerCompaction doesn't wait for the compaction to happen.
+// If automatic compaction is disabled, TriggerCompaction does nothing.
+func (st *State) TriggerCompaction() {
+	select {
+	case st.compactionTrigger <- struct{}{}:
+	default:
+	}
+}
+
 func (st *State) runCompaction() {
 	defer st.wg.Done()
 
 	ticker := time.NewTicker(st.options.CompactionInterval)
 	defer ticker.Stop()
 
+	var lastOptimized time.Time
+
 	for {
 		var (
 			info *CompactionInfo
 			err  error
 		)
 
-		err = panicsafe.RunErrF(func() error {
-			info, err = st.Compact(st.compactionCtx)
-
-			return err
-		})()
-		if err != nil {
-			st.options.Logger.Error("failed to compact database", zap.Error(err))
+		if st.IsLeader() {
+			err = panicsafe.RunErrF(func() error {
+				info, err = st.TryCompact(st.compactionCtx)
+
+				return err
+			})()
+
+			switch {
+			case IsCompactionInProgressError(err):
+				st.options.Logger.Debug("skipping compaction, manual compaction is in progress")
+			case err != nil:
+				st.options.Logger.Error("failed to compact database", zap.Error(err))
+			default:
+				st.options.Logger.Info("database compaction completed",
+					zap.Int64("events_compacted", info.EventsCompacted),
+					zap.Int64("remaining_events", info.RemainingEvents),
+					zap.Int64("keep_events", info.KeepEvents),
+					zap.Bool("incomplete", info.Incomplete),
+				)
+			}
+
+			st.pruneQueuedNamespaces(st.compactionCtx)
+
+			if st.options.GraveyardRetention > 0 {
+				if pruned, pruneErr := st.pruneGraveyard(st.compactionCtx); pruneErr != nil {
+					st.options.Logger.Error("failed to prune graveyard", zap.Error(pruneErr))
+				} else if pruned > 0 {
+					st.options.Logger.Info("graveyard pruned", zap.Int("resources", pruned))
+				}
+			}
+
+			if st.options.OptimizeInterval > 0 && time.Since(lastOptimized) >= st.options.OptimizeInterval {
+				if err = st.Optimize(st.compactionCtx); err != nil {
+					st.options.Logger.Error("failed to optimize database", zap.Error(err))
+				}
+
+				lastOptimized = time.Now()
+			}
 		} else {
-			st.options.Logger.Info("database compaction completed",
-				zap.Int64("events_compacted", info.EventsCompacted),
-				zap.Int64("remaining_events", info.RemainingEvents),
-			)
+			st.options.Logger.Debug("skipping compaction, ownership lease is held by another state instance")
 		}
 
 		select {
 		case <-st.shutdown:
 			return
 		case <-ticker.C:
+		case <-st.compactionTrigger:
 		}
 	}
 }
@@ -5,13 +5,22 @@
 package sqlite_test
 
 import (
+	"context"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 
 	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
 )
@@ -74,3 +83,356 @@ func TestCompactEvents(t *testing.T) {
 		assert.EqualValues(t, 10, result.RemainingEvents)
 	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0))
 }
+
+func TestTriggerCompaction(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		// wait for the initial compaction run
+		require.Eventually(t, func() bool {
+			return logs.FilterMessage("database compaction completed").Len() == 1
+		}, time.Second, time.Millisecond)
+
+		for i := range 20 {
+			require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		st.TriggerCompaction()
+
+		require.Eventually(t, func() bool {
+			return logs.FilterMessage("database compaction completed").FilterField(zap.Int64("events_compacted", 10)).Len() == 1
+		}, time.Second, time.Millisecond)
+	},
+		sqlite.WithCompactKeepEvents(10),
+		sqlite.WithCompactMinAge(-time.Minute),
+		sqlite.WithCompactionInterval(time.Hour),
+		sqlite.WithLogger(zap.New(core)),
+	)
+}
+
+func TestCompactPerKindReport(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		for i := range 10 {
+			require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+			require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns2", strconv.Itoa(i))))
+		}
+
+		result, err := st.Compact(t.Context())
+		require.NoError(t, err)
+		assert.EqualValues(t, 10, result.EventsCompacted)
+		assert.Equal(t, map[sqlite.CompactedKind]int64{
+			{Namespace: "ns1", Type: conformance.PathResourceType}: 5,
+			{Namespace: "ns2", Type: conformance.PathResourceType}: 5,
+		}, result.EventsCompactedPerKind)
+
+		// the oldest retained event is still available to watch from
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), make(chan state.Event), state.WithKindStartFromBookmark(result.MinBookmark)))
+	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0))
+}
+
+func TestCompactTimeBudget(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		for i := range 50 {
+			require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		// the budget is exhausted after the first batch
+		result, err := st.Compact(t.Context())
+		require.NoError(t, err)
+		assert.True(t, result.Incomplete)
+		assert.EqualValues(t, 10, result.EventsCompacted)
+		assert.Equal(t, map[sqlite.CompactedKind]int64{
+			{Namespace: "ns1", Type: conformance.PathResourceType}: 10,
+		}, result.EventsCompactedPerKind)
+
+		var total int64
+
+		for range 10 {
+			result, err = st.Compact(t.Context())
+			require.NoError(t, err)
+
+			total += result.EventsCompacted
+
+			if !result.Incomplete {
+				break
+			}
+		}
+
+		assert.False(t, result.Incomplete)
+		assert.EqualValues(t, 30, total)
+		assert.EqualValues(t, 10, result.RemainingEvents)
+	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0),
+		sqlite.WithCompactBatchSize(10), sqlite.WithCompactTimeBudget(time.Nanosecond),
+	)
+}
+
+func TestCompactInvalidBatchSize(t *testing.T) {
+	t.Parallel()
+
+	for _, batchSize := range []int{0, -1} {
+		t.Run(strconv.Itoa(batchSize), func(t *testing.T) {
+			t.Parallel()
+
+			withSqliteCore(t, func(st *sqlite.State) {
+				for i := range 20 {
+					require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+				}
+
+				// the default batch size is used, so the compaction finishes
+				ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+				defer cancel()
+
+				result, err := st.Compact(ctx)
+				require.NoError(t, err)
+				assert.False(t, result.Incomplete)
+				assert.EqualValues(t, 10, result.EventsCompacted)
+				assert.EqualValues(t, 10, result.RemainingEvents)
+			}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0),
+				sqlite.WithCompactBatchSize(batchSize),
+			)
+		})
+	}
+}
+
+func TestTryCompact(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for i := range 50 {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		assert.False(t, st.CompactionStatus().Running())
+
+		// the batch pauses make the compaction slow
+		errCh := make(chan error, 1)
+
+		go func() {
+			_, err := st.Compact(ctx)
+			errCh <- err
+		}()
+
+		require.Eventually(t, func() bool {
+			return st.CompactionStatus().Running()
+		}, time.Second, time.Millisecond)
+
+		_, err := st.TryCompact(ctx)
+		require.Error(t, err)
+		assert.True(t, sqlite.IsCompactionInProgressError(err))
+
+		shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		_, err = st.Compact(shortCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// the manual compaction waits for the running one, and then runs with its own options
+		vacuumCh := make(chan *sqlite.CompactionInfo, 1)
+
+		go func() {
+			result, vacuumErr := st.Compact(ctx, sqlite.WithVacuum())
+			assert.NoError(t, vacuumErr)
+
+			vacuumCh <- result
+		}()
+
+		require.Eventually(t, func() bool {
+			return st.CompactionStatus().Waiting == 1
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, <-errCh)
+
+		result := <-vacuumCh
+		require.NotNil(t, result)
+		assert.True(t, result.Vacuumed)
+
+		status := st.CompactionStatus()
+		assert.False(t, status.Running())
+		assert.Zero(t, status.Waiting)
+		assert.NoError(t, status.LastError)
+		assert.Same(t, result, status.LastInfo)
+	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0),
+		sqlite.WithCompactBatchSize(10), sqlite.WithCompactBatchPause(100*time.Millisecond),
+	)
+}
+
+func TestCompactSlowWatch(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		// the watch channel is not read until compaction is done
+		watchCh := make(chan state.Event)
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), watchCh))
+
+		for i := range 20 {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		_, err := st.Compact(ctx)
+		require.NoError(t, err)
+
+		for i := range 20 {
+			select {
+			case ev := <-watchCh:
+				require.Equal(t, state.Created, ev.Type, "event %s", ev.Error)
+				assert.Equal(t, strconv.Itoa(i), ev.Resource.Metadata().ID())
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0))
+}
+
+func TestCompactExpiredWatch(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		// the buffer lets the first events in without blocking the watch
+		watchCh := make(chan state.Event, 1)
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), watchCh))
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "0")))
+
+		// wait for the watch loop to start
+		select {
+		case <-watchCh:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// with synchronous delivery, the watch fetches the next events until the channel is full
+		// and gets stuck sending, so the rest of the events stay unconsumed
+		for i := 1; i < 20; i++ {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		// events are stored with second precision
+		time.Sleep(1100 * time.Millisecond)
+
+		result, err := st.Compact(ctx)
+		require.NoError(t, err)
+		assert.Positive(t, result.EventsCompacted)
+
+		for {
+			select {
+			case ev := <-watchCh:
+				if ev.Type == state.Errored {
+					assert.True(t, state.IsInvalidWatchBookmarkError(ev.Error))
+
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+	},
+		sqlite.WithCompactKeepEvents(10),
+		sqlite.WithCompactMinAge(-time.Minute),
+		sqlite.WithCompactionInterval(0),
+		sqlite.WithCompactMaxWatchHold(time.Nanosecond),
+		sqlite.WithSynchronousEventDelivery(true),
+	)
+}
+
+func TestCompactEventIDsMonotonic(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+	opts := []sqlite.StateOption{sqlite.WithCompactKeepEvents(0), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0)}
+
+	st, err := sqlite.NewState(t.Context(), newSqlitePool(t, path), store.ProtobufMarshaler{}, opts...)
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", id)))
+	}
+
+	// the latest events are deleted as well
+	result, err := st.Compact(t.Context())
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, result.EventsCompacted)
+	assert.Zero(t, st.Health(t.Context()).LastEventID)
+
+	for _, id := range []string{"c", "d"} {
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", id)))
+	}
+
+	assert.EqualValues(t, 4, st.Health(t.Context()).LastEventID)
+
+	result, err = st.Compact(t.Context())
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, result.EventsCompacted)
+
+	st.Close()
+
+	// the IDs are not reused after the restart either
+	st = newSqliteState(t, path, opts...)
+
+	require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "e")))
+	assert.EqualValues(t, 5, st.Health(t.Context()).LastEventID)
+}
+
+func TestCompactRetention(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name          string
+		keepEvents    int
+		maxKeepEvents int
+		expected      int64
+	}{
+		{name: "rate", keepEvents: 5, expected: 20},
+		{name: "min", keepEvents: 30, expected: 30},
+		{name: "max", keepEvents: 5, maxKeepEvents: 10, expected: 10},
+		{name: "max below min", keepEvents: 15, maxKeepEvents: 10, expected: 15},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "state.db")
+			st := newSqliteState(t, "file:"+path,
+				sqlite.WithCompactKeepEvents(test.keepEvents),
+				sqlite.WithCompactRetention(20*time.Second, test.maxKeepEvents),
+				sqlite.WithCompactMinAge(-time.Minute),
+				sqlite.WithCompactionInterval(0),
+			)
+
+			for i := range 100 {
+				require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+			}
+
+			// spread the events over the last 100 seconds, i.e. one event per second
+			conn, err := zombiesqlite.OpenConn(path, zombiesqlite.OpenReadWrite)
+			require.NoError(t, err)
+
+			err = sqlitex.ExecuteTransient(conn, `UPDATE events SET event_timestamp = unixepoch() - (101 - event_id)`, nil)
+			require.NoError(t, conn.Close())
+			require.NoError(t, err)
+
+			result, err := st.Compact(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, result.KeepEvents)
+			assert.Equal(t, test.expected, result.RemainingEvents)
+			assert.Equal(t, 100-test.expected, result.EventsCompacted)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// minSQLiteVersion is the oldest SQLite version supporting the schema (the JSONB functions were added in 3.45.0).
+const minSQLiteVersion = 3_045_000
+
+// checkConfiguration verifies that the database is opened with the settings the state relies on.
+//
+// The settings which can't work are rejected with ErrUnsupportedConfiguration, the settings which only
+// degrade the state are adjusted with a warning, or rejected if StrictConfiguration is set.
+func (st *State) checkConfiguration(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for configuration check: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	var (
+		version     string
+		journalMode string
+	)
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT sqlite_version() AS version, journal_mode FROM pragma_journal_mode()`)
+	if err != nil {
+		return fmt.Errorf("preparing query for configuration: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			version = stmt.GetText("version")
+			journalMode = stmt.GetText("journal_mode")
+
+			return nil
+		},
+	); err != nil {
+		return fmt.Errorf("failed to get configuration: %w", err)
+	}
+
+	if versionNumber(version) < minSQLiteVersion {
+		return ErrUnsupportedConfiguration(fmt.Sprintf("SQLite %s is too old, 3.45.0 or newer is required", version))
+	}
+
+	filename, err := databaseFilename(conn)
+	if err != nil {
+		return err
+	}
+
+	// without the URI flag, the parameters become a part of the file name, and the pragmas are silently ignored
+	if strings.Contains(filename, "_pragma=") || strings.Contains(filename, "_txlock=") {
+		return ErrUnsupportedConfiguration(fmt.Sprintf("database file name %q contains URI parameters, "+
+			"the URI should be opened with the URI flag, and the pragmas should match the driver (see DSN)", filename))
+	}
+
+	// in-memory databases don't support WAL, and are only used with a single connection
+	if filename == "" || journalMode == "wal" {
+		return nil
+	}
+
+	if st.options.StrictConfiguration {
+		return ErrUnsupportedConfiguration(fmt.Sprintf("journal mode is %q, WAL is required", journalMode))
+	}
+
+	// the rollback journal makes the readers block the writers, so the watches polling the events stall the writes
+	q, err = sqlitexx.NewQuery(conn, `PRAGMA journal_mode = WAL`)
+	if err != nil {
+		return fmt.Errorf("preparing query for journal mode: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			journalMode = stmt.ColumnText(0)
+
+			return nil
+		},
+	); err != nil {
+		return fmt.Errorf("error changing journal mode: %w", err)
+	}
+
+	if journalMode != "wal" {
+		st.options.Logger.Warn("database journal mode can't be switched to WAL, concurrent reads block the writes",
+			zap.String("journal_mode", journalMode),
+		)
+
+		return nil
+	}
+
+	st.options.Logger.Warn("database journal mode was switched to WAL, the pool should open the database in WAL mode (see DSNPragmas)")
+
+	return nil
+}
+
+// versionNumber converts the SQLite version (e.g. "3.45.1") to the number compared with minSQLiteVersion (e.g. 3045001).
+func versionNumber(version string) int {
+	var number int
+
+	parts := strings.SplitN(version, ".", 3)
+
+	for i := range 3 {
+		number *= 1000
+
+		if i < len(parts) {
+			n, _ := strconv.Atoi(parts[i]) //nolint:errcheck
+
+			number += n
+		}
+	}
+
+	return number
+}
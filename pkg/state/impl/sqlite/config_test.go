@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	zombiesqlite "zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestCheckConfiguration(t *testing.T) {
+	t.Parallel()
+
+	newPool := func(t *testing.T, uri string, flags zombiesqlite.OpenFlags) *sqlitexx.Pool {
+		pool, err := sqlitexx.NewPool(uri, sqlitexx.PoolOptions{Flags: flags})
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			require.NoError(t, pool.Close())
+		})
+
+		return pool
+	}
+
+	t.Run("journal mode", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "state.db")
+		flags := zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenURI
+
+		_, err := sqlite.NewState(t.Context(), newPool(t, path, flags), store.ProtobufMarshaler{}, sqlite.WithStrictConfiguration(true))
+		assert.True(t, sqlite.IsUnsupportedConfigurationError(err), "unexpected error: %v", err)
+
+		core, logs := observer.New(zapcore.WarnLevel)
+
+		st, err := sqlite.NewState(t.Context(), newPool(t, path, flags), store.ProtobufMarshaler{}, sqlite.WithLogger(zap.New(core)))
+		require.NoError(t, err)
+
+		t.Cleanup(st.Close)
+
+		assert.Equal(t, 1, logs.FilterMessageSnippet("switched to WAL").Len())
+
+		// the journal mode is persistent
+		st2, err := sqlite.NewState(t.Context(), newPool(t, path, flags), store.ProtobufMarshaler{}, sqlite.WithStrictConfiguration(true))
+		require.NoError(t, err)
+
+		t.Cleanup(st2.Close)
+	})
+
+	t.Run("pragmas in file name", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "state.db") + "?_pragma=busy_timeout(5000)"
+
+		_, err := sqlite.NewState(t.Context(), newPool(t, path, zombiesqlite.OpenReadWrite|zombiesqlite.OpenCreate|zombiesqlite.OpenWAL),
+			store.ProtobufMarshaler{})
+		assert.True(t, sqlite.IsUnsupportedConfigurationError(err), "unexpected error: %v", err)
+	})
+}
@@ -12,8 +12,11 @@ import (
 	"github.com/cosi-project/runtime/pkg/logging"
 	"github.com/cosi-project/runtime/pkg/resource/protobuf"
 	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
 	tmust "github.com/siderolabs/gen/xtesting/must"
 	suiterunner "github.com/stretchr/testify/suite"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
 )
 
 func init() {
@@ -37,3 +40,20 @@ func TestRuntimeConformance(t *testing.T) {
 
 	suiterunner.Run(t, suite)
 }
+
+func TestRuntimeConformanceMemory(t *testing.T) {
+	t.Parallel()
+
+	suite := &conformance.RuntimeSuite{
+		SetupRuntime: func(rs *conformance.RuntimeSuite) {
+			st := tmust.Value(sqlite.NewMemoryState(t.Context(), store.ProtobufMarshaler{}))(rs.T())
+
+			rs.T().Cleanup(st.Close)
+
+			rs.State = state.WrapCore(st)
+			rs.Runtime = tmust.Value(runtime.NewRuntime(rs.State, logging.DefaultLogger()))(rs.T())
+		},
+	}
+
+	suiterunner.Run(t, suite)
+}
@@ -0,0 +1,271 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// KindDiff lists the resources of a kind which differ between two points in time, see DiffBookmarks and DiffSnapshot.
+type KindDiff struct {
+	Namespace resource.Namespace
+	Type      resource.Type
+
+	// Added are the resources which exist only at the later point.
+	Added []resource.ID
+
+	// Changed are the resources which exist at both points, and were updated in between.
+	Changed []resource.ID
+
+	// Removed are the resources which exist only at the earlier point.
+	Removed []resource.ID
+}
+
+// resourceDiff accumulates the differences of the resources by kind.
+type resourceDiff map[kindKey]*KindDiff
+
+func (d resourceDiff) kind(ns resource.Namespace, typ resource.Type) *KindDiff {
+	key := kindKey{ns: ns, typ: typ}
+
+	kind, ok := d[key]
+	if !ok {
+		kind = &KindDiff{Namespace: ns, Type: typ}
+		d[key] = kind
+	}
+
+	return kind
+}
+
+// sorted returns the kinds ordered by the namespace and type, with the resource IDs sorted.
+func (d resourceDiff) sorted() []KindDiff {
+	kinds := make([]KindDiff, 0, len(d))
+
+	for _, kind := range d {
+		for _, ids := range [][]resource.ID{kind.Added, kind.Changed, kind.Removed} {
+			slices.Sort(ids)
+		}
+
+		kinds = append(kinds, *kind)
+	}
+
+	slices.SortFunc(kinds, func(a, b KindDiff) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Type, b.Type))
+	})
+
+	return kinds
+}
+
+// DiffBookmarks returns the resources which differ between the two bookmarks, grouped by kind.
+//
+// The differences are computed from the event log like ListChangedSince does, so the post-incident analysis
+// can tell what the controllers changed between two points (e.g. the bookmarks of the watch events, or EventBounds
+// taken at different times) without keeping the copies of the database. The kinds without differences are not listed,
+// neither are the resources in the namespaces not allowed by WithNamespaces.
+//
+// The bookmark from should not be later than to. If the events after from were compacted, an error matching
+// state.IsInvalidWatchBookmarkError is returned; if the resources were imported or their events pruned
+// between the bookmarks, an error matching IsResyncRequiredError is returned.
+func (st *State) DiffBookmarks(ctx context.Context, from, to state.Bookmark) ([]KindDiff, error) {
+	fromID, err := decodeBookmarkOrZero(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff bookmarks: %w", err)
+	}
+
+	toID, err := decodeBookmark(to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff bookmarks: %w", err)
+	}
+
+	if fromID > toID {
+		return nil, errors.New("failed to diff bookmarks: from bookmark is later than to bookmark")
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("taking connection for diff: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	type changeKey struct {
+		ns  resource.Namespace
+		typ resource.Type
+		id  resource.ID
+	}
+
+	changes := netChanges[changeKey]{}
+
+	err = func() (err error) {
+		defer sqlitex.Transaction(conn)(&err)
+
+		if err = st.verifyChangesBookmark(conn, fromID); err != nil {
+			return fmt.Errorf("failed to diff bookmarks: %w", err)
+		}
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`SELECT namespace, type, id, event_type
+			FROM `+st.options.TablePrefix+`events
+			WHERE event_id > $from_event_id AND event_id <= $to_event_id AND event_type IN (1, 2, 3, $resync_event_type)
+			ORDER BY event_id ASC`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for diff: %w", err)
+		}
+
+		return q.
+			BindInt64("$from_event_id", fromID).
+			BindInt64("$to_event_id", toID).
+			BindInt("$resync_event_type", resyncEventType).
+			QueryAll(
+				func(stmt *sqlite.Stmt) error {
+					key := changeKey{ns: stmt.GetText("namespace"), typ: stmt.GetText("type"), id: stmt.GetText("id")}
+
+					if st.checkNamespace(key.ns) != nil {
+						return nil
+					}
+
+					eventType := stmt.GetInt64("event_type")
+
+					if eventType == resyncEventType {
+						return fmt.Errorf("failed to diff bookmarks: %w", ErrResyncRequired(resource.NewMetadata(key.ns, key.typ, "", resource.VersionUndefined)))
+					}
+
+					changes.add(key, eventType)
+
+					return nil
+				},
+			)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := resourceDiff{}
+
+	for key, c := range changes {
+		switch c.kind() {
+		case changeNone:
+			// the resource didn't exist at either bookmark
+		case changeCreated:
+			kind := diff.kind(key.ns, key.typ)
+			kind.Added = append(kind.Added, key.id)
+		case changeDestroyed:
+			kind := diff.kind(key.ns, key.typ)
+			kind.Removed = append(kind.Removed, key.id)
+		case changeUpdated:
+			kind := diff.kind(key.ns, key.typ)
+			kind.Changed = append(kind.Changed, key.id)
+		}
+	}
+
+	return diff.sorted(), nil
+}
+
+// DiffSnapshot returns the resources which differ between the copy of the database at path and the live database,
+// grouped by kind.
+//
+// The copy is the earlier point (e.g. made with CloneTo or BeginSnapshot), it's opened read-only, and its resources
+// with the state's table prefix are compared with the live ones by the version and the creation time, so the resources
+// are not unmarshaled. The creation time is stored with the second precision, so a resource destroyed and created again
+// within the same second with the same version is not reported as changed.
+// Unlike DiffBookmarks, this doesn't depend on the event log, so the copy can be of any age.
+// The kinds without differences are not listed, neither are the resources in the namespaces not allowed by WithNamespaces.
+func (st *State) DiffSnapshot(ctx context.Context, path string) ([]KindDiff, error) {
+	snapshotConn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("opening snapshot for diff: %w", err)
+	}
+
+	defer snapshotConn.Close() //nolint:errcheck
+
+	snapshotConn.SetInterrupt(ctx.Done())
+
+	type resourceKey struct {
+		ns  resource.Namespace
+		typ resource.Type
+		id  resource.ID
+	}
+
+	snapshotVersions := map[resourceKey]resourceVersion{}
+
+	if err = st.queryVersions(snapshotConn, func(ns resource.Namespace, typ resource.Type, id resource.ID, version resourceVersion) {
+		snapshotVersions[resourceKey{ns: ns, typ: typ, id: id}] = version
+	}); err != nil {
+		return nil, fmt.Errorf("error reading snapshot for diff: %w", err)
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("taking connection for diff: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	diff := resourceDiff{}
+
+	if err = st.queryVersions(conn, func(ns resource.Namespace, typ resource.Type, id resource.ID, version resourceVersion) {
+		key := resourceKey{ns: ns, typ: typ, id: id}
+
+		snapshotVersion, ok := snapshotVersions[key]
+		delete(snapshotVersions, key)
+
+		switch {
+		case !ok:
+			kind := diff.kind(ns, typ)
+			kind.Added = append(kind.Added, id)
+		case snapshotVersion != version:
+			kind := diff.kind(ns, typ)
+			kind.Changed = append(kind.Changed, id)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("error reading resources for diff: %w", err)
+	}
+
+	for key := range snapshotVersions {
+		kind := diff.kind(key.ns, key.typ)
+		kind.Removed = append(kind.Removed, key.id)
+	}
+
+	return diff.sorted(), nil
+}
+
+// resourceVersion identifies the version of a resource across the destroys, see DiffSnapshot.
+type resourceVersion struct {
+	version   int64
+	createdAt int64
+}
+
+// queryVersions calls fn with the key and the version of each resource in the allowed namespaces.
+func (st *State) queryVersions(conn *sqlite.Conn, fn func(ns resource.Namespace, typ resource.Type, id resource.ID, version resourceVersion)) error {
+	q, err := sqlitexx.NewQuery(conn, `SELECT namespace, type, id, version, created_at FROM `+st.options.TablePrefix+`resources`)
+	if err != nil {
+		return fmt.Errorf("preparing query for resource versions: %w", err)
+	}
+
+	return q.QueryAll(func(stmt *sqlite.Stmt) error {
+		ns := stmt.GetText("namespace")
+
+		if st.checkNamespace(ns) == nil {
+			fn(ns, stmt.GetText("type"), stmt.GetText("id"), resourceVersion{
+				version:   stmt.GetInt64("version"),
+				createdAt: stmt.GetInt64("created_at"),
+			})
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", id)))
+		}
+
+		bounds, err := st.EventBounds(ctx)
+		require.NoError(t, err)
+
+		from := bounds.Newest
+		path := filepath.Join(t.TempDir(), "snapshot.db")
+
+		require.NoError(t, st.CloneTo(ctx, path))
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "d")))
+
+		res, err := st.Get(ctx, conformance.NewPathResource("ns1", "a").Metadata())
+		require.NoError(t, err)
+
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, st.Update(ctx, res))
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("ns1", "b").Metadata()))
+
+		// the temporary resources are left out
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "e")))
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("ns1", "e").Metadata()))
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "x")))
+
+		bounds, err = st.EventBounds(ctx)
+		require.NoError(t, err)
+
+		to := bounds.Newest
+
+		expected := []sqlite.KindDiff{
+			{
+				Namespace: "ns1",
+				Type:      conformance.PathResourceType,
+				Added:     []resource.ID{"d"},
+				Changed:   []resource.ID{"a"},
+				Removed:   []resource.ID{"b"},
+			},
+			{
+				Namespace: "ns2",
+				Type:      conformance.PathResourceType,
+				Added:     []resource.ID{"x"},
+			},
+		}
+
+		diff, err := st.DiffBookmarks(ctx, from, to)
+		require.NoError(t, err)
+		assert.Equal(t, expected, diff)
+
+		diff, err = st.DiffSnapshot(ctx, path)
+		require.NoError(t, err)
+		assert.Equal(t, expected, diff)
+
+		diff, err = st.DiffBookmarks(ctx, to, to)
+		require.NoError(t, err)
+		assert.Empty(t, diff)
+
+		diff, err = st.DiffBookmarks(ctx, nil, to)
+		require.NoError(t, err)
+		require.Len(t, diff, 2)
+		assert.Equal(t, []resource.ID{"a", "c", "d"}, diff[0].Added)
+
+		_, err = st.DiffBookmarks(ctx, to, from)
+		assert.ErrorContains(t, err, "from bookmark is later than to bookmark")
+
+		_, err = st.DiffSnapshot(ctx, filepath.Join(t.TempDir(), "missing.db"))
+		assert.Error(t, err)
+
+		// the imported resources have no events to diff
+		require.NoError(t, st.Import(ctx, []resource.Resource{conformance.NewPathResource("ns1", "imported")}))
+
+		bounds, err = st.EventBounds(ctx)
+		require.NoError(t, err)
+
+		_, err = st.DiffBookmarks(ctx, from, bounds.Newest)
+		assert.True(t, sqlite.IsResyncRequiredError(err), "unexpected error: %v", err)
+
+		_, err = st.DiffBookmarks(ctx, state.Bookmark("invalid"), bounds.Newest)
+		assert.True(t, state.IsInvalidWatchBookmarkError(err), "unexpected error: %v", err)
+	})
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// writeAmplification is the rough ratio of bytes written to the payload size.
+//
+// Each write stores the resource row and an event with the spec before and after the change.
+const writeAmplification = 3
+
+// writeCheckMaxWrites is the number of writes after which the measurements of writeCheck are refreshed.
+const writeCheckMaxWrites = 100
+
+// writeCheck holds the measurements of the database size and of the free disk space
+// shared by the preflight checks of the writes, see WriteCheckInterval.
+type writeCheck struct {
+	measuredAt    time.Time
+	size          int64 // database size, if MaxDatabaseSize is set
+	free          int64 // free disk space, if MinFreeDiskSpace is set and supported
+	freeSupported bool
+	writes        int
+	pending       int64 // estimated bytes written since the measurement
+	mu            sync.Mutex
+}
+
+// measureFreeDiskSpace returns the free space of the filesystem holding the database.
+//
+// It returns false if the check is not supported (e.g. for in-memory databases).
+func measureFreeDiskSpace(conn *sqlite.Conn) (int64, bool, error) {
+	filename, err := databaseFilename(conn)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// in-memory databases have no file
+	if filename == "" {
+		return 0, false, nil
+	}
+
+	return freeDiskSpace(filepath.Dir(filename))
+}
+
+// checkDiskSpace verifies that the (estimated) free disk space is enough for the write
+// of the given payload size plus the configured headroom.
+func (st *State) checkDiskSpace(free int64, payloadSize int) error {
+	if st.options.MinFreeDiskSpace <= 0 {
+		return nil
+	}
+
+	required := int64(payloadSize)*writeAmplification + st.options.MinFreeDiskSpace
+
+	if free < required {
+		return ErrInsufficientDiskSpace(free, required)
+	}
+
+	return nil
+}
+
+// checkWrite runs all preflight checks before writing a payload of the given size.
+//
+// The measurements are reused for WriteCheckInterval (or writeCheckMaxWrites writes),
+// the writes done in the meantime are added to the estimate.
+func (st *State) checkWrite(conn *sqlite.Conn, payloadSize int) error {
+	if st.options.MaxDatabaseSize <= 0 && st.options.MinFreeDiskSpace <= 0 {
+		return nil
+	}
+
+	wc := &st.writeCheck
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if wc.writes >= writeCheckMaxWrites || time.Since(wc.measuredAt) >= st.options.WriteCheckInterval {
+		if err := st.measureWriteCheck(conn); err != nil {
+			return err
+		}
+	}
+
+	if err := st.checkDatabaseSize(wc.size + wc.pending); err != nil {
+		return err
+	}
+
+	if wc.freeSupported {
+		if err := st.checkDiskSpace(wc.free-wc.pending, payloadSize); err != nil {
+			return err
+		}
+	}
+
+	wc.writes++
+	wc.pending += int64(payloadSize) * writeAmplification
+
+	return nil
+}
+
+// measureWriteCheck refreshes the measurements of writeCheck, wc.mu should be held.
+func (st *State) measureWriteCheck(conn *sqlite.Conn) error {
+	wc := &st.writeCheck
+
+	if st.options.MaxDatabaseSize > 0 {
+		size, err := databaseFileSize(conn)
+		if err != nil {
+			return err
+		}
+
+		wc.size = size
+	}
+
+	if st.options.MinFreeDiskSpace > 0 {
+		free, supported, err := measureFreeDiskSpace(conn)
+		if err != nil {
+			return err
+		}
+
+		wc.free, wc.freeSupported = free, supported
+	}
+
+	wc.measuredAt = time.Now()
+	wc.writes = 0
+	wc.pending = 0
+
+	return nil
+}
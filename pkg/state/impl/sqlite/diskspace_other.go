@@ -0,0 +1,12 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin
+
+package sqlite
+
+// freeDiskSpace is not supported on this platform, so the disk space check is skipped.
+func freeDiskSpace(string) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,23 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux || darwin
+
+package sqlite
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeDiskSpace returns the number of bytes available to unprivileged users on the filesystem holding path.
+func freeDiskSpace(path string) (int64, bool, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false, fmt.Errorf("failed to stat filesystem %q: %w", path, err)
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), true, nil //nolint:gosec,unconvert
+}
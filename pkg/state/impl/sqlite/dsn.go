@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Driver is the SQLite driver a DSN is built for, see DSN.
+type Driver int
+
+// Drivers.
+const (
+	// DriverZombiezen is zombiezen.com/go/sqlite, used with sqlitexx.NewPool.
+	DriverZombiezen Driver = iota
+
+	// DriverModernc is modernc.org/sqlite, used with database/sql.
+	DriverModernc
+)
+
+// DSNOptions configures DSN.
+type DSNOptions struct {
+	// Driver is the driver the DSN is built for.
+	//
+	// Default is DriverZombiezen.
+	Driver Driver
+
+	// BusyTimeout is the time a connection waits for the database lock held by another connection.
+	//
+	// Default is 5 seconds.
+	BusyTimeout time.Duration
+
+	// ReadOnly opens the database read-only (e.g. for the read replicas or the analysis tools).
+	//
+	// Default is false.
+	ReadOnly bool
+}
+
+// DefaultDSNOptions returns default value of DSNOptions.
+func DefaultDSNOptions() DSNOptions {
+	return DSNOptions{
+		Driver:      DriverZombiezen,
+		BusyTimeout: 5 * time.Second,
+	}
+}
+
+// DSNOption configures DSN.
+type DSNOption func(*DSNOptions)
+
+// WithDSNDriver sets the driver the DSN is built for.
+func WithDSNDriver(driver Driver) DSNOption {
+	return func(opts *DSNOptions) {
+		opts.Driver = driver
+	}
+}
+
+// WithDSNBusyTimeout sets the busy timeout of the connections.
+func WithDSNBusyTimeout(timeout time.Duration) DSNOption {
+	return func(opts *DSNOptions) {
+		opts.BusyTimeout = timeout
+	}
+}
+
+// WithDSNReadOnly opens the database read-only.
+func WithDSNReadOnly(readOnly bool) DSNOption {
+	return func(opts *DSNOptions) {
+		opts.ReadOnly = readOnly
+	}
+}
+
+// DSN returns the URI opening the database at the path with the settings the state requires (see NewState).
+//
+// The drivers differ in how the settings are passed: modernc.org/sqlite takes the pragmas and the transaction
+// locking mode as the _pragma and _txlock URI parameters, while zombiezen.com/go/sqlite passes the URI to SQLite
+// as is, so the pragmas should be applied to each connection with PoolOptions.Pragmas, see DSNPragmas.
+// Both drivers should open the URI with the URI flag (sqlite.OpenURI), which is the default of sqlitexx.NewPool.
+func DSN(path string, opts ...DSNOption) string {
+	options := DefaultDSNOptions()
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	params := url.Values{}
+
+	if options.ReadOnly {
+		params.Set("mode", "ro")
+	}
+
+	if options.Driver == DriverModernc {
+		for _, pragma := range dsnPragmas(options) {
+			params.Add("_pragma", pragma.name+"("+pragma.value+")")
+		}
+
+		if !options.ReadOnly {
+			params.Set("_txlock", "immediate")
+		}
+	}
+
+	dsn := "file:" + escapeURIPath(path)
+
+	if len(params) > 0 {
+		// the parentheses of the pragmas don't need escaping, and are easier to read as is
+		dsn += "?" + strings.NewReplacer("%28", "(", "%29", ")").Replace(params.Encode())
+	}
+
+	return dsn
+}
+
+// DSNPragmas returns the pragma statements to run on each connection opened with the DSN (see PoolOptions.Pragmas).
+//
+// With DriverModernc, the pragmas are already in the DSN, so none are returned.
+func DSNPragmas(opts ...DSNOption) []string {
+	options := DefaultDSNOptions()
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.Driver == DriverModernc {
+		return nil
+	}
+
+	pragmas := dsnPragmas(options)
+	statements := make([]string, 0, len(pragmas))
+
+	for _, pragma := range pragmas {
+		statements = append(statements, "PRAGMA "+pragma.name+" = "+pragma.value)
+	}
+
+	return statements
+}
+
+type dsnPragma struct {
+	name, value string
+}
+
+func dsnPragmas(options DSNOptions) []dsnPragma {
+	pragmas := []dsnPragma{
+		{name: "busy_timeout", value: strconv.FormatInt(options.BusyTimeout.Milliseconds(), 10)},
+	}
+
+	// the journal mode is stored in the database, and can't be changed by a read-only connection
+	if !options.ReadOnly {
+		pragmas = append(pragmas, dsnPragma{name: "journal_mode", value: "WAL"})
+	}
+
+	return pragmas
+}
+
+// escapeURIPath escapes the characters which have a special meaning in the SQLite URIs.
+func escapeURIPath(path string) string {
+	return strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestDSN(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "file:/var/lib/state.db", sqlite.DSN("/var/lib/state.db"))
+	assert.Equal(t, "file:/var/lib/state%3f%231.db?mode=ro", sqlite.DSN("/var/lib/state?#1.db", sqlite.WithDSNReadOnly(true)))
+	assert.Equal(t,
+		"file:state.db?_pragma=busy_timeout(1000)&_pragma=journal_mode(WAL)&_txlock=immediate",
+		sqlite.DSN("state.db", sqlite.WithDSNDriver(sqlite.DriverModernc), sqlite.WithDSNBusyTimeout(time.Second)),
+	)
+	assert.Equal(t,
+		"file:state.db?_pragma=busy_timeout(5000)&mode=ro",
+		sqlite.DSN("state.db", sqlite.WithDSNDriver(sqlite.DriverModernc), sqlite.WithDSNReadOnly(true)),
+	)
+
+	assert.Equal(t, []string{"PRAGMA busy_timeout = 5000", "PRAGMA journal_mode = WAL"}, sqlite.DSNPragmas())
+	assert.Empty(t, sqlite.DSNPragmas(sqlite.WithDSNDriver(sqlite.DriverModernc)))
+}
+
+func TestDSNPool(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "state?.db")
+
+	pool, err := sqlitexx.NewPool(sqlite.DSN(path), sqlitexx.PoolOptions{
+		Pragmas: sqlite.DSNPragmas(sqlite.WithDSNBusyTimeout(time.Second)),
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, pool.Close())
+	})
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	var (
+		busyTimeout int
+		journalMode string
+	)
+
+	require.NoError(t, sqlitex.Execute(conn, `SELECT * FROM pragma_busy_timeout(), pragma_journal_mode()`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			busyTimeout = stmt.ColumnInt(0)
+			journalMode = stmt.ColumnText(1)
+
+			return nil
+		},
+	}))
+
+	assert.Equal(t, 1000, busyTimeout)
+	assert.Equal(t, "wal", journalMode)
+	assert.FileExists(t, path)
+}
@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// KeyProvider provides the keys to encrypt the resource specs (see WithEncryption).
+type KeyProvider interface {
+	// KeyID returns the ID of the key to encrypt the resources of the kind with.
+	KeyID(kind resource.Kind) (string, error)
+
+	// Key returns the AES key (16, 24 or 32 bytes long) with the given ID.
+	//
+	// Keys are cached by the ID, so the key material for the ID should never change.
+	Key(keyID string) ([]byte, error)
+}
+
+// encryptedSpecMagic starts the encrypted specs.
+//
+// Neither protobuf nor JSON encodings start with a zero byte, so the encrypted specs
+// can be told apart from the plaintext ones.
+const encryptedSpecMagic = "\x00enc1"
+
+// encryptedSpecMaxKeyIDLen is the maximum length of the key ID, which is stored as a single byte.
+const encryptedSpecMaxKeyIDLen = 255
+
+// ciphers caches the AEAD ciphers by the key ID.
+type ciphers struct {
+	byKeyID map[string]cipher.AEAD
+	mu      sync.Mutex
+}
+
+// encrypts checks if the resources of the kind should be encrypted.
+func (st *State) encrypts(kind resource.Kind) bool {
+	if st.options.KeyProvider == nil {
+		return false
+	}
+
+	for _, encrypted := range st.options.EncryptedKinds {
+		if encrypted.Namespace() == kind.Namespace() && (encrypted.Type() == "" || encrypted.Type() == kind.Type()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (st *State) cipher(keyID string) (cipher.AEAD, error) {
+	st.ciphers.mu.Lock()
+	defer st.ciphers.mu.Unlock()
+
+	if aead, ok := st.ciphers.byKeyID[keyID]; ok {
+		return aead, nil
+	}
+
+	key, err := st.options.KeyProvider.Key(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %q: %w", keyID, err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %w", keyID, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %w", keyID, err)
+	}
+
+	if st.ciphers.byKeyID == nil {
+		st.ciphers.byKeyID = map[string]cipher.AEAD{}
+	}
+
+	st.ciphers.byKeyID[keyID] = aead
+
+	return aead, nil
+}
+
+// encryptSpec encrypts the marshaled resource if the resources of the kind are encrypted.
+func (st *State) encryptSpec(kind resource.Kind, spec []byte) ([]byte, error) {
+	if !st.encrypts(kind) {
+		return spec, nil
+	}
+
+	keyID, err := st.options.KeyProvider.KeyID(kind)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key ID for %q: %w", kind, err)
+	}
+
+	return st.encryptSpecWithKey(keyID, spec)
+}
+
+// encryptSpecWithKey encrypts the marshaled resource with the key.
+//
+// The encrypted spec is the magic, the key ID length and the key ID, the nonce and the sealed spec.
+func (st *State) encryptSpecWithKey(keyID string, spec []byte) ([]byte, error) {
+	if len(keyID) > encryptedSpecMaxKeyIDLen {
+		return nil, fmt.Errorf("key ID %q is too long", keyID)
+	}
+
+	aead, err := st.cipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := len(encryptedSpecMagic) + 1 + len(keyID)
+	out := make([]byte, header+aead.NonceSize(), header+aead.NonceSize()+len(spec)+aead.Overhead())
+
+	copy(out, encryptedSpecMagic)
+	out[len(encryptedSpecMagic)] = byte(len(keyID))
+	copy(out[len(encryptedSpecMagic)+1:], keyID)
+
+	nonce := out[header:]
+	rand.Read(nonce) //nolint:errcheck
+
+	return aead.Seal(out, nonce, spec, nil), nil
+}
+
+// specKeyID returns the ID of the key the spec is encrypted with.
+//
+// For the plaintext specs, false is returned.
+func specKeyID(spec []byte) (keyID string, rest []byte, encrypted bool, err error) {
+	if !bytes.HasPrefix(spec, []byte(encryptedSpecMagic)) {
+		return "", spec, false, nil
+	}
+
+	spec = spec[len(encryptedSpecMagic):]
+
+	if len(spec) < 1 || len(spec) < 1+int(spec[0]) {
+		return "", nil, true, errors.New("truncated encrypted spec")
+	}
+
+	return string(spec[1 : 1+spec[0]]), spec[1+spec[0]:], true, nil
+}
+
+// decryptSpec decrypts the stored spec; plaintext specs are returned as is.
+//
+// Plaintext specs are accepted for the encrypted kinds as well, so that encryption can be enabled
+// for the kinds with existing resources.
+func (st *State) decryptSpec(spec []byte) ([]byte, error) {
+	keyID, sealed, encrypted, err := specKeyID(spec)
+	if err != nil || !encrypted {
+		return sealed, err
+	}
+
+	if st.options.KeyProvider == nil {
+		return nil, errors.New("spec is encrypted, but no key provider is configured")
+	}
+
+	aead, err := st.cipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted spec")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting spec with key %q: %w", keyID, err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,248 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+type staticKeys struct {
+	keys    map[string][]byte
+	current string
+}
+
+func (k staticKeys) KeyID(resource.Kind) (string, error) {
+	return k.current, nil
+}
+
+func (k staticKeys) Key(keyID string) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+
+	return key, nil
+}
+
+// storedSpec returns the spec of the resource as stored in the database.
+func storedSpec(t *testing.T, pool *sqlitexx.Pool, id resource.ID) []byte {
+	t.Helper()
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	var spec []byte
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT spec FROM resources WHERE id = $id`)
+	require.NoError(t, err)
+
+	require.NoError(t, q.BindString("$id", id).QueryRow(func(stmt *zombiesqlite.Stmt) error {
+		spec = make([]byte, stmt.GetLen("spec"))
+		stmt.GetBytes("spec", spec)
+
+		return nil
+	}))
+
+	return spec
+}
+
+func TestEncryption(t *testing.T) {
+	t.Parallel()
+
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+	keys := staticKeys{keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}, current: "k1"}
+	encrypted := conformance.NewPathResource("ns1", "").Metadata()
+
+	// resources written before encryption was enabled
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "plain")))
+
+	st.Close()
+
+	st, err = sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{}, sqlite.WithEncryption(keys, encrypted))
+	require.NoError(t, err)
+
+	ctx := t.Context()
+
+	secret := conformance.NewPathResource("ns1", "secret")
+	secret.Metadata().Labels().Set("app", "foo")
+
+	require.NoError(t, st.Create(ctx, secret))
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "other")))
+
+	assert.True(t, bytes.HasPrefix(storedSpec(t, pool, "secret"), []byte("\x00enc1")))
+	assert.NotContains(t, string(storedSpec(t, pool, "secret")), "secret")
+	assert.Contains(t, string(storedSpec(t, pool, "other")), "other")
+
+	got, err := st.Get(ctx, secret.Metadata())
+	require.NoError(t, err)
+	assert.Equal(t, "secret", got.Metadata().ID())
+
+	_, err = st.Get(ctx, conformance.NewPathResource("ns1", "plain").Metadata())
+	require.NoError(t, err)
+
+	// labels stay queryable
+	list, err := st.List(ctx, encrypted, state.WithLabelQuery(resource.LabelEqual("app", "foo")))
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, "secret", list.Items[0].Metadata().ID())
+
+	raw, err := st.GetRaw(ctx, secret.Metadata())
+	require.NoError(t, err)
+
+	decoded, err := store.ProtobufMarshaler{}.UnmarshalResource(raw.Spec)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", decoded.Metadata().ID())
+
+	// events are encrypted as well
+	watchCh := make(chan state.Event)
+
+	require.NoError(t, st.Watch(ctx, secret.Metadata(), watchCh))
+
+	select {
+	case ev := <-watchCh:
+		assert.Equal(t, state.Created, ev.Type)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	secret.Metadata().Labels().Set("app", "bar")
+	require.NoError(t, st.Update(ctx, secret))
+
+	select {
+	case ev := <-watchCh:
+		require.Equal(t, state.Updated, ev.Type, "event %s", ev.Error)
+
+		label, _ := ev.Old.Metadata().Labels().Get("app")
+		assert.Equal(t, "foo", label)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	st.Close()
+
+	// without the keys, encrypted resources can't be read
+	st, err = sqlite.NewState(ctx, pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	defer st.Close()
+
+	_, err = st.Get(ctx, secret.Metadata())
+	assert.ErrorContains(t, err, "no key provider is configured")
+
+	_, err = st.Get(ctx, conformance.NewPathResource("ns2", "other").Metadata())
+	require.NoError(t, err)
+}
+
+func TestRotateKeys(t *testing.T) {
+	t.Parallel()
+
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+	keys := staticKeys{
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32), "k2": bytes.Repeat([]byte{2}, 32)},
+		current: "k1",
+	}
+	kind := conformance.NewPathResource("ns1", "").Metadata()
+	ctx := t.Context()
+
+	countEvents := func() int64 {
+		conn, err := pool.Take(ctx)
+		require.NoError(t, err)
+
+		defer pool.Put(conn)
+
+		count, err := sqlitex.ResultInt64(conn.Prep(`SELECT count(*) FROM events`))
+		require.NoError(t, err)
+
+		return count
+	}
+
+	opts := []sqlite.StateOption{
+		sqlite.WithVersionHistory(kind, 5),
+		sqlite.WithGraveyardRetention(time.Hour),
+	}
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, append(opts, sqlite.WithEncryption(keys, kind))...)
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		res := conformance.NewPathResource("ns1", id)
+
+		require.NoError(t, st.Create(ctx, res))
+		require.NoError(t, st.Update(ctx, res))
+	}
+
+	require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("ns1", "c").Metadata()))
+
+	events := countEvents()
+
+	_, err = st.RotateKeys(ctx, "k3")
+	require.ErrorContains(t, err, `unknown key "k3"`)
+
+	// 2 resources, 10 specs in 7 events, 4 versions, 1 graveyard entry
+	rotated, err := st.RotateKeys(ctx, "k2")
+	require.NoError(t, err)
+	assert.Equal(t, 2+10+4+1, rotated)
+
+	assert.True(t, bytes.HasPrefix(storedSpec(t, pool, "a"), []byte("\x00enc1\x02k2")))
+	assert.Equal(t, events, countEvents())
+
+	rotated, err = st.RotateKeys(ctx, "k2")
+	require.NoError(t, err)
+	assert.Zero(t, rotated)
+
+	st.Close()
+
+	// the old key is no longer needed
+	delete(keys.keys, "k1")
+	keys.current = "k2"
+
+	st, err = sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, append(opts, sqlite.WithEncryption(keys, kind))...)
+	require.NoError(t, err)
+
+	defer st.Close()
+
+	_, err = st.Get(ctx, conformance.NewPathResource("ns1", "a").Metadata())
+	require.NoError(t, err)
+
+	_, err = st.GetVersion(ctx, conformance.NewPathResource("ns1", "b").Metadata(), resource.VersionUndefined.Next())
+	require.NoError(t, err)
+
+	_, err = st.Recover(ctx, conformance.NewPathResource("ns1", "c").Metadata())
+	require.NoError(t, err)
+
+	watchCh := make(chan state.Event)
+
+	require.NoError(t, st.WatchKind(ctx, kind, watchCh, state.WithKindStartFromBookmark(sqlite.EncodeBookmark(0))))
+
+	for range events {
+		select {
+		case ev := <-watchCh:
+			require.NotEqual(t, state.Errored, ev.Type, "event %s", ev.Error)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+}
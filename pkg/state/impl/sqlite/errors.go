@@ -5,7 +5,9 @@
 package sqlite
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/cosi-project/runtime/pkg/resource"
 	"zombiezen.com/go/sqlite"
@@ -55,6 +57,16 @@ type ePhaseConflict struct {
 
 func (ePhaseConflict) PhaseConflictError() {}
 
+//nolint:errname
+type eVersionConflict struct {
+	eConflict
+	conflict VersionConflict
+}
+
+func (e eVersionConflict) GetVersionConflict() VersionConflict {
+	return e.conflict
+}
+
 //nolint:errname
 type eUnsupported struct {
 	error
@@ -69,6 +81,91 @@ type eInvalidWatchBookmark struct {
 
 func (eInvalidWatchBookmark) InvalidWatchBookmarkError() {}
 
+//nolint:errname
+type eNamespaceNotAllowed struct {
+	error
+}
+
+func (eNamespaceNotAllowed) NamespaceNotAllowedError() {}
+
+//nolint:errname
+type eDatabaseFull struct {
+	error
+}
+
+func (eDatabaseFull) DatabaseFullError() {}
+
+//nolint:errname
+type eInsufficientDiskSpace struct {
+	error
+}
+
+func (eInsufficientDiskSpace) InsufficientDiskSpaceError() {}
+
+//nolint:errname
+type eLeaseHeld struct {
+	error
+}
+
+func (eLeaseHeld) LeaseHeldError() {}
+
+//nolint:errname
+type eValidation struct {
+	error
+}
+
+func (eValidation) ValidationError() {}
+
+func (e eValidation) Unwrap() error {
+	return errors.Unwrap(e.error)
+}
+
+//nolint:errname
+type eSchemaTooNew struct {
+	error
+}
+
+func (eSchemaTooNew) SchemaTooNewError() {}
+
+//nolint:errname
+type eMarshalerMismatch struct {
+	error
+}
+
+func (eMarshalerMismatch) MarshalerMismatchError() {}
+
+//nolint:errname
+type eResyncRequired struct {
+	error
+}
+
+func (eResyncRequired) ResyncRequiredError() {}
+
+//nolint:errname
+type eCompactionInProgress struct {
+	error
+}
+
+func (eCompactionInProgress) CompactionInProgressError() {}
+
+//nolint:errname
+type eUnsupportedConfiguration struct {
+	error
+}
+
+func (eUnsupportedConfiguration) UnsupportedConfigurationError() {}
+
+//nolint:errname
+type eCanceled struct {
+	error
+}
+
+func (eCanceled) CanceledError() {}
+
+func (e eCanceled) Unwrap() error {
+	return e.error
+}
+
 // ErrAlreadyExists generates error compatible with state.ErrConflict.
 func ErrAlreadyExists(r resource.Reference) error {
 	return eConflict{
@@ -79,10 +176,55 @@ func ErrAlreadyExists(r resource.Reference) error {
 
 // ErrVersionConflict generates error compatible with state.ErrConflict.
 func ErrVersionConflict(r resource.Pointer, expected, found uint64) error {
-	return eConflict{
-		error:    fmt.Errorf("resource %s update conflict: expected version %q, actual version %q", r, expected, found),
-		resource: r,
+	return ErrStoredVersionConflict(r, VersionConflict{Expected: expected, Stored: found})
+}
+
+// VersionConflict describes the stored resource a write expecting another version conflicted with, see GetVersionConflict.
+type VersionConflict struct {
+	// Updated is the time the stored resource was last updated, zero if it's not known.
+	Updated time.Time
+
+	// Owner is the owner of the stored resource.
+	Owner resource.Owner
+
+	// Expected is the version the write expected.
+	Expected uint64
+
+	// Stored is the version of the stored resource.
+	Stored uint64
+}
+
+// ErrStoredVersionConflict generates error compatible with state.ErrConflict, which holds the details of the stored resource.
+func ErrStoredVersionConflict(r resource.Pointer, conflict VersionConflict) error {
+	msg := fmt.Sprintf("resource %s update conflict: expected version %d, actual version %d", r, conflict.Expected, conflict.Stored)
+
+	if !conflict.Updated.IsZero() {
+		msg += fmt.Sprintf(" (updated at %s by owner %q)", conflict.Updated.Format(time.RFC3339), conflict.Owner)
+	}
+
+	return eVersionConflict{
+		eConflict: eConflict{
+			error:    errors.New(msg),
+			resource: r,
+		},
+		conflict: conflict,
+	}
+}
+
+// GetVersionConflict returns the details of the stored resource if err is caused by the version conflict.
+//
+// The details allow to log the conflict, or to decide whether the write should be retried on top of the stored resource
+// (e.g. the resource was updated by the same owner since it was read).
+func GetVersionConflict(err error) (VersionConflict, bool) {
+	var i interface {
+		GetVersionConflict() VersionConflict
 	}
+
+	if !errors.As(err, &i) {
+		return VersionConflict{}, false
+	}
+
+	return i.GetVersionConflict(), true
 }
 
 // ErrPendingFinalizers generates error compatible with state.ErrConflict.
@@ -126,3 +268,191 @@ func ErrInvalidWatchBookmark(e error) error {
 		e,
 	}
 }
+
+// ErrNamespaceNotAllowed generates error for namespaces not in the allowed list (see WithNamespaces).
+func ErrNamespaceNotAllowed(ns resource.Namespace) error {
+	return eNamespaceNotAllowed{
+		fmt.Errorf("namespace %q is not allowed", ns),
+	}
+}
+
+// IsNamespaceNotAllowedError checks if err is caused by the namespace not in the allowed list.
+func IsNamespaceNotAllowedError(err error) bool {
+	var i interface {
+		NamespaceNotAllowedError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrDatabaseFull generates error for writes refused because of the database size limit (see WithMaxDatabaseSize).
+func ErrDatabaseFull(size, limit int64) error {
+	return eDatabaseFull{
+		fmt.Errorf("database size %d exceeds the limit %d", size, limit),
+	}
+}
+
+// IsDatabaseFullError checks if err is caused by the database size limit.
+func IsDatabaseFullError(err error) bool {
+	var i interface {
+		DatabaseFullError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrInsufficientDiskSpace generates error for writes refused because of low free disk space (see WithMinFreeDiskSpace).
+func ErrInsufficientDiskSpace(free, required int64) error {
+	return eInsufficientDiskSpace{
+		fmt.Errorf("insufficient disk space: %d bytes free, %d bytes required", free, required),
+	}
+}
+
+// IsInsufficientDiskSpaceError checks if err is caused by low free disk space.
+func IsInsufficientDiskSpaceError(err error) bool {
+	var i interface {
+		InsufficientDiskSpaceError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrLeaseHeld generates error for the ownership lease held by another state instance (see WithOwnership).
+func ErrLeaseHeld(owner string, expiresAt time.Time) error {
+	return eLeaseHeld{
+		fmt.Errorf("ownership lease is held by %q until %s", owner, expiresAt.Format(time.RFC3339)),
+	}
+}
+
+// IsLeaseHeldError checks if err is caused by the ownership lease held by another state instance.
+func IsLeaseHeldError(err error) bool {
+	var i interface {
+		LeaseHeldError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrValidation generates error for writes rejected by a validator (see WithValidator).
+//
+// The error returned by the validator can be unwrapped.
+func ErrValidation(r resource.Pointer, op Operation, err error) error {
+	return eValidation{
+		fmt.Errorf("%s of resource %s rejected: %w", op, r, err),
+	}
+}
+
+// IsValidationError checks if err is caused by a validator rejecting the write.
+func IsValidationError(err error) bool {
+	var i interface {
+		ValidationError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrSchemaTooNew generates error for databases written by a newer incompatible version of the package.
+func ErrSchemaTooNew(minReaderVersion, supportedVersion int64) error {
+	return eSchemaTooNew{
+		fmt.Errorf("database schema requires version %d or newer, this version supports schema version %d", minReaderVersion, supportedVersion),
+	}
+}
+
+// IsSchemaTooNewError checks if err is caused by the database written by a newer incompatible version of the package.
+func IsSchemaTooNewError(err error) bool {
+	var i interface {
+		SchemaTooNewError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrMarshalerMismatch generates error for databases written with a different marshaler (see WithMarshalerIdentity).
+func ErrMarshalerMismatch(stored, current string) error {
+	return eMarshalerMismatch{
+		fmt.Errorf("database was written with marshaler %q, the state uses marshaler %q", stored, current),
+	}
+}
+
+// IsMarshalerMismatchError checks if err is caused by the database written with a different marshaler.
+func IsMarshalerMismatchError(err error) bool {
+	var i interface {
+		MarshalerMismatchError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrResyncRequired generates error for watches which missed the changes done without events (see Import).
+func ErrResyncRequired(kind resource.Kind) error {
+	return eResyncRequired{
+		fmt.Errorf("resources of kind %s/%s were imported without events, resync is required", kind.Namespace(), kind.Type()),
+	}
+}
+
+// IsResyncRequiredError checks if err is caused by the changes done without events, which the watch has missed.
+//
+// The watch should be restarted with the bootstrap contents (or the resources listed again).
+func IsResyncRequiredError(err error) bool {
+	var i interface {
+		ResyncRequiredError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrCompactionInProgress generates error for compactions which can't start because another one is running (see TryCompact).
+func ErrCompactionInProgress() error {
+	return eCompactionInProgress{
+		errors.New("compaction is already in progress"),
+	}
+}
+
+// IsCompactionInProgressError checks if err is caused by another compaction running.
+func IsCompactionInProgressError(err error) bool {
+	var i interface {
+		CompactionInProgressError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrUnsupportedConfiguration generates error for databases opened with the settings the state doesn't support (see NewState).
+func ErrUnsupportedConfiguration(reason string) error {
+	return eUnsupportedConfiguration{
+		fmt.Errorf("unsupported database configuration: %s", reason),
+	}
+}
+
+// IsUnsupportedConfigurationError checks if err is caused by the database opened with the unsupported settings.
+func IsUnsupportedConfigurationError(err error) bool {
+	var i interface {
+		UnsupportedConfigurationError()
+	}
+
+	return errors.As(err, &i)
+}
+
+// ErrCanceled generates error for writes which were stopped by the context cancellation (see WithCanceledErrors).
+//
+// Both err and the context error ctxErr can be unwrapped.
+func ErrCanceled(err, ctxErr error) error {
+	if errors.Is(err, ctxErr) {
+		return eCanceled{err}
+	}
+
+	return eCanceled{
+		fmt.Errorf("%w (%w)", err, ctxErr),
+	}
+}
+
+// IsCanceledError checks if err is caused by the context of the write being canceled (or its deadline exceeded).
+//
+// Nothing is written by such a write.
+func IsCanceledError(err error) bool {
+	var i interface {
+		CanceledError()
+	}
+
+	return errors.As(err, &i)
+}
@@ -7,9 +7,12 @@ package sqlite_test
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
@@ -31,3 +34,72 @@ func TestErrors(t *testing.T) {
 
 	require.True(t, state.IsInvalidWatchBookmarkError(sqlite.ErrInvalidWatchBookmark(errors.New("invalid"))))
 }
+
+func TestNamespaceNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(st state.State) {
+		ctx := t.Context()
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "a")))
+
+		err := st.Create(ctx, conformance.NewPathResource("ns3", "a"))
+		require.Error(t, err)
+		require.True(t, sqlite.IsNamespaceNotAllowedError(err))
+
+		_, err = st.Get(ctx, conformance.NewPathResource("ns3", "a").Metadata())
+		require.True(t, sqlite.IsNamespaceNotAllowedError(err))
+
+		_, err = st.List(ctx, conformance.NewPathResource("ns3", "").Metadata())
+		require.True(t, sqlite.IsNamespaceNotAllowedError(err))
+
+		err = st.WatchKind(ctx, conformance.NewPathResource("ns3", "").Metadata(), make(chan state.Event))
+		require.True(t, sqlite.IsNamespaceNotAllowedError(err))
+
+		require.False(t, sqlite.IsNamespaceNotAllowedError(st.Destroy(ctx, conformance.NewPathResource("ns2", "a").Metadata())))
+	}, sqlite.WithNamespaces("ns1", "ns2"))
+}
+
+func TestVersionConflict(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("owner")))
+
+		stale := res.DeepCopy()
+
+		res.Metadata().Labels().Set("app", "foo")
+		require.NoError(t, st.Update(ctx, res, state.WithUpdateOwner("owner")))
+
+		stale.Metadata().Labels().Set("app", "bar")
+
+		err := st.Update(ctx, stale, state.WithUpdateOwner("owner"))
+		require.Error(t, err)
+		assert.True(t, state.IsConflictError(err))
+		assert.ErrorContains(t, err, "expected version 1, actual version 2")
+
+		conflict, ok := sqlite.GetVersionConflict(err)
+		require.True(t, ok)
+		assert.Equal(t, uint64(1), conflict.Expected)
+		assert.Equal(t, uint64(2), conflict.Stored)
+		assert.Equal(t, "owner", conflict.Owner)
+		assert.WithinDuration(t, time.Now(), conflict.Updated, time.Minute)
+
+		_, err = st.Apply(ctx, stale, "owner")
+		conflict, ok = sqlite.GetVersionConflict(err)
+		require.True(t, ok, "%v", err)
+		assert.Equal(t, uint64(2), conflict.Stored)
+
+		// the other conflicts have no version details
+		_, ok = sqlite.GetVersionConflict(st.Create(ctx, res))
+		assert.False(t, ok)
+
+		// the versions are known without the stored resource
+		conflict, ok = sqlite.GetVersionConflict(sqlite.ErrVersionConflict(res.Metadata(), 1, 2))
+		require.True(t, ok)
+		assert.Equal(t, sqlite.VersionConflict{Expected: 1, Stored: 2}, conflict)
+	})
+}
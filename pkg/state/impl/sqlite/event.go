@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// AppendEvent appends an application-level event to the event log.
+//
+// The event is not related to any resource change; the payload is not stored as a resource,
+// it is only recorded in the event log.
+// Watches matching the payload's metadata receive it as a state.Noop event with the payload
+// as the event resource, in order with the other events.
+// This allows to pass coordination signals (e.g. "snapshot taken") through the same event stream.
+//
+// AppendEvent returns the bookmark of the appended event.
+func (st *State) AppendEvent(ctx context.Context, payload resource.Resource) (state.Bookmark, error) {
+	if err := st.checkNamespace(payload.Metadata().Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to append event: %w", err)
+	}
+
+	unlock, err := st.lockKind(ctx, payload.Metadata())
+	if err != nil {
+		return nil, fmt.Errorf("failed to append event: %w", err)
+	}
+
+	defer unlock()
+
+	m, err := st.marshalResource(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event payload: %w", err)
+	}
+
+	var eventID int64
+
+	st.localEvents.Add(payload.Metadata(), 1)
+
+	err = func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for append event: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		if err = st.checkWrite(conn, len(m)); err != nil {
+			return fmt.Errorf("failed to append event: %w", err)
+		}
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`INSERT INTO `+st.options.TablePrefix+`events (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
+			VALUES ($namespace, $type, $id, unixepoch(), 4, NULL, $spec)`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing insert statement for event: %w", err)
+		}
+
+		if err = q.
+			BindString("$namespace", payload.Metadata().Namespace()).
+			BindString("$type", payload.Metadata().Type()).
+			BindString("$id", payload.Metadata().ID()).
+			BindBytes("$spec", m).
+			Exec(); err != nil {
+			return fmt.Errorf("inserting event into database: %w", err)
+		}
+
+		eventID = conn.LastInsertRowID()
+
+		return nil
+	}()
+	if err != nil {
+		st.localEvents.Add(payload.Metadata(), -1)
+
+		return nil, err
+	}
+
+	st.recordWrite("append_event", int64(len(m)), 1)
+
+	st.notify(ctx, payload.Metadata())
+
+	return encodeBookmark(eventID), nil
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestAppendEvent(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		watchCh := make(chan state.Event)
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), watchCh))
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "a")))
+
+		bookmark, err := st.AppendEvent(ctx, conformance.NewPathResource("ns1", "snapshot-taken"))
+		require.NoError(t, err)
+
+		// custom event doesn't create a resource
+		_, err = st.Get(ctx, conformance.NewPathResource("ns1", "snapshot-taken").Metadata())
+		require.True(t, state.IsNotFoundError(err))
+
+		for _, expected := range []struct {
+			typ state.EventType
+			id  string
+		}{
+			{typ: state.Created, id: "a"},
+			{typ: state.Noop, id: "snapshot-taken"},
+		} {
+			select {
+			case ev := <-watchCh:
+				assert.Equal(t, expected.typ, ev.Type)
+				assert.Equal(t, expected.id, ev.Resource.Metadata().ID())
+
+				if ev.Type == state.Noop {
+					assert.Equal(t, bookmark, ev.Bookmark)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+	})
+}
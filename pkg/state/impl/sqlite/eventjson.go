@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cosi-project/runtime/pkg/state"
+)
+
+// jsonEvent is the JSON representation of an event.
+type jsonEvent struct {
+	Labels    map[string]string `json:"labels,omitempty"`
+	Spec      any               `json:"spec,omitempty"`
+	Event     string            `json:"event"`
+	Namespace string            `json:"namespace"`
+	Type      string            `json:"type"`
+	ID        string            `json:"id"`
+	Version   string            `json:"version"`
+	Phase     string            `json:"phase"`
+	Owner     string            `json:"owner,omitempty"`
+	Bookmark  []byte            `json:"bookmark,omitempty"`
+}
+
+// MarshalEventJSON encodes the event with the resource as JSON.
+//
+// This is the format used to deliver events to the systems which don't speak the COSI protocol (e.g. webhooks).
+// The event type is lowercase ("created", "updated", ...), the bookmark is base64-encoded.
+func MarshalEventJSON(event state.Event) ([]byte, error) {
+	return marshalEventJSON(event, false)
+}
+
+// MarshalEventJSON encodes the event like the MarshalEventJSON function, with the specs of RedactedKinds masked.
+func (st *State) MarshalEventJSON(event state.Event) ([]byte, error) {
+	redact := event.Resource != nil && st.redacts(event.Resource.Metadata().Namespace(), event.Resource.Metadata().Type())
+
+	return marshalEventJSON(event, redact)
+}
+
+func marshalEventJSON(event state.Event, redact bool) ([]byte, error) {
+	if event.Resource == nil {
+		return nil, errors.New("event has no resource")
+	}
+
+	md := event.Resource.Metadata()
+
+	var spec any = event.Resource.Spec()
+
+	if redact {
+		spec = redactedValue
+	}
+
+	data, err := json.Marshal(jsonEvent{
+		Event:     strings.ToLower(event.Type.String()),
+		Bookmark:  event.Bookmark,
+		Namespace: md.Namespace(),
+		Type:      md.Type(),
+		ID:        md.ID(),
+		Version:   md.Version().String(),
+		Phase:     md.Phase().String(),
+		Owner:     md.Owner(),
+		Labels:    md.Labels().Raw(),
+		Spec:      spec,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// eventRateWindow is the time constant of the event rate moving averages.
+const eventRateWindow = time.Minute
+
+// eventRateIdle is the rate below which the kind is dropped from the stats.
+const eventRateIdle = 1e-4
+
+// Stats is a snapshot of the state statistics.
+type Stats struct {
+	// Kinds are the per-kind event rates, hottest kinds first.
+	//
+	// Kinds without events in the last several minutes are omitted.
+	Kinds []KindStats `json:"kinds"`
+
+	// Watches is the number of active watches.
+	Watches int `json:"watches"`
+}
+
+// KindStats are the event rates of a resource kind.
+//
+// The rates are exponentially weighted moving averages over about a minute, in events per second.
+type KindStats struct {
+	Namespace resource.Namespace `json:"namespace"`
+	Type      resource.Type      `json:"type"`
+
+	// EventRate is the rate of the events written via this State.
+	EventRate float64 `json:"event_rate"`
+
+	// ExternalEventRate is the rate of the resources changed outside of this State.
+	//
+	// It's only tracked if ExternalChangesPollInterval is set.
+	ExternalEventRate float64 `json:"external_event_rate"`
+}
+
+// Stats returns the state statistics.
+//
+// The statistics cover the resources of this State only, so with several states sharing the database
+// (see WithTablePrefix) they are per table prefix, like DBSize.
+func (st *State) Stats() Stats {
+	st.watchesMu.Lock()
+	watches := len(st.watches)
+	st.watchesMu.Unlock()
+
+	return Stats{
+		Kinds:   st.eventRates.stats(time.Now()),
+		Watches: watches,
+	}
+}
+
+type kindKey struct {
+	ns  resource.Namespace
+	typ resource.Type
+}
+
+// eventRate is an exponentially weighted moving average of the event rate.
+type eventRate struct {
+	updated time.Time
+	value   float64
+}
+
+func (r *eventRate) at(now time.Time) float64 {
+	return r.value * math.Exp(-now.Sub(r.updated).Seconds()/eventRateWindow.Seconds())
+}
+
+func (r *eventRate) add(now time.Time, events float64) {
+	r.value = r.at(now) + events/eventRateWindow.Seconds()
+	r.updated = now
+}
+
+type kindRates struct {
+	local    eventRate
+	external eventRate
+}
+
+// eventRates tracks the event rates per resource kind.
+type eventRates struct {
+	kinds map[kindKey]*kindRates
+	mu    sync.Mutex
+}
+
+func (r *eventRates) get(ns resource.Namespace, typ resource.Type) *kindRates {
+	if r.kinds == nil {
+		r.kinds = map[kindKey]*kindRates{}
+	}
+
+	key := kindKey{ns: ns, typ: typ}
+
+	rates, ok := r.kinds[key]
+	if !ok {
+		rates = &kindRates{}
+		r.kinds[key] = rates
+	}
+
+	return rates
+}
+
+func (r *eventRates) recordLocal(now time.Time, kind resource.Kind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.get(kind.Namespace(), kind.Type()).local.add(now, 1)
+}
+
+func (r *eventRates) recordExternal(now time.Time, ns resource.Namespace, typ resource.Type, events float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.get(ns, typ).external.add(now, events)
+}
+
+// maxExternal returns the highest external event rate across all kinds.
+func (r *eventRates) maxExternal(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result float64
+
+	for _, rates := range r.kinds {
+		result = max(result, rates.external.at(now))
+	}
+
+	return result
+}
+
+func (r *eventRates) stats(now time.Time) []KindStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]KindStats, 0, len(r.kinds))
+
+	for key, rates := range r.kinds {
+		local, external := rates.local.at(now), rates.external.at(now)
+
+		if local < eventRateIdle && external < eventRateIdle {
+			delete(r.kinds, key)
+
+			continue
+		}
+
+		result = append(result, KindStats{
+			Namespace:         key.ns,
+			Type:              key.typ,
+			EventRate:         local,
+			ExternalEventRate: external,
+		})
+	}
+
+	slices.SortFunc(result, func(a, b KindStats) int {
+		return cmp.Or(
+			cmp.Compare(b.EventRate+b.ExternalEventRate, a.EventRate+a.ExternalEventRate),
+			cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.Type, b.Type),
+		)
+	})
+
+	return result
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestStatsEventRates(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		assert.Empty(t, st.Stats().Kinds)
+
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", id)))
+		}
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "a")))
+
+		kinds := st.Stats().Kinds
+		require.Len(t, kinds, 2)
+
+		assert.Equal(t, "ns1", kinds[0].Namespace)
+		assert.Equal(t, conformance.PathResourceType, kinds[0].Type)
+		assert.InDelta(t, 3./60, kinds[0].EventRate, 0.001)
+		assert.Zero(t, kinds[0].ExternalEventRate)
+
+		assert.Equal(t, "ns2", kinds[1].Namespace)
+		assert.InDelta(t, 1./60, kinds[1].EventRate, 0.001)
+	})
+}
+
+func TestStatsExternalEventRates(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+
+	local := newSqliteState(t, path,
+		sqlite.WithExternalChangesPollInterval(10*time.Millisecond),
+		sqlite.WithExternalChangesMaxPollInterval(100*time.Millisecond),
+	)
+	external := newSqliteState(t, path)
+
+	ctx := t.Context()
+
+	require.NoError(t, local.Create(ctx, conformance.NewPathResource("ns1", "local")))
+	require.NoError(t, external.Create(ctx, conformance.NewPathResource("ns2", "external")))
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		kinds := local.Stats().Kinds
+
+		if !assert.Len(collect, kinds, 2) {
+			return
+		}
+
+		for _, kind := range kinds {
+			switch kind.Namespace {
+			case "ns1":
+				assert.Positive(collect, kind.EventRate)
+				assert.Zero(collect, kind.ExternalEventRate)
+			case "ns2":
+				assert.Zero(collect, kind.EventRate)
+				assert.Positive(collect, kind.ExternalEventRate)
+			}
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"container/list"
+	"sync"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// explainedQueriesSize is the number of the explained queries remembered by the state.
+//
+// The text of the queries depends on the label queries, so the number of the distinct queries is unbounded.
+const explainedQueriesSize = 256
+
+// explainedQueries is the LRU set of the queries which plan was already logged.
+//
+// A query evicted from the set gets its plan logged again the next time it's executed.
+// The zero value is ready to use.
+type explainedQueries struct {
+	entries map[string]*list.Element
+	lru     list.List
+	mu      sync.Mutex
+}
+
+// add marks the query as explained, and returns false if it wasn't.
+func (e *explainedQueries) add(query string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if elem, ok := e.entries[query]; ok {
+		e.lru.MoveToFront(elem)
+
+		return true
+	}
+
+	if e.entries == nil {
+		e.entries = map[string]*list.Element{}
+	}
+
+	e.entries[query] = e.lru.PushFront(query)
+
+	if e.lru.Len() > explainedQueriesSize {
+		oldest := e.lru.Back()
+
+		e.lru.Remove(oldest)
+		delete(e.entries, oldest.Value.(string)) //nolint:forcetypeassert,errcheck
+	}
+
+	return false
+}
+
+func (e *explainedQueries) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.lru.Len()
+}
+
+// newExplainedQuery creates a query like sqlitexx.NewQuery does.
+//
+// If ExplainQueries is enabled, the query plan is logged the first time each query is executed
+// (see explainedQueriesSize).
+func (st *State) newExplainedQuery(conn *sqlite.Conn, query string) (*sqlitexx.Query, error) {
+	if st.options.ExplainQueries {
+		if explained := st.explainedQueries.add(query); !explained {
+			st.explainQuery(conn, query)
+		}
+	}
+
+	return sqlitexx.NewQuery(conn, query)
+}
+
+func (st *State) explainQuery(conn *sqlite.Conn, query string) {
+	q, err := sqlitexx.NewQuery(conn, `EXPLAIN QUERY PLAN `+query)
+	if err != nil {
+		st.options.Logger.Warn("failed to explain query", zap.String("query", query), zap.Error(err))
+
+		return
+	}
+
+	var plan []string
+
+	if err = q.QueryAll(
+		func(stmt *sqlite.Stmt) error {
+			plan = append(plan, stmt.GetText("detail"))
+
+			return nil
+		},
+	); err != nil {
+		st.options.Logger.Warn("failed to explain query", zap.String("query", query), zap.Error(err))
+
+		return
+	}
+
+	st.options.Logger.Info("query plan", zap.String("query", query), zap.Strings("plan", plan))
+}
@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestExplainQueries(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	withSqlite(t, func(st state.State) {
+		kind := conformance.NewPathResource("ns1", "").Metadata()
+
+		for range 2 {
+			_, err := st.List(t.Context(), kind, state.WithLabelQuery(resource.LabelEqual("app", "foo")))
+			require.NoError(t, err)
+		}
+
+		plans := logs.FilterMessage("query plan").All()
+		require.Len(t, plans, 1)
+
+		assert.NotEmpty(t, plans[0].ContextMap()["plan"])
+
+		_, err := st.List(t.Context(), kind)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, logs.FilterMessage("query plan").Len())
+	},
+		sqlite.WithExplainQueries(true),
+		sqlite.WithLogger(zap.New(core)),
+	)
+}
+
+func TestExplainOwnerIndex(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		kind := conformance.NewPathResource("ns1", "").Metadata()
+
+		_, err := st.List(t.Context(), kind, sqlite.WithOwner("ctrl"))
+		require.NoError(t, err)
+
+		plans := logs.FilterMessage("query plan").All()
+		require.Len(t, plans, 1)
+		assert.Contains(t, plans[0].ContextMap()["plan"], "SEARCH test_resources USING INDEX test_resources_owner (owner=? AND namespace=? AND type=?)")
+
+		// the resources without an owner are not indexed
+		_, err = st.List(t.Context(), kind, sqlite.WithOwner(""))
+		require.NoError(t, err)
+
+		plans = logs.FilterMessage("query plan").All()
+		require.Len(t, plans, 2)
+		assert.NotContains(t, plans[1].ContextMap()["plan"], "SEARCH test_resources USING INDEX test_resources_owner (owner=? AND namespace=? AND type=?)")
+	},
+		sqlite.WithExplainQueries(true),
+		sqlite.WithLogger(zap.New(core)),
+	)
+}
+
+func TestExplainedQueriesBounded(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		for i := range sqlite.ExplainedQueriesSize + 10 {
+			require.NoError(t, st.ExplainedQuery(t.Context(), "SELECT "+strconv.Itoa(i)))
+		}
+
+		assert.Equal(t, sqlite.ExplainedQueriesSize, st.ExplainedQueries())
+		assert.Equal(t, sqlite.ExplainedQueriesSize+10, logs.FilterMessage("query plan").Len())
+
+		// the most recent queries are remembered, the evicted ones are explained again
+		require.NoError(t, st.ExplainedQuery(t.Context(), "SELECT "+strconv.Itoa(sqlite.ExplainedQueriesSize+9)))
+		assert.Equal(t, sqlite.ExplainedQueriesSize+10, logs.FilterMessage("query plan").Len())
+
+		require.NoError(t, st.ExplainedQuery(t.Context(), "SELECT 0"))
+		assert.Equal(t, sqlite.ExplainedQueriesSize+11, logs.FilterMessage("query plan").Len())
+	},
+		sqlite.WithExplainQueries(true),
+		sqlite.WithLogger(zap.New(core)),
+	)
+}
@@ -4,9 +4,118 @@
 
 package sqlite
 
-// EmptySubscriptions checks whether there are any active subscriptions in the manager.
+import (
+	"context"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Schema versions exposed for tests.
+const (
+	SchemaVersion    = schemaVersion
+	MinReaderVersion = minReaderVersion
+)
+
+// EmptySubscriptions checks whether there are any active subscriptions in the manager
+// besides the ones of the mirrors of the cached kinds and the event fanout.
 //
 // Used in tests assertions.
 func (st *State) EmptySubscriptions() bool {
-	return st.sub.Empty()
+	expected := len(st.mirrors)
+
+	if st.fanout != nil {
+		expected++
+
+		st.fanout.mu.Lock()
+		defer st.fanout.mu.Unlock()
+
+		if len(st.fanout.subscribers) > 0 {
+			return false
+		}
+	}
+
+	return st.sub.Len() == expected
+}
+
+// RebuildTable exposes rebuildTable for tests.
+func (st *State) RebuildTable(ctx context.Context, table, createSQL string, columns []string) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer st.db.Put(conn)
+
+	return st.rebuildTable(conn, table, createSQL, columns)
 }
+
+// CacheSize returns the cache size of a connection from the pool.
+func (st *State) CacheSize(ctx context.Context) (int, error) {
+	return st.connectionPragma(ctx, "cache_size")
+}
+
+// BusyTimeout returns the busy timeout of a connection from the pool.
+func (st *State) BusyTimeout(ctx context.Context) (time.Duration, error) {
+	timeout, err := st.connectionPragma(ctx, "busy_timeout")
+
+	return time.Duration(timeout) * time.Millisecond, err
+}
+
+func (st *State) connectionPragma(ctx context.Context, name string) (int, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer st.db.Put(conn)
+
+	var value int
+
+	err = sqlitex.Execute(conn, `PRAGMA `+name, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			value = stmt.ColumnInt(0)
+
+			return nil
+		},
+	})
+
+	return value, err
+}
+
+// PruneGraveyard exposes pruneGraveyard for tests.
+func (st *State) PruneGraveyard(ctx context.Context) (int, error) {
+	return st.pruneGraveyard(ctx)
+}
+
+// EncodeBookmark exposes encodeBookmark for tests.
+func EncodeBookmark(eventID int64) state.Bookmark {
+	return encodeBookmark(eventID)
+}
+
+// ExplainedQuery prepares the query with newExplainedQuery for tests.
+func (st *State) ExplainedQuery(ctx context.Context, query string) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := st.newExplainedQuery(conn, query)
+	if err != nil {
+		return err
+	}
+
+	return q.QueryAll(func(*sqlite.Stmt) error { return nil })
+}
+
+// ExplainedQueries returns the number of the queries remembered as explained.
+func (st *State) ExplainedQueries() int {
+	return st.explainedQueries.len()
+}
+
+// ExplainedQueriesSize is the number of the explained queries remembered by the state.
+const ExplainedQueriesSize = explainedQueriesSize
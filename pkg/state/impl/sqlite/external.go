@@ -0,0 +1,225 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/siderolabs/gen/panicsafe"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+var externalEvents expvar.Int
+
+func init() {
+	expvar.Publish("sqlite_state_external_events", &externalEvents)
+}
+
+// externalChanges tracks events written to the database outside of this State.
+//
+// Every local mutation bumps State.localEvents before committing, so the number of events
+// of a kind observed in the database can never exceed the local counter unless some other process
+// (or another State sharing the tables) wrote to the database.
+//
+// PRAGMA data_version can't be used directly, as it also changes on commits done via other
+// connections of the same pool.
+type externalChanges struct {
+	seen        map[kindKey]int64
+	reported    map[kindKey]int64
+	localBase   map[kindKey]int64
+	lastEventID int64
+}
+
+// localEventCounter counts the events written via this State per resource kind.
+type localEventCounter struct {
+	kinds map[kindKey]int64
+	mu    sync.Mutex
+}
+
+// Add adjusts the number of events of the kind.
+func (c *localEventCounter) Add(kind resource.Kind, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.kinds == nil {
+		c.kinds = map[kindKey]int64{}
+	}
+
+	c.kinds[kindKey{ns: kind.Namespace(), typ: kind.Type()}] += delta
+}
+
+func (c *localEventCounter) snapshot() map[kindKey]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return maps.Clone(c.kinds)
+}
+
+type resourceKey struct {
+	ns  resource.Namespace
+	typ resource.Type
+	id  resource.ID
+}
+
+// initExternalChanges records the current position in the event log.
+func (st *State) initExternalChanges(ctx context.Context) (*externalChanges, error) {
+	ec := &externalChanges{
+		seen:      map[kindKey]int64{},
+		reported:  map[kindKey]int64{},
+		localBase: st.localEvents.snapshot(),
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error taking connection for external changes: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	if ec.lastEventID, err = st.lastEventID(conn); err != nil {
+		return nil, err
+	}
+
+	return ec, nil
+}
+
+func (st *State) runExternalChanges(ec *externalChanges) {
+	defer st.wg.Done()
+
+	timer := time.NewTimer(st.options.ExternalChangesPollInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-st.shutdown:
+			return
+		case <-timer.C:
+		}
+
+		if err := panicsafe.RunErrF(func() error {
+			return st.pollExternalChanges(st.compactionCtx, ec)
+		})(); err != nil {
+			st.options.Logger.Error("failed to poll for external changes", zap.Error(err))
+		}
+
+		timer.Reset(st.externalChangesPollInterval())
+	}
+}
+
+// externalChangesPollInterval returns the interval until the next poll.
+//
+// With adaptive polling, the database is polled about once per expected external event
+// of the hottest kind, within the configured bounds.
+func (st *State) externalChangesPollInterval() time.Duration {
+	minInterval, maxInterval := st.options.ExternalChangesPollInterval, st.options.ExternalChangesMaxPollInterval
+
+	if maxInterval <= minInterval {
+		return minInterval
+	}
+
+	rate := st.eventRates.maxExternal(time.Now())
+	if rate*maxInterval.Seconds() <= 1 {
+		return maxInterval
+	}
+
+	return max(time.Duration(float64(time.Second)/rate), minInterval)
+}
+
+// pollExternalChanges fetches new events, and notifies the watches if some of them were written externally.
+func (st *State) pollExternalChanges(ctx context.Context, ec *externalChanges) error {
+	pointers := map[resourceKey]struct{}{}
+
+	err := func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for external changes: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		q, err := sqlitexx.NewQuery(conn,
+			`SELECT event_id, namespace, type, id FROM `+st.options.TablePrefix+`events
+			WHERE event_id > $last_event_id
+			ORDER BY event_id`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for new events: %w", err)
+		}
+
+		return q.
+			BindInt64("$last_event_id", ec.lastEventID).
+			QueryAll(func(stmt *sqlite.Stmt) error {
+				ec.lastEventID = stmt.GetInt64("event_id")
+
+				key := resourceKey{
+					ns:  stmt.GetText("namespace"),
+					typ: stmt.GetText("type"),
+					id:  stmt.GetText("id"),
+				}
+
+				pointers[key] = struct{}{}
+				ec.seen[kindKey{ns: key.ns, typ: key.typ}]++
+
+				return nil
+			})
+	}()
+	if err != nil {
+		return fmt.Errorf("error querying new events: %w", err)
+	}
+
+	// the local counters should be read after the events, so that every local event seen
+	// is already accounted for
+	var (
+		local    = st.localEvents.snapshot()
+		now      = time.Now()
+		external int64
+	)
+
+	for k, seen := range ec.seen {
+		kindExternal := seen - (local[k] - ec.localBase[k]) - ec.reported[k]
+		if kindExternal <= 0 {
+			continue
+		}
+
+		ec.reported[k] += kindExternal
+		external += kindExternal
+
+		st.eventRates.recordExternal(now, k.ns, k.typ, float64(kindExternal))
+	}
+
+	if external == 0 {
+		return nil
+	}
+
+	externalEvents.Add(external)
+
+	st.options.Logger.Warn("detected external modifications of the database",
+		zap.Int64("events", external),
+		zap.Int64("last_event_id", ec.lastEventID),
+	)
+
+	for k := range pointers {
+		md := resource.NewMetadata(k.ns, k.typ, k.id, resource.VersionUndefined)
+
+		if st.getCache != nil {
+			st.getCache.invalidate(md)
+		}
+
+		st.sub.Notify(md)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestExternalChanges(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	local := newSqliteState(t, path, sqlite.WithExternalChangesPollInterval(10*time.Millisecond), sqlite.WithLogger(zap.New(core)))
+	external := newSqliteState(t, path)
+
+	ctx := t.Context()
+
+	require.NoError(t, local.Create(ctx, conformance.NewPathResource("ns1", "local")))
+
+	ch := make(chan state.Event)
+
+	require.NoError(t, local.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), ch, state.WithBootstrapContents(true)))
+
+	ev := <-ch
+	assert.Equal(t, state.Created, ev.Type)
+	assert.Equal(t, "local", ev.Resource.Metadata().ID())
+
+	ev = <-ch
+	assert.Equal(t, state.Bootstrapped, ev.Type)
+
+	require.NoError(t, external.Create(ctx, conformance.NewPathResource("ns1", "external")))
+
+	select {
+	case ev = <-ch:
+		assert.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, "external", ev.Resource.Metadata().ID())
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for the external change")
+	}
+
+	detected := logs.FilterMessage("detected external modifications of the database").Len()
+	assert.Positive(t, detected)
+
+	// the resync markers written by the namespace pruning are local events
+	res := conformance.NewPathResource("ns2", "pruned")
+
+	require.NoError(t, local.Create(ctx, res))
+	require.NoError(t, local.Destroy(ctx, res.Metadata()))
+
+	// the events are polled before they are pruned
+	time.Sleep(100 * time.Millisecond)
+
+	pruned, err := local.PruneNamespaceEvents(ctx, "ns2")
+	require.NoError(t, err)
+	assert.Positive(t, pruned)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, detected, logs.FilterMessage("detected external modifications of the database").Len())
+}
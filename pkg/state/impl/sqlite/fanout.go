@@ -0,0 +1,590 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/siderolabs/gen/panicsafe"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/sub"
+)
+
+// fanoutOverflows counts the kind watch queues dropped because the watch fell behind, see FanoutQueueSize.
+var fanoutOverflows expvar.Int
+
+func init() {
+	expvar.Publish("sqlite_state_fanout_overflows", &fanoutOverflows)
+}
+
+// fanout reads the new events once for all the kind watches, and converts them for each watch
+// in a pool of workers, see FanoutWorkers.
+type fanout struct {
+	st          *State
+	sub         sub.Subscription
+	work        chan *fanoutSubscriber
+	subscribers map[kindKey][]*fanoutSubscriber // guarded by mu
+	eventID     int64                           // guarded by mu, the last event read
+	mu          sync.Mutex
+}
+
+// fanoutSubscriber is a kind watch fed by the fanout.
+//
+// The events queued by the reader are converted by one worker at a time, and handed over to the watch goroutine,
+// which delivers them to the consumer. The subscriber is not converting new events until the watch goroutine
+// delivers the previous ones, so the queue of a slow consumer overflows, instead of the converted events piling up.
+type fanoutSubscriber struct {
+	handle   func(storedEvent) (state.Event, bool, error)
+	fetch    func(afterEventID int64, fn func(storedEvent) error) (int64, error)
+	pos      *watchPosition
+	panics   *watchPanicHandler
+	notifyCh chan struct{}
+	kind     resource.Kind
+	key      kindKey
+
+	// eventID is the last converted event, it's accessed only by the worker converting the events
+	eventID int64
+
+	pending        []storedEvent
+	pendingBatches []*fanoutBatch
+	ready          []state.Event
+	readyBatches   []*fanoutBatch
+	err            error
+	mu             sync.Mutex
+	gap            bool // the queue overflowed, the events after eventID should be read from the database
+	scheduled      bool // a worker is converting the events
+	delivering     bool // the watch goroutine is delivering the converted events
+	blocked        bool
+	unsubscribed   bool
+}
+
+// fanoutBatch tracks the delivery of the events read together, see SynchronousEventDelivery.
+type fanoutBatch struct {
+	done    chan struct{}
+	pending atomic.Int64
+}
+
+func newFanoutBatch() *fanoutBatch {
+	batch := &fanoutBatch{done: make(chan struct{})}
+
+	// the reference of the reader, released once the events are queued
+	batch.pending.Store(1)
+
+	return batch
+}
+
+func (b *fanoutBatch) add() {
+	b.pending.Add(1)
+}
+
+func (b *fanoutBatch) complete() {
+	if b.pending.Add(-1) == 0 {
+		close(b.done)
+	}
+}
+
+func completeBatches(batches []*fanoutBatch) {
+	for _, batch := range batches {
+		batch.complete()
+	}
+}
+
+// startFanout starts the reader and the workers of the fanout.
+func (st *State) startFanout(ctx context.Context) error {
+	f := &fanout{
+		st:          st,
+		work:        make(chan *fanoutSubscriber, st.options.FanoutWorkers),
+		subscribers: make(map[kindKey][]*fanoutSubscriber),
+	}
+
+	// subscribe before reading the position, so that no event is missed
+	f.sub = st.sub.SubscribeAll(st.watchSubscribeOptions()...)
+
+	if err := f.readPosition(ctx); err != nil {
+		f.sub.Unsubscribe()
+
+		return err
+	}
+
+	st.fanout = f
+
+	st.wg.Add(1 + st.options.FanoutWorkers)
+
+	go f.runReader() //nolint:contextcheck
+
+	for range st.options.FanoutWorkers {
+		go f.runWorker()
+	}
+
+	return nil
+}
+
+func (f *fanout) readPosition(ctx context.Context) error {
+	conn, err := f.st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for event fanout: %w", err)
+	}
+
+	defer f.st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT coalesce(max(event_id), 0) AS max_event_id FROM `+f.st.options.TablePrefix+`events`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing query for event fanout position: %w", err)
+	}
+
+	if err = q.QueryRow(func(stmt *sqlite.Stmt) error {
+		f.eventID = stmt.GetInt64("max_event_id")
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("querying event fanout position: %w", err)
+	}
+
+	return nil
+}
+
+func (f *fanout) runReader() {
+	defer f.st.wg.Done()
+	defer f.sub.Unsubscribe()
+
+	for {
+		select {
+		case <-f.st.shutdown:
+			return
+		case <-f.sub.NotifyCh():
+		}
+
+		gen := f.sub.Generation()
+
+		var batch *fanoutBatch
+
+		if err := panicsafe.RunErrF(func() error {
+			var err error
+
+			batch, err = f.read(f.st.compactionCtx)
+
+			return err
+		})(); err != nil {
+			f.st.options.Logger.Error("failed to read events for the watches", zap.Error(err))
+
+			// the watches read the events on their own
+			f.resync()
+		}
+
+		if batch != nil {
+			batch.complete()
+
+			select {
+			case <-batch.done:
+			case <-f.st.shutdown:
+				return
+			}
+		}
+
+		f.sub.Ack(gen)
+	}
+}
+
+// read queues the events after the last read one for the subscribers of their kinds.
+//
+// With SynchronousEventDelivery, the returned batch is completed once the subscribers deliver the events.
+func (f *fanout) read(ctx context.Context) (*fanoutBatch, error) {
+	var batch *fanoutBatch
+
+	if f.st.options.SynchronousEventDelivery {
+		batch = newFanoutBatch()
+	}
+
+	conn, err := f.st.db.Take(ctx)
+	if err != nil {
+		return batch, fmt.Errorf("taking connection for event fanout: %w", err)
+	}
+
+	defer f.st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT event_id, namespace, type, spec_before, spec_after, event_type, generation_changed
+		FROM `+f.st.options.TablePrefix+`events
+		WHERE event_id > $event_id
+		ORDER BY event_id ASC`,
+	)
+	if err != nil {
+		return batch, fmt.Errorf("preparing query for event fanout: %w", err)
+	}
+
+	queued := map[*fanoutSubscriber]struct{}{}
+
+	f.mu.Lock()
+
+	err = q.
+		BindInt64("$event_id", f.eventID).
+		QueryAll(
+			func(stmt *sqlite.Stmt) error {
+				f.eventID = stmt.GetInt64("event_id")
+
+				key := kindKey{ns: stmt.GetText("namespace"), typ: stmt.GetText("type")}
+
+				subscribers := slices.Concat(f.subscribers[key], f.subscribers[kindKey{ns: key.ns}])
+				if len(subscribers) == 0 {
+					return nil
+				}
+
+				// the specs are shared by the subscribers, they are never modified
+				stored := storedEvent{
+					eventID:           f.eventID,
+					eventType:         int(stmt.GetInt64("event_type")),
+					generationChanged: stmt.GetInt64("generation_changed") != 0,
+					specBefore:        make([]byte, stmt.GetLen("spec_before")),
+					specAfter:         make([]byte, stmt.GetLen("spec_after")),
+				}
+
+				stmt.GetBytes("spec_before", stored.specBefore)
+				stmt.GetBytes("spec_after", stored.specAfter)
+
+				for _, fs := range subscribers {
+					_, seen := queued[fs]
+					queued[fs] = struct{}{}
+
+					fs.enqueue(stored, batch, !seen, f.st.options.FanoutQueueSize)
+				}
+
+				return nil
+			},
+		)
+
+	f.mu.Unlock()
+
+	for fs := range queued {
+		f.schedule(fs)
+	}
+
+	if err != nil {
+		return batch, fmt.Errorf("querying events for event fanout: %w", err)
+	}
+
+	return batch, nil
+}
+
+// resync makes all the subscribers read the events from the database after the last converted one.
+func (f *fanout) resync() {
+	f.mu.Lock()
+
+	var subscribers []*fanoutSubscriber
+
+	for _, kindSubscribers := range f.subscribers {
+		subscribers = append(subscribers, kindSubscribers...)
+	}
+
+	f.mu.Unlock()
+
+	for _, fs := range subscribers {
+		fs.mu.Lock()
+		fs.pending = nil
+		fs.gap = true
+		fs.mu.Unlock()
+
+		f.schedule(fs)
+	}
+}
+
+// subscribe registers the kind watch, which has delivered the events up to the event ID.
+//
+// The events are queued for the watch right away, but they are not converted until the watch resumes
+// after delivering the initial events (see resume).
+func (f *fanout) subscribe(resourceKind resource.Kind, eventID int64, pos *watchPosition) *fanoutSubscriber {
+	fs := &fanoutSubscriber{
+		pos:        pos,
+		notifyCh:   make(chan struct{}, 1),
+		kind:       resourceKind,
+		key:        kindKey{ns: resourceKind.Namespace(), typ: resourceKind.Type()},
+		eventID:    eventID,
+		delivering: true,
+		blocked:    true,
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subscribers[fs.key] = append(f.subscribers[fs.key], fs)
+
+	// the events the reader has already read are not going to be queued, the watch reads them on its own;
+	// the events the reader reads later are skipped by the watch up to its event ID
+	fs.gap = eventID < f.eventID
+
+	return fs
+}
+
+// resume starts converting the events for the watch with handle, and reading them with fetch if the queue overflows.
+func (f *fanout) resume(
+	fs *fanoutSubscriber, panics *watchPanicHandler,
+	handle func(storedEvent) (state.Event, bool, error), fetch func(int64, func(storedEvent) error) (int64, error),
+) {
+	fs.mu.Lock()
+	fs.panics, fs.handle, fs.fetch = panics, handle, fetch
+	fs.blocked = false
+	fs.mu.Unlock()
+
+	f.delivered(fs)
+}
+
+func (f *fanout) unsubscribe(fs *fanoutSubscriber) {
+	f.mu.Lock()
+
+	f.subscribers[fs.key] = slices.DeleteFunc(f.subscribers[fs.key], func(other *fanoutSubscriber) bool {
+		return other == fs
+	})
+
+	if len(f.subscribers[fs.key]) == 0 {
+		delete(f.subscribers, fs.key)
+	}
+
+	f.mu.Unlock()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.unsubscribed = true
+	fs.pending, fs.ready = nil, nil
+
+	completeBatches(fs.pendingBatches)
+	completeBatches(fs.readyBatches)
+
+	fs.pendingBatches, fs.readyBatches = nil, nil
+}
+
+// delivered is called by the watch goroutine once the converted events are delivered.
+func (f *fanout) delivered(fs *fanoutSubscriber) {
+	fs.mu.Lock()
+	fs.delivering = false
+	fs.mu.Unlock()
+
+	f.schedule(fs)
+}
+
+// schedule hands the subscriber over to a worker if it has events to convert.
+func (f *fanout) schedule(fs *fanoutSubscriber) {
+	fs.mu.Lock()
+
+	if fs.scheduled || fs.delivering || fs.unsubscribed || (len(fs.pending) == 0 && !fs.gap) {
+		fs.mu.Unlock()
+
+		return
+	}
+
+	fs.scheduled = true
+
+	fs.mu.Unlock()
+
+	select {
+	case f.work <- fs:
+	case <-f.st.shutdown:
+	}
+}
+
+func (f *fanout) runWorker() {
+	defer f.st.wg.Done()
+
+	for {
+		select {
+		case <-f.st.shutdown:
+			return
+		case fs := <-f.work:
+			f.process(fs)
+		}
+	}
+}
+
+// process converts the queued events of the subscriber until there are events to deliver.
+func (f *fanout) process(fs *fanoutSubscriber) {
+	for {
+		fs.mu.Lock()
+
+		pending, batches, gap := fs.pending, fs.pendingBatches, fs.gap
+		fs.pending, fs.pendingBatches, fs.gap = nil, nil, false
+
+		if len(pending) == 0 && !gap {
+			fs.scheduled = false
+			fs.mu.Unlock()
+
+			return
+		}
+
+		fs.mu.Unlock()
+
+		var events []state.Event
+
+		restart, err := fs.panics.run(func() error {
+			var err error
+
+			events, err = fs.convert(pending, gap)
+
+			return err
+		})
+		if restart {
+			// convert the events again after the last delivered one
+			fs.eventID = fs.pos.eventID.Load()
+
+			fs.mu.Lock()
+			fs.gap = true
+			fs.pendingBatches = append(batches, fs.pendingBatches...)
+			fs.mu.Unlock()
+
+			continue
+		}
+
+		if err == nil && fs.pos.expired.Load() {
+			// compaction removed some events before we could read them
+			err = fmt.Errorf("watching %s: %w", fs.kind, errWatchExpired)
+		}
+
+		if err == nil {
+			fs.pos.eventID.Store(fs.eventID)
+		} else {
+			events = nil
+		}
+
+		fs.mu.Lock()
+
+		if err == nil && len(events) == 0 {
+			fs.mu.Unlock()
+
+			completeBatches(batches)
+
+			continue
+		}
+
+		fs.ready, fs.err = events, err
+		fs.scheduled = false
+		fs.delivering = true
+
+		if fs.blocked || fs.unsubscribed {
+			completeBatches(batches)
+		} else {
+			fs.readyBatches = batches
+		}
+
+		fs.mu.Unlock()
+
+		select {
+		case fs.notifyCh <- struct{}{}:
+		default:
+		}
+
+		return
+	}
+}
+
+// enqueue queues the event for the subscriber, and adds the subscriber to the batch of the event (if it's new to the batch).
+func (fs *fanoutSubscriber) enqueue(stored storedEvent, batch *fanoutBatch, newToBatch bool, queueSize int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch {
+	case fs.gap:
+		// the event is read from the database along with the dropped ones
+	case len(fs.pending) >= queueSize:
+		// the watch is not keeping up, it reads the events from the database once it catches up
+		fanoutOverflows.Add(1)
+
+		fs.pending = nil
+		fs.gap = true
+	default:
+		fs.pending = append(fs.pending, stored)
+	}
+
+	// NotifyWait doesn't wait for the blocked watches
+	if batch != nil && newToBatch && !fs.blocked {
+		batch.add()
+
+		fs.pendingBatches = append(fs.pendingBatches, batch)
+	}
+}
+
+// convert converts the queued events, reading the events from the database first if the queue overflowed.
+func (fs *fanoutSubscriber) convert(pending []storedEvent, gap bool) ([]state.Event, error) {
+	var events []state.Event
+
+	handle := func(stored storedEvent) error {
+		if stored.eventID <= fs.eventID {
+			// already converted (e.g. read from the database after the overflow)
+			return nil
+		}
+
+		fs.eventID = stored.eventID
+
+		event, ok, err := fs.handle(stored)
+		if err != nil || !ok {
+			return err
+		}
+
+		events = append(events, event)
+
+		return nil
+	}
+
+	if gap {
+		if _, err := fs.fetch(fs.eventID, handle); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, stored := range pending {
+		if err := handle(stored); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// takeReady returns the converted events (or the error) to deliver.
+func (fs *fanoutSubscriber) takeReady() ([]state.Event, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	events := fs.ready
+	fs.ready = nil
+
+	return events, fs.err
+}
+
+// Ack implements deliveryAcker.
+func (fs *fanoutSubscriber) Ack(uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	completeBatches(fs.readyBatches)
+
+	fs.readyBatches = nil
+}
+
+// SetBlocked implements deliveryAcker.
+func (fs *fanoutSubscriber) SetBlocked(blocked bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.blocked = blocked
+
+	if blocked {
+		completeBatches(fs.pendingBatches)
+		completeBatches(fs.readyBatches)
+
+		fs.pendingBatches, fs.readyBatches = nil, nil
+	}
+}
@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestEventFanout(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numWatches = 10
+		numObjects = 100
+	)
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+		defer cancel()
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "initial")))
+
+		watchChannels := make([]chan state.Event, numWatches)
+
+		for i := range watchChannels {
+			watchChannels[i] = make(chan state.Event, 2*numObjects+2)
+
+			require.NoError(t, s.WatchKind(ctx, conformance.NewPathResource("default", "").Metadata(), watchChannels[i], state.WithBootstrapContents(true)))
+		}
+
+		// the slow consumer overflows its queue, and reads the missed events from the database
+		slowCh := make(chan state.Event)
+
+		require.NoError(t, s.WatchKind(ctx, conformance.NewPathResource("default", "").Metadata(), slowCh))
+
+		// the watch of another namespace gets no events
+		otherCh := make(chan state.Event, 1)
+
+		require.NoError(t, s.WatchKind(ctx, conformance.NewPathResource("other", "").Metadata(), otherCh))
+
+		for i := range numObjects {
+			r := conformance.NewPathResource("default", fmt.Sprintf("o-%d", i))
+
+			require.NoError(t, s.Create(ctx, r))
+
+			r.Metadata().Labels().Set("app", "foo")
+
+			require.NoError(t, s.Update(ctx, r))
+		}
+
+		for _, watchCh := range watchChannels {
+			ev := receiveEvent(ctx, t, watchCh)
+			assert.Equal(t, state.Created, ev.Type)
+			assert.Equal(t, "initial", ev.Resource.Metadata().ID())
+
+			assert.Equal(t, state.Bootstrapped, receiveEvent(ctx, t, watchCh).Type)
+
+			for i := range numObjects {
+				ev = receiveEvent(ctx, t, watchCh)
+				assert.Equal(t, state.Created, ev.Type)
+				assert.Equal(t, fmt.Sprintf("o-%d", i), ev.Resource.Metadata().ID())
+
+				ev = receiveEvent(ctx, t, watchCh)
+				assert.Equal(t, state.Updated, ev.Type)
+				assert.Equal(t, fmt.Sprintf("o-%d", i), ev.Resource.Metadata().ID())
+			}
+		}
+
+		for i := range numObjects {
+			ev := receiveEvent(ctx, t, slowCh)
+			assert.Equal(t, state.Created, ev.Type)
+			assert.Equal(t, fmt.Sprintf("o-%d", i), ev.Resource.Metadata().ID())
+
+			ev = receiveEvent(ctx, t, slowCh)
+			assert.Equal(t, state.Updated, ev.Type)
+			assert.Equal(t, fmt.Sprintf("o-%d", i), ev.Resource.Metadata().ID())
+		}
+
+		assert.Empty(t, otherCh)
+	}, sqlite.WithEventFanout(2), sqlite.WithEventFanoutQueueSize(8))
+}
+
+func TestEventFanoutSynchronousDelivery(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		kindCh := make(chan state.Event, 16)
+		aggCh := make(chan []state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, conformance.NewPathResource("default", "").Metadata(), kindCh))
+		require.NoError(t, s.WatchKindAggregated(ctx, conformance.NewPathResource("default", "").Metadata(), aggCh))
+
+		for i := range 10 {
+			require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", fmt.Sprintf("path-%d", i))))
+
+			// no waiting: the events should be already in the channels
+			select {
+			case ev := <-kindCh:
+				assert.Equal(t, state.Created, ev.Type)
+				assert.Equal(t, fmt.Sprintf("path-%d", i), ev.Resource.Metadata().ID())
+			default:
+				t.Fatal("event is not delivered")
+			}
+
+			select {
+			case evs := <-aggCh:
+				require.Len(t, evs, 1)
+				assert.Equal(t, state.Created, evs[0].Type)
+			default:
+				t.Fatal("event is not delivered")
+			}
+		}
+	}, sqlite.WithEventFanout(2), sqlite.WithSynchronousEventDelivery(true))
+}
+
+func receiveEvent(ctx context.Context, t *testing.T, ch <-chan state.Event) state.Event {
+	t.Helper()
+
+	select {
+	case <-ctx.Done():
+		require.FailNow(t, "timeout waiting for event")
+	case ev := <-ch:
+		return ev
+	}
+
+	return state.Event{}
+}
@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// Faults injects storage errors into the statements run by the State, see WithFaults.
+//
+// It lets the embedders test how their controllers handle the storage errors without mocking the whole State.
+// The statements are matched by a fragment of their SQL text (e.g. "INSERT INTO" or the table name, the text
+// of the statements is not a stable API). Each fault counts the statements it matches on its own.
+//
+// Faults are meant for tests only. The zero value is ready to use and is safe for concurrent use.
+type Faults struct {
+	mu     sync.Mutex
+	faults []*fault
+}
+
+type fault struct {
+	err      error
+	fragment string
+	nth      int
+	seen     int
+	after    bool
+}
+
+// FailStatements makes the statements containing the fragment fail with err without being run.
+//
+// If nth is positive, only the nth matching statement fails (counting from 1), otherwise all of them do.
+func (f *Faults) FailStatements(fragment string, nth int, err error) {
+	f.add(&fault{fragment: fragment, nth: nth, err: err})
+}
+
+// FailStatementsAfterRun makes the statements containing the fragment fail with err after they are run.
+//
+// This simulates a partial write: outside of a transaction the change is stored, but the caller sees it failed,
+// within a transaction the change is rolled back along with the rest of the transaction.
+// Only the statements not returning rows are failed. See FailStatements for nth.
+func (f *Faults) FailStatementsAfterRun(fragment string, nth int, err error) {
+	f.add(&fault{fragment: fragment, nth: nth, err: err, after: true})
+}
+
+// FailCommits makes the commits of the write transactions fail with err, the transactions are rolled back.
+//
+// See FailStatements for nth.
+func (f *Faults) FailCommits(nth int, err error) {
+	f.FailStatements(sqlitexx.CommitStatement, nth, err)
+}
+
+// Busy makes the statements containing the fragment fail with SQLITE_BUSY, as if the database was locked
+// by another connection for longer than the busy timeout.
+//
+// The write paths retry the busy statements starting the write, so a single busy fault is not seen by the caller,
+// unless the context is done before the retry. See FailStatements for nth.
+func (f *Faults) Busy(fragment string, nth int) {
+	f.FailStatements(fragment, nth, sqlite.ResultBusy.ToError())
+}
+
+// Reset removes all the faults.
+func (f *Faults) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+func (f *Faults) add(flt *fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = append(f.faults, flt)
+}
+
+// BeforeStatement implements sqlitexx.Faults.
+func (f *Faults) BeforeStatement(query string) error {
+	return f.match(query, false)
+}
+
+// AfterStatement implements sqlitexx.Faults.
+func (f *Faults) AfterStatement(query string) error {
+	return f.match(query, true)
+}
+
+func (f *Faults) match(query string, after bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+
+	for _, flt := range f.faults {
+		if flt.after != after || !strings.Contains(query, flt.fragment) {
+			continue
+		}
+
+		flt.seen++
+
+		if err == nil && (flt.nth <= 0 || flt.seen == flt.nth) {
+			err = flt.err
+		}
+	}
+
+	return err
+}
+
+// faultyPool sets the faults on the connections taken from the pool.
+type faultyPool struct {
+	SqlitexPool
+
+	faults *Faults
+}
+
+// Take implements SqlitexPool.
+func (p *faultyPool) Take(ctx context.Context) (*sqlite.Conn, error) {
+	conn, err := p.SqlitexPool.Take(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlitexx.SetFaults(conn, p.faults)
+
+	return conn, nil
+}
+
+// Put implements SqlitexPool.
+func (p *faultyPool) Put(conn *sqlite.Conn) {
+	sqlitexx.SetFaults(conn, nil)
+
+	p.SqlitexPool.Put(conn)
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestFaults(t *testing.T) {
+	t.Parallel()
+
+	var faults sqlite.Faults
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		errFault := errors.New("fault")
+
+		// busy on the second insert only, the insert is retried
+		faults.Busy("INSERT INTO", 2)
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "a")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "b")))
+
+		faults.Reset()
+
+		// busy on every insert, the retries give up when the context is done
+		faults.Busy("INSERT INTO", 0)
+
+		busyCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		err := st.Create(busyCtx, conformance.NewPathResource("default", "busy"))
+		assert.True(t, sqlitexx.IsBusy(err), "unexpected error: %v", err)
+
+		faults.Reset()
+
+		// the failed commit leaves the resource unchanged
+		faults.FailCommits(0, errFault)
+
+		res, err := st.Get(ctx, conformance.NewPathResource("default", "a").Metadata())
+		require.NoError(t, err)
+
+		updated := res.DeepCopy()
+		updated.Metadata().Labels().Set("app", "foo")
+
+		require.ErrorIs(t, st.Update(ctx, updated), errFault)
+
+		faults.Reset()
+
+		stored, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, res.Metadata().Version(), stored.Metadata().Version())
+
+		bounds, err := st.EventBounds(ctx)
+		require.NoError(t, err)
+
+		// the partial write outside of a transaction is stored, although it failed
+		faults.FailStatementsAfterRun("INSERT INTO", 1, errFault)
+
+		require.ErrorIs(t, st.Create(ctx, conformance.NewPathResource("default", "c")), errFault)
+
+		faults.Reset()
+
+		_, err = st.Get(ctx, conformance.NewPathResource("default", "c").Metadata())
+		require.NoError(t, err)
+
+		changes, err := st.ListChangedSince(ctx, res.Metadata(), bounds.Newest)
+		require.NoError(t, err)
+		assert.Len(t, changes.Created, 1)
+
+		err = st.Create(ctx, conformance.NewPathResource("default", "c"))
+		assert.True(t, state.IsConflictError(err), "unexpected error: %v", err)
+	}, sqlite.WithFaults(&faults))
+}
@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/filter"
+)
+
+// FindAll finds resources of all types in the given namespaces which match the label query and the filter.
+//
+// If namespaces is empty, all namespaces are searched.
+// The label query and the filter are pushed down to the database, so FindAll is a cheap way for
+// garbage collection and audit controllers to scan for resources regardless of their type
+// (e.g. all resources in the tearing down phase).
+// Results are ordered by namespace, type and ID, unless OrderByLabel is set in the filter.
+func (st *State) FindAll(
+	ctx context.Context, namespaces []resource.Namespace, labelQuery resource.LabelQuery, listFilter ListFilter, opts ...state.GetOption,
+) (resource.List, error) {
+	var options state.GetOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	for _, ns := range namespaces {
+		if err := st.checkNamespace(ns); err != nil {
+			return resource.List{}, fmt.Errorf("failed to find: %w", err)
+		}
+	}
+
+	conn, err := st.readDB.Take(ctx)
+	if err != nil {
+		return resource.List{}, fmt.Errorf("taking connection for find: %w", err)
+	}
+
+	defer st.readDB.Put(conn)
+
+	query := `SELECT spec
+		FROM ` + st.options.TablePrefix + `resources` + listFilter.indexHint(st.options.TablePrefix) + `
+		WHERE ` + filter.CompileLabelQuery(labelQuery) + listFilter.compile()
+
+	if len(namespaces) > 0 {
+		placeholders := make([]string, len(namespaces))
+
+		for i := range namespaces {
+			placeholders[i] = "$namespace" + strconv.Itoa(i)
+		}
+
+		query += ` AND namespace IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+
+	// labels which can't be ordered by the database are ordered after fetching the results
+	var orderInMemory bool
+
+	orderBy := `namespace, type, id`
+
+	if listFilter.OrderByLabel != "" {
+		if order := filter.CompileLabelOrder(listFilter.OrderByLabel); order != "" {
+			orderBy = order + `, ` + orderBy
+		} else {
+			orderInMemory = true
+		}
+	}
+
+	query += ` ORDER BY ` + orderBy
+
+	q, err := st.newExplainedQuery(conn, query)
+	if err != nil {
+		return resource.List{}, fmt.Errorf("preparing query for find: %w", err)
+	}
+
+	listFilter.bind(q)
+
+	for i, ns := range namespaces {
+		q.BindString("$namespace"+strconv.Itoa(i), ns)
+	}
+
+	var result resource.List
+
+	err = q.QueryAll(
+		func(stmt *sqlite.Stmt) error {
+			spec := make([]byte, stmt.GetLen("spec"))
+			stmt.GetBytes("spec", spec)
+
+			res, err := st.unmarshalResource(spec, options.UnmarshalOptions)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal resource: %w", err)
+			}
+
+			// some label terms can't be compiled to SQL, so match them again
+			if !labelQuery.Matches(*res.Metadata().Labels()) {
+				return nil
+			}
+
+			result.Items = append(result.Items, res)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return resource.List{}, fmt.Errorf("error querying resources for find: %w", err)
+	}
+
+	if orderInMemory {
+		sortByLabel(result.Items, listFilter.OrderByLabel)
+	}
+
+	return result, nil
+}
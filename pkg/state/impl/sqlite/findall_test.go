@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/siderolabs/gen/xslices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestFindAll(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for _, ns := range []resource.Namespace{"ns1", "ns2", "ns3"} {
+			for _, id := range []string{"a", "b", "c"} {
+				res := conformance.NewPathResource(ns, id)
+
+				if id != "c" {
+					res.Metadata().Labels().Set("app", id)
+				}
+
+				if id == "b" {
+					res.Metadata().SetPhase(resource.PhaseTearingDown)
+				}
+
+				require.NoError(t, st.Create(ctx, res))
+			}
+		}
+
+		ids := func(list resource.List) []string {
+			return xslices.Map(list.Items, func(r resource.Resource) string {
+				return r.Metadata().Namespace() + "/" + r.Metadata().ID()
+			})
+		}
+
+		tearingDown := resource.PhaseTearingDown
+
+		list, err := st.FindAll(ctx, nil, resource.LabelQuery{}, sqlite.ListFilter{Phase: &tearingDown})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ns1/b", "ns2/b", "ns3/b"}, ids(list))
+
+		list, err = st.FindAll(ctx, []resource.Namespace{"ns3", "ns1"},
+			resource.LabelQuery{Terms: []resource.LabelTerm{{Key: "app", Op: resource.LabelOpExists}}},
+			sqlite.ListFilter{OrderByLabel: "app"},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ns1/a", "ns3/a", "ns1/b", "ns3/b"}, ids(list))
+
+		list, err = st.FindAll(ctx, []resource.Namespace{"ns2"},
+			resource.LabelQuery{Terms: []resource.LabelTerm{{Key: "app", Op: resource.LabelOpExists, Invert: true}}},
+			sqlite.ListFilter{},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ns2/c"}, ids(list))
+	})
+}
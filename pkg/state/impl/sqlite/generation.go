@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// GetGeneration returns the generation of the resource.
+//
+// Unlike the version, which is bumped by every update, the generation is only bumped by the updates
+// which change the resource spec, so the controllers can tell the spec changes from the metadata-only
+// updates (e.g. labels, finalizers or phase changes). The generation starts at 1 when the resource is created.
+// The specs are compared the same way as by SkipNoopUpdates; a stored resource which can't be unmarshaled
+// is considered changed. See also WithGenerationChanges.
+//
+// If a resource is not found, error is returned.
+func (st *State) GetGeneration(ctx context.Context, ptr resource.Pointer) (uint64, error) {
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return 0, fmt.Errorf("failed to get generation: %w", err)
+	}
+
+	conn, err := st.readDB.Take(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("taking connection for get generation: %w", err)
+	}
+
+	defer st.readDB.Put(conn)
+
+	var generation uint64
+
+	q, err := sqlitexx.NewQuery(conn,
+		`SELECT generation FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query for resource generation %q: %w", ptr, err)
+	}
+
+	err = q.
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		QueryRow(
+			func(stmt *sqlite.Stmt) error {
+				generation = uint64(stmt.GetInt64("generation"))
+
+				return nil
+			},
+		)
+	if err != nil {
+		if errors.Is(err, sqlitexx.ErrNoRows) {
+			return 0, fmt.Errorf("failed to get generation: %w", ErrNotFound(ptr))
+		}
+
+		return 0, fmt.Errorf("error querying resource generation %q: %w", ptr, err)
+	}
+
+	return generation, nil
+}
@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	ctrlconformance "github.com/cosi-project/runtime/pkg/controller/conformance"
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestGeneration(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := ctrlconformance.NewIntResource("default", "int", 1)
+
+		require.NoError(t, st.Create(ctx, res))
+
+		generation := func() uint64 {
+			g, err := st.GetGeneration(ctx, res.Metadata())
+			require.NoError(t, err)
+
+			return g
+		}
+
+		assert.EqualValues(t, 1, generation())
+
+		ch := make(chan state.Event, 2)
+
+		require.NoError(t, st.WatchKind(ctx, res.Metadata(), ch, sqlite.WithGenerationChanges()))
+
+		// metadata-only updates don't bump the generation
+		res.Metadata().Labels().Set("app", "foo")
+		require.NoError(t, st.Update(ctx, res))
+
+		res.Metadata().Finalizers().Add("controller")
+		require.NoError(t, st.Update(ctx, res))
+
+		assert.EqualValues(t, 1, generation())
+
+		res.SetValue(2)
+		require.NoError(t, st.Update(ctx, res))
+
+		assert.EqualValues(t, 2, generation())
+
+		raw, err := st.GetRaw(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, raw.Generation)
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Updated, ev.Type)
+			assert.Equal(t, 2, ev.Resource.(*ctrlconformance.IntResource).Value()) //nolint:forcetypeassert,errcheck
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// with label queries, the metadata-only update making the resource match is delivered
+		ch = make(chan state.Event, 2)
+
+		require.NoError(t, st.WatchKind(ctx, res.Metadata(), ch, sqlite.WithGenerationChanges(),
+			state.WatchWithLabelQuery(resource.LabelEqual("app", "bar"))))
+
+		res.Metadata().Labels().Set("app", "bar")
+		require.NoError(t, st.Update(ctx, res))
+
+		select {
+		case ev := <-ch:
+			assert.Equal(t, state.Created, ev.Type)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		assert.EqualValues(t, 2, generation())
+
+		_, err = st.GetGeneration(ctx, ctrlconformance.NewIntResource("default", "missing", 0).Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+	})
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// getCacheStats counts the hits and misses of the Get cache (see GetCacheSize).
+var getCacheStats expvar.Map
+
+func init() {
+	expvar.Publish("sqlite_state_get_cache", &getCacheStats)
+}
+
+type getCacheKey struct {
+	ns  resource.Namespace
+	typ resource.Type
+	id  resource.ID
+}
+
+type getCacheEntry struct {
+	res resource.Resource
+	key getCacheKey
+}
+
+// getCache is the LRU cache of the unmarshaled resources returned by Get.
+//
+// The entries are invalidated on the change notifications, so the cache is only coherent with the writes
+// which notify the state: the writes via the state itself, and the external changes if they are polled.
+type getCache struct {
+	entries map[getCacheKey]*list.Element
+	lru     *list.List
+	size    int
+
+	// generation is bumped on every invalidation, a resource read before the invalidation is not cached
+	generation uint64
+
+	mu sync.Mutex
+}
+
+func newGetCache(size int) *getCache {
+	return &getCache{
+		entries: map[getCacheKey]*list.Element{},
+		lru:     list.New(),
+		size:    size,
+	}
+}
+
+// get returns a copy of the cached resource, or the generation to pass to put on a miss.
+func (c *getCache) get(ptr resource.Pointer) (resource.Resource, uint64, bool) {
+	c.mu.Lock()
+
+	elem, ok := c.entries[getCacheKey{ns: ptr.Namespace(), typ: ptr.Type(), id: ptr.ID()}]
+	if !ok {
+		generation := c.generation
+
+		c.mu.Unlock()
+
+		getCacheStats.Add("misses", 1)
+
+		return nil, generation, false
+	}
+
+	c.lru.MoveToFront(elem)
+	res := elem.Value.(*getCacheEntry).res //nolint:forcetypeassert,errcheck
+
+	c.mu.Unlock()
+
+	getCacheStats.Add("hits", 1)
+
+	// the callers are free to modify the returned resource
+	return res.DeepCopy(), 0, true
+}
+
+// put caches a copy of the resource read at the generation, unless it was invalidated since.
+func (c *getCache) put(res resource.Resource, generation uint64) {
+	entry := &getCacheEntry{
+		key: getCacheKey{ns: res.Metadata().Namespace(), typ: res.Metadata().Type(), id: res.Metadata().ID()},
+		res: res.DeepCopy(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*getCacheEntry).key) //nolint:forcetypeassert,errcheck
+	}
+}
+
+// invalidate drops the cached resource, a pointer with an empty ID drops all resources of the kind.
+func (c *getCache) invalidate(ptr resource.Pointer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if ptr.ID() != "" {
+		key := getCacheKey{ns: ptr.Namespace(), typ: ptr.Type(), id: ptr.ID()}
+
+		if elem, ok := c.entries[key]; ok {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+
+		return
+	}
+
+	for key, elem := range c.entries {
+		if key.ns == ptr.Namespace() && (ptr.Type() == "" || key.typ == ptr.Type()) {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
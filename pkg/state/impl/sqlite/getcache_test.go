@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+// countingMarshaler counts the unmarshaled resources.
+type countingMarshaler struct {
+	store.ProtobufMarshaler
+
+	unmarshaled *atomic.Int64
+}
+
+func (m countingMarshaler) UnmarshalResource(b []byte) (resource.Resource, error) { //nolint:ireturn
+	m.unmarshaled.Add(1)
+
+	return m.ProtobufMarshaler.UnmarshalResource(b)
+}
+
+func TestGetCache(t *testing.T) {
+	t.Parallel()
+
+	var unmarshaled atomic.Int64
+
+	withSqliteMarshaler(t, countingMarshaler{unmarshaled: &unmarshaled}, func(st *sqlite.State) {
+		ctx := t.Context()
+		s := state.WrapCore(st)
+
+		res := conformance.NewPathResource("default", "path")
+
+		require.NoError(t, s.Create(ctx, res))
+
+		hits := func() int64 {
+			v, _ := expvar.Get("sqlite_state_get_cache").(*expvar.Map).Get("hits").(*expvar.Int) //nolint:errcheck
+			if v == nil {
+				return 0
+			}
+
+			return v.Value()
+		}
+
+		_, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+
+		before, hitsBefore := unmarshaled.Load(), hits()
+
+		got, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, before, unmarshaled.Load(), "the cached resource should not be unmarshaled")
+		assert.Greater(t, hits(), hitsBefore)
+
+		// the returned resource is a copy
+		got.Metadata().Labels().Set("modified", "true")
+
+		got, err = st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.True(t, got.Metadata().Labels().Empty())
+
+		// the update invalidates the entry
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, s.Update(ctx, res))
+
+		got, err = st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, res.Metadata().Version(), got.Metadata().Version())
+
+		require.NoError(t, s.Destroy(ctx, res.Metadata()))
+
+		_, err = st.Get(ctx, res.Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+
+		// the import invalidates the whole kind
+		for i := range 3 {
+			require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", strconv.Itoa(i))))
+
+			_, err = st.Get(ctx, conformance.NewPathResource("default", strconv.Itoa(i)).Metadata())
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, st.Import(ctx, []resource.Resource{conformance.NewPathResource("default", "path")}))
+
+		_, err = st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+
+		// the least recently used entries are evicted
+		before = unmarshaled.Load()
+
+		for i := range 3 {
+			_, err = st.Get(ctx, conformance.NewPathResource("default", strconv.Itoa(i)).Metadata())
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, before+3, unmarshaled.Load())
+
+		before = unmarshaled.Load()
+
+		_, err = st.Get(ctx, conformance.NewPathResource("default", "2").Metadata())
+		require.NoError(t, err)
+
+		_, err = st.Get(ctx, conformance.NewPathResource("default", "path").Metadata())
+		require.NoError(t, err)
+
+		assert.Equal(t, before+1, unmarshaled.Load())
+	}, sqlite.WithGetCacheSize(2))
+}
@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// buryResource copies the resource to the graveyard table.
+//
+// It should be called within the transaction deleting the resource, before the deletion.
+func (st *State) buryResource(conn *sqlite.Conn, ptr resource.Pointer) error {
+	if st.options.GraveyardRetention <= 0 {
+		return nil
+	}
+
+	q, err := sqlitexx.NewQuery(conn,
+		`INSERT OR REPLACE INTO `+st.options.TablePrefix+`graveyard (namespace, type, id, version, destroyed_at, spec)
+		SELECT namespace, type, id, version, $destroyed_at, spec FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing graveyard statement: %w", err)
+	}
+
+	if err = q.
+		BindInt64("$destroyed_at", time.Now().Unix()).
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		Exec(); err != nil {
+		return fmt.Errorf("error copying %q to the graveyard: %w", ptr, err)
+	}
+
+	return nil
+}
+
+// pruneGraveyard removes the destroyed resources older than the retention period.
+func (st *State) pruneGraveyard(ctx context.Context) (int, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error taking connection for graveyard pruning: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(conn, `DELETE FROM `+st.options.TablePrefix+`graveyard WHERE destroyed_at < $cutoff`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing graveyard pruning statement: %w", err)
+	}
+
+	if err = q.BindInt64("$cutoff", time.Now().Add(-st.options.GraveyardRetention).Unix()).Exec(); err != nil {
+		return 0, fmt.Errorf("error pruning graveyard: %w", err)
+	}
+
+	return conn.Changes(), nil
+}
+
+// Recover creates again the destroyed resource from the graveyard (see WithGraveyardRetention).
+//
+// The resource is recreated with the spec, labels, finalizers and owner it had when destroyed,
+// the version continues from the destroyed one. The recovered resource is returned.
+// If the resource is not in the graveyard, a NotFound error is returned; if a resource with the same ID
+// exists, a Conflict error is returned.
+func (st *State) Recover(ctx context.Context, ptr resource.Pointer) (resource.Resource, error) {
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to recover: %w", err)
+	}
+
+	var (
+		spec    []byte
+		version int64
+	)
+
+	err := func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for recover: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		q, err := sqlitexx.NewQuery(conn,
+			`SELECT version, spec FROM `+st.options.TablePrefix+`graveyard
+			WHERE namespace = $namespace AND type = $type AND id = $id`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for graveyard: %w", err)
+		}
+
+		return q.
+			BindString("$namespace", ptr.Namespace()).
+			BindString("$type", ptr.Type()).
+			BindString("$id", ptr.ID()).
+			QueryRow(func(stmt *sqlite.Stmt) error {
+				version = stmt.GetInt64("version")
+				spec = make([]byte, stmt.GetLen("spec"))
+				stmt.GetBytes("spec", spec)
+
+				return nil
+			})
+	}()
+	if err != nil {
+		if errors.Is(err, sqlitexx.ErrNoRows) {
+			return nil, fmt.Errorf("failed to recover: %w", ErrNotFound(ptr))
+		}
+
+		return nil, fmt.Errorf("error querying graveyard for %q: %w", ptr, err)
+	}
+
+	res, err := st.unmarshalResource(spec, state.UnmarshalOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resource %q: %w", ptr, err)
+	}
+
+	// the graveyard entry is removed in the same transaction as the resource is created,
+	// unless the resource was buried again since it was read
+	removeBuried := func(conn *sqlite.Conn) error {
+		q, err := sqlitexx.NewQuery(conn,
+			`DELETE FROM `+st.options.TablePrefix+`graveyard
+			WHERE namespace = $namespace AND type = $type AND id = $id AND version = $version`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing graveyard statement: %w", err)
+		}
+
+		if err = q.
+			BindString("$namespace", ptr.Namespace()).
+			BindString("$type", ptr.Type()).
+			BindString("$id", ptr.ID()).
+			BindInt64("$version", version).
+			Exec(); err != nil {
+			return fmt.Errorf("error removing %q from the graveyard: %w", ptr, err)
+		}
+
+		if conn.Changes() != 1 {
+			return eConflict{
+				error:    fmt.Errorf("resource %s was destroyed again while being recovered", ptr),
+				resource: ptr,
+			}
+		}
+
+		return nil
+	}
+
+	if err = st.create(ctx, res, state.CreateOptions{Owner: res.Metadata().Owner()}, removeBuried); err != nil {
+		return nil, fmt.Errorf("failed to recover: %w", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestGraveyard(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("ctrl")))
+		require.NoError(t, st.Update(ctx, res, state.WithUpdateOwner("ctrl")))
+		require.NoError(t, st.Destroy(ctx, res.Metadata(), state.WithDestroyOwner("ctrl")))
+
+		// not expired yet
+		pruned, err := st.PruneGraveyard(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, pruned)
+
+		recovered, err := st.Recover(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, "3", recovered.Metadata().Version().String())
+
+		got, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, "ctrl", got.Metadata().Owner())
+		assert.Equal(t, "3", got.Metadata().Version().String())
+
+		label, _ := got.Metadata().Labels().Get("app")
+		assert.Equal(t, "foo", label)
+
+		// the resource is removed from the graveyard on recovery
+		_, err = st.Recover(ctx, res.Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+
+		// a resource with the same ID is created after destroy
+		require.NoError(t, st.Destroy(ctx, res.Metadata(), state.WithDestroyOwner("ctrl")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "a")))
+
+		_, err = st.Recover(ctx, res.Metadata())
+		assert.True(t, state.IsConflictError(err))
+	}, sqlite.WithGraveyardRetention(time.Hour))
+}
+
+func TestGraveyardDisabled(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+
+		require.NoError(t, st.Create(ctx, res))
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		_, err := st.Recover(ctx, res.Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+	})
+}
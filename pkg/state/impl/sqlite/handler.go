@@ -0,0 +1,310 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// HealthReport is the result of the state health check, see Health.
+type HealthReport struct {
+	// LastCompaction is the time the last compaction finished.
+	LastCompaction time.Time `json:"last_compaction,omitzero"`
+
+	// Error is the error of the database check, the state is unhealthy if it's set.
+	Error string `json:"error,omitempty"`
+
+	// CompactionError is the error of the last compaction.
+	//
+	// A failed compaction doesn't make the state unhealthy, it's retried on the next interval.
+	CompactionError string `json:"compaction_error,omitempty"`
+
+	// LastEventID is the ID of the latest event in the log.
+	LastEventID int64 `json:"last_event_id"`
+
+	// Healthy is true if the database can be queried.
+	Healthy bool `json:"healthy"`
+
+	// Leader is true if the state holds the ownership lease (or ownership is disabled), see IsLeader.
+	Leader bool `json:"leader"`
+}
+
+// WatchInfo describes an active watch, see Watches.
+type WatchInfo struct {
+	Namespace resource.Namespace `json:"namespace"`
+	Type      resource.Type      `json:"type"`
+
+	// ID is the watched resource, empty for the kind watches.
+	ID resource.ID `json:"id,omitempty"`
+
+	// EventID is the ID of the last event consumed by the watch.
+	EventID int64 `json:"event_id"`
+
+	// Lag is the number of events written after the last event consumed by the watch (of any kind).
+	Lag int64 `json:"lag"`
+
+	// Expired is true if the watch fell behind the compaction, and is being terminated.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// Health checks that the database can be queried, and reports the state of the background tasks.
+func (st *State) Health(ctx context.Context) HealthReport {
+	compaction := st.CompactionStatus()
+
+	report := HealthReport{
+		LastCompaction: compaction.LastFinished,
+		Leader:         st.IsLeader(),
+	}
+
+	if compaction.LastError != nil {
+		report.CompactionError = compaction.LastError.Error()
+	}
+
+	eventID, err := st.queryLastEventID(ctx)
+	if err != nil {
+		report.Error = err.Error()
+
+		return report
+	}
+
+	report.LastEventID = eventID
+	report.Healthy = true
+
+	return report
+}
+
+// Watches returns the active watches, ordered by the namespace, type and ID.
+func (st *State) Watches(ctx context.Context) ([]WatchInfo, error) {
+	lastEventID, err := st.queryLastEventID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st.watchesMu.Lock()
+
+	watches := make([]WatchInfo, 0, len(st.watches))
+
+	for pos := range st.watches {
+		watches = append(watches, WatchInfo{
+			Namespace: pos.namespace,
+			Type:      pos.typ,
+			ID:        pos.id,
+			EventID:   pos.eventID.Load(),
+			Expired:   pos.expired.Load(),
+		})
+	}
+
+	st.watchesMu.Unlock()
+
+	for i := range watches {
+		watches[i].Lag = max(lastEventID-watches[i].EventID, 0)
+	}
+
+	slices.SortFunc(watches, func(a, b WatchInfo) int {
+		return cmp.Or(
+			cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.Type, b.Type),
+			cmp.Compare(a.ID, b.ID),
+			cmp.Compare(a.EventID, b.EventID),
+		)
+	})
+
+	return watches, nil
+}
+
+func (st *State) queryLastEventID(ctx context.Context) (int64, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("taking connection for health check: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	return st.lastEventID(conn)
+}
+
+// Handler returns the HTTP handler serving the state statistics, so that the embedders get observability
+// without wiring a metrics library.
+//
+// The handler serves the following paths (relative to where it's mounted, e.g. with http.StripPrefix):
+//   - /stats: Stats as JSON;
+//   - /health: Health as JSON, with the 503 status if the state is unhealthy;
+//   - /watches: Watches as JSON;
+//   - /metrics: the statistics in the Prometheus text format (or OpenMetrics, if the scraper accepts it).
+func (st *State) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, st.Stats())
+	})
+
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, req *http.Request) {
+		report := st.Health(req.Context())
+
+		status := http.StatusOK
+		if !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+
+	mux.HandleFunc("GET /watches", func(w http.ResponseWriter, req *http.Request) {
+		watches, err := st.Watches(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, watches)
+	})
+
+	mux.HandleFunc("GET /metrics", st.serveMetrics)
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data) //nolint:errcheck
+}
+
+// serveMetrics writes the gauges in the Prometheus text exposition format, which is also valid OpenMetrics
+// once terminated with the EOF marker.
+func (st *State) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	health := st.Health(req.Context())
+	stats := st.Stats()
+	compaction := st.CompactionStatus()
+
+	var mw metricsWriter
+
+	mw.gauge("sqlite_state_up", "Whether the database can be queried.", metricSample{value: boolMetric(health.Healthy)})
+	mw.gauge("sqlite_state_leader", "Whether the state holds the ownership lease.", metricSample{value: boolMetric(health.Leader)})
+
+	if health.Healthy {
+		mw.gauge("sqlite_state_last_event_id", "ID of the latest event in the log.", metricSample{value: float64(health.LastEventID)})
+	}
+
+	mw.gauge("sqlite_state_watches", "Number of active watches.", metricSample{value: float64(stats.Watches)})
+
+	if watches, err := st.Watches(req.Context()); err == nil {
+		var maxLag int64
+
+		for _, watch := range watches {
+			maxLag = max(maxLag, watch.Lag)
+		}
+
+		mw.gauge("sqlite_state_watch_max_lag_events", "Number of events the slowest watch is behind.", metricSample{value: float64(maxLag)})
+	}
+
+	eventRates := make([]metricSample, 0, len(stats.Kinds))
+	externalRates := make([]metricSample, 0, len(stats.Kinds))
+
+	for _, kind := range stats.Kinds {
+		labels := []string{"namespace", kind.Namespace, "type", kind.Type}
+
+		eventRates = append(eventRates, metricSample{labels: labels, value: kind.EventRate})
+		externalRates = append(externalRates, metricSample{labels: labels, value: kind.ExternalEventRate})
+	}
+
+	mw.gauge("sqlite_state_event_rate", "Rate of the events written via the state, in events per second.", eventRates...)
+
+	if st.options.ExternalChangesPollInterval > 0 {
+		mw.gauge("sqlite_state_external_event_rate", "Rate of the resources changed outside of the state, in events per second.", externalRates...)
+	}
+
+	mw.gauge("sqlite_state_compaction_running", "Whether a compaction is running.", metricSample{value: boolMetric(compaction.Running())})
+
+	if !compaction.LastFinished.IsZero() {
+		mw.gauge("sqlite_state_last_compaction_timestamp_seconds", "Time the last compaction finished.",
+			metricSample{value: float64(compaction.LastFinished.UnixMilli()) / 1000})
+		mw.gauge("sqlite_state_last_compaction_success", "Whether the last compaction succeeded.",
+			metricSample{value: boolMetric(compaction.LastError == nil)})
+	}
+
+	if compaction.LastInfo != nil {
+		mw.gauge("sqlite_state_compaction_remaining_events", "Number of events left after the last compaction.",
+			metricSample{value: float64(compaction.LastInfo.RemainingEvents)})
+	}
+
+	contentType := "text/plain; version=0.0.4; charset=utf-8"
+
+	if strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+		contentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+		mw.buf.WriteString("# EOF\n")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(mw.buf.Bytes()) //nolint:errcheck
+}
+
+// metricSample is a sample of a metric, labels are the pairs of the label names and values.
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricsWriter) gauge(name, help string, samples ...metricSample) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+
+	for _, sample := range samples {
+		mw.buf.WriteString(name)
+
+		for i := 0; i+1 < len(sample.labels); i += 2 {
+			if i == 0 {
+				mw.buf.WriteByte('{')
+			} else {
+				mw.buf.WriteByte(',')
+			}
+
+			fmt.Fprintf(&mw.buf, "%s=\"%s\"", sample.labels[i], escapeLabelValue(sample.labels[i+1]))
+		}
+
+		if len(sample.labels) > 1 {
+			mw.buf.WriteByte('}')
+		}
+
+		mw.buf.WriteByte(' ')
+		mw.buf.WriteString(strconv.FormatFloat(sample.value, 'g', -1, 64))
+		mw.buf.WriteByte('\n')
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func boolMetric(v bool) float64 {
+	if v {
+		return 1
+	}
+
+	return 0
+}
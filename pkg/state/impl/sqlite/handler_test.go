@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "path")))
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("default", "").Metadata(), make(chan state.Event, 1)))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "path2")))
+
+		handler := st.Handler()
+
+		get := func(path, accept string) *httptest.ResponseRecorder {
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+			req.Header.Set("Accept", accept)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			return rec
+		}
+
+		rec := get("/stats", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var stats sqlite.Stats
+
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+		assert.Equal(t, 1, stats.Watches)
+		require.NotEmpty(t, stats.Kinds)
+		assert.Equal(t, "default", stats.Kinds[0].Namespace)
+		assert.Contains(t, rec.Body.String(), `"event_rate":`)
+
+		rec = get("/health", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var health sqlite.HealthReport
+
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+		assert.True(t, health.Healthy)
+		assert.True(t, health.Leader)
+		assert.EqualValues(t, 2, health.LastEventID)
+
+		rec = get("/watches", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var watches []sqlite.WatchInfo
+
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &watches))
+		require.Len(t, watches, 1)
+		assert.Equal(t, conformance.PathResourceType, watches[0].Type)
+		assert.Empty(t, watches[0].ID)
+
+		rec = get("/metrics", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), "# TYPE sqlite_state_up gauge\nsqlite_state_up 1\n")
+		assert.Contains(t, rec.Body.String(), "sqlite_state_watches 1\n")
+		assert.Contains(t, rec.Body.String(), "sqlite_state_last_event_id 2\n")
+		assert.Contains(t, rec.Body.String(), `sqlite_state_event_rate{namespace="default",type="`+conformance.PathResourceType+`"} `)
+		assert.NotContains(t, rec.Body.String(), "# EOF")
+
+		rec = get("/metrics", "application/openmetrics-text; version=1.0.0")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), "\n# EOF\n")
+
+		rec = get("/unknown", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// VersionHistory configures the version history retention for a resource kind.
+type VersionHistory struct {
+	// Kind is the resource kind (namespace and type) to keep the history for.
+	Kind resource.Kind
+
+	// Keep is the number of previous versions to keep for each resource.
+	Keep int
+}
+
+// historyKeep returns the number of previous versions to keep for the resource kind.
+func (st *State) historyKeep(kind resource.Kind) int {
+	for _, history := range st.options.VersionHistory {
+		if history.Kind.Namespace() == kind.Namespace() && history.Kind.Type() == kind.Type() {
+			return history.Keep
+		}
+	}
+
+	return 0
+}
+
+// archiveVersion copies the current version of the resource to the versions table, and prunes the old versions.
+//
+// It should be called within the transaction updating or deleting the resource, before the change.
+// If the resource was destroyed and created again, the versions of the new resource replace
+// the archived versions with the same numbers.
+func (st *State) archiveVersion(conn *sqlite.Conn, ptr resource.Pointer) error {
+	keep := st.historyKeep(ptr)
+	if keep <= 0 {
+		return nil
+	}
+
+	q, err := sqlitexx.NewQuery(conn,
+		`INSERT OR REPLACE INTO `+st.options.TablePrefix+`versions (namespace, type, id, version, archived_at, spec)
+		SELECT namespace, type, id, version, $archived_at, spec FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing version archive statement: %w", err)
+	}
+
+	if err = q.
+		BindInt64("$archived_at", time.Now().Unix()).
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		Exec(); err != nil {
+		return fmt.Errorf("error archiving version of %q: %w", ptr, err)
+	}
+
+	q, err = sqlitexx.NewQuery(conn,
+		`DELETE FROM `+st.options.TablePrefix+`versions
+		WHERE namespace = $namespace AND type = $type AND id = $id AND version NOT IN (
+			SELECT version FROM `+st.options.TablePrefix+`versions
+			WHERE namespace = $namespace AND type = $type AND id = $id
+			ORDER BY version DESC
+			LIMIT $keep
+		)`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing version prune statement: %w", err)
+	}
+
+	if err = q.
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		BindInt("$keep", keep).
+		Exec(); err != nil {
+		return fmt.Errorf("error pruning versions of %q: %w", ptr, err)
+	}
+
+	return nil
+}
+
+// GetVersion returns the specific version of the resource.
+//
+// Previous versions are available for the kinds with version history enabled (see WithVersionHistory),
+// including the versions of destroyed resources.
+// If the version is neither the current one nor kept in the history, a NotFound error is returned.
+func (st *State) GetVersion(ctx context.Context, ptr resource.Pointer, version resource.Version, opts ...state.GetOption) (resource.Resource, error) {
+	var options state.GetOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to get version: %w", err)
+	}
+
+	conn, err := st.readDB.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("taking connection for get version: %w", err)
+	}
+
+	defer st.readDB.Put(conn)
+
+	var spec []byte
+
+	q, err := sqlitexx.NewQuery(conn,
+		`SELECT spec FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id AND version = $version
+		UNION ALL
+		SELECT spec FROM `+st.options.TablePrefix+`versions
+		WHERE namespace = $namespace AND type = $type AND id = $id AND version = $version
+		LIMIT 1`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("preparing query for resource version %q: %w", ptr, err)
+	}
+
+	err = q.
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		BindUint64("$version", version.Value()).
+		QueryRow(
+			func(stmt *sqlite.Stmt) error {
+				spec = make([]byte, stmt.GetLen("spec"))
+				stmt.GetBytes("spec", spec)
+
+				return nil
+			},
+		)
+	if err != nil {
+		if errors.Is(err, sqlitexx.ErrNoRows) {
+			return nil, fmt.Errorf("failed to get version %s: %w", version, ErrNotFound(ptr))
+		}
+
+		return nil, fmt.Errorf("error querying resource version %q: %w", ptr, err)
+	}
+
+	res, err := st.unmarshalResource(spec, options.UnmarshalOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resource %q: %w", ptr, err)
+	}
+
+	return res, nil
+}
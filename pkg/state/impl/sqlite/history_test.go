@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestVersionHistory(t *testing.T) {
+	t.Parallel()
+
+	version := func(t *testing.T, v string) resource.Version {
+		t.Helper()
+
+		ver, err := resource.ParseVersion(v)
+		require.NoError(t, err)
+
+		return ver
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		other := conformance.NewPathResource("ns2", "a")
+
+		require.NoError(t, st.Create(ctx, res))
+		require.NoError(t, st.Create(ctx, other))
+
+		for range 4 {
+			res.Metadata().Labels().Set("version", res.Metadata().Version().Next().String())
+			require.NoError(t, st.Update(ctx, res))
+
+			require.NoError(t, st.Update(ctx, other))
+		}
+
+		// current version 5, versions 3 and 4 are kept
+		for _, v := range []string{"3", "4", "5"} {
+			got, err := st.GetVersion(ctx, res.Metadata(), version(t, v))
+			require.NoError(t, err, v)
+			assert.Equal(t, v, got.Metadata().Version().String())
+
+			label, _ := got.Metadata().Labels().Get("version")
+			assert.Equal(t, v, label)
+		}
+
+		for _, v := range []string{"1", "2", "6"} {
+			_, err := st.GetVersion(ctx, res.Metadata(), version(t, v))
+			assert.True(t, state.IsNotFoundError(err), v)
+		}
+
+		// history is not kept for other kinds
+		_, err := st.GetVersion(ctx, other.Metadata(), version(t, "4"))
+		assert.True(t, state.IsNotFoundError(err))
+
+		// the last version is kept after destroy
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		got, err := st.GetVersion(ctx, res.Metadata(), version(t, "5"))
+		require.NoError(t, err)
+		assert.Equal(t, "5", got.Metadata().Version().String())
+
+		_, err = st.GetVersion(ctx, res.Metadata(), version(t, "3"))
+		assert.True(t, state.IsNotFoundError(err))
+	}, sqlite.WithVersionHistory(conformance.NewPathResource("ns1", "").Metadata(), 2))
+}
@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"go.uber.org/zap"
+)
+
+// Operation is a resource mutation.
+type Operation int
+
+// Operations.
+const (
+	OperationCreate Operation = iota + 1
+	OperationUpdate
+	OperationDestroy
+)
+
+// String implements fmt.Stringer.
+func (op Operation) String() string {
+	switch op {
+	case OperationCreate:
+		return "create"
+	case OperationUpdate:
+		return "update"
+	case OperationDestroy:
+		return "destroy"
+	default:
+		return "unknown"
+	}
+}
+
+// Mutator normalizes the resource before it is written by Create or Update (e.g. sets default labels).
+//
+// The resource is passed as it is going to be stored (with the new version and timestamps),
+// the mutator might modify it in place, except for the namespace, type, ID and version.
+// Mutators are called before the validators. The metadata changes are reflected in the resource
+// passed to Create or Update (as the version is), the spec changes are only stored.
+type Mutator func(ctx context.Context, op Operation, res resource.Resource) error
+
+// mutate runs the mutators on the resource.
+func (st *State) mutate(ctx context.Context, op Operation, res resource.Resource) error {
+	if len(st.options.Mutators) == 0 {
+		return nil
+	}
+
+	md := res.Metadata()
+	ns, typ, id, version := md.Namespace(), md.Type(), md.ID(), md.Version()
+
+	for _, mutator := range st.options.Mutators {
+		if err := mutator(ctx, op, res); err != nil {
+			return fmt.Errorf("mutator failed on %s of resource %s: %w", op, md, err)
+		}
+	}
+
+	if md = res.Metadata(); md.Namespace() != ns || md.Type() != typ || md.ID() != id || !md.Version().Equal(version) {
+		return fmt.Errorf("mutator changed the identity or the version of resource %s/%s/%s", ns, typ, id)
+	}
+
+	return nil
+}
+
+// Validator checks the resource before it is written by Create or Update.
+//
+// The resource is passed as it is going to be stored (with the new version and timestamps),
+// and it must not be modified.
+// Validators are called inside the write transaction, so a rejected write leaves no trace
+// in the database; they should be fast, as they hold the database write lock.
+type Validator func(ctx context.Context, op Operation, res resource.Resource) error
+
+// validate runs the validators on the resource.
+func (st *State) validate(ctx context.Context, op Operation, res resource.Resource) error {
+	for _, validator := range st.options.Validators {
+		if err := validator(ctx, op, res); err != nil {
+			return ErrValidation(res.Metadata(), op, err)
+		}
+	}
+
+	return nil
+}
+
+// PostCommitHook is called after Create, Update or Destroy is committed and the watches are notified.
+//
+// For Destroy, the resource is a tombstone carrying the metadata of the destroyed resource.
+// The hooks are called synchronously by the goroutine doing the write, in the order of registration,
+// so they should be fast and must not modify the resource.
+type PostCommitHook func(op Operation, res resource.Resource)
+
+// runPostCommitHooks calls the post-commit hooks.
+func (st *State) runPostCommitHooks(op Operation, res resource.Resource) {
+	for _, hook := range st.options.PostCommitHooks {
+		hook(op, res)
+	}
+}
+
+// audit logs the committed write with the audit logger, if set.
+//
+// Each write bumps the version by one, so the version before an update is derived from the stored one.
+// For Destroy, md is the metadata of the destroyed resource (with the owner, unlike the tombstone passed to the hooks).
+func (st *State) audit(op Operation, md *resource.Metadata) {
+	if st.options.AuditLogger == nil {
+		return
+	}
+
+	var oldVersion, newVersion uint64
+
+	switch op {
+	case OperationCreate:
+		newVersion = md.Version().Value()
+	case OperationUpdate:
+		newVersion = md.Version().Value()
+		oldVersion = newVersion - 1
+	case OperationDestroy:
+		oldVersion = md.Version().Value()
+	}
+
+	st.options.AuditLogger.Info("resource write",
+		zap.String("op", op.String()),
+		zap.String("namespace", md.Namespace()),
+		zap.String("type", md.Type()),
+		zap.String("id", md.ID()),
+		zap.String("owner", md.Owner()),
+		zap.Uint64("old_version", oldVersion),
+		zap.Uint64("new_version", newVersion),
+	)
+}
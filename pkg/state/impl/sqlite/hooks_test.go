@@ -0,0 +1,215 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+var errFrozen = errors.New("resource is frozen")
+
+func TestValidator(t *testing.T) {
+	t.Parallel()
+
+	var ops []sqlite.Operation
+
+	validator := func(_ context.Context, op sqlite.Operation, res resource.Resource) error {
+		ops = append(ops, op)
+
+		if _, frozen := res.Metadata().Labels().Get("frozen"); frozen && op == sqlite.OperationUpdate {
+			return errFrozen
+		}
+
+		if _, invalid := res.Metadata().Labels().Get("invalid"); invalid {
+			return errors.New("invalid resource")
+		}
+
+		return nil
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		invalid := conformance.NewPathResource("ns1", "invalid")
+		invalid.Metadata().Labels().Set("invalid", "")
+
+		err := st.Create(ctx, invalid)
+		require.Error(t, err)
+		assert.True(t, sqlite.IsValidationError(err))
+		assert.ErrorContains(t, err, "create of resource")
+
+		_, err = st.Get(ctx, invalid.Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+
+		res := conformance.NewPathResource("ns1", "a")
+		res.Metadata().Labels().Set("frozen", "")
+
+		require.NoError(t, st.Create(ctx, res))
+
+		err = st.Update(ctx, res)
+		require.Error(t, err)
+		assert.True(t, sqlite.IsValidationError(err))
+		assert.ErrorIs(t, err, errFrozen)
+
+		current, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, res.Metadata().Version(), current.Metadata().Version())
+
+		assert.Equal(t, []sqlite.Operation{sqlite.OperationCreate, sqlite.OperationCreate, sqlite.OperationUpdate}, ops)
+	}, sqlite.WithValidator(validator))
+}
+
+func TestPostCommitHook(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+
+	hook := func(op sqlite.Operation, res resource.Resource) {
+		events = append(events, fmt.Sprintf("%s %s %s tombstone=%v", op, res.Metadata().ID(), res.Metadata().Version(), resource.IsTombstone(res)))
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+
+		require.NoError(t, st.Create(ctx, res))
+		require.NoError(t, st.Update(ctx, res))
+		require.Error(t, st.Update(ctx, conformance.NewPathResource("ns1", "b")))
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		assert.Equal(t, []string{
+			"create a 1 tombstone=false",
+			"update a 2 tombstone=false",
+			"destroy a 2 tombstone=true",
+		}, events)
+	}, sqlite.WithPostCommitHook(hook))
+}
+
+func TestAuditLogger(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("owner")))
+		require.NoError(t, st.Update(ctx, res, state.WithUpdateOwner("owner")))
+		require.Error(t, st.Update(ctx, conformance.NewPathResource("ns1", "b")))
+		require.NoError(t, st.Destroy(ctx, res.Metadata(), state.WithDestroyOwner("owner")))
+
+		entries := logs.FilterMessage("resource write").All()
+		require.Len(t, entries, 3)
+
+		for i, expected := range []map[string]any{
+			{"op": "create", "old_version": uint64(0), "new_version": uint64(1)},
+			{"op": "update", "old_version": uint64(1), "new_version": uint64(2)},
+			{"op": "destroy", "old_version": uint64(2), "new_version": uint64(0)},
+		} {
+			fields := entries[i].ContextMap()
+
+			for key, value := range expected {
+				assert.Equal(t, value, fields[key], "%d: %s", i, key)
+			}
+
+			assert.Equal(t, "ns1", fields["namespace"])
+			assert.Equal(t, conformance.PathResourceType, fields["type"])
+			assert.Equal(t, "a", fields["id"])
+			assert.Equal(t, "owner", fields["owner"], "%d", i)
+			assert.NotContains(t, fields, "spec")
+		}
+	}, sqlite.WithAuditLogger(zap.New(core)))
+}
+
+func TestAuditLoggerImport(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		res := conformance.NewPathResource("ns1", "a")
+		res.Metadata().SetOwner("owner")
+
+		require.NoError(t, st.Import(t.Context(), []resource.Resource{res, conformance.NewPathResource("ns1", "b")}))
+
+		entries := logs.FilterMessage("resource write").All()
+		require.Len(t, entries, 2)
+
+		for i, id := range []string{"a", "b"} {
+			fields := entries[i].ContextMap()
+
+			assert.Equal(t, "create", fields["op"])
+			assert.Equal(t, id, fields["id"])
+			assert.Equal(t, uint64(1), fields["new_version"])
+		}
+
+		assert.Equal(t, "owner", entries[0].ContextMap()["owner"])
+	}, sqlite.WithAuditLogger(zap.New(core)))
+}
+
+func TestMutator(t *testing.T) {
+	t.Parallel()
+
+	defaults := func(_ context.Context, op sqlite.Operation, res resource.Resource) error {
+		if _, ok := res.Metadata().Labels().Get("managed-by"); !ok {
+			res.Metadata().Labels().Set("managed-by", "sqlite-state")
+		}
+
+		if op == sqlite.OperationUpdate {
+			res.Metadata().Labels().Set("updated", "true")
+		}
+
+		return nil
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+
+		require.NoError(t, st.Create(ctx, res))
+		assert.Equal(t, map[string]string{"managed-by": "sqlite-state"}, res.Metadata().Labels().Raw())
+
+		stored, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"managed-by": "sqlite-state"}, stored.Metadata().Labels().Raw())
+
+		res.Metadata().Labels().Delete("managed-by")
+
+		require.NoError(t, st.Update(ctx, res))
+
+		list, err := st.List(ctx, res.Metadata(), state.WithLabelQuery(resource.LabelEqual("updated", "true")))
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, map[string]string{"managed-by": "sqlite-state", "updated": "true"}, list.Items[0].Metadata().Labels().Raw())
+	}, sqlite.WithMutator(defaults))
+
+	renaming := func(_ context.Context, _ sqlite.Operation, res resource.Resource) error {
+		*res.Metadata() = resource.NewMetadata(res.Metadata().Namespace(), res.Metadata().Type(), "other", res.Metadata().Version())
+
+		return nil
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		require.ErrorContains(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "a")), "changed the identity")
+	}, sqlite.WithMutator(renaming))
+}
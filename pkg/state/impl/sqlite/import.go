@@ -0,0 +1,264 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// resyncEventType is the event_type of the marker written by Import instead of the create events.
+const resyncEventType = 5
+
+// importedResource is a resource prepared for Import.
+type importedResource struct {
+	res        resource.Resource
+	labels     []byte
+	finalizers []byte
+	spec       []byte
+}
+
+// Import creates the resources without generating an event for each of them.
+//
+// It is intended for the initial seeding and restores of tens of thousands of resources,
+// which would otherwise flood the events table. The resources are created as by Create
+// (with the owner set in their metadata), the mutators and validators are run, the post-commit hooks are not.
+// All resources are written in a single transaction: if any of them already exists, nothing is written.
+//
+// Instead of the create events, a single resync marker is written for each imported resource kind.
+// The kind watches and the resource watches (Watch) of the kind receive it as an Errored event with the error
+// matching IsResyncRequiredError, they should be restarted to list (or get) the resources again.
+func (st *State) Import(ctx context.Context, resources []resource.Resource) (err error) {
+	defer st.convertCanceled(ctx, &err)
+
+	var (
+		imported = make([]importedResource, 0, len(resources))
+		kinds    []resource.Kind
+		seen     = map[kindKey]struct{}{}
+		size     int
+		now      = time.Now()
+	)
+
+	for _, res := range resources {
+		if err := st.checkNamespace(res.Metadata().Namespace()); err != nil {
+			return fmt.Errorf("failed to import: %w", err)
+		}
+
+		resCopy := res.DeepCopy()
+
+		resCopy.Metadata().SetCreated(now)
+		resCopy.Metadata().SetVersion(resCopy.Metadata().Version().Next())
+
+		if err := st.mutate(ctx, OperationCreate, resCopy); err != nil {
+			return fmt.Errorf("failed to import: %w", err)
+		}
+
+		item := importedResource{res: resCopy}
+
+		var err error
+
+		if !resCopy.Metadata().Labels().Empty() {
+			if item.labels, err = json.Marshal(resCopy.Metadata().Labels().Raw()); err != nil {
+				return fmt.Errorf("failed to marshal labels: %w", err)
+			}
+		}
+
+		if !resCopy.Metadata().Finalizers().Empty() {
+			if item.finalizers, err = json.Marshal(resCopy.Metadata().Finalizers()); err != nil {
+				return fmt.Errorf("failed to marshal finalizers: %w", err)
+			}
+		}
+
+		if item.spec, err = st.marshalResource(resCopy); err != nil {
+			return fmt.Errorf("failed to marshal resource: %w", err)
+		}
+
+		imported = append(imported, item)
+		size += len(item.spec) + len(item.labels) + len(item.finalizers)
+
+		key := kindKey{ns: resCopy.Metadata().Namespace(), typ: resCopy.Metadata().Type()}
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+
+			kinds = append(kinds, resCopy.Metadata())
+		}
+	}
+
+	if len(imported) == 0 {
+		return nil
+	}
+
+	unlock, err := st.lockKinds(ctx, slices.Collect(maps.Keys(seen)))
+	if err != nil {
+		return fmt.Errorf("failed to import: %w", err)
+	}
+
+	defer unlock()
+
+	// the resync markers are accounted before they are committed, see externalChanges
+	for _, kind := range kinds {
+		st.localEvents.Add(kind, 1)
+	}
+
+	err = func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for import: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		doneFn, err := sqlitexx.BeginWithRetry(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("starting transaction for import: %w", err)
+		}
+
+		defer doneFn(&err)
+
+		if err = st.checkWrite(conn, size); err != nil {
+			return fmt.Errorf("failed to import: %w", err)
+		}
+
+		return st.importResources(ctx, conn, imported, kinds)
+	}()
+	if err != nil {
+		for _, kind := range kinds {
+			st.localEvents.Add(kind, -1)
+		}
+
+		return err
+	}
+
+	st.recordWrite("import", int64(size), int64(len(imported)))
+
+	for _, item := range imported {
+		st.audit(OperationCreate, item.res.Metadata())
+	}
+
+	for _, kind := range kinds {
+		md := resource.NewMetadata(kind.Namespace(), kind.Type(), "", resource.VersionUndefined)
+
+		st.notify(ctx, &md)
+	}
+
+	// the statistics of the query planner are refreshed for the imported rows
+	if optimizeErr := st.Optimize(ctx); optimizeErr != nil {
+		st.options.Logger.Warn("failed to optimize database after import", zap.Error(optimizeErr))
+	}
+
+	for i, res := range resources {
+		// This should be safe, because we don't allow to share metadata between goroutines even for read-only
+		// purposes.
+		*res.Metadata() = *imported[i].res.Metadata()
+	}
+
+	return nil
+}
+
+// importResources writes the resources and the resync markers within the import transaction.
+//
+// The insert trigger is dropped for the duration of the transaction, and it is created again as it was,
+// so other connections never observe the database without it.
+func (st *State) importResources(ctx context.Context, conn *sqlite.Conn, imported []importedResource, kinds []resource.Kind) error {
+	trigger := `trg_` + st.options.TablePrefix + `resources_after_insert`
+
+	var triggerSQL string
+
+	if err := sqlitex.ExecuteTransient(conn, `SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?`, &sqlitex.ExecOptions{
+		Args: []any{trigger},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			triggerSQL = stmt.ColumnText(0)
+
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("querying the insert trigger for import: %w", err)
+	}
+
+	if triggerSQL == "" {
+		return fmt.Errorf("insert trigger %q is missing", trigger)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, `DROP TRIGGER `+trigger, nil); err != nil {
+		return fmt.Errorf("disabling events for import: %w", err)
+	}
+
+	for _, item := range imported {
+		if err := st.validate(ctx, OperationCreate, item.res); err != nil {
+			return fmt.Errorf("failed to import: %w", err)
+		}
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`INSERT INTO `+st.options.TablePrefix+`resources
+			(namespace, type, id, version, created_at, updated_at, labels, finalizers, phase, owner, spec)
+			VALUES
+			($namespace, $type, $id, $version, $created_at, $updated_at, jsonb($labels), jsonb($finalizers), $phase, $owner, $spec)`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing insert statement: %w", err)
+		}
+
+		md := item.res.Metadata()
+
+		if err = q.
+			BindString("$namespace", md.Namespace()).
+			BindString("$type", md.Type()).
+			BindString("$id", md.ID()).
+			BindUint64("$version", md.Version().Value()).
+			BindInt64("$created_at", md.Created().Unix()).
+			BindInt64("$updated_at", md.Updated().Unix()).
+			BindBytes("$labels", item.labels).
+			BindBytes("$finalizers", item.finalizers).
+			BindInt("$phase", int(md.Phase())).
+			BindString("$owner", md.Owner()).
+			BindBytes("$spec", item.spec).
+			Exec(); err != nil {
+			if isUniqueViolationError(err) {
+				return ErrAlreadyExists(md)
+			}
+
+			return fmt.Errorf("inserting resource into database: %w", err)
+		}
+	}
+
+	for _, kind := range kinds {
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`INSERT INTO `+st.options.TablePrefix+`events (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
+			VALUES ($namespace, $type, '', unixepoch(), $event_type, NULL, NULL)`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing insert statement for resync marker: %w", err)
+		}
+
+		if err = q.
+			BindString("$namespace", kind.Namespace()).
+			BindString("$type", kind.Type()).
+			BindInt("$event_type", resyncEventType).
+			Exec(); err != nil {
+			return fmt.Errorf("inserting resync marker: %w", err)
+		}
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, triggerSQL, nil); err != nil {
+		return fmt.Errorf("enabling events after import: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithTablePrefix("test_"))
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	kind := conformance.NewPathResource("ns1", "").Metadata()
+
+	watchCh := make(chan state.Event, 16)
+
+	require.NoError(t, st.WatchKind(ctx, kind, watchCh))
+
+	resources := make([]resource.Resource, 0, 101)
+
+	for i := range 100 {
+		resources = append(resources, conformance.NewPathResource("ns1", strconv.Itoa(i)))
+	}
+
+	resources = append(resources, conformance.NewPathResource("ns2", "other"))
+
+	require.NoError(t, st.Import(ctx, resources))
+
+	assert.Equal(t, "1", resources[0].Metadata().Version().String())
+
+	select {
+	case ev := <-watchCh:
+		require.Equal(t, state.Errored, ev.Type)
+		assert.True(t, sqlite.IsResyncRequiredError(ev.Error), "unexpected error: %v", ev.Error)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	items, err := st.List(ctx, kind)
+	require.NoError(t, err)
+	assert.Len(t, items.Items, 100)
+
+	countEvents := func() int64 {
+		conn, err := pool.Take(ctx)
+		require.NoError(t, err)
+
+		defer pool.Put(conn)
+
+		var count int64
+
+		require.NoError(t, sqlitex.ExecuteTransient(conn, `SELECT count(*) FROM test_events`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				count = stmt.ColumnInt64(0)
+
+				return nil
+			},
+		}))
+
+		return count
+	}
+
+	// a resync marker per kind
+	assert.EqualValues(t, 2, countEvents())
+
+	// a conflicting import is rolled back
+	err = st.Import(ctx, []resource.Resource{conformance.NewPathResource("ns1", "new"), conformance.NewPathResource("ns1", "0")})
+	require.Error(t, err)
+	assert.True(t, state.IsConflictError(err))
+
+	_, err = st.Get(ctx, conformance.NewPathResource("ns1", "new").Metadata())
+	assert.True(t, state.IsNotFoundError(err))
+
+	assert.EqualValues(t, 2, countEvents())
+
+	// the events are generated again after the import
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "new")))
+
+	assert.EqualValues(t, 3, countEvents())
+}
+
+func TestImportWatch(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "imported")
+
+		watchCh := make(chan state.Event, 4)
+
+		require.NoError(t, st.Watch(ctx, res.Metadata(), watchCh))
+
+		select {
+		case ev := <-watchCh:
+			require.Equal(t, state.Destroyed, ev.Type)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		require.NoError(t, st.Import(ctx, []resource.Resource{res}))
+
+		select {
+		case ev := <-watchCh:
+			require.Equal(t, state.Errored, ev.Type)
+			assert.True(t, sqlite.IsResyncRequiredError(ev.Error), "unexpected error: %v", ev.Error)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	})
+}
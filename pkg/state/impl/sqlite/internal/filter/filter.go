@@ -24,7 +24,12 @@ const (
 // some unsupported terms.
 // So the original filtering should still be applied after fetching results from the DB.
 func CompileLabelQueries(query resource.LabelQueries) string {
-	result := strings.Join(xslices.Map(query, CompileLabelQuery), " OR ")
+	return CompileLabelQueriesOn(query, "labels")
+}
+
+// CompileLabelQueriesOn compiles label query into sqlite condition on the labels stored in the column.
+func CompileLabelQueriesOn(query resource.LabelQueries, column string) string {
+	result := strings.Join(xslices.Map(query, func(q resource.LabelQuery) string { return compileLabelQuery(q, column) }), " OR ")
 
 	if result == "" {
 		return sqliteTrue
@@ -35,10 +40,14 @@ func CompileLabelQueries(query resource.LabelQueries) string {
 
 // CompileLabelQuery compiles a single label query into sqlite condition.
 func CompileLabelQuery(query resource.LabelQuery) string {
+	return compileLabelQuery(query, "labels")
+}
+
+func compileLabelQuery(query resource.LabelQuery, column string) string {
 	var terms []string
 
 	for _, t := range query.Terms {
-		compiledTerm := CompileLabelQueryTerm(t)
+		compiledTerm := compileLabelQueryTerm(t, column)
 		if compiledTerm != "" { // returns empty for unsupported terms.
 			terms = append(terms, "("+compiledTerm+")")
 		}
@@ -56,15 +65,39 @@ func quote(value string) string {
 	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
 }
 
+// labelSelector returns sqlite expression selecting the label value from the column.
+func labelSelector(column, key string) string {
+	// SQLite JSON path spec uses $."key" to access object fields.
+	return column + " ->> " + quote(`$."`+key+`"`)
+}
+
+// CompileLabelOrder compiles ordering by the label value into sqlite ORDER BY terms.
+//
+// Resources without the label are ordered last.
+// If the label key is not supported, empty string is returned.
+func CompileLabelOrder(key string) string {
+	if strings.ContainsRune(key, '"') {
+		// we can't support escaping double quote in JSON path in sqlite
+		return ""
+	}
+
+	selector := labelSelector("labels", key)
+
+	return selector + " IS NULL, " + selector
+}
+
 // CompileLabelQueryTerm compiles a single label query term into sqlite condition.
 func CompileLabelQueryTerm(term resource.LabelTerm) string {
+	return compileLabelQueryTerm(term, "labels")
+}
+
+func compileLabelQueryTerm(term resource.LabelTerm, column string) string {
 	if strings.ContainsRune(term.Key, '"') {
 		// we can't support escaping double quote in JSON path in sqlite
 		return ""
 	}
 
-	// SQLite JSON path spec uses $."key" to access object fields.
-	selector := "labels ->> " + quote(`$."`+term.Key+`"`)
+	selector := labelSelector(column, term.Key)
 
 	switch term.Op {
 	case resource.LabelOpExists:
@@ -190,3 +190,20 @@ func TestCompile(t *testing.T) {
 		})
 	}
 }
+
+func TestCompileOn(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, `((labels_before ->> '$."foo"' = 'bar'))`, filter.CompileLabelQueriesOn(resource.LabelQueries{
+		{Terms: []resource.LabelTerm{{Key: "foo", Op: resource.LabelOpEqual, Value: []string{"bar"}}}},
+	}, "labels_before"))
+	assert.Equal(t, "true", filter.CompileLabelQueriesOn(nil, "labels_before"))
+}
+
+func TestCompileLabelOrder(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, `labels ->> '$."foo"' IS NULL, labels ->> '$."foo"'`, filter.CompileLabelOrder("foo"))
+	assert.Equal(t, `labels ->> '$."it''s"' IS NULL, labels ->> '$."it''s"'`, filter.CompileLabelOrder("it's"))
+	assert.Empty(t, filter.CompileLabelOrder(`foo"bar`))
+}
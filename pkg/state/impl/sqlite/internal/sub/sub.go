@@ -6,6 +6,7 @@
 package sub
 
 import (
+	"context"
 	"slices"
 	"sync"
 
@@ -15,19 +16,45 @@ import (
 
 // Manager defines a subscription manager.
 type Manager struct {
-	subscriptions map[key][]chan struct{}
+	subscriptions map[key][]*subscription
 	mu            sync.Mutex
 }
 
+// key identifies a subscription.
+//
+// Empty fields act as wildcards: an empty ID matches all resources of the kind,
+// an empty type matches all types within the namespace, and an empty namespace
+// (with an empty type) matches all namespaces.
 type key struct {
 	ns  resource.Namespace
 	typ resource.Type
+	id  resource.ID
+}
+
+// matchingKeys returns all subscription keys which should be notified for the given key.
+func (k key) matchingKeys() []key {
+	// compact removes duplicates if the key itself is a wildcard
+	return slices.Compact([]key{
+		k,
+		{ns: k.ns, typ: k.typ},
+		{ns: k.ns},
+		{},
+	})
 }
 
 type subscription struct {
 	ch  chan struct{}
 	m   *Manager
 	key key
+
+	// ackCh is closed (and replaced) whenever the acknowledgement state changes.
+	ackCh        chan struct{}
+	notified     uint64
+	acked        uint64
+	mu           sync.Mutex
+	ack          bool
+	blocked      bool
+	unsubscribed bool
 }
 
 // Subscription is an active subscription interface.
@@ -35,53 +62,153 @@ type Subscription interface {
 	NotifyCh() <-chan struct{}
 	TriggerNotify()
 	Unsubscribe()
+
+	// Generation returns the number of notifications sent to the subscription so far.
+	//
+	// It should be read after receiving from NotifyCh and before processing the notification.
+	Generation() uint64
+	// Ack acknowledges that notifications up to the given generation have been processed.
+	Ack(gen uint64)
+	// SetBlocked marks the subscriber as blocked (e.g. on sending to a slow consumer).
+	//
+	// NotifyWait doesn't wait for blocked subscribers.
+	SetBlocked(blocked bool)
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscription)
+
+// WithAck makes NotifyWait wait for the subscriber to acknowledge notifications.
+func WithAck() SubscribeOption {
+	return func(s *subscription) {
+		s.ack = true
+	}
 }
 
 // NewManager creates a new subscription manager.
 func NewManager() *Manager {
 	return &Manager{
-		subscriptions: make(map[key][]chan struct{}),
+		subscriptions: make(map[key][]*subscription),
 	}
 }
 
 // Subscribe creates a new subscription for the given resource kind.
-func (m *Manager) Subscribe(resourceKind resource.Kind) Subscription {
+func (m *Manager) Subscribe(resourceKind resource.Kind, opts ...SubscribeOption) Subscription {
+	return m.subscribe(key{
+		ns:  resourceKind.Namespace(),
+		typ: resourceKind.Type(),
+	}, opts)
+}
+
+// SubscribeResource creates a new subscription for the single resource.
+//
+// The subscription is not notified about changes to other resources of the same kind,
+// but it is notified about the changes to the whole kind (see Notify).
+func (m *Manager) SubscribeResource(ptr resource.Pointer, opts ...SubscribeOption) Subscription {
+	return m.subscribe(key{
+		ns:  ptr.Namespace(),
+		typ: ptr.Type(),
+		id:  ptr.ID(),
+	}, opts)
+}
+
+// SubscribeNamespace creates a new subscription for all resource types in the given namespace.
+func (m *Manager) SubscribeNamespace(ns resource.Namespace, opts ...SubscribeOption) Subscription {
+	return m.subscribe(key{
+		ns: ns,
+	}, opts)
+}
+
+// SubscribeAll creates a new subscription for all resource kinds in all namespaces.
+func (m *Manager) SubscribeAll(opts ...SubscribeOption) Subscription {
+	return m.subscribe(key{}, opts)
+}
+
+func (m *Manager) subscribe(k key, opts []SubscribeOption) Subscription {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	k := key{
-		ns:  resourceKind.Namespace(),
-		typ: resourceKind.Type(),
+	s := &subscription{
+		ch:    make(chan struct{}, 1),
+		ackCh: make(chan struct{}),
+		key:   k,
+		m:     m,
 	}
 
-	ch := make(chan struct{}, 1)
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	m.subscriptions[k] = append(m.subscriptions[k], s)
+
+	return s
+}
 
-	m.subscriptions[k] = append(m.subscriptions[k], ch)
+// Notify notifies all subscribers about an event for the given resource.
+//
+// Subscribers of the resource kind and wildcard subscribers matching the resource are notified as well.
+// If the ID of the pointer is empty, the change is to the whole kind, and the subscribers
+// of the single resources of the kind are notified too.
+func (m *Manager) Notify(ptr resource.Pointer) {
+	m.notify(ptr)
+}
 
-	return &subscription{
-		ch:  ch,
-		key: k,
-		m:   m,
+// NotifyWait notifies all subscribers like Notify does, and waits for the subscribers
+// created with WithAck to acknowledge the notification.
+//
+// Waiting stops early if the context is canceled, the subscriber is blocked or unsubscribes.
+func (m *Manager) NotifyWait(ctx context.Context, ptr resource.Pointer) {
+	for _, n := range m.notify(ptr) {
+		if n.sub.ack {
+			n.sub.wait(ctx, n.gen)
+		}
 	}
 }
 
-// Notify notifies all subscribers about an event for the given resource kind.
-func (m *Manager) Notify(resourceKind resource.Kind) {
+type notification struct {
+	sub *subscription
+	gen uint64
+}
+
+func (m *Manager) notify(ptr resource.Pointer) []notification {
 	k := key{
-		ns:  resourceKind.Namespace(),
-		typ: resourceKind.Type(),
+		ns:  ptr.Namespace(),
+		typ: ptr.Type(),
+		id:  ptr.ID(),
 	}
 
+	var subs []*subscription
+
 	m.mu.Lock()
-	subs := slices.Clone(m.subscriptions[k])
-	m.mu.Unlock()
 
-	for _, ch := range subs {
-		select {
-		case ch <- struct{}{}:
-		default:
+	for _, mk := range k.matchingKeys() {
+		subs = append(subs, m.subscriptions[mk]...)
+	}
+
+	if k.id == "" && k.typ != "" {
+		for sk, resourceSubs := range m.subscriptions {
+			if sk.id != "" && sk.ns == k.ns && sk.typ == k.typ {
+				subs = append(subs, resourceSubs...)
+			}
 		}
 	}
+
+	m.mu.Unlock()
+
+	notifications := make([]notification, 0, len(subs))
+
+	for _, s := range subs {
+		s.mu.Lock()
+		s.notified++
+		gen := s.notified
+		s.mu.Unlock()
+
+		s.TriggerNotify()
+
+		notifications = append(notifications, notification{sub: s, gen: gen})
+	}
+
+	return notifications
 }
 
 // Empty checks whether there are any subscriptions.
@@ -92,6 +219,20 @@ func (m *Manager) Empty() bool {
 	return len(m.subscriptions) == 0
 }
 
+// Len returns the number of subscriptions.
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+
+	for _, subs := range m.subscriptions {
+		n += len(subs)
+	}
+
+	return n
+}
+
 // NotifyCh implements Subscription interface.
 func (s *subscription) NotifyCh() <-chan struct{} {
 	return s.ch
@@ -105,18 +246,77 @@ func (s *subscription) TriggerNotify() {
 	}
 }
 
+// Generation implements Subscription interface.
+func (s *subscription) Generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.notified
+}
+
+// Ack implements Subscription interface.
+func (s *subscription) Ack(gen uint64) {
+	s.update(func() {
+		s.acked = max(s.acked, gen)
+	})
+}
+
+// SetBlocked implements Subscription interface.
+func (s *subscription) SetBlocked(blocked bool) {
+	s.update(func() {
+		s.blocked = blocked
+	})
+}
+
 // Unsubscribe implements Subscription interface.
 func (s *subscription) Unsubscribe() {
 	s.m.mu.Lock()
-	defer s.m.mu.Unlock()
 
 	s.m.subscriptions[s.key] = xslices.FilterInPlace(s.m.subscriptions[s.key],
-		func(ch chan struct{}) bool {
-			return ch != s.ch
+		func(sub *subscription) bool {
+			return sub != s
 		},
 	)
 
 	if len(s.m.subscriptions[s.key]) == 0 {
 		delete(s.m.subscriptions, s.key)
 	}
+
+	s.m.mu.Unlock()
+
+	s.update(func() {
+		s.unsubscribed = true
+	})
+}
+
+// update changes acknowledgement state under the lock and wakes up the waiters.
+func (s *subscription) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn()
+
+	close(s.ackCh)
+	s.ackCh = make(chan struct{})
+}
+
+func (s *subscription) wait(ctx context.Context, gen uint64) {
+	for {
+		s.mu.Lock()
+
+		if s.acked >= gen || s.blocked || s.unsubscribed {
+			s.mu.Unlock()
+
+			return
+		}
+
+		ackCh := s.ackCh
+		s.mu.Unlock()
+
+		select {
+		case <-ackCh:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
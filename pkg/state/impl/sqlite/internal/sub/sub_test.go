@@ -6,6 +6,7 @@ package sub_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/cosi-project/runtime/pkg/resource"
 
@@ -20,6 +21,10 @@ func TestManager(t *testing.T) {
 	s1 := m.Subscribe(resource.NewMetadata("ns1", "t1", "", resource.VersionUndefined))
 	s2 := m.Subscribe(resource.NewMetadata("ns1", "t1", "", resource.VersionUndefined))
 
+	if m.Len() != 2 {
+		t.Fatalf("expected 2 subscriptions, got %d", m.Len())
+	}
+
 	select {
 	case <-s1.NotifyCh():
 		t.Fatal("unexpected notification")
@@ -55,6 +60,10 @@ func TestManager(t *testing.T) {
 
 	s1.Unsubscribe()
 
+	if m.Len() != 1 {
+		t.Fatalf("expected 1 subscription, got %d", m.Len())
+	}
+
 	m.Notify(resource.NewMetadata("ns1", "t1", "", resource.VersionUndefined))
 
 	select {
@@ -69,3 +78,160 @@ func TestManager(t *testing.T) {
 	default:
 	}
 }
+
+func TestManagerWildcard(t *testing.T) {
+	t.Parallel()
+
+	m := sub.NewManager()
+
+	all := m.SubscribeAll()
+	ns1 := m.SubscribeNamespace("ns1")
+
+	assertNotified := func(s sub.Subscription, expected bool) {
+		t.Helper()
+
+		select {
+		case <-s.NotifyCh():
+			if !expected {
+				t.Fatal("unexpected notification")
+			}
+		default:
+			if expected {
+				t.Fatal("expected notification")
+			}
+		}
+	}
+
+	m.Notify(resource.NewMetadata("ns2", "t1", "", resource.VersionUndefined))
+
+	assertNotified(all, true)
+	assertNotified(ns1, false)
+
+	m.Notify(resource.NewMetadata("ns1", "t2", "", resource.VersionUndefined))
+
+	assertNotified(all, true)
+	assertNotified(ns1, true)
+
+	all.Unsubscribe()
+	ns1.Unsubscribe()
+
+	if !m.Empty() {
+		t.Fatal("expected no subscriptions")
+	}
+}
+
+func TestManagerResource(t *testing.T) {
+	t.Parallel()
+
+	m := sub.NewManager()
+
+	res1 := m.SubscribeResource(resource.NewMetadata("ns1", "t1", "id1", resource.VersionUndefined))
+	kind := m.Subscribe(resource.NewMetadata("ns1", "t1", "", resource.VersionUndefined))
+
+	m.Notify(resource.NewMetadata("ns1", "t1", "id2", resource.VersionUndefined))
+
+	select {
+	case <-res1.NotifyCh():
+		t.Fatal("unexpected notification")
+	default:
+	}
+
+	select {
+	case <-kind.NotifyCh():
+	default:
+		t.Fatal("expected notification")
+	}
+
+	m.Notify(resource.NewMetadata("ns1", "t1", "id1", resource.VersionUndefined))
+
+	select {
+	case <-res1.NotifyCh():
+	default:
+		t.Fatal("expected notification")
+	}
+
+	select {
+	case <-kind.NotifyCh():
+	default:
+		t.Fatal("expected notification")
+	}
+
+	// the change to the whole kind reaches the resource subscriptions
+	m.Notify(resource.NewMetadata("ns1", "t1", "", resource.VersionUndefined))
+
+	select {
+	case <-res1.NotifyCh():
+	default:
+		t.Fatal("expected notification")
+	}
+
+	select {
+	case <-kind.NotifyCh():
+	default:
+		t.Fatal("expected notification")
+	}
+
+	m.Notify(resource.NewMetadata("ns1", "t2", "", resource.VersionUndefined))
+
+	select {
+	case <-res1.NotifyCh():
+		t.Fatal("unexpected notification")
+	default:
+	}
+
+	res1.Unsubscribe()
+	kind.Unsubscribe()
+
+	if !m.Empty() {
+		t.Fatal("expected no subscriptions")
+	}
+}
+
+func TestManagerNotifyWait(t *testing.T) {
+	t.Parallel()
+
+	m := sub.NewManager()
+
+	s := m.Subscribe(resource.NewMetadata("ns1", "t1", "", resource.VersionUndefined), sub.WithAck())
+	defer s.Unsubscribe()
+
+	processed := make(chan uint64, 1)
+
+	go func() {
+		<-s.NotifyCh()
+
+		gen := s.Generation()
+
+		processed <- gen
+
+		s.Ack(gen)
+	}()
+
+	m.NotifyWait(t.Context(), resource.NewMetadata("ns1", "t1", "id", resource.VersionUndefined))
+
+	select {
+	case gen := <-processed:
+		if gen != 1 {
+			t.Fatalf("unexpected generation %d", gen)
+		}
+	default:
+		t.Fatal("NotifyWait returned before the notification was processed")
+	}
+
+	// blocked subscribers are not waited for
+	s.SetBlocked(true)
+
+	done := make(chan struct{})
+
+	go func() {
+		m.NotifyWait(t.Context(), resource.NewMetadata("ns1", "t1", "id", resource.VersionUndefined))
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("NotifyWait is blocked")
+	}
+}
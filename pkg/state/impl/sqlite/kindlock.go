@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// kindLock serializes the writes of a kind, see SerializeKindWrites.
+type kindLock struct {
+	sem  chan struct{}
+	refs int // guarded by kindLocksMu
+}
+
+// lockKind waits for the writes of the resource kind done by other goroutines, if SerializeKindWrites is enabled.
+//
+// The returned function releases the lock, it should be called once the write is committed or rolled back.
+func (st *State) lockKind(ctx context.Context, ptr resource.Pointer) (unlock func(), err error) {
+	if !st.options.SerializeKindWrites {
+		return func() {}, nil
+	}
+
+	key := kindKey{ns: ptr.Namespace(), typ: ptr.Type()}
+
+	st.kindLocksMu.Lock()
+
+	lock, ok := st.kindLocks[key]
+	if !ok {
+		lock = &kindLock{sem: make(chan struct{}, 1)}
+		st.kindLocks[key] = lock
+	}
+
+	lock.refs++
+
+	st.kindLocksMu.Unlock()
+
+	release := func() {
+		st.kindLocksMu.Lock()
+		defer st.kindLocksMu.Unlock()
+
+		// the locks of the kinds nobody writes are dropped, so the map doesn't grow with the short-lived kinds
+		lock.refs--
+		if lock.refs == 0 {
+			delete(st.kindLocks, key)
+		}
+	}
+
+	select {
+	case lock.sem <- struct{}{}:
+	case <-ctx.Done():
+		release()
+
+		return nil, context.Cause(ctx)
+	}
+
+	return func() {
+		<-lock.sem
+
+		release()
+	}, nil
+}
+
+// lockKinds is lockKind for the writes of several kinds (e.g. Import), the kinds are sorted in place.
+//
+// The kinds are locked in the same order by all the callers, so they don't deadlock.
+func (st *State) lockKinds(ctx context.Context, kinds []kindKey) (unlock func(), err error) {
+	slices.SortFunc(kinds, func(a, b kindKey) int {
+		return cmp.Or(cmp.Compare(a.ns, b.ns), cmp.Compare(a.typ, b.typ))
+	})
+
+	unlocks := make([]func(), 0, len(kinds))
+
+	unlock = func() {
+		for _, fn := range slices.Backward(unlocks) {
+			fn()
+		}
+	}
+
+	for _, kind := range kinds {
+		fn, err := st.lockKind(ctx, resource.NewMetadata(kind.ns, kind.typ, "", resource.VersionUndefined))
+		if err != nil {
+			unlock()
+
+			return nil, err
+		}
+
+		unlocks = append(unlocks, fn)
+	}
+
+	return unlock, nil
+}
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"strconv"
+	"testing"
+
+	ctrlconformance "github.com/cosi-project/runtime/pkg/controller/conformance"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestSerializedKindWrites(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := ctrlconformance.NewIntResource("default", "counter", 0)
+		require.NoError(t, st.Create(ctx, res))
+
+		var eg errgroup.Group
+
+		for i := range 20 {
+			eg.Go(func() error {
+				if err := st.Create(ctx, ctrlconformance.NewIntResource("default", strconv.Itoa(i), i)); err != nil {
+					return err
+				}
+
+				// the read-modify-write of the same resource only conflicts on the version
+				for {
+					current, err := st.Get(ctx, res.Metadata())
+					if err != nil {
+						return err
+					}
+
+					counter := current.(*ctrlconformance.IntResource) //nolint:forcetypeassert,errcheck
+					counter.SetValue(counter.Value() + 1)
+
+					err = st.Update(ctx, counter)
+					if !state.IsConflictError(err) {
+						return err
+					}
+				}
+			})
+		}
+
+		require.NoError(t, eg.Wait())
+
+		counter, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, 20, counter.(*ctrlconformance.IntResource).Value()) //nolint:forcetypeassert,errcheck
+	}, sqlite.WithSerializedKindWrites(true))
+}
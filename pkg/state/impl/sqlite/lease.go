@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// OwnershipMode defines how the state coordinates with other state instances sharing the same tables.
+//
+// Two state instances with the same table prefix on the same database would otherwise both
+// run the background tasks (e.g. compaction).
+type OwnershipMode int
+
+// Ownership modes.
+const (
+	// OwnershipDisabled doesn't coordinate with other state instances.
+	OwnershipDisabled OwnershipMode = iota
+	// OwnershipFailFast makes NewState fail with ErrLeaseHeld if another state instance holds the lease.
+	OwnershipFailFast
+	// OwnershipFollower runs the state as a follower if another state instance holds the lease.
+	//
+	// The follower serves all operations, but the background tasks are only run by the lease holder.
+	// The follower takes over the lease when it expires.
+	OwnershipFollower
+)
+
+// IsLeader returns true if the state holds the ownership lease (or ownership is disabled).
+//
+// Only the leader runs the background tasks.
+func (st *State) IsLeader() bool {
+	return st.options.Ownership == OwnershipDisabled || st.leader.Load()
+}
+
+// initLease acquires the ownership lease on startup.
+func (st *State) initLease(ctx context.Context) error {
+	st.leaseOwner = rand.Text()
+
+	acquired, err := st.acquireLease(ctx)
+	if err != nil {
+		if IsLeaseHeldError(err) && st.options.Ownership == OwnershipFollower {
+			st.options.Logger.Info("running as a follower", zap.Error(err))
+
+			return nil
+		}
+
+		return err
+	}
+
+	st.leader.Store(acquired)
+
+	return nil
+}
+
+// acquireLease acquires or renews the ownership lease.
+//
+// If the lease is held by another state instance, ErrLeaseHeld is returned.
+func (st *State) acquireLease(ctx context.Context) (bool, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error taking connection for lease: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	now := time.Now()
+
+	q, err := sqlitexx.NewQuery(conn,
+		`INSERT INTO `+st.options.TablePrefix+`lease (id, owner, expires_at) VALUES (1, $owner, $expires_at)
+		ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE owner = excluded.owner OR expires_at < $now`,
+	)
+	if err != nil {
+		return false, fmt.Errorf("preparing lease statement: %w", err)
+	}
+
+	if err = q.
+		BindString("$owner", st.leaseOwner).
+		BindInt64("$expires_at", now.Add(st.options.LeaseDuration).UnixMilli()).
+		BindInt64("$now", now.UnixMilli()).
+		Exec(); err != nil {
+		return false, fmt.Errorf("error acquiring lease: %w", err)
+	}
+
+	if conn.Changes() == 1 {
+		return true, nil
+	}
+
+	var (
+		owner     string
+		expiresAt int64
+	)
+
+	q, err = sqlitexx.NewQuery(conn, `SELECT owner, expires_at FROM `+st.options.TablePrefix+`lease WHERE id = 1`)
+	if err != nil {
+		return false, fmt.Errorf("preparing query for lease: %w", err)
+	}
+
+	if err = q.QueryRow(func(stmt *sqlite.Stmt) error {
+		owner = stmt.GetText("owner")
+		expiresAt = stmt.GetInt64("expires_at")
+
+		return nil
+	}); err != nil {
+		return false, fmt.Errorf("error querying lease: %w", err)
+	}
+
+	return false, ErrLeaseHeld(owner, time.UnixMilli(expiresAt))
+}
+
+// releaseLease releases the lease if it's held by this state instance.
+func (st *State) releaseLease(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking connection for lease: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(conn, `DELETE FROM `+st.options.TablePrefix+`lease WHERE owner = $owner`)
+	if err != nil {
+		return fmt.Errorf("preparing lease release statement: %w", err)
+	}
+
+	if err = q.BindString("$owner", st.leaseOwner).Exec(); err != nil {
+		return fmt.Errorf("error releasing lease: %w", err)
+	}
+
+	return nil
+}
+
+// runLease renews the lease held by this state instance, or takes it over once it expires.
+func (st *State) runLease() {
+	defer st.wg.Done()
+
+	ticker := time.NewTicker(st.options.LeaseDuration / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+
+	for {
+		select {
+		case <-st.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		acquired, err := st.acquireLease(st.compactionCtx)
+		if err != nil && !IsLeaseHeldError(err) {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+
+			st.options.Logger.Error("failed to renew ownership lease", zap.Error(err))
+
+			// the lease might have expired in the meantime, so another instance might take over
+			if time.Since(renewed) < st.options.LeaseDuration {
+				continue
+			}
+		}
+
+		if acquired {
+			renewed = time.Now()
+		}
+
+		switch wasLeader := st.leader.Swap(acquired); {
+		case acquired && !wasLeader:
+			st.options.Logger.Info("acquired ownership lease")
+		case !acquired && wasLeader:
+			st.options.Logger.Warn("lost ownership lease, running as a follower", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestOwnershipFailFast(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+
+	leader := newSqliteState(t, path, sqlite.WithOwnership(sqlite.OwnershipFailFast))
+	assert.True(t, leader.IsLeader())
+
+	_, err := sqlite.NewState(t.Context(), newSqlitePool(t, path), store.ProtobufMarshaler{},
+		sqlite.WithLogger(zaptest.NewLogger(t)),
+		sqlite.WithOwnership(sqlite.OwnershipFailFast),
+	)
+	require.Error(t, err)
+	assert.True(t, sqlite.IsLeaseHeldError(err))
+
+	// a different prefix doesn't conflict
+	other := newSqliteState(t, path, sqlite.WithOwnership(sqlite.OwnershipFailFast), sqlite.WithTablePrefix("other_"))
+	assert.True(t, other.IsLeader())
+}
+
+func TestOwnershipFollower(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+
+	leader, err := sqlite.NewState(t.Context(), newSqlitePool(t, path), store.ProtobufMarshaler{},
+		sqlite.WithLogger(zaptest.NewLogger(t)),
+		sqlite.WithOwnership(sqlite.OwnershipFollower),
+		sqlite.WithLeaseDuration(300*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	follower := newSqliteState(t, path,
+		sqlite.WithOwnership(sqlite.OwnershipFollower),
+		sqlite.WithLeaseDuration(300*time.Millisecond),
+	)
+
+	assert.True(t, leader.IsLeader())
+	assert.False(t, follower.IsLeader())
+
+	// the follower serves the requests
+	require.NoError(t, follower.Create(t.Context(), conformance.NewPathResource("ns1", "a")))
+
+	// the leader keeps renewing the lease
+	time.Sleep(time.Second)
+
+	assert.True(t, leader.IsLeader())
+	assert.False(t, follower.IsLeader())
+
+	// the follower takes over once the leader is gone
+	leader.Close()
+
+	assert.Eventually(t, follower.IsLeader, 5*time.Second, 10*time.Millisecond)
+}
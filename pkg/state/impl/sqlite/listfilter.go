@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// ListFilter defines additional conditions for ListFiltered.
+//
+// All conditions are pushed down to the database.
+type ListFilter struct {
+	// Owner, if set, matches resources with the given owner (empty string matches resources without an owner).
+	Owner *string
+
+	// Phase, if set, matches resources in the given phase.
+	Phase *resource.Phase
+
+	// UpdatedWithin, if set, matches resources updated within the given duration.
+	UpdatedWithin time.Duration
+
+	// OrderByLabel, if set, orders the results by the value of the label.
+	//
+	// Resources without the label are listed last, ties are broken by the resource ID.
+	OrderByLabel string
+}
+
+// compile returns additional sqlite conditions for the filter.
+func (f ListFilter) compile() string {
+	var condition string
+
+	switch {
+	case f.Owner == nil:
+	case *f.Owner == "":
+		condition += ` AND owner = $owner`
+	default:
+		// the repeated condition makes the partial owner index usable, see indexHint
+		condition += ` AND owner = $owner AND owner != ''`
+	}
+
+	if f.Phase != nil {
+		condition += ` AND phase = $phase`
+	}
+
+	if f.UpdatedWithin > 0 {
+		condition += ` AND updated_at >= $updated_after`
+	}
+
+	return condition
+}
+
+// indexHint returns the index clause to follow the resources table name.
+//
+// Without table statistics, the planner prefers the primary key over the partial owner index,
+// so the index is forced when listing the resources of an owner.
+func (f ListFilter) indexHint(tablePrefix string) string {
+	if f.Owner == nil || *f.Owner == "" {
+		return ""
+	}
+
+	return ` INDEXED BY ` + tablePrefix + `resources_owner`
+}
+
+// bind binds the parameters of the conditions returned by compile.
+func (f ListFilter) bind(q *sqlitexx.Query) {
+	if f.Owner != nil {
+		q.BindString("$owner", *f.Owner)
+	}
+
+	if f.Phase != nil {
+		q.BindInt("$phase", int(*f.Phase))
+	}
+
+	if f.UpdatedWithin > 0 {
+		q.BindInt64("$updated_after", time.Now().Add(-f.UpdatedWithin).Unix())
+	}
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"runtime"
+	"sync"
+	"weak"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+)
+
+// listExtensions are the List options specific to this package.
+type listExtensions struct {
+	owner *string
+}
+
+// pendingListExtensions holds the extensions set by the options of this package
+// until List picks them up, see pendingWatchKindExtensions.
+var pendingListExtensions sync.Map // map[weak.Pointer[state.ListOptions]]*listExtensions
+
+func listExtension(fn func(ext *listExtensions)) state.ListOption {
+	return func(opts *state.ListOptions) {
+		key := weak.Make(opts)
+
+		ext, loaded := pendingListExtensions.LoadOrStore(key, &listExtensions{})
+		if !loaded {
+			runtime.AddCleanup(opts, func(key weak.Pointer[state.ListOptions]) {
+				pendingListExtensions.Delete(key)
+			}, key)
+		}
+
+		fn(ext.(*listExtensions)) //nolint:forcetypeassert,errcheck
+	}
+}
+
+// takeListExtensions returns the extensions applied to the options.
+func takeListExtensions(opts *state.ListOptions) listExtensions {
+	ext, ok := pendingListExtensions.LoadAndDelete(weak.Make(opts))
+	if !ok {
+		return listExtensions{}
+	}
+
+	return *ext.(*listExtensions) //nolint:forcetypeassert,errcheck
+}
+
+// WithOwner makes List return only the resources with the given owner.
+//
+// This is the List option variant of ListFilter.Owner, so it can be passed through the state wrappers
+// (e.g. state.WrapCore). The filter is pushed down to the database, the resources with an owner are indexed by it,
+// so the controllers listing their outputs on every reconcile don't scan the whole kind.
+// The option has no effect on other state implementations.
+func WithOwner(owner resource.Owner) state.ListOption {
+	return listExtension(func(ext *listExtensions) {
+		ext.owner = &owner
+	})
+}
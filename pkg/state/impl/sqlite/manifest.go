@@ -0,0 +1,392 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/protobuf"
+	"go.uber.org/zap"
+	"go.yaml.in/yaml/v4"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// ManifestOptions configures ApplyManifests.
+type ManifestOptions struct {
+	// Owner is the owner the resources of the manifests are applied with, see Apply.
+	Owner resource.Owner
+
+	// PruneKinds are the kinds pruned in addition to the kinds of the manifests, see Prune.
+	//
+	// The kinds of the resources removed from all the manifests should be listed here, so they are pruned as well.
+	PruneKinds []resource.Kind
+
+	// Prune destroys the resources owned by Owner which are not in the manifests.
+	//
+	// Only the kinds of the manifests and PruneKinds are pruned, and Owner should be set,
+	// so the resources created by other means are never destroyed.
+	Prune bool
+}
+
+// ManifestResult describes the changes done by ApplyManifests.
+type ManifestResult struct {
+	Created   []resource.Pointer
+	Updated   []resource.Pointer
+	Unchanged []resource.Pointer
+	Destroyed []resource.Pointer
+}
+
+// ReadManifests reads the resources from the YAML and JSON manifests in the file system, in the lexical order of the paths.
+//
+// The files with the .yaml, .yml and .json extensions are read, including the subdirectories.
+// A file holds one or more resources in the format of resource.MarshalYAML (metadata and spec),
+// as separate YAML documents or as a list. The resource types should be registered with protobuf.RegisterResource.
+func ReadManifests(fsys fs.FS) ([]resource.Resource, error) {
+	var resources []resource.Resource
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch path.Ext(p) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close() //nolint:errcheck
+
+		decoded, err := decodeManifest(f)
+		if err != nil {
+			return fmt.Errorf("reading manifest %q: %w", p, err)
+		}
+
+		resources = append(resources, decoded...)
+
+		return nil
+	})
+
+	return resources, err
+}
+
+func decodeManifest(r io.Reader) ([]resource.Resource, error) {
+	var resources []resource.Resource
+
+	decodeResource := func(node *yaml.Node) error {
+		var res protobuf.YAMLResource
+
+		if err := node.Decode(&res); err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+
+		resources = append(resources, res.Resource())
+
+		return nil
+	}
+
+	decoder := yaml.NewDecoder(r)
+
+	for {
+		var doc yaml.Node
+
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return resources, nil
+			}
+
+			return nil, err
+		}
+
+		// empty documents (e.g. after the trailing separator) are skipped
+		if len(doc.Content) == 0 || doc.Content[0].ShortTag() == "!!null" {
+			continue
+		}
+
+		node := doc.Content[0]
+
+		if node.Kind != yaml.SequenceNode {
+			if err := decodeResource(node); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		for _, item := range node.Content {
+			if err := decodeResource(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// ApplyManifests reads the resources from the manifests in the file system (see ReadManifests), and applies them.
+//
+// This is the declarative bootstrapping of the baseline resources, similar to kubectl apply: the resources
+// are created, or updated if they exist (as by Apply with opts.Owner, overwriting the stored version),
+// and the resources left out of the manifests are destroyed with opts.Prune. The changes are made in
+// a single transaction: if any of them fails (e.g. a resource has another owner, or a pruned resource
+// has pending finalizers), nothing is written.
+func (st *State) ApplyManifests(ctx context.Context, fsys fs.FS, opts ManifestOptions) (_ *ManifestResult, err error) {
+	defer st.convertCanceled(ctx, &err)
+
+	resources, err := ReadManifests(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply manifests: %w", err)
+	}
+
+	return st.applyManifests(ctx, resources, opts)
+}
+
+type manifestKey struct {
+	kindKey
+
+	id resource.ID
+}
+
+//nolint:gocognit,gocyclo,cyclop
+func (st *State) applyManifests(ctx context.Context, resources []resource.Resource, opts ManifestOptions) (*ManifestResult, error) {
+	if opts.Prune && opts.Owner == "" {
+		return nil, errors.New("failed to apply manifests: pruning requires the owner")
+	}
+
+	var (
+		declared = make(map[manifestKey]struct{}, len(resources))
+		kinds    []kindKey
+	)
+
+	addKind := func(key kindKey) {
+		if !slices.Contains(kinds, key) {
+			kinds = append(kinds, key)
+		}
+	}
+
+	for _, res := range resources {
+		md := res.Metadata()
+
+		if err := st.checkNamespace(md.Namespace()); err != nil {
+			return nil, fmt.Errorf("failed to apply manifests: %w", err)
+		}
+
+		key := manifestKey{kindKey: kindKey{ns: md.Namespace(), typ: md.Type()}, id: md.ID()}
+
+		if _, ok := declared[key]; ok {
+			return nil, fmt.Errorf("failed to apply manifests: resource %s is declared more than once", resource.String(res))
+		}
+
+		declared[key] = struct{}{}
+
+		addKind(key.kindKey)
+	}
+
+	if opts.Prune {
+		for _, kind := range opts.PruneKinds {
+			if err := st.checkNamespace(kind.Namespace()); err != nil {
+				return nil, fmt.Errorf("failed to apply manifests: %w", err)
+			}
+
+			addKind(kindKey{ns: kind.Namespace(), typ: kind.Type()})
+		}
+	}
+
+	unlock, err := st.lockKinds(ctx, kinds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply manifests: %w", err)
+	}
+
+	defer unlock()
+
+	type appliedResource struct {
+		res      resource.Resource
+		op       Operation
+		rowBytes int64
+	}
+
+	type destroyedResource struct {
+		ptr      *resource.Metadata
+		specSize int64
+	}
+
+	var (
+		applied   = make([]appliedResource, 0, len(resources))
+		destroyed []destroyedResource
+		result    ManifestResult
+	)
+
+	for _, res := range resources {
+		st.localEvents.Add(res.Metadata(), 1)
+	}
+
+	err = func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for manifests: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		doneFn, transErr := sqlitexx.BeginWithRetry(ctx, conn)
+		if transErr != nil {
+			return fmt.Errorf("starting transaction for manifests: %w", transErr)
+		}
+		defer doneFn(&err)
+
+		for _, res := range resources {
+			// the manifests declare the desired state, which overwrites the stored one
+			res = res.DeepCopy()
+			res.Metadata().SetVersion(resource.VersionUndefined)
+
+			resCopy := res.DeepCopy()
+			*resCopy.Metadata() = withOwner(resCopy.Metadata(), opts.Owner)
+
+			op, stored, rowBytes, err := st.applyConn(ctx, conn, res, resCopy, opts.Owner)
+			if err != nil {
+				return err
+			}
+
+			*resCopy.Metadata() = *stored
+
+			applied = append(applied, appliedResource{res: resCopy, op: op, rowBytes: rowBytes})
+		}
+
+		if !opts.Prune {
+			return nil
+		}
+
+		for _, kind := range kinds {
+			var ids []resource.ID
+
+			q, err := sqlitexx.NewQuery(
+				conn,
+				`SELECT id FROM `+st.options.TablePrefix+`resources
+				WHERE namespace = $namespace AND type = $type AND owner = $owner
+				ORDER BY id`,
+			)
+			if err != nil {
+				return fmt.Errorf("preparing query for pruned resources: %w", err)
+			}
+
+			if err = q.
+				BindString("$owner", opts.Owner).
+				BindString("$namespace", kind.ns).
+				BindString("$type", kind.typ).
+				QueryAll(func(stmt *sqlite.Stmt) error {
+					ids = append(ids, stmt.GetText("id"))
+
+					return nil
+				}); err != nil {
+				return fmt.Errorf("error querying pruned resources: %w", err)
+			}
+
+			for _, id := range ids {
+				if _, ok := declared[manifestKey{kindKey: kind, id: id}]; ok {
+					continue
+				}
+
+				md := resource.NewMetadata(kind.ns, kind.typ, id, resource.VersionUndefined)
+				ptr := &md
+
+				st.localEvents.Add(ptr, 1)
+
+				ver, size, err := st.destroyConn(conn, ptr, opts.Owner)
+				if err != nil {
+					st.localEvents.Add(ptr, -1)
+
+					return err
+				}
+
+				version, _ := resource.ParseVersion(strconv.FormatUint(ver, 10)) //nolint:errcheck
+				ptr.SetVersion(version)
+
+				destroyed = append(destroyed, destroyedResource{ptr: ptr, specSize: size})
+			}
+		}
+
+		return nil
+	}()
+	if err != nil {
+		for _, res := range resources {
+			st.localEvents.Add(res.Metadata(), -1)
+		}
+
+		for _, item := range destroyed {
+			st.localEvents.Add(item.ptr, -1)
+		}
+
+		return nil, fmt.Errorf("failed to apply manifests: %w", err)
+	}
+
+	for _, item := range applied {
+		switch item.op {
+		case OperationCreate:
+			result.Created = append(result.Created, item.res.Metadata())
+		case OperationUpdate:
+			result.Updated = append(result.Updated, item.res.Metadata())
+		default:
+			result.Unchanged = append(result.Unchanged, item.res.Metadata())
+
+			st.localEvents.Add(item.res.Metadata(), -1)
+
+			continue
+		}
+
+		st.recordWrite(item.op.String(), item.rowBytes, 2)
+
+		st.notify(ctx, item.res.Metadata())
+
+		st.audit(item.op, item.res.Metadata())
+
+		st.runPostCommitHooks(item.op, item.res)
+	}
+
+	for _, item := range destroyed {
+		result.Destroyed = append(result.Destroyed, item.ptr)
+
+		st.recordWrite("destroy", item.specSize, 2)
+
+		st.notify(ctx, item.ptr)
+
+		if st.options.PruneEmptyNamespaces {
+			st.queueNamespacePruning(item.ptr.Namespace())
+		}
+
+		md := withOwner(item.ptr, opts.Owner)
+
+		st.audit(OperationDestroy, &md)
+
+		st.runPostCommitHooks(OperationDestroy, resource.NewTombstone(*item.ptr))
+	}
+
+	// the statistics of the query planner are refreshed for the written rows
+	if len(result.Created)+len(result.Updated)+len(result.Destroyed) > 0 {
+		if optimizeErr := st.Optimize(ctx); optimizeErr != nil {
+			st.options.Logger.Warn("failed to optimize database after applying manifests", zap.Error(optimizeErr))
+		}
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,125 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/siderolabs/gen/xslices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func manifest(ns, id string, labels ...string) string {
+	m := "metadata:\n  namespace: " + ns + "\n  type: " + conformance.PathResourceType + "\n  id: " + id + "\n  version: 1\n  phase: running\n"
+
+	if len(labels) > 0 {
+		m += "  labels:\n"
+
+		for i := 0; i+1 < len(labels); i += 2 {
+			m += "    " + labels[i] + ": " + labels[i+1] + "\n"
+		}
+	}
+
+	return m + "spec: {}\n"
+}
+
+func TestReadManifests(t *testing.T) {
+	t.Parallel()
+
+	resources, err := sqlite.ReadManifests(fstest.MapFS{
+		"b.yaml":          {Data: []byte(manifest("ns1", "b") + "---\n" + manifest("ns1", "c") + "---\n")},
+		"a/list.json":     {Data: []byte(`[{"metadata": {"namespace": "ns1", "type": "os/path", "id": "a"}, "spec": {}}]`)},
+		"README.md":       {Data: []byte("not a manifest")},
+		"nested/d.yml":    {Data: []byte(manifest("ns2", "d", "app", "foo"))},
+		"ignored.yaml.md": {Data: []byte("not a manifest")},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"ns1/a", "ns1/b", "ns1/c", "ns2/d"}, xslices.Map(resources, func(r resource.Resource) string {
+		return r.Metadata().Namespace() + "/" + r.Metadata().ID()
+	}))
+	assert.Equal(t, "foo", resources[3].Metadata().Labels().Raw()["app"])
+
+	_, err = sqlite.ReadManifests(fstest.MapFS{
+		"broken.yaml": {Data: []byte("metadata:\n  type: unknown\nspec: {}\n")},
+	})
+	assert.ErrorContains(t, err, `reading manifest "broken.yaml"`)
+}
+
+func TestApplyManifests(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		opts := sqlite.ManifestOptions{Owner: "manifests", Prune: true}
+
+		result, err := st.ApplyManifests(ctx, fstest.MapFS{
+			"a.yaml": {Data: []byte(manifest("ns1", "a") + "---\n" + manifest("ns1", "b"))},
+		}, opts)
+		require.NoError(t, err)
+		assert.Len(t, result.Created, 2)
+
+		// not owned by the manifests, so it's never pruned
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "unowned")))
+
+		result, err = st.ApplyManifests(ctx, fstest.MapFS{
+			"a.yaml": {Data: []byte(manifest("ns1", "a", "app", "foo") + "---\n" + manifest("ns1", "c"))},
+		}, opts)
+		require.NoError(t, err)
+
+		ids := func(ptrs []resource.Pointer) []string {
+			return xslices.Map(ptrs, resource.Pointer.ID)
+		}
+
+		assert.Equal(t, []string{"c"}, ids(result.Created))
+		assert.Equal(t, []string{"a"}, ids(result.Updated))
+		assert.Empty(t, result.Unchanged)
+		assert.Equal(t, []string{"b"}, ids(result.Destroyed))
+
+		list, err := st.List(ctx, conformance.NewPathResource("ns1", "").Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "c", "unowned"}, xslices.Map(list.Items, func(r resource.Resource) string { return r.Metadata().ID() }))
+		assert.Equal(t, "manifests", list.Items[0].Metadata().Owner())
+		assert.Equal(t, "foo", list.Items[0].Metadata().Labels().Raw()["app"])
+
+		// nothing is written if any of the changes fails
+		stored, err := st.Get(ctx, conformance.NewPathResource("ns1", "a").Metadata())
+		require.NoError(t, err)
+
+		stored.Metadata().Finalizers().Add("test")
+		require.NoError(t, st.Update(ctx, stored, state.WithUpdateOwner("manifests")))
+
+		_, err = st.ApplyManifests(ctx, fstest.MapFS{
+			"a.yaml": {Data: []byte(manifest("ns1", "c") + "---\n" + manifest("ns1", "d"))},
+		}, opts)
+		require.Error(t, err)
+		assert.True(t, state.IsConflictError(err), "%v", err)
+
+		_, err = st.Get(ctx, conformance.NewPathResource("ns1", "d").Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+
+		result, err = st.ApplyManifests(ctx, fstest.MapFS{
+			"a.yaml": {Data: []byte(manifest("ns1", "c"))},
+		}, sqlite.ManifestOptions{Owner: "manifests"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c"}, ids(result.Unchanged))
+
+		_, err = st.ApplyManifests(ctx, fstest.MapFS{}, sqlite.ManifestOptions{Prune: true})
+		assert.ErrorContains(t, err, "pruning requires the owner")
+
+		_, err = st.ApplyManifests(ctx, fstest.MapFS{
+			"a.yaml": {Data: []byte(manifest("ns1", "c") + "---\n" + manifest("ns1", "c"))},
+		}, opts)
+		assert.ErrorContains(t, err, "declared more than once")
+	})
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// marshalerIdentity returns the identity of the marshaler recorded in the database.
+func (st *State) marshalerIdentity() string {
+	if st.options.MarshalerIdentity != "" {
+		return st.options.MarshalerIdentity
+	}
+
+	switch st.marshaler.(type) {
+	case store.ProtobufMarshaler, *store.ProtobufMarshaler:
+		return "protobuf-v1"
+	default:
+		return fmt.Sprintf("%T", st.marshaler)
+	}
+}
+
+// checkMarshaler verifies that the database was written with the same marshaler.
+//
+// The identity is recorded when the database is opened for the first time, so that
+// opening it with an incompatible marshaler fails early instead of failing to unmarshal every resource.
+func (st *State) checkMarshaler(conn *sqlite.Conn) error {
+	identity := st.marshalerIdentity()
+
+	stored, err := st.storedMarshalerIdentity(conn)
+
+	switch {
+	case errors.Is(err, sqlitexx.ErrNoRows):
+	case err != nil:
+		return err
+	case stored != identity:
+		return ErrMarshalerMismatch(stored, identity)
+	default:
+		return nil
+	}
+
+	q, err := sqlitexx.NewQuery(conn, `INSERT INTO `+st.options.TablePrefix+`meta (key, value) VALUES ('marshaler', $identity)`)
+	if err != nil {
+		return fmt.Errorf("preparing marshaler identity statement: %w", err)
+	}
+
+	if err = q.BindString("$identity", identity).Exec(); err != nil {
+		return fmt.Errorf("error recording marshaler identity: %w", err)
+	}
+
+	return nil
+}
+
+// storedMarshalerIdentity returns the identity of the marshaler recorded in the database, or ErrNoRows.
+func (st *State) storedMarshalerIdentity(conn *sqlite.Conn) (string, error) {
+	q, err := sqlitexx.NewQuery(conn, `SELECT value FROM `+st.options.TablePrefix+`meta WHERE key = 'marshaler'`)
+	if err != nil {
+		return "", fmt.Errorf("preparing query for marshaler identity: %w", err)
+	}
+
+	var stored string
+
+	if err = q.QueryRow(func(stmt *sqlite.Stmt) error {
+		stored = stmt.GetText("value")
+
+		return nil
+	}); err != nil && !errors.Is(err, sqlitexx.ErrNoRows) {
+		return "", fmt.Errorf("error querying marshaler identity: %w", err)
+	}
+
+	return stored, err
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestMarshalerIdentity(t *testing.T) {
+	t.Parallel()
+
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	st.Close()
+
+	_, err = sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{}, sqlite.WithMarshalerIdentity("protobuf-v2"))
+	require.Error(t, err)
+	assert.True(t, sqlite.IsMarshalerMismatchError(err))
+	assert.ErrorContains(t, err, `database was written with marshaler "protobuf-v1"`)
+
+	_, err = sqlite.NewState(t.Context(), pool, brokenMarshaler{})
+	require.Error(t, err)
+	assert.True(t, sqlite.IsMarshalerMismatchError(err))
+
+	st, err = sqlite.NewState(t.Context(), pool, &store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	st.Close()
+
+	// tables with another prefix are independent
+	st, err = sqlite.NewState(t.Context(), pool, brokenMarshaler{}, sqlite.WithTablePrefix("other_"))
+	require.NoError(t, err)
+
+	st.Close()
+}
@@ -0,0 +1,39 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// NewMemoryState creates a State backed by a new private in-memory database.
+//
+// It's the supported way to unit test controllers without touching the disk: the state passes
+// the same conformance suite as the file-backed one, including the watches.
+// The database is dropped on Close.
+//
+// All operations share a single connection (see sqlitexx.NewMemoryPool), so an active snapshot
+// (see BeginSnapshot) blocks all other operations until it's released.
+func NewMemoryState(ctx context.Context, marshaler store.Marshaler, opts ...StateOption) (*State, error) {
+	pool, err := sqlitexx.NewMemoryPool()
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := NewState(ctx, pool, marshaler, opts...)
+	if err != nil {
+		pool.Close() //nolint:errcheck
+
+		return nil, err
+	}
+
+	st.closePool = pool.Close
+
+	return st, nil
+}
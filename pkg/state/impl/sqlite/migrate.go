@@ -8,17 +8,50 @@ import (
 	"context"
 	_ "embed"
 	"fmt"
+	"strings"
 
+	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
 )
 
 //go:embed schema/schema.sql
 var schemaSQL string
 
+//go:embed schema/indexes.sql
+var indexesSQL string
+
+//go:embed schema/views.sql
+var viewsSQL string
+
+const (
+	// schemaVersion is the version of the schema created by this package.
+	//
+	// It should be bumped on every schema change.
+	//
+	//  1. meta and versions tables
+	//  2. graveyard table
+	//  3. resources update trigger ignores updates which don't change the version
+	//  4. resources generation and events generation_changed columns
+	//  5. resources owner index
+	//  6. resources updated_at index
+	//  7. events event_id AUTOINCREMENT
+	//  8. events labels, phase and owner columns
+	schemaVersion = 8
+
+	// minReaderVersion is the oldest schema version which can safely read and write the databases
+	// created by this package.
+	//
+	// It should be bumped to schemaVersion when older versions of the package would misbehave
+	// on the new schema (e.g. a new column without a default value).
+	//
+	//  4. older versions don't bump the generation on update
+	minReaderVersion = 4
+)
+
 // migrate applies necessary database migrations.
 func (st *State) migrate(ctx context.Context) error {
-	schemaReplaced := fmt.Sprintf(schemaSQL, st.options.TablePrefix)
-
 	conn, err := st.db.Take(ctx)
 	if err != nil {
 		return fmt.Errorf("taking connection for migration: %w", err)
@@ -26,9 +59,342 @@ func (st *State) migrate(ctx context.Context) error {
 
 	defer st.db.Put(conn)
 
-	if err = sqlitex.ExecScript(conn, schemaReplaced); err != nil {
+	storedVersion, err := st.checkSchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+
+	if err = st.upgradeSchema(conn, storedVersion); err != nil {
+		return err
+	}
+
+	if err = st.recordSchemaVersion(conn); err != nil {
+		return err
+	}
+
+	return st.checkMarshaler(conn)
+}
+
+// checkSchemaVersion refuses to open the databases written by newer incompatible versions of the package.
+//
+// The recorded schema version is returned, zero for new databases and the databases created before the meta table.
+func (st *State) checkSchemaVersion(conn *sqlite.Conn) (int64, error) {
+	var exists bool
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT count(*) AS count FROM sqlite_schema WHERE type = 'table' AND name = $name`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query for meta table: %w", err)
+	}
+
+	if err = q.BindString("$name", st.options.TablePrefix+"meta").QueryRow(func(stmt *sqlite.Stmt) error {
+		exists = stmt.GetInt64("count") > 0
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error querying meta table: %w", err)
+	}
+
+	// databases created before the meta table was introduced are compatible
+	if !exists {
+		return 0, nil
+	}
+
+	versions := map[string]int64{}
+
+	q, err = sqlitexx.NewQuery(conn, `SELECT key, value FROM `+st.options.TablePrefix+`meta WHERE key IN ('schema_version', 'min_reader_version')`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query for schema version: %w", err)
+	}
+
+	if err = q.QueryAll(func(stmt *sqlite.Stmt) error {
+		versions[stmt.GetText("key")] = stmt.GetInt64("value")
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error querying schema version: %w", err)
+	}
+
+	if minReader := versions["min_reader_version"]; minReader > schemaVersion {
+		return 0, ErrSchemaTooNew(minReader, schemaVersion)
+	}
+
+	return versions["schema_version"], nil
+}
+
+// upgradeSchema applies the schema, upgrading the objects changed since the recorded schema version.
+//
+// The schema only creates the missing objects, so the changed triggers are dropped to be created again.
+// This happens in a single transaction, so the concurrent writes don't miss the triggers.
+func (st *State) upgradeSchema(conn *sqlite.Conn, from int64) (err error) {
+	endFn, err := sqlitexx.Begin(conn)
+	if err != nil {
+		return fmt.Errorf("starting transaction for schema upgrade: %w", err)
+	}
+
+	defer endFn(&err)
+
+	if from < 4 {
+		if err = sqlitex.ExecuteTransient(conn, `DROP TRIGGER IF EXISTS trg_`+st.options.TablePrefix+`resources_after_update`, nil); err != nil {
+			return fmt.Errorf("dropping resources update trigger: %w", err)
+		}
+
+		if err = st.addColumn(conn, "resources", "generation", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+
+		if err = st.addColumn(conn, "events", "generation_changed", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+	}
+
+	if from < 7 {
+		if err = st.autoincrementEvents(conn); err != nil {
+			return err
+		}
+	}
+
+	if from < 8 {
+		for _, trigger := range []string{"insert", "update", "delete"} {
+			if err = sqlitex.ExecuteTransient(conn, `DROP TRIGGER IF EXISTS trg_`+st.options.TablePrefix+`resources_after_`+trigger, nil); err != nil {
+				return fmt.Errorf("dropping resources %s trigger: %w", trigger, err)
+			}
+		}
+
+		for _, column := range []struct{ name, definition string }{
+			{"labels", "BLOB NULL"},
+			{"phase", "INTEGER NULL"},
+			{"owner", "TEXT NULL"},
+			{"labels_before", "BLOB NULL"},
+			{"phase_before", "INTEGER NULL"},
+		} {
+			if err = st.addColumn(conn, "events", column.name, column.definition); err != nil {
+				return err
+			}
+		}
+	}
+
+	return st.applySchema(conn)
+}
+
+// autoincrementEventsSQL is the events table definition of the schema version 7, see autoincrementEvents.
+const autoincrementEventsSQL = `CREATE TABLE %s (
+	event_id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	namespace TEXT NOT NULL,
+	type TEXT NOT NULL,
+	id TEXT NOT NULL,
+	event_timestamp INTEGER NOT NULL,
+	event_type INTEGER NOT NULL,
+	spec_before BLOB NULL,
+	spec_after BLOB NULL,
+	generation_changed INTEGER NOT NULL DEFAULT 1
+) STRICT`
+
+// autoincrementEvents rebuilds the events table created without AUTOINCREMENT.
+//
+// Without AUTOINCREMENT, the next event ID is the largest one plus one, so the IDs of the latest events are reused
+// once they are deleted (e.g. by the compaction keeping no events), and the watches and bookmarks positioned
+// after them miss the new events. The ID sequence starts from the largest ID left in the table,
+// so the IDs already reused before the upgrade can't be detected.
+func (st *State) autoincrementEvents(conn *sqlite.Conn) error {
+	var tableSQL string
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT sql FROM sqlite_schema WHERE type = 'table' AND name = $name`)
+	if err != nil {
+		return fmt.Errorf("preparing query for events table: %w", err)
+	}
+
+	if err = q.BindString("$name", st.options.TablePrefix+"events").QueryAll(func(stmt *sqlite.Stmt) error {
+		tableSQL = stmt.GetText("sql")
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error querying events table: %w", err)
+	}
+
+	// the new databases get the table from the schema
+	if tableSQL == "" || strings.Contains(strings.ToUpper(tableSQL), "AUTOINCREMENT") {
+		return nil
+	}
+
+	return st.rebuildTable(conn, "events", autoincrementEventsSQL, []string{
+		"event_id", "namespace", "type", "id", "event_timestamp", "event_type", "spec_before", "spec_after", "generation_changed",
+	})
+}
+
+// addColumn adds the column to the table (without the prefix), if the table exists and the column doesn't.
+//
+// The new tables are created by the schema with all the columns.
+func (st *State) addColumn(conn *sqlite.Conn, table, column, definition string) error {
+	table = st.options.TablePrefix + table
+
+	var tableExists, columnExists bool
+
+	q, err := sqlitexx.NewQuery(conn,
+		`SELECT
+			(SELECT count(*) FROM sqlite_schema WHERE type = 'table' AND name = $table) AS table_exists,
+			(SELECT count(*) FROM pragma_table_info($table) WHERE name = $column) AS column_exists`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing query for column %q of table %q: %w", column, table, err)
+	}
+
+	if err = q.
+		BindString("$table", table).
+		BindString("$column", column).
+		QueryRow(func(stmt *sqlite.Stmt) error {
+			tableExists = stmt.GetInt64("table_exists") > 0
+			columnExists = stmt.GetInt64("column_exists") > 0
+
+			return nil
+		}); err != nil {
+		return fmt.Errorf("error querying column %q of table %q: %w", column, table, err)
+	}
+
+	if !tableExists || columnExists {
+		return nil
+	}
+
+	if err = sqlitex.ExecuteTransient(conn, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+definition, nil); err != nil {
+		return fmt.Errorf("adding column %q to table %q: %w", column, table, err)
+	}
+
+	return nil
+}
+
+// recordSchemaVersion records the schema version, keeping the versions recorded by newer compatible versions of the package.
+func (st *State) recordSchemaVersion(conn *sqlite.Conn) error {
+	for key, version := range map[string]int64{
+		"schema_version":     schemaVersion,
+		"min_reader_version": minReaderVersion,
+	} {
+		q, err := sqlitexx.NewQuery(conn,
+			`INSERT INTO `+st.options.TablePrefix+`meta (key, value) VALUES ($key, $value)
+			ON CONFLICT (key) DO UPDATE SET value = max(value, excluded.value)`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing schema version statement: %w", err)
+		}
+
+		if err = q.BindString("$key", key).BindInt64("$value", version).Exec(); err != nil {
+			return fmt.Errorf("error recording schema version: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// applySchema creates the tables, indexes and triggers which don't exist yet, followed by the metadata views
+// (if enabled) and the ExtraSchema.
+//
+// If DeferIndexes is set, the secondary indexes are left to buildIndexes.
+func (st *State) applySchema(conn *sqlite.Conn) error {
+	if err := applySchema(conn, st.options.TablePrefix, !st.options.DeferIndexes); err != nil {
+		return err
+	}
+
+	if st.options.MetadataViews {
+		if err := applyViews(conn, st.options.TablePrefix); err != nil {
+			return err
+		}
+	}
+
+	if st.options.ExtraSchema == "" {
+		return nil
+	}
+
+	// the placeholder is replaced literally (unlike the embedded schema), so the percent signs don't need escaping
+	extraSchema := strings.ReplaceAll(st.options.ExtraSchema, "%[1]s", st.options.TablePrefix)
+
+	if err := sqlitex.ExecScript(conn, extraSchema); err != nil {
+		return fmt.Errorf("applying extra schema: %w", err)
+	}
+
+	return nil
+}
+
+func applySchema(conn *sqlite.Conn, tablePrefix string, withIndexes bool) error {
+	schemaReplaced := fmt.Sprintf(schemaSQL, tablePrefix)
+
+	if err := sqlitex.ExecScript(conn, schemaReplaced); err != nil {
 		return fmt.Errorf("applying schema migration: %w", err)
 	}
 
+	if !withIndexes {
+		return nil
+	}
+
+	return applyIndexes(conn, tablePrefix)
+}
+
+func applyIndexes(conn *sqlite.Conn, tablePrefix string) error {
+	if err := sqlitex.ExecScript(conn, fmt.Sprintf(indexesSQL, tablePrefix)); err != nil {
+		return fmt.Errorf("creating indexes: %w", err)
+	}
+
+	return nil
+}
+
+func applyViews(conn *sqlite.Conn, tablePrefix string) error {
+	if err := sqlitex.ExecScript(conn, fmt.Sprintf(viewsSQL, tablePrefix)); err != nil {
+		return fmt.Errorf("creating metadata views: %w", err)
+	}
+
 	return nil
 }
+
+// rebuildTable changes the definition of the table (without the prefix) preserving the data.
+//
+// SQLite supports only a few ALTER TABLE changes, so other changes (e.g. adding NOT NULL constraints or defaults)
+// are done by creating a new table, copying the data, dropping the old table and renaming the new one,
+// see https://www.sqlite.org/lang_altertable.html#otheralter.
+//
+// Everything happens in a single transaction: readers keep using the old table until the commit,
+// so the migration doesn't require downtime even for big databases, only the writes are blocked.
+// Indexes and triggers are dropped with the old table, so the schema is applied again to recreate them.
+// The triggers and views referencing the table (e.g. the resources triggers inserting the events) are kept:
+// the legacy rename doesn't check them while the table is missing, and they reference the new table once it's renamed.
+//
+// The createSQL is the CREATE TABLE statement with the %s placeholder for the table name.
+// Columns are copied by name, so the new definition must have all of them.
+func (st *State) rebuildTable(conn *sqlite.Conn, table, createSQL string, columns []string) (err error) {
+	endFn, err := sqlitexx.Begin(conn)
+	if err != nil {
+		return fmt.Errorf("starting transaction for table rebuild: %w", err)
+	}
+
+	defer endFn(&err)
+
+	table = st.options.TablePrefix + table
+	newTable := table + "_rebuild"
+	columnList := strings.Join(columns, ", ")
+
+	if err = sqlitex.ExecuteTransient(conn, `PRAGMA legacy_alter_table = ON`, nil); err != nil {
+		return fmt.Errorf("enabling legacy rename for table %q: %w", table, err)
+	}
+
+	defer func() {
+		if pragmaErr := sqlitex.ExecuteTransient(conn, `PRAGMA legacy_alter_table = OFF`, nil); pragmaErr != nil && err == nil {
+			err = fmt.Errorf("disabling legacy rename for table %q: %w", table, pragmaErr)
+		}
+	}()
+
+	for _, query := range []string{
+		fmt.Sprintf(createSQL, newTable),
+		`INSERT INTO ` + newTable + ` (` + columnList + `) SELECT ` + columnList + ` FROM ` + table,
+		`DROP TABLE ` + table,
+		`ALTER TABLE ` + newTable + ` RENAME TO ` + table,
+	} {
+		var q *sqlitexx.Query
+
+		q, err = sqlitexx.NewQuery(conn, query)
+		if err != nil {
+			return fmt.Errorf("preparing table rebuild statement for %q: %w", table, err)
+		}
+
+		if err = q.Exec(); err != nil {
+			return fmt.Errorf("rebuilding table %q: %w", table, err)
+		}
+	}
+
+	return st.applySchema(conn)
+}
@@ -0,0 +1,476 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestRebuildTable(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		res := conformance.NewPathResource("ns1", "a")
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("ctrl")))
+
+		// add defaults to the owner and phase columns
+		require.NoError(t, st.RebuildTable(ctx, "resources", `CREATE TABLE %s (
+			namespace TEXT NOT NULL,
+			type TEXT NOT NULL,
+			id TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			labels BLOB NULL,
+			finalizers BLOB NULL,
+			phase INTEGER NOT NULL DEFAULT 0,
+			owner TEXT NOT NULL DEFAULT '',
+			spec BLOB NOT NULL,
+			generation INTEGER NOT NULL DEFAULT 1,
+			PRIMARY KEY (namespace, type, id)
+		) WITHOUT ROWID, STRICT`,
+			[]string{"namespace", "type", "id", "version", "created_at", "updated_at", "labels", "finalizers", "phase", "owner", "spec", "generation"},
+		))
+
+		list, err := st.List(ctx, res.Metadata(), state.WithLabelQuery(resource.LabelEqual("app", "foo")))
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, "ctrl", list.Items[0].Metadata().Owner())
+
+		// triggers are recreated
+		watchCh := make(chan state.Event, 1)
+
+		require.NoError(t, st.WatchKind(ctx, res.Metadata(), watchCh))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "b")))
+
+		select {
+		case ev := <-watchCh:
+			assert.Equal(t, state.Created, ev.Type)
+			assert.Equal(t, "b", ev.Resource.Metadata().ID())
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// invalid definition leaves the table intact
+		require.Error(t, st.RebuildTable(ctx, "resources", `CREATE TABLE %s (namespace TEXT NOT NULL)`, []string{"namespace", "spec"}))
+
+		_, err = st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+	})
+}
+
+func TestSchemaVersionGuard(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+	pool := newSqlitePool(t, path)
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	st.Close()
+
+	metaValue := func(key string) int64 {
+		conn, err := pool.Take(t.Context())
+		require.NoError(t, err)
+
+		defer pool.Put(conn)
+
+		var value int64
+
+		require.NoError(t, sqlitex.Execute(conn, `SELECT value FROM meta WHERE key = ?`, &sqlitex.ExecOptions{
+			Args: []any{key},
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				value = stmt.ColumnInt64(0)
+
+				return nil
+			},
+		}))
+
+		return value
+	}
+
+	assert.EqualValues(t, sqlite.SchemaVersion, metaValue("schema_version"))
+	assert.EqualValues(t, sqlite.MinReaderVersion, metaValue("min_reader_version"))
+
+	// a newer compatible version doesn't prevent opening the database, and the version is not downgraded
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.Execute(conn, `UPDATE meta SET value = ? WHERE key = 'schema_version'`, &sqlitex.ExecOptions{
+		Args: []any{sqlite.SchemaVersion + 1},
+	}))
+	pool.Put(conn)
+
+	st, err = sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	st.Close()
+
+	assert.EqualValues(t, sqlite.SchemaVersion+1, metaValue("schema_version"))
+
+	// an incompatible version is refused
+	conn, err = pool.Take(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.Execute(conn, `UPDATE meta SET value = ? WHERE key = 'min_reader_version'`, &sqlitex.ExecOptions{
+		Args: []any{sqlite.SchemaVersion + 1},
+	}))
+	pool.Put(conn)
+
+	_, err = sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.Error(t, err)
+	assert.True(t, sqlite.IsSchemaTooNewError(err))
+}
+
+func TestSchemaUpgradeTriggers(t *testing.T) {
+	t.Parallel()
+
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	st.Close()
+
+	triggerSQL := func() string {
+		conn, err := pool.Take(t.Context())
+		require.NoError(t, err)
+
+		defer pool.Put(conn)
+
+		var sql string
+
+		require.NoError(t, sqlitex.Execute(conn, `SELECT sql FROM sqlite_schema WHERE name = 'trg_resources_after_update'`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				sql = stmt.ColumnText(0)
+
+				return nil
+			},
+		}))
+
+		return sql
+	}
+
+	assert.Contains(t, triggerSQL(), "WHEN OLD.version != NEW.version")
+
+	// the trigger created by the schema version 2
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.ExecuteScript(conn, `
+		DROP TRIGGER trg_resources_after_update;
+		CREATE TRIGGER trg_resources_after_update AFTER UPDATE ON resources
+		BEGIN
+			INSERT INTO events (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
+			VALUES (NEW.namespace, NEW.type, NEW.id, unixepoch(), 2, OLD.spec, NEW.spec);
+		END;
+		UPDATE meta SET value = 2 WHERE key = 'schema_version';
+	`, nil))
+	pool.Put(conn)
+
+	st, err = sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	st.Close()
+
+	assert.Contains(t, triggerSQL(), "WHEN OLD.version != NEW.version")
+}
+
+func TestSchemaUpgradeGeneration(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	res := conformance.NewPathResource("default", "path")
+
+	require.NoError(t, st.Create(ctx, res))
+
+	st.Close()
+
+	// the schema version 3, without the generation columns
+	conn, err := pool.Take(ctx)
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.ExecuteScript(conn, `
+		DROP TRIGGER trg_resources_after_update;
+		ALTER TABLE resources DROP COLUMN generation;
+		ALTER TABLE events DROP COLUMN generation_changed;
+		CREATE TRIGGER trg_resources_after_update AFTER UPDATE ON resources
+		WHEN OLD.version != NEW.version
+		BEGIN
+			INSERT INTO events (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
+			VALUES (NEW.namespace, NEW.type, NEW.id, unixepoch(), 2, OLD.spec, NEW.spec);
+		END;
+		UPDATE meta SET value = 3 WHERE key = 'schema_version';
+		UPDATE meta SET value = 1 WHERE key = 'min_reader_version';
+	`, nil))
+	pool.Put(conn)
+
+	st, err = sqlite.NewState(ctx, pool, store.ProtobufMarshaler{})
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	generation, err := st.GetGeneration(ctx, res.Metadata())
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, generation)
+
+	ch := make(chan state.Event, 1)
+
+	require.NoError(t, st.WatchKind(ctx, res.Metadata(), ch, sqlite.WithGenerationChanges()))
+
+	res.Metadata().Labels().Set("app", "foo")
+	require.NoError(t, st.Update(ctx, res))
+
+	require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+	select {
+	case ev := <-ch:
+		assert.Equal(t, state.Destroyed, ev.Type)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+func TestExtraSchema(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+	pool := newSqlitePool(t, path)
+
+	const extraSchema = `
+		CREATE TABLE IF NOT EXISTS %[1]snotes (
+			id TEXT NOT NULL PRIMARY KEY,
+			note TEXT NOT NULL
+		) STRICT;
+
+		CREATE VIEW IF NOT EXISTS %[1]spath_resources AS
+			SELECT id FROM %[1]sresources WHERE type LIKE 'os/%'`
+
+	// the extra schema is applied to the new and the existing databases
+	for _, id := range []string{"path1", "path2"} {
+		st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{},
+			sqlite.WithTablePrefix("app_"), sqlite.WithExtraSchema(extraSchema))
+		require.NoError(t, err)
+
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("default", id)))
+
+		st.Close()
+	}
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	require.NoError(t, sqlitex.Execute(conn, `INSERT INTO app_notes (id, note) VALUES ('path1', 'note')`, nil))
+
+	var ids []string
+
+	require.NoError(t, sqlitex.Execute(conn, `SELECT id FROM app_path_resources ORDER BY id`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			ids = append(ids, stmt.ColumnText(0))
+
+			return nil
+		},
+	}))
+
+	assert.Equal(t, []string{"path1", "path2"}, ids)
+
+	_, err = sqlite.NewState(t.Context(), newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db")), store.ProtobufMarshaler{},
+		sqlite.WithExtraSchema(`CREATE TABLE notes (id TEXT NOT NULL PRIMARY KEY`))
+	assert.ErrorContains(t, err, "applying extra schema")
+}
+
+func TestMetadataViews(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{},
+		sqlite.WithTablePrefix("app_"), sqlite.WithMetadataViews(true), sqlite.WithGraveyardRetention(time.Hour))
+	require.NoError(t, err)
+
+	res := conformance.NewPathResource("default", "path")
+	res.Metadata().Labels().Set("app", "foo")
+
+	s := state.WrapCore(st)
+
+	require.NoError(t, s.Create(ctx, res))
+	require.NoError(t, s.AddFinalizer(ctx, res.Metadata(), "cleanup"))
+
+	_, err = s.Teardown(ctx, res.Metadata())
+	require.NoError(t, err)
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "destroyed")))
+	require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("default", "destroyed").Metadata()))
+
+	st.Close()
+
+	query := func(query string) []map[string]string {
+		conn, err := pool.Take(ctx)
+		require.NoError(t, err)
+
+		defer pool.Put(conn)
+
+		var rows []map[string]string
+
+		require.NoError(t, sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				row := map[string]string{}
+
+				for i := range stmt.ColumnCount() {
+					row[stmt.ColumnName(i)] = stmt.ColumnText(i)
+				}
+
+				rows = append(rows, row)
+
+				return nil
+			},
+		}))
+
+		return rows
+	}
+
+	rows := query(`SELECT * FROM app_resources_meta`)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "path", rows[0]["id"])
+	assert.Equal(t, "tearingDown", rows[0]["phase"])
+	assert.JSONEq(t, `{"app":"foo"}`, rows[0]["labels"])
+	assert.JSONEq(t, `["cleanup"]`, rows[0]["finalizers"])
+
+	created, err := time.Parse(time.RFC3339, rows[0]["created"])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), created, time.Minute)
+
+	var eventTypes []string
+
+	for _, row := range query(`SELECT event_type FROM app_events_meta ORDER BY event_id`) {
+		eventTypes = append(eventTypes, row["event_type"])
+	}
+
+	assert.Equal(t, []string{"created", "updated", "updated", "created", "destroyed"}, eventTypes)
+
+	rows = query(`SELECT * FROM app_graveyard_meta`)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "destroyed", rows[0]["id"])
+
+	// the views are read-only
+	conn, err := pool.Take(ctx)
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	assert.Error(t, sqlitex.Execute(conn, `DELETE FROM app_resources_meta`, nil))
+}
+
+func TestSchemaUpgradeAutoincrement(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithMetadataViews(true))
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", id)))
+	}
+
+	st.Close()
+
+	// the events table created by the schema version 6
+	conn, err := pool.Take(ctx)
+	require.NoError(t, err)
+	err = sqlitex.ExecuteScript(conn, `
+		CREATE TABLE events_v6 (
+			event_id INTEGER NOT NULL PRIMARY KEY,
+			namespace TEXT NOT NULL,
+			type TEXT NOT NULL,
+			id TEXT NOT NULL,
+			event_timestamp INTEGER NOT NULL,
+			event_type INTEGER NOT NULL,
+			spec_before BLOB NULL,
+			spec_after BLOB NULL,
+			generation_changed INTEGER NOT NULL DEFAULT 1
+		) STRICT;
+		INSERT INTO events_v6 SELECT event_id, namespace, type, id, event_timestamp, event_type, spec_before, spec_after, generation_changed FROM events;
+		DROP VIEW events_meta;
+		DROP TABLE events;
+		PRAGMA legacy_alter_table = ON;
+		ALTER TABLE events_v6 RENAME TO events;
+		PRAGMA legacy_alter_table = OFF;
+		DELETE FROM sqlite_sequence WHERE name = 'events';
+		UPDATE meta SET value = 6 WHERE key = 'schema_version';
+	`, nil)
+	pool.Put(conn)
+	require.NoError(t, err)
+
+	st, err = sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithMetadataViews(true))
+	require.NoError(t, err)
+
+	defer st.Close()
+
+	conn, err = pool.Take(ctx)
+	require.NoError(t, err)
+
+	defer pool.Put(conn)
+
+	var (
+		tableSQL string
+		events   int
+	)
+
+	require.NoError(t, sqlitex.Execute(conn, `SELECT (SELECT sql FROM sqlite_schema WHERE name = 'events'), (SELECT count(*) FROM events_meta)`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			tableSQL = stmt.ColumnText(0)
+			events = stmt.ColumnInt(1)
+
+			return nil
+		},
+	}))
+
+	assert.Contains(t, tableSQL, "AUTOINCREMENT")
+	assert.Equal(t, 2, events)
+
+	// the ID of the deleted latest event is not reused
+	require.NoError(t, sqlitex.Execute(conn, `DELETE FROM events WHERE event_id = 2`, nil))
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "c")))
+	assert.EqualValues(t, 3, st.Health(ctx).LastEventID)
+
+	// the metadata columns are added, and only populated for the new events
+	var withMetadata []int64
+
+	require.NoError(t, sqlitex.Execute(conn, `SELECT event_id FROM events WHERE phase IS NOT NULL AND owner IS NOT NULL`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			withMetadata = append(withMetadata, stmt.ColumnInt64(0))
+
+			return nil
+		},
+	}))
+
+	assert.Equal(t, []int64{3}, withMetadata)
+}
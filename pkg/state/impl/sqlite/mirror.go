@@ -0,0 +1,311 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/sub"
+)
+
+// mirror is the in-memory copy of the resources of a kind, see CachedKinds.
+//
+// The mirror is brought up to date from the event log on read, if it was notified about changes since the last read.
+// Like a kind watch, it holds back the compaction of the events it hasn't applied yet.
+type mirror struct {
+	kind      resource.Kind
+	sub       sub.Subscription
+	pos       *watchPosition
+	resources map[getCacheKey]resource.Resource
+
+	// loaded is false until the resources are loaded, and when they should be loaded again
+	loaded bool
+
+	mu sync.Mutex
+}
+
+func (st *State) startMirrors(ctx context.Context) error {
+	for _, kind := range st.options.CachedKinds {
+		m := &mirror{
+			kind: kind,
+			sub:  st.sub.Subscribe(kind),
+			pos:  st.trackWatch(kind.Namespace(), kind.Type(), ""),
+		}
+
+		st.mirrors = append(st.mirrors, m)
+
+		m.mu.Lock()
+		err := st.loadMirror(ctx, m)
+		m.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (st *State) stopMirrors() {
+	for _, m := range st.mirrors {
+		m.sub.Unsubscribe()
+		st.untrackWatch(m.pos)
+	}
+}
+
+// mirrorFor returns the mirror covering the resources of the type in the namespace,
+// an empty type only matches the mirror of the whole namespace.
+func (st *State) mirrorFor(ns resource.Namespace, typ resource.Type) *mirror {
+	for _, m := range st.mirrors {
+		if m.kind.Namespace() == ns && (m.kind.Type() == "" || m.kind.Type() == typ) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// loadMirror reads all the resources of the kind along with the last event ID in a single read transaction.
+func (st *State) loadMirror(ctx context.Context, m *mirror) error {
+	// the changes committed after the load notify the mirror again
+	select {
+	case <-m.sub.NotifyCh():
+	default:
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for cached kind %s: %w", m, err)
+	}
+
+	defer st.db.Put(conn)
+
+	resources := map[getCacheKey]resource.Resource{}
+
+	var eventID int64
+
+	err = func() (err error) {
+		defer sqlitex.Transaction(conn)(&err)
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`SELECT spec FROM `+st.options.TablePrefix+`resources WHERE `+kindCondition(m.kind),
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for cached kind %s: %w", m, err)
+		}
+
+		if err = q.
+			BindString("$namespace", m.kind.Namespace()).
+			BindStringIfSet("$type", m.kind.Type()).
+			QueryAll(
+				func(stmt *sqlite.Stmt) error {
+					spec := make([]byte, stmt.GetLen("spec"))
+					stmt.GetBytes("spec", spec)
+
+					res, unmarshalErr := st.unmarshalResource(spec, state.UnmarshalOptions{})
+					if unmarshalErr != nil {
+						return fmt.Errorf("failed to unmarshal resource of cached kind %s: %w", m, unmarshalErr)
+					}
+
+					resources[mirrorKey(res.Metadata())] = res
+
+					return nil
+				},
+			); err != nil {
+			return fmt.Errorf("error querying resources of cached kind %s: %w", m, err)
+		}
+
+		q, err = sqlitexx.NewQuery(
+			conn,
+			`SELECT coalesce(max(event_id), 0) AS max_event_id FROM `+st.options.TablePrefix+`events`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for initial event ID for cached kind %s: %w", m, err)
+		}
+
+		return q.QueryRow(func(stmt *sqlite.Stmt) error {
+			eventID = stmt.GetInt64("max_event_id")
+
+			return nil
+		})
+	}()
+	if err != nil {
+		return err
+	}
+
+	m.resources = resources
+	m.loaded = true
+	m.pos.eventID.Store(eventID)
+	m.pos.expired.Store(false)
+
+	return nil
+}
+
+// syncMirror applies the events written since the last sync, m.mu should be held.
+func (st *State) syncMirror(ctx context.Context, m *mirror) error {
+	if m.pos.expired.Load() {
+		// the compaction dropped the events the mirror hasn't applied yet
+		m.loaded = false
+	}
+
+	if !m.loaded {
+		return st.loadMirror(ctx, m)
+	}
+
+	select {
+	case <-m.sub.NotifyCh():
+	default:
+		return nil
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for cached kind %s: %w", m, err)
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT event_id, type, id, spec_after, event_type
+		FROM `+st.options.TablePrefix+`events
+		WHERE event_id > $event_id AND namespace = $namespace AND ($type = '' OR type = $type)
+		ORDER BY event_id ASC`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing query for cached kind %s events: %w", m, err)
+	}
+
+	eventID := m.pos.eventID.Load()
+
+	if err = q.
+		BindInt64("$event_id", eventID).
+		BindString("$namespace", m.kind.Namespace()).
+		BindString("$type", m.kind.Type()).
+		QueryAll(
+			func(stmt *sqlite.Stmt) error {
+				eventID = stmt.GetInt64("event_id")
+
+				key := getCacheKey{ns: m.kind.Namespace(), typ: stmt.GetText("type"), id: stmt.GetText("id")}
+
+				switch stmt.GetInt64("event_type") {
+				case 1, 2:
+					spec := make([]byte, stmt.GetLen("spec_after"))
+					stmt.GetBytes("spec_after", spec)
+
+					res, unmarshalErr := st.unmarshalResource(spec, state.UnmarshalOptions{})
+					if unmarshalErr != nil {
+						return fmt.Errorf("failed to unmarshal resource of cached kind %s: %w", m, unmarshalErr)
+					}
+
+					m.resources[key] = res
+				case 3:
+					delete(m.resources, key)
+				case resyncEventType:
+					// the resources were imported without events
+					m.loaded = false
+				}
+
+				return nil
+			},
+		); err != nil {
+		// the events can't be applied partially
+		m.loaded = false
+
+		return fmt.Errorf("error querying events for cached kind %s: %w", m, err)
+	}
+
+	if !m.loaded {
+		return st.loadMirror(ctx, m)
+	}
+
+	m.pos.eventID.Store(eventID)
+
+	return nil
+}
+
+func mirrorKey(md *resource.Metadata) getCacheKey {
+	return getCacheKey{ns: md.Namespace(), typ: md.Type(), id: md.ID()}
+}
+
+// mirrorGet returns a copy of the resource from the mirror, nil if the resource doesn't exist.
+func (st *State) mirrorGet(ctx context.Context, m *mirror, ptr resource.Pointer) (resource.Resource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := st.syncMirror(ctx, m); err != nil {
+		return nil, err
+	}
+
+	res, ok := m.resources[getCacheKey{ns: ptr.Namespace(), typ: ptr.Type(), id: ptr.ID()}]
+	if !ok {
+		return nil, nil
+	}
+
+	return res.DeepCopy(), nil
+}
+
+// mirrorList returns copies of the resources of the kind from the mirror, ordered by type and ID.
+//
+// If the owner is set, only the resources with the owner are returned (see WithOwner).
+func (st *State) mirrorList(ctx context.Context, m *mirror, resourceKind resource.Kind, options state.ListOptions, owner *string) (resource.List, error) {
+	m.mu.Lock()
+
+	if err := st.syncMirror(ctx, m); err != nil {
+		m.mu.Unlock()
+
+		return resource.List{}, err
+	}
+
+	var result resource.List
+
+	for key, res := range m.resources {
+		if resourceKind.Type() != "" && key.typ != resourceKind.Type() {
+			continue
+		}
+
+		if owner != nil && res.Metadata().Owner() != *owner {
+			continue
+		}
+
+		if !options.LabelQueries.Matches(*res.Metadata().Labels()) || !options.IDQuery.Matches(*res.Metadata()) {
+			continue
+		}
+
+		result.Items = append(result.Items, res.DeepCopy())
+	}
+
+	m.mu.Unlock()
+
+	slices.SortFunc(result.Items, func(a, b resource.Resource) int {
+		return cmp.Or(
+			cmp.Compare(a.Metadata().Type(), b.Metadata().Type()),
+			cmp.Compare(a.Metadata().ID(), b.Metadata().ID()),
+		)
+	})
+
+	return result, nil
+}
+
+// logMirrorError logs the failure to serve the read from the mirror, the read falls back to the database.
+func (st *State) logMirrorError(m *mirror, err error) {
+	st.options.Logger.Warn("failed to read cached kind, reading from the database", zap.Stringer("kind", m), zap.Error(err))
+}
+
+func (m *mirror) String() string {
+	return m.kind.Namespace() + "/" + m.kind.Type()
+}
@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestCachedKinds(t *testing.T) {
+	t.Parallel()
+
+	var unmarshaled atomic.Int64
+
+	kind := conformance.NewPathResource("default", "").Metadata()
+
+	withSqliteMarshaler(t, countingMarshaler{unmarshaled: &unmarshaled}, func(st *sqlite.State) {
+		ctx := t.Context()
+		s := state.WrapCore(st)
+
+		res := conformance.NewPathResource("default", "b")
+
+		require.NoError(t, s.Create(ctx, res))
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "a")))
+
+		// the writes are seen by the following reads
+		list, err := st.List(ctx, kind)
+		require.NoError(t, err)
+		require.Len(t, list.Items, 2)
+		assert.Equal(t, "a", list.Items[0].Metadata().ID())
+		assert.Equal(t, "b", list.Items[1].Metadata().ID())
+
+		before := unmarshaled.Load()
+
+		got, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, res.Metadata().Version(), got.Metadata().Version())
+
+		_, err = st.List(ctx, kind)
+		require.NoError(t, err)
+		assert.Equal(t, before, unmarshaled.Load(), "the mirrored resources should not be unmarshaled")
+
+		// the returned resources are copies
+		got.Metadata().Labels().Set("modified", "true")
+
+		res.Metadata().Labels().Set("app", "foo")
+		require.NoError(t, s.Update(ctx, res))
+
+		got, err = st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, res.Metadata().Version(), got.Metadata().Version())
+
+		list, err = st.List(ctx, kind, state.WithLabelQuery(resource.LabelExists("modified")))
+		require.NoError(t, err)
+		assert.Empty(t, list.Items)
+
+		list, err = st.List(ctx, kind, state.WithLabelQuery(resource.LabelEqual("app", "foo")))
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, "b", list.Items[0].Metadata().ID())
+
+		require.NoError(t, s.Destroy(ctx, res.Metadata()))
+
+		_, err = st.Get(ctx, res.Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+
+		// the import reloads the mirror
+		require.NoError(t, st.Import(ctx, []resource.Resource{
+			conformance.NewPathResource("default", "c"),
+			conformance.NewPathResource("default", "d"),
+		}))
+
+		list, err = st.List(ctx, kind)
+		require.NoError(t, err)
+		require.Len(t, list.Items, 3)
+		assert.Equal(t, "a", list.Items[0].Metadata().ID())
+		assert.Equal(t, "c", list.Items[1].Metadata().ID())
+		assert.Equal(t, "d", list.Items[2].Metadata().ID())
+
+		// the resources of other kinds are read from the database
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("other", "e")))
+
+		_, err = st.Get(ctx, conformance.NewPathResource("other", "e").Metadata())
+		require.NoError(t, err)
+	}, sqlite.WithCachedKinds(kind))
+}
+
+func TestCachedKindsWatchLeak(t *testing.T) {
+	t.Parallel()
+
+	kind := conformance.NewPathResource("default", "").Metadata()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		require.True(t, st.EmptySubscriptions())
+
+		// the watch shares the subscription key with the mirror of the kind
+		require.NoError(t, st.WatchKind(ctx, kind, make(chan state.Event, 1)))
+
+		assert.False(t, st.EmptySubscriptions())
+
+		cancel()
+
+		assert.Eventually(t, st.EmptySubscriptions, time.Second, time.Millisecond)
+	}, sqlite.WithCachedKinds(kind))
+}
@@ -10,12 +10,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/state"
 	"zombiezen.com/go/sqlite"
-	"zombiezen.com/go/sqlite/sqlitex"
 
 	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
 )
@@ -23,13 +24,33 @@ import (
 // Create a resource.
 //
 // If a resource already exists, Create returns an error.
-func (st *State) Create(ctx context.Context, res resource.Resource, opts ...state.CreateOption) error {
+func (st *State) Create(ctx context.Context, res resource.Resource, opts ...state.CreateOption) (err error) {
+	defer st.convertCanceled(ctx, &err)
+
 	var options state.CreateOptions
 
 	for _, opt := range opts {
 		opt(&options)
 	}
 
+	return st.create(ctx, res, options, nil)
+}
+
+// create is Create, inTx (if set) is called within the transaction after the resource is inserted.
+//
+//nolint:gocognit
+func (st *State) create(ctx context.Context, res resource.Resource, options state.CreateOptions, inTx func(*sqlite.Conn) error) error {
+	if err := st.checkNamespace(res.Metadata().Namespace()); err != nil {
+		return fmt.Errorf("failed to create: %w", err)
+	}
+
+	unlock, err := st.lockKind(ctx, res.Metadata())
+	if err != nil {
+		return fmt.Errorf("failed to create: %w", err)
+	}
+
+	defer unlock()
+
 	resCopy := res.DeepCopy()
 
 	if err := resCopy.Metadata().SetOwner(options.Owner); err != nil {
@@ -39,6 +60,10 @@ func (st *State) Create(ctx context.Context, res resource.Resource, opts ...stat
 	resCopy.Metadata().SetCreated(time.Now())
 	resCopy.Metadata().SetVersion(resCopy.Metadata().Version().Next())
 
+	if err := st.mutate(ctx, OperationCreate, resCopy); err != nil {
+		return fmt.Errorf("failed to create: %w", err)
+	}
+
 	var labels []byte
 
 	if !resCopy.Metadata().Labels().Empty() {
@@ -61,63 +86,122 @@ func (st *State) Create(ctx context.Context, res resource.Resource, opts ...stat
 		}
 	}
 
-	m, err := st.marshaler.MarshalResource(resCopy)
+	m, err := st.marshalResource(resCopy)
 	if err != nil {
 		return fmt.Errorf("failed to marshal resource: %w", err)
 	}
 
-	conn, err := st.db.Take(ctx)
-	if err != nil {
-		return fmt.Errorf("error taking connection for create: %w", err)
-	}
+	var (
+		result  = mutationResultFromContext(ctx)
+		eventID int64
+	)
 
-	defer st.db.Put(conn)
+	// the event is accounted before it is committed, see externalChanges
+	st.localEvents.Add(resCopy.Metadata(), 1)
 
-	q, err := sqlitexx.NewQuery(
-		conn,
-		`INSERT INTO `+st.options.TablePrefix+`resources 
-		(
-			namespace, 
-			type, 
-			id, 
-			version, 
-			created_at, 
-			updated_at, 
-			labels, 
-			finalizers,
-			phase, 
-			owner, 
-			spec
-		) 
-		VALUES 
-		($namespace, $type, $id, $version, $created_at, $updated_at, jsonb($labels), jsonb($finalizers), $phase, $owner, $spec)`,
-	)
-	if err != nil {
-		return fmt.Errorf("preparing insert statement: %w", err)
-	}
+	err = func() (err error) {
+		var conn *sqlite.Conn
 
-	err = q.
-		BindString("$namespace", resCopy.Metadata().Namespace()).
-		BindString("$type", resCopy.Metadata().Type()).
-		BindString("$id", resCopy.Metadata().ID()).
-		BindUint64("$version", resCopy.Metadata().Version().Value()).
-		BindInt64("$created_at", resCopy.Metadata().Created().Unix()).
-		BindInt64("$updated_at", resCopy.Metadata().Updated().Unix()).
-		BindBytes("$labels", labels).
-		BindBytes("$finalizers", finalizers).
-		BindInt("$phase", int(resCopy.Metadata().Phase())).
-		BindString("$owner", resCopy.Metadata().Owner()).
-		BindBytes("$spec", m).
-		Exec()
-	if err != nil {
-		if isUniqueViolationError(err) {
-			return ErrAlreadyExists(res.Metadata())
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for create: %w", err)
 		}
 
-		return fmt.Errorf("inserting resource into database: %w", err)
+		defer st.db.Put(conn)
+
+		// the event ID can only be fetched reliably within the same transaction,
+		// and the validators should see the database locked for writes
+		if result != nil || len(st.options.Validators) > 0 || inTx != nil {
+			doneFn, transErr := sqlitexx.BeginWithRetry(ctx, conn)
+			if transErr != nil {
+				return fmt.Errorf("starting transaction for create: %w", transErr)
+			}
+			defer doneFn(&err)
+		}
+
+		if err = st.checkWrite(conn, len(m)); err != nil {
+			return fmt.Errorf("failed to create: %w", err)
+		}
+
+		if err = st.validate(ctx, OperationCreate, resCopy); err != nil {
+			return fmt.Errorf("failed to create: %w", err)
+		}
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`INSERT INTO `+st.options.TablePrefix+`resources 
+			(
+				namespace, 
+				type, 
+				id, 
+				version, 
+				created_at, 
+				updated_at, 
+				labels, 
+				finalizers,
+				phase, 
+				owner, 
+				spec
+			) 
+			VALUES 
+			($namespace, $type, $id, $version, $created_at, $updated_at, jsonb($labels), jsonb($finalizers), $phase, $owner, $spec)`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing insert statement: %w", err)
+		}
+
+		// without the transaction, the insert takes the write lock itself, so it is retried the same way
+		err = q.
+			BindString("$namespace", resCopy.Metadata().Namespace()).
+			BindString("$type", resCopy.Metadata().Type()).
+			BindString("$id", resCopy.Metadata().ID()).
+			BindUint64("$version", resCopy.Metadata().Version().Value()).
+			BindInt64("$created_at", resCopy.Metadata().Created().Unix()).
+			BindInt64("$updated_at", resCopy.Metadata().Updated().Unix()).
+			BindBytes("$labels", labels).
+			BindBytes("$finalizers", finalizers).
+			BindInt("$phase", int(resCopy.Metadata().Phase())).
+			BindString("$owner", resCopy.Metadata().Owner()).
+			BindBytes("$spec", m).
+			ExecWithRetry(ctx)
+		if err != nil {
+			if isUniqueViolationError(err) {
+				return ErrAlreadyExists(res.Metadata())
+			}
+
+			return fmt.Errorf("inserting resource into database: %w", err)
+		}
+
+		if inTx != nil {
+			if err = inTx(conn); err != nil {
+				return err
+			}
+		}
+
+		if result != nil {
+			eventID, err = st.lastEventID(conn)
+		}
+
+		return err
+	}()
+	if err != nil {
+		st.localEvents.Add(resCopy.Metadata(), -1)
+
+		return err
 	}
 
-	st.sub.Notify(resCopy.Metadata())
+	// resource row and the create event
+	if result != nil {
+		result.Bookmark = encodeBookmark(eventID)
+	}
+
+	st.recordWrite("create", int64(2*len(m)+len(labels)+len(finalizers)), 2)
+
+	st.notify(ctx, resCopy.Metadata())
+
+	st.audit(OperationCreate, resCopy.Metadata())
+
+	st.runPostCommitHooks(OperationCreate, resCopy)
 
 	// This should be safe, because we don't allow to share metadata between goroutines even for read-only
 	// purposes.
@@ -132,25 +216,53 @@ func (st *State) Create(ctx context.Context, res resource.Resource, opts ...stat
 // On update current version of resource `new` in the state should match
 // the version on the backend, otherwise conflict error is returned.
 //
+// With SkipNoopUpdates, an update which doesn't change the resource succeeds without
+// writing anything: the version is not bumped and no event is generated.
+// The updates changing the resource spec bump the generation as well (see GetGeneration).
+//
 //nolint:gocognit
-func (st *State) Update(ctx context.Context, newResource resource.Resource, opts ...state.UpdateOption) error {
+func (st *State) Update(ctx context.Context, newResource resource.Resource, opts ...state.UpdateOption) (err error) {
+	defer st.convertCanceled(ctx, &err)
+
 	options := state.DefaultUpdateOptions()
 
 	for _, opt := range opts {
 		opt(&options)
 	}
 
-	resCopy := newResource.DeepCopy()
+	if err := st.checkNamespace(newResource.Metadata().Namespace()); err != nil {
+		return fmt.Errorf("failed to update: %w", err)
+	}
 
-	conn, err := st.db.Take(ctx)
+	unlock, err := st.lockKind(ctx, newResource.Metadata())
 	if err != nil {
-		return fmt.Errorf("error taking connection for update: %w", err)
+		return fmt.Errorf("failed to update: %w", err)
 	}
 
-	defer st.db.Put(conn)
+	defer unlock()
+
+	resCopy := newResource.DeepCopy()
+
+	var (
+		result   = mutationResultFromContext(ctx)
+		rowBytes int64
+		eventID  int64
+		noop     bool
+	)
+
+	st.localEvents.Add(resCopy.Metadata(), 1)
 
 	err = func() (err error) {
-		doneFn, transErr := sqlitex.ImmediateTransaction(conn)
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for update: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		doneFn, transErr := sqlitexx.BeginWithRetry(ctx, conn)
 		if transErr != nil {
 			return fmt.Errorf("starting transaction for update: %w", transErr)
 		}
@@ -160,12 +272,14 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 			currentOwner string
 			currentVer   uint64
 			createdAt    int64
+			updatedAt    int64
 			currentPhase int
+			currentSpec  []byte
 		)
 
 		q, err := sqlitexx.NewQuery(
 			conn,
-			`SELECT owner, version, created_at, phase 
+			`SELECT owner, version, created_at, updated_at, phase, spec
 	 		FROM `+st.options.TablePrefix+`resources
 			WHERE namespace = $namespace AND type = $type AND id = $id`,
 		)
@@ -181,7 +295,10 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 				currentOwner = stmt.GetText("owner")
 				currentVer = uint64(stmt.GetInt64("version"))
 				createdAt = stmt.GetInt64("created_at")
+				updatedAt = stmt.GetInt64("updated_at")
 				currentPhase = int(stmt.GetInt64("phase"))
+				currentSpec = make([]byte, stmt.GetLen("spec"))
+				stmt.GetBytes("spec", currentSpec)
 
 				return nil
 			}); err != nil {
@@ -193,7 +310,12 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 		}
 
 		if currentVer != newResource.Metadata().Version().Value() {
-			return fmt.Errorf("failed to update: %w", ErrVersionConflict(newResource.Metadata(), newResource.Metadata().Version().Value(), currentVer))
+			return fmt.Errorf("failed to update: %w", ErrStoredVersionConflict(newResource.Metadata(), VersionConflict{
+				Updated:  time.Unix(updatedAt, 0),
+				Owner:    currentOwner,
+				Expected: newResource.Metadata().Version().Value(),
+				Stored:   currentVer,
+			}))
 		}
 
 		if currentOwner != options.Owner {
@@ -210,11 +332,41 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 		resCopy.Metadata().SetCreated(time.Unix(createdAt, 0))
 		resCopy.Metadata().SetVersion(resCopy.Metadata().Version().Next())
 
-		m, err := st.marshaler.MarshalResource(resCopy)
+		if err = st.mutate(ctx, OperationUpdate, resCopy); err != nil {
+			return fmt.Errorf("failed to update: %w", err)
+		}
+
+		// the stored resource which can't be unmarshaled is considered changed
+		current, unmarshalErr := st.unmarshalResource(currentSpec, state.UnmarshalOptions{})
+		if unmarshalErr != nil {
+			current = nil
+		}
+
+		if st.options.SkipNoopUpdates && current != nil && isNoopUpdate(current, resCopy) {
+			noop = true
+
+			return nil
+		}
+
+		var generationDelta int
+
+		if current == nil || !specEqual(current, resCopy) {
+			generationDelta = 1
+		}
+
+		if err = st.validate(ctx, OperationUpdate, resCopy); err != nil {
+			return fmt.Errorf("failed to update: %w", err)
+		}
+
+		m, err := st.marshalResource(resCopy)
 		if err != nil {
 			return fmt.Errorf("failed to marshal resource: %w", err)
 		}
 
+		if err = st.checkWrite(conn, len(m)); err != nil {
+			return fmt.Errorf("failed to update: %w", err)
+		}
+
 		var labels []byte
 
 		if !resCopy.Metadata().Labels().Empty() {
@@ -235,6 +387,13 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 			}
 		}
 
+		// resource row and the update event with the spec before and after
+		rowBytes = int64(3*len(m) + len(labels) + len(finalizers))
+
+		if err = st.archiveVersion(conn, newResource.Metadata()); err != nil {
+			return fmt.Errorf("failed to update: %w", err)
+		}
+
 		q, err = sqlitexx.NewQuery(
 			conn,
 			`UPDATE `+st.options.TablePrefix+`resources
@@ -245,7 +404,8 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 					finalizers = jsonb($finalizers),
 					phase = $phase, 
 					owner = $owner, 
-					spec = $spec
+					spec = $spec,
+					generation = generation + $generation_delta
 				WHERE
 					namespace = $namespace AND type = $type AND id = $id AND version = $version_old`,
 		)
@@ -261,6 +421,7 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 			BindInt("$phase", int(resCopy.Metadata().Phase())).
 			BindString("$owner", resCopy.Metadata().Owner()).
 			BindBytes("$spec", m).
+			BindInt("$generation_delta", generationDelta).
 			BindString("$namespace", resCopy.Metadata().Namespace()).
 			BindString("$type", resCopy.Metadata().Type()).
 			BindString("$id", resCopy.Metadata().ID()).
@@ -270,16 +431,37 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 		}
 
 		if conn.Changes() != 1 {
-			return fmt.Errorf("failed to update: %w", ErrVersionConflict(newResource.Metadata(), newResource.Metadata().Version().Value(), currentVer))
+			return fmt.Errorf("failed to update: %w", ErrStoredVersionConflict(newResource.Metadata(), VersionConflict{
+				Updated:  time.Unix(updatedAt, 0),
+				Owner:    currentOwner,
+				Expected: newResource.Metadata().Version().Value(),
+				Stored:   currentVer,
+			}))
 		}
 
-		return nil
+		if result != nil {
+			eventID, err = st.lastEventID(conn)
+		}
+
+		return err
 	}()
-	if err != nil {
+	if err != nil || noop {
+		st.localEvents.Add(resCopy.Metadata(), -1)
+
 		return err
 	}
 
-	st.sub.Notify(resCopy.Metadata())
+	if result != nil {
+		result.Bookmark = encodeBookmark(eventID)
+	}
+
+	st.recordWrite("update", rowBytes, 2)
+
+	st.notify(ctx, resCopy.Metadata())
+
+	st.audit(OperationUpdate, resCopy.Metadata())
+
+	st.runPostCommitHooks(OperationUpdate, resCopy)
 
 	// This should be safe, because we don't allow to share metadata between goroutines even for read-only
 	// purposes.
@@ -288,18 +470,64 @@ func (st *State) Update(ctx context.Context, newResource resource.Resource, opts
 	return nil
 }
 
+// isNoopUpdate checks if the updated resource is the same as the stored one, apart from the version and timestamps.
+//
+// Specs without the Equal method are compared with reflect.DeepEqual, which might report
+// equal specs as different, and the stored resources which can't be unmarshaled are considered different;
+// this only makes the update not skipped.
+func isNoopUpdate(current, res resource.Resource) bool {
+	current.Metadata().SetVersion(res.Metadata().Version())
+
+	return resource.Equal(current, res)
+}
+
+// specEqual checks if the specs of the resources are equal, the same way resource.Equal does.
+func specEqual(r1, r2 resource.Resource) bool {
+	spec1, spec2 := r1.Spec(), r2.Spec()
+
+	if equality, ok := spec1.(interface {
+		Equal(any) bool
+	}); ok {
+		return equality.Equal(spec2)
+	}
+
+	return reflect.DeepEqual(spec1, spec2)
+}
+
 // Destroy a resource.
 //
 // If a resource doesn't exist, error is returned.
 // If a resource has pending finalizers, error is returned.
-func (st *State) Destroy(ctx context.Context, ptr resource.Pointer, opts ...state.DestroyOption) error {
+func (st *State) Destroy(ctx context.Context, ptr resource.Pointer, opts ...state.DestroyOption) (err error) {
+	defer st.convertCanceled(ctx, &err)
+
 	var options state.DestroyOptions
 
 	for _, opt := range opts {
 		opt(&options)
 	}
 
-	err := func() (err error) {
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return fmt.Errorf("failed to destroy: %w", err)
+	}
+
+	unlock, err := st.lockKind(ctx, ptr)
+	if err != nil {
+		return fmt.Errorf("failed to destroy: %w", err)
+	}
+
+	defer unlock()
+
+	var (
+		result     = mutationResultFromContext(ctx)
+		specSize   int64
+		eventID    int64
+		currentVer uint64
+	)
+
+	st.localEvents.Add(ptr, 1)
+
+	err = func() (err error) {
 		var conn *sqlite.Conn
 
 		conn, err = st.db.Take(ctx)
@@ -309,95 +537,142 @@ func (st *State) Destroy(ctx context.Context, ptr resource.Pointer, opts ...stat
 
 		defer st.db.Put(conn)
 
-		doneFn, transErr := sqlitex.ImmediateTransaction(conn)
+		doneFn, transErr := sqlitexx.BeginWithRetry(ctx, conn)
 		if transErr != nil {
 			return fmt.Errorf("starting transaction for destroy: %w", transErr)
 		}
 		defer doneFn(&err)
 
-		var (
-			currentOwner      string
-			currentVer        uint64
-			currentFinalizers []byte
-		)
+		if currentVer, specSize, err = st.destroyConn(conn, ptr, options.Owner); err != nil {
+			return err
+		}
 
-		q, err := sqlitexx.NewQuery(
-			conn,
-			`SELECT owner, json(finalizers) AS finalizers, version
-	 		FROM `+st.options.TablePrefix+`resources
-			WHERE namespace = $namespace AND type = $type AND id = $id`,
-		)
-		if err != nil {
-			return fmt.Errorf("preparing query for current resource state: %w", err)
+		if result != nil {
+			eventID, err = st.lastEventID(conn)
 		}
 
-		err = q.
-			BindString("$namespace", ptr.Namespace()).
-			BindString("$type", ptr.Type()).
-			BindString("$id", ptr.ID()).
-			QueryRow(
-				func(stmt *sqlite.Stmt) error {
-					currentOwner = stmt.GetText("owner")
-
-					currentFinalizers = make([]byte, stmt.GetLen("finalizers"))
-					stmt.GetBytes("finalizers", currentFinalizers)
-					currentVer = uint64(stmt.GetInt64("version"))
-
-					return nil
-				},
-			)
-		if err != nil {
-			if errors.Is(err, sqlitexx.ErrNoRows) {
-				return fmt.Errorf("failed to delete: %w", ErrNotFound(ptr))
-			}
+		return err
+	}()
+	if err != nil {
+		st.localEvents.Add(ptr, -1)
 
-			return fmt.Errorf("error querying current resource state: %w", err)
-		}
+		return err
+	}
 
-		if currentOwner != options.Owner {
-			return fmt.Errorf("failed to destroy: %w", ErrOwnerConflict(ptr, currentOwner))
-		}
+	// the resource row is removed, the destroy event keeps the spec before
+	if result != nil {
+		result.Bookmark = encodeBookmark(eventID)
+	}
 
-		if len(currentFinalizers) != 0 {
-			var fins resource.Finalizers
+	st.recordWrite("destroy", specSize, 2)
 
-			// attempt to unmarshal finalizers, but ignore errors, as it's only for message
-			json.Unmarshal(currentFinalizers, &fins) //nolint:errcheck
+	st.notify(ctx, ptr)
 
-			return fmt.Errorf("failed to destroy: %w", ErrPendingFinalizers(ptr, fins))
-		}
+	if st.options.PruneEmptyNamespaces {
+		st.queueNamespacePruning(ptr.Namespace())
+	}
 
-		q, err = sqlitexx.NewQuery(
-			conn,
-			`DELETE FROM `+st.options.TablePrefix+`resources
-				  WHERE
-		 			namespace = $namespace AND type = $type AND id = $id AND version = $version`,
+	if len(st.options.PostCommitHooks) > 0 || st.options.AuditLogger != nil {
+		version, _ := resource.ParseVersion(strconv.FormatUint(currentVer, 10)) //nolint:errcheck
+
+		md := resource.NewMetadata(ptr.Namespace(), ptr.Type(), ptr.ID(), version)
+		md.SetOwner(options.Owner) //nolint:errcheck // the owner of the new metadata is empty
+
+		st.audit(OperationDestroy, &md)
+
+		st.runPostCommitHooks(OperationDestroy, resource.NewTombstone(&md))
+	}
+
+	return nil
+}
+
+// destroyConn is Destroy on the connection, within the transaction of the caller.
+//
+// The version and the spec size of the destroyed resource are returned.
+func (st *State) destroyConn(conn *sqlite.Conn, ptr resource.Pointer, owner resource.Owner) (currentVer uint64, specSize int64, err error) {
+	var (
+		currentOwner      string
+		currentFinalizers []byte
+	)
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT owner, json(finalizers) AS finalizers, version, length(spec) AS spec_size
+ 		FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id`,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("preparing query for current resource state: %w", err)
+	}
+
+	err = q.
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		QueryRow(
+			func(stmt *sqlite.Stmt) error {
+				currentOwner = stmt.GetText("owner")
+
+				currentFinalizers = make([]byte, stmt.GetLen("finalizers"))
+				stmt.GetBytes("finalizers", currentFinalizers)
+				currentVer = uint64(stmt.GetInt64("version"))
+				specSize = stmt.GetInt64("spec_size")
+
+				return nil
+			},
 		)
-		if err != nil {
-			return fmt.Errorf("preparing delete statement: %w", err)
+	if err != nil {
+		if errors.Is(err, sqlitexx.ErrNoRows) {
+			return 0, 0, fmt.Errorf("failed to delete: %w", ErrNotFound(ptr))
 		}
 
-		err = q.
-			BindString("$namespace", ptr.Namespace()).
-			BindString("$type", ptr.Type()).
-			BindString("$id", ptr.ID()).
-			BindUint64("$version", currentVer).
-			Exec()
-		if err != nil {
-			return fmt.Errorf("error deleting resource from database: %w", err)
-		}
+		return 0, 0, fmt.Errorf("error querying current resource state: %w", err)
+	}
 
-		if conn.Changes() != 1 {
-			return fmt.Errorf("failed to delete: %w", ErrVersionConflict(ptr, currentVer, currentVer))
-		}
+	if currentOwner != owner {
+		return 0, 0, fmt.Errorf("failed to destroy: %w", ErrOwnerConflict(ptr, currentOwner))
+	}
 
-		return nil
-	}()
+	if len(currentFinalizers) != 0 {
+		var fins resource.Finalizers
+
+		// attempt to unmarshal finalizers, but ignore errors, as it's only for message
+		json.Unmarshal(currentFinalizers, &fins) //nolint:errcheck
+
+		return 0, 0, fmt.Errorf("failed to destroy: %w", ErrPendingFinalizers(ptr, fins))
+	}
+
+	if err = st.archiveVersion(conn, ptr); err != nil {
+		return 0, 0, fmt.Errorf("failed to destroy: %w", err)
+	}
+
+	if err = st.buryResource(conn, ptr); err != nil {
+		return 0, 0, fmt.Errorf("failed to destroy: %w", err)
+	}
+
+	q, err = sqlitexx.NewQuery(
+		conn,
+		`DELETE FROM `+st.options.TablePrefix+`resources
+			  WHERE
+	 			namespace = $namespace AND type = $type AND id = $id AND version = $version`,
+	)
 	if err != nil {
-		return err
+		return 0, 0, fmt.Errorf("preparing delete statement: %w", err)
 	}
 
-	st.sub.Notify(ptr)
+	err = q.
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		BindUint64("$version", currentVer).
+		Exec()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error deleting resource from database: %w", err)
+	}
 
-	return nil
+	if conn.Changes() != 1 {
+		return 0, 0, fmt.Errorf("failed to delete: %w", ErrVersionConflict(ptr, currentVer, currentVer))
+	}
+
+	return currentVer, specSize, nil
 }
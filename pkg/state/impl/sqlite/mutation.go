@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// MutationResult holds the outcome of a mutation (Create, Update or Destroy).
+type MutationResult struct {
+	// Bookmark points to the event produced by the mutation.
+	Bookmark state.Bookmark
+}
+
+// WatchOption returns a watch option which starts the watch with the event produced by the mutation.
+//
+// The watch delivers the mutation's own event first, followed by all later events,
+// which guarantees that the watcher observes its own write (read-your-writes).
+// If no mutation was recorded, the option does nothing.
+func (r *MutationResult) WatchOption() state.WatchOption {
+	return func(opts *state.WatchOptions) {
+		eventID, err := decodeBookmarkOrZero(r.Bookmark)
+		if err != nil || eventID == 0 {
+			return
+		}
+
+		// the bookmark right before the event, so that the event itself is delivered
+		opts.StartFromBookmark = encodeBookmark(eventID - 1)
+	}
+}
+
+type mutationResultKey struct{}
+
+// WithMutationResult returns a context which makes Create, Update and Destroy record their result into res.
+//
+// If several mutations are done with the same context, res holds the result of the last successful one.
+// As the context is passed through state wrappers unmodified, this works with state.WrapCore as well.
+func WithMutationResult(ctx context.Context, res *MutationResult) context.Context {
+	return context.WithValue(ctx, mutationResultKey{}, res)
+}
+
+func mutationResultFromContext(ctx context.Context) *MutationResult {
+	res, _ := ctx.Value(mutationResultKey{}).(*MutationResult) //nolint:errcheck
+
+	return res
+}
+
+// lastEventID returns the ID of the last event in the log, or zero if the log is empty.
+func (st *State) lastEventID(conn *sqlite.Conn) (int64, error) {
+	var eventID int64
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT coalesce(max(event_id), 0) AS max_event_id FROM `+st.options.TablePrefix+`events`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query for max event ID: %w", err)
+	}
+
+	if err = q.QueryRow(func(stmt *sqlite.Stmt) error {
+		eventID = stmt.GetInt64("max_event_id")
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error querying max event ID: %w", err)
+	}
+
+	return eventID, nil
+}
+
+// CreateWithResult creates a resource like Create does, and returns the result of the mutation.
+func (st *State) CreateWithResult(ctx context.Context, res resource.Resource, opts ...state.CreateOption) (MutationResult, error) {
+	var result MutationResult
+
+	err := st.Create(WithMutationResult(ctx, &result), res, opts...)
+
+	return result, err
+}
+
+// UpdateWithResult updates a resource like Update does, and returns the result of the mutation.
+func (st *State) UpdateWithResult(ctx context.Context, newResource resource.Resource, opts ...state.UpdateOption) (MutationResult, error) {
+	var result MutationResult
+
+	err := st.Update(WithMutationResult(ctx, &result), newResource, opts...)
+
+	return result, err
+}
+
+// DestroyWithResult destroys a resource like Destroy does, and returns the result of the mutation.
+func (st *State) DestroyWithResult(ctx context.Context, ptr resource.Pointer, opts ...state.DestroyOption) (MutationResult, error) {
+	var result MutationResult
+
+	err := st.Destroy(WithMutationResult(ctx, &result), ptr, opts...)
+
+	return result, err
+}
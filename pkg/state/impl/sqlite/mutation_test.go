@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestMutationResult(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(st state.State) {
+		var result sqlite.MutationResult
+
+		ctx := sqlite.WithMutationResult(t.Context(), &result)
+
+		res := conformance.NewPathResource("ns1", "a")
+
+		require.NoError(t, st.Create(ctx, res))
+
+		createBookmark := result.Bookmark
+		require.NotNil(t, createBookmark)
+
+		// the watch starts with the create event
+		ch := make(chan state.Event)
+
+		watchCtx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		require.NoError(t, st.Watch(watchCtx, res.Metadata(), ch, result.WatchOption()))
+
+		ev := <-ch
+		assert.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, createBookmark, ev.Bookmark)
+
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "b")))
+
+		res.Metadata().Labels().Set("key", "value")
+		require.NoError(t, st.Update(ctx, res))
+
+		updateBookmark := result.Bookmark
+
+		cmp, err := sqlite.CompareBookmarks(createBookmark, updateBookmark)
+		require.NoError(t, err)
+		assert.Equal(t, -1, cmp)
+
+		ev = <-ch
+		assert.Equal(t, state.Updated, ev.Type)
+		assert.Equal(t, updateBookmark, ev.Bookmark)
+
+		// failed mutations don't change the result
+		require.Error(t, st.Create(ctx, res))
+		assert.Equal(t, updateBookmark, result.Bookmark)
+
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		ev = <-ch
+		assert.Equal(t, state.Destroyed, ev.Type)
+		assert.Equal(t, result.Bookmark, ev.Bookmark)
+	})
+}
+
+func TestMutationWithResult(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+
+		created, err := st.CreateWithResult(ctx, res)
+		require.NoError(t, err)
+
+		res.Metadata().Labels().Set("key", "value")
+
+		updated, err := st.UpdateWithResult(ctx, res)
+		require.NoError(t, err)
+
+		destroyed, err := st.DestroyWithResult(ctx, res.Metadata())
+		require.NoError(t, err)
+
+		// resuming from the create bookmark yields exactly the update and destroy events
+		ch := make(chan state.Event)
+
+		require.NoError(t, st.Watch(ctx, res.Metadata(), ch, state.WithStartFromBookmark(created.Bookmark)))
+
+		ev := <-ch
+		assert.Equal(t, state.Updated, ev.Type)
+		assert.Equal(t, updated.Bookmark, ev.Bookmark)
+
+		ev = <-ch
+		assert.Equal(t, state.Destroyed, ev.Type)
+		assert.Equal(t, destroyed.Bookmark, ev.Bookmark)
+
+		_, err = st.DestroyWithResult(ctx, res.Metadata())
+		require.Error(t, err)
+		assert.True(t, state.IsNotFoundError(err))
+	})
+}
+
+func TestSkipNoopUpdates(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(st state.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, st.Create(ctx, res))
+
+		ch := make(chan state.Event)
+
+		require.NoError(t, st.Watch(ctx, res.Metadata(), ch))
+
+		ev := <-ch
+		assert.Equal(t, state.Created, ev.Type)
+
+		require.NoError(t, st.Update(ctx, res))
+		assert.Equal(t, "1", res.Metadata().Version().String())
+
+		got, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, "1", got.Metadata().Version().String())
+
+		res.Metadata().Annotations().Set("note", "changed")
+		require.NoError(t, st.Update(ctx, res))
+		assert.Equal(t, "2", res.Metadata().Version().String())
+
+		// the next event is the update which changed the resource
+		ev = <-ch
+		assert.Equal(t, state.Updated, ev.Type)
+		assert.Equal(t, "2", ev.Resource.Metadata().Version().String())
+
+		// the version is still checked
+		res.Metadata().SetVersion(res.Metadata().Version().Next())
+		require.Error(t, st.Update(ctx, res))
+	}, sqlite.WithSkipNoopUpdates(true))
+}
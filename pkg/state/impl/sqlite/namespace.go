@@ -0,0 +1,20 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"slices"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// checkNamespace verifies that the namespace is allowed by the state options.
+func (st *State) checkNamespace(ns resource.Namespace) error {
+	if len(st.options.Namespaces) == 0 || slices.Contains(st.options.Namespaces, ns) {
+		return nil
+	}
+
+	return ErrNamespaceNotAllowed(ns)
+}
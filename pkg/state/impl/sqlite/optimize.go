@@ -0,0 +1,35 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Optimize refreshes the statistics used by the query planner.
+//
+// Stale statistics might cause SQLite to choose table scans for label-filtered lists as the tables grow.
+// Optimize runs PRAGMA optimize, which runs ANALYZE only on the tables which changed significantly
+// since the last analysis, so it's cheap if nothing changed.
+// Optimize is run periodically in the background (see OptimizeInterval), and after Import and ApplyManifests.
+func (st *State) Optimize(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking connection for optimize: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	// 0x10000 checks all tables, not only the ones queried via this connection,
+	// 0x02 runs ANALYZE if it's beneficial
+	if err = sqlitex.ExecuteTransient(conn, `PRAGMA optimize=0x10002`, nil); err != nil {
+		return fmt.Errorf("error optimizing database: %w", err)
+	}
+
+	return nil
+}
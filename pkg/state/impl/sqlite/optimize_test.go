@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestOptimize(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	st := newSqliteState(t, "file:"+dbPath, sqlite.WithCompactionInterval(0))
+
+	for i := range 100 {
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+	}
+
+	require.NoError(t, st.Optimize(t.Context()))
+
+	assert.Subset(t, analyzedTables(t, dbPath), []string{"events", "resources"})
+}
+
+func TestOptimizeAfterImport(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	st := newSqliteState(t, "file:"+dbPath, sqlite.WithCompactionInterval(0))
+
+	resources := make([]resource.Resource, 0, 100)
+
+	for i := range 100 {
+		resources = append(resources, conformance.NewPathResource("ns1", strconv.Itoa(i)))
+	}
+
+	require.NoError(t, st.Import(t.Context(), resources))
+
+	assert.Contains(t, analyzedTables(t, dbPath), "resources")
+}
+
+// analyzedTables returns the tables with the query planner statistics.
+func analyzedTables(t *testing.T, dbPath string) []string {
+	t.Helper()
+
+	conn, err := zombiesqlite.OpenConn(dbPath, zombiesqlite.OpenReadOnly)
+	require.NoError(t, err)
+
+	defer conn.Close() //nolint:errcheck
+
+	var analyzed []string
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `SELECT DISTINCT tbl FROM sqlite_stat1 ORDER BY tbl`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			analyzed = append(analyzed, stmt.ColumnText(0))
+
+			return nil
+		},
+	}))
+
+	return analyzed
+}
@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+var schemaObjectRe = regexp.MustCompile(`CREATE (TABLE|INDEX|TRIGGER|VIEW) (?:IF NOT EXISTS )?(\S+)`)
+
+// schemaObject is a table, index, trigger or view created by the schema (or the metadata views).
+type schemaObject struct {
+	typ  string
+	name string
+}
+
+// schemaObjects returns the objects created by the schema, the indexes and the metadata views with the table prefix, in the schema order.
+func schemaObjects(tablePrefix string) []schemaObject {
+	matches := schemaObjectRe.FindAllStringSubmatch(fmt.Sprintf(schemaSQL+indexesSQL+viewsSQL, tablePrefix), -1)
+	objects := make([]schemaObject, 0, len(matches))
+
+	for _, match := range matches {
+		objects = append(objects, schemaObject{typ: match[1], name: match[2]})
+	}
+
+	return objects
+}
+
+// RenamePrefix renames the tables of the state with the table prefix oldPrefix to use newPrefix.
+//
+// The tables are renamed and the indexes and triggers are created again with the new names
+// in a single transaction, so the rename either fully succeeds or leaves the database intact.
+// This allows to rename or consolidate the tenants sharing the database without dump and restore.
+//
+// No State should use the old prefix while the tables are renamed.
+// If the tables with the new prefix already exist, an error is returned.
+func RenamePrefix(ctx context.Context, db SqlitexPool, oldPrefix, newPrefix string) error {
+	if oldPrefix == newPrefix {
+		return errors.New("old and new prefixes are the same")
+	}
+
+	conn, err := db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking connection for prefix rename: %w", err)
+	}
+
+	defer db.Put(conn)
+
+	return renamePrefix(conn, oldPrefix, newPrefix)
+}
+
+func renamePrefix(conn *sqlite.Conn, oldPrefix, newPrefix string) (err error) {
+	endFn, err := sqlitexx.Begin(conn)
+	if err != nil {
+		return fmt.Errorf("starting transaction for prefix rename: %w", err)
+	}
+
+	defer endFn(&err)
+
+	existing := map[string]struct{}{}
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT name FROM sqlite_schema`)
+	if err != nil {
+		return fmt.Errorf("preparing query for schema: %w", err)
+	}
+
+	if err = q.QueryAll(func(stmt *sqlite.Stmt) error {
+		existing[stmt.GetText("name")] = struct{}{}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("querying schema: %w", err)
+	}
+
+	if _, ok := existing[oldPrefix+"resources"]; !ok {
+		return fmt.Errorf("no tables with prefix %q", oldPrefix)
+	}
+
+	oldObjects, newObjects := schemaObjects(oldPrefix), schemaObjects(newPrefix)
+
+	for _, obj := range newObjects {
+		if _, ok := existing[obj.name]; ok && obj.typ == "TABLE" {
+			return fmt.Errorf("table %q already exists", obj.name)
+		}
+	}
+
+	var (
+		statements []string
+		hasViews   bool
+	)
+
+	// indexes, triggers and views are named after the prefix, so they are dropped and created again by the schema;
+	// dropping the triggers first also keeps them from being rewritten by the table renames
+	for _, obj := range oldObjects {
+		if _, ok := existing[obj.name]; ok && obj.typ != "TABLE" {
+			statements = append(statements, `DROP `+obj.typ+` `+obj.name)
+			hasViews = hasViews || obj.typ == "VIEW"
+		}
+	}
+
+	for i, obj := range oldObjects {
+		if _, ok := existing[obj.name]; ok && obj.typ == "TABLE" {
+			statements = append(statements, `ALTER TABLE `+obj.name+` RENAME TO `+newObjects[i].name)
+		}
+	}
+
+	for _, statement := range statements {
+		if err = sqlitex.ExecuteTransient(conn, statement, nil); err != nil {
+			return fmt.Errorf("renaming prefix %q to %q: %w", oldPrefix, newPrefix, err)
+		}
+	}
+
+	if err = applySchema(conn, newPrefix, true); err != nil {
+		return err
+	}
+
+	if hasViews {
+		return applyViews(conn, newPrefix)
+	}
+
+	return nil
+}
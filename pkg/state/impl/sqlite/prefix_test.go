@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestRenamePrefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithTablePrefix("old_"), sqlite.WithMetadataViews(true))
+	require.NoError(t, err)
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "a")))
+
+	st.Close()
+
+	other, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithTablePrefix("other_"))
+	require.NoError(t, err)
+
+	other.Close()
+
+	require.NoError(t, sqlite.RenamePrefix(ctx, pool, "old_", "new_"))
+
+	require.ErrorContains(t, sqlite.RenamePrefix(ctx, pool, "old_", "new_"), `no tables with prefix "old_"`)
+	require.ErrorContains(t, sqlite.RenamePrefix(ctx, pool, "new_", "other_"), `table "other_resources" already exists`)
+
+	conn, err := pool.Take(ctx)
+	require.NoError(t, err)
+
+	var names []string
+
+	require.NoError(t, sqlitex.Execute(conn, `SELECT name FROM sqlite_schema WHERE name LIKE '%old\_%' ESCAPE '\'`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			names = append(names, stmt.ColumnText(0))
+
+			return nil
+		},
+	}))
+
+	assert.Empty(t, names)
+
+	// the metadata views are created again for the renamed tables
+	var resources int
+
+	require.NoError(t, sqlitex.Execute(conn, `SELECT count(*) FROM new_resources_meta`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			resources = stmt.ColumnInt(0)
+
+			return nil
+		},
+	}))
+
+	pool.Put(conn)
+
+	assert.Equal(t, 1, resources)
+
+	st, err = sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithTablePrefix("new_"))
+	require.NoError(t, err)
+
+	defer st.Close()
+
+	_, err = st.Get(ctx, conformance.NewPathResource("ns1", "a").Metadata())
+	require.NoError(t, err)
+
+	// triggers are created for the renamed tables
+	watchCh := make(chan state.Event)
+
+	require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), watchCh))
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "b")))
+
+	select {
+	case ev := <-watchCh:
+		assert.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, "b", ev.Resource.Metadata().ID())
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// PruneNamespaceEvents deletes the events of the namespace, if all its resources were destroyed.
+//
+// The events of a deleted namespace (e.g. of a removed tenant) are otherwise kept until the compaction
+// reaches them, which takes CompactMinAge at least. The events not consumed yet by the active watches
+// of the namespace are kept. Instead of the deleted events, a resync marker is written for each resource
+// type of the namespace (see Import), so the kind watches resuming from a bookmark taken before the pruning
+// receive an error matching IsResyncRequiredError rather than miss the events.
+//
+// If the namespace still has resources, nothing is deleted. Pruning is skipped while a snapshot is active
+// (see BeginSnapshot). The number of deleted events is returned.
+func (st *State) PruneNamespaceEvents(ctx context.Context, ns resource.Namespace) (int64, error) {
+	if err := st.checkNamespace(ns); err != nil {
+		return 0, fmt.Errorf("failed to prune namespace events: %w", err)
+	}
+
+	// pruning is serialized with the compaction and the snapshots
+	select {
+	case st.compactSem <- struct{}{}:
+	case <-ctx.Done():
+		return 0, fmt.Errorf("waiting for the running compaction: %w", ctx.Err())
+	}
+
+	defer func() { <-st.compactSem }()
+
+	if st.snapshots > 0 {
+		st.options.Logger.Debug("namespace events pruning skipped due to active snapshot", zap.String("namespace", ns))
+
+		return 0, nil
+	}
+
+	var (
+		pruned int64
+		types  []resource.Type
+		marked []resource.Kind
+	)
+
+	err := func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for namespace events pruning: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		doneFn, err := sqlitexx.BeginWithRetry(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("starting transaction for namespace events pruning: %w", err)
+		}
+		defer doneFn(&err)
+
+		q, err := sqlitexx.NewQuery(conn,
+			`SELECT 1 FROM `+st.options.TablePrefix+`resources WHERE namespace = $namespace LIMIT 1`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for namespace resources: %w", err)
+		}
+
+		err = q.BindString("$namespace", ns).QueryRow(func(*sqlite.Stmt) error { return nil })
+
+		switch {
+		case err == nil:
+			// the namespace is still in use
+			return nil
+		case !errors.Is(err, sqlitexx.ErrNoRows):
+			return fmt.Errorf("error querying namespace resources: %w", err)
+		}
+
+		cutoff := st.namespaceWatchesCutoff(ns)
+
+		q, err = sqlitexx.NewQuery(conn,
+			`SELECT DISTINCT type FROM `+st.options.TablePrefix+`events
+			WHERE namespace = $namespace AND event_id < $cutoff AND event_type != $resync_event_type`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for namespace event types: %w", err)
+		}
+
+		if err = q.
+			BindString("$namespace", ns).
+			BindInt64("$cutoff", cutoff).
+			BindInt("$resync_event_type", resyncEventType).
+			QueryAll(
+				func(stmt *sqlite.Stmt) error {
+					types = append(types, stmt.GetText("type"))
+
+					return nil
+				},
+			); err != nil {
+			return fmt.Errorf("error querying namespace event types: %w", err)
+		}
+
+		// the markers get the IDs after all the pruned events (the event IDs are never reused),
+		// so the watches positioned anywhere before the cutoff see them
+		for _, typ := range types {
+			// the marker is accounted before it is committed, see externalChanges
+			md := resource.NewMetadata(ns, typ, "", resource.VersionUndefined)
+
+			st.localEvents.Add(&md, 1)
+
+			marked = append(marked, &md)
+
+			q, err = sqlitexx.NewQuery(
+				conn,
+				`INSERT INTO `+st.options.TablePrefix+`events (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
+				VALUES ($namespace, $type, '', unixepoch(), $event_type, NULL, NULL)`,
+			)
+			if err != nil {
+				return fmt.Errorf("preparing insert statement for resync marker: %w", err)
+			}
+
+			if err = q.
+				BindString("$namespace", ns).
+				BindString("$type", typ).
+				BindInt("$event_type", resyncEventType).
+				Exec(); err != nil {
+				return fmt.Errorf("inserting resync marker: %w", err)
+			}
+		}
+
+		// the resync markers are left to the compaction, so that the pruning can be repeated
+		q, err = sqlitexx.NewQuery(conn,
+			`DELETE FROM `+st.options.TablePrefix+`events
+			WHERE namespace = $namespace AND event_id < $cutoff AND event_type != $resync_event_type`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing namespace events pruning statement: %w", err)
+		}
+
+		if err = q.
+			BindString("$namespace", ns).
+			BindInt64("$cutoff", cutoff).
+			BindInt("$resync_event_type", resyncEventType).
+			Exec(); err != nil {
+			return fmt.Errorf("error pruning namespace events: %w", err)
+		}
+
+		pruned = int64(conn.Changes())
+
+		return nil
+	}()
+	if err != nil {
+		for _, kind := range marked {
+			st.localEvents.Add(kind, -1)
+		}
+
+		return 0, err
+	}
+
+	for _, typ := range types {
+		md := resource.NewMetadata(ns, typ, "", resource.VersionUndefined)
+
+		st.notify(ctx, &md)
+	}
+
+	return pruned, nil
+}
+
+// namespaceWatchesCutoff returns the first event ID which the active watches of the namespace might not have consumed yet.
+func (st *State) namespaceWatchesCutoff(ns resource.Namespace) int64 {
+	st.watchesMu.Lock()
+	defer st.watchesMu.Unlock()
+
+	cutoff := int64(math.MaxInt64)
+
+	for pos := range st.watches {
+		if pos.namespace == ns {
+			cutoff = min(cutoff, pos.eventID.Load()+1)
+		}
+	}
+
+	return cutoff
+}
+
+// queueNamespacePruning schedules the pruning of the namespace events by the background compaction, see PruneEmptyNamespaces.
+func (st *State) queueNamespacePruning(ns resource.Namespace) {
+	st.pruneQueueMu.Lock()
+	st.pruneQueue[ns] = struct{}{}
+	st.pruneQueueMu.Unlock()
+
+	st.TriggerCompaction()
+}
+
+// pruneQueuedNamespaces prunes the events of the namespaces queued by queueNamespacePruning.
+func (st *State) pruneQueuedNamespaces(ctx context.Context) {
+	st.pruneQueueMu.Lock()
+
+	namespaces := make([]resource.Namespace, 0, len(st.pruneQueue))
+
+	for ns := range st.pruneQueue {
+		namespaces = append(namespaces, ns)
+	}
+
+	clear(st.pruneQueue)
+
+	st.pruneQueueMu.Unlock()
+
+	for _, ns := range namespaces {
+		pruned, err := st.PruneNamespaceEvents(ctx, ns)
+		if err != nil {
+			st.options.Logger.Error("failed to prune namespace events", zap.String("namespace", ns), zap.Error(err))
+
+			continue
+		}
+
+		if pruned > 0 {
+			st.options.Logger.Info("namespace events pruned", zap.String("namespace", ns), zap.Int64("events", pruned))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestPruneNamespaceEvents(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		kept, err := st.CreateWithResult(ctx, conformance.NewPathResource("default", "kept"))
+		require.NoError(t, err)
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("tenant", "a")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("tenant", "b")))
+
+		// the namespace is still in use
+		pruned, err := st.PruneNamespaceEvents(ctx, "tenant")
+		require.NoError(t, err)
+		assert.Zero(t, pruned)
+
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("tenant", "a").Metadata()))
+		require.NoError(t, st.Destroy(ctx, conformance.NewPathResource("tenant", "b").Metadata()))
+
+		pruned, err = st.PruneNamespaceEvents(ctx, "tenant")
+		require.NoError(t, err)
+		assert.EqualValues(t, 4, pruned)
+
+		// the resync marker is left in place of the pruned events
+		pruned, err = st.PruneNamespaceEvents(ctx, "tenant")
+		require.NoError(t, err)
+		assert.Zero(t, pruned)
+
+		ch := make(chan state.Event, 1)
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("tenant", "").Metadata(), ch, state.WithKindStartFromBookmark(kept.Bookmark)))
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Errored, ev.Type)
+			assert.True(t, sqlite.IsResyncRequiredError(ev.Error), "unexpected error: %v", ev.Error)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// the events of other namespaces are kept
+		ch = make(chan state.Event, 1)
+
+		require.NoError(t, st.Watch(ctx, conformance.NewPathResource("default", "kept").Metadata(), ch, kept.WatchOption()))
+
+		select {
+		case ev := <-ch:
+			assert.Equal(t, state.Created, ev.Type)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	})
+}
+
+func TestPruneEmptyNamespaces(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("tenant", "a")
+
+		require.NoError(t, st.Create(ctx, res))
+
+		ch := make(chan state.Event, 2)
+
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("tenant", "").Metadata(), ch))
+
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		// the destroy event might be delivered before the marker
+		for {
+			select {
+			case ev := <-ch:
+				if ev.Type == state.Destroyed {
+					continue
+				}
+
+				require.Equal(t, state.Errored, ev.Type)
+				assert.True(t, sqlite.IsResyncRequiredError(ev.Error), "unexpected error: %v", ev.Error)
+
+				return
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+	}, sqlite.WithPruneEmptyNamespaces(true), sqlite.WithCompactionInterval(time.Hour))
+}
@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// redactedValue replaces the redacted specs, see RedactedKinds.
+const redactedValue = "<redacted>"
+
+// redacts returns true if the specs of the kind are redacted, see RedactedKinds.
+func (st *State) redacts(ns resource.Namespace, typ resource.Type) bool {
+	for _, kind := range st.options.RedactedKinds {
+		if kind.Namespace() == ns && (kind.Type() == "" || kind.Type() == typ) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactsParams returns true if the blobs bound to the statement should be redacted.
+//
+// The kind is found by the namespace and type parameters. If the statement doesn't have them
+// (e.g. it spans several kinds), the blobs are redacted if any of the kinds it might cover are redacted.
+func (st *State) redactsParams(params []sqlitexx.Param) bool {
+	if len(st.options.RedactedKinds) == 0 {
+		return false
+	}
+
+	var ns, typ *string
+
+	for _, param := range params {
+		value, ok := param.Value.(string)
+		if !ok || len(param.Name) < 2 {
+			continue
+		}
+
+		switch param.Name[1:] {
+		case "namespace":
+			ns = &value
+		case "type":
+			typ = &value
+		}
+	}
+
+	for _, kind := range st.options.RedactedKinds {
+		if ns != nil && *ns != kind.Namespace() {
+			continue
+		}
+
+		if typ != nil && *typ != "" && kind.Type() != "" && *typ != kind.Type() {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// statementLogger logs the statements at the debug level, see LogStatements.
+type statementLogger struct {
+	st     *State
+	logger *zap.Logger
+}
+
+// TraceStatement implements sqlitexx.Tracer.
+func (l *statementLogger) TraceStatement(query string, params []sqlitexx.Param) {
+	if ce := l.logger.Check(zap.DebugLevel, "sql statement"); ce != nil {
+		redact := l.st.redactsParams(params)
+
+		fields := make([]zap.Field, 0, len(params)+1)
+		fields = append(fields, zap.String("query", strings.Join(strings.Fields(query), " ")))
+
+		for _, param := range params {
+			switch value := param.Value.(type) {
+			case []byte:
+				if redact {
+					fields = append(fields, zap.String(param.Name, redactedValue+" ("+strconv.Itoa(len(value))+" bytes)"))
+				} else {
+					fields = append(fields, zap.Binary(param.Name, value))
+				}
+			default:
+				fields = append(fields, zap.Any(param.Name, value))
+			}
+		}
+
+		ce.Write(fields...)
+	}
+}
+
+// tracers passes the statements to each of the tracers.
+type tracers []sqlitexx.Tracer
+
+// TraceStatement implements sqlitexx.Tracer.
+func (t tracers) TraceStatement(query string, params []sqlitexx.Param) {
+	for _, tracer := range t {
+		tracer.TraceStatement(query, params)
+	}
+}
+
+// tracingPool sets the tracer on the connections taken from the pool, see LogStatements and StatementCounter.
+type tracingPool struct {
+	SqlitexPool
+
+	tracer sqlitexx.Tracer
+}
+
+// Take implements SqlitexPool.
+func (p *tracingPool) Take(ctx context.Context) (*sqlite.Conn, error) {
+	conn, err := p.SqlitexPool.Take(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlitexx.SetTracer(conn, p.tracer)
+
+	return conn, nil
+}
+
+// Put implements SqlitexPool.
+func (p *tracingPool) Put(conn *sqlite.Conn) {
+	sqlitexx.SetTracer(conn, nil)
+
+	p.SqlitexPool.Put(conn)
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestStatementLogging(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "public")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("secrets", "private")))
+
+		inserts := map[resource.Namespace]map[string]any{}
+
+		for _, entry := range logs.FilterMessage("sql statement").All() {
+			fields := entry.ContextMap()
+
+			query, _ := fields["query"].(string) //nolint:errcheck
+			if !strings.HasPrefix(query, "INSERT INTO test_resources") {
+				continue
+			}
+
+			ns, _ := fields["$namespace"].(string) //nolint:errcheck
+			inserts[ns] = fields
+		}
+
+		require.Contains(t, inserts, "default")
+		require.Contains(t, inserts, "secrets")
+
+		assert.IsType(t, []byte{}, inserts["default"]["$spec"])
+		assert.Contains(t, inserts["secrets"]["$spec"], "<redacted>")
+		assert.Equal(t, "private", inserts["secrets"]["$id"])
+
+		res := conformance.NewPathResource("secrets", "private")
+
+		spec := func(data []byte, err error) any {
+			require.NoError(t, err)
+
+			var event map[string]any
+
+			require.NoError(t, json.Unmarshal(data, &event))
+
+			return event["spec"]
+		}
+
+		assert.Equal(t, "<redacted>", spec(st.MarshalEventJSON(state.Event{Type: state.Created, Resource: res})))
+		assert.NotEqual(t, "<redacted>", spec(st.MarshalEventJSON(state.Event{Type: state.Created, Resource: conformance.NewPathResource("default", "public")})))
+		assert.NotEqual(t, "<redacted>", spec(sqlite.MarshalEventJSON(state.Event{Type: state.Created, Resource: res})))
+	},
+		sqlite.WithLogger(zap.New(core)),
+		sqlite.WithStatementLogging(true),
+		sqlite.WithRedactedKinds(conformance.NewPathResource("secrets", "").Metadata()),
+	)
+}
@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/filter"
+)
+
+// RawResource is a resource in the stored form.
+type RawResource struct {
+	// Metadata is built from the database columns.
+	//
+	// Annotations are not stored as columns, so they are not set.
+	Metadata resource.Metadata
+
+	// Spec is the full resource marshaled with the state marshaler.
+	Spec []byte
+
+	// Generation is the generation of the resource, see GetGeneration.
+	Generation uint64
+}
+
+const rawResourceColumns = `namespace, type, id, version, created_at, updated_at, json(labels) AS labels, json(finalizers) AS finalizers, phase, owner, spec, generation`
+
+// GetRaw returns a resource by type and ID in the stored form.
+//
+// GetRaw avoids unmarshaling the resource, which is useful for replication and proxy layers
+// forwarding the marshaled resource.
+// If a resource is not found, error is returned.
+func (st *State) GetRaw(ctx context.Context, ptr resource.Pointer) (*RawResource, error) {
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("taking connection for get: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	var raw *RawResource
+
+	q, err := sqlitexx.NewQuery(conn,
+		`SELECT `+rawResourceColumns+`
+		FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND id = $id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("preparing query for resource %q: %w", ptr, err)
+	}
+
+	err = q.
+		BindString("$namespace", ptr.Namespace()).
+		BindString("$type", ptr.Type()).
+		BindString("$id", ptr.ID()).
+		QueryRow(
+			func(stmt *sqlite.Stmt) error {
+				raw, err = st.scanRawResource(stmt)
+
+				return err
+			},
+		)
+	if err != nil {
+		if errors.Is(err, sqlitexx.ErrNoRows) {
+			return nil, fmt.Errorf("failed to get: %w", ErrNotFound(ptr))
+		}
+
+		return nil, fmt.Errorf("error querying resource %q: %w", ptr, err)
+	}
+
+	return raw, nil
+}
+
+// ListRaw lists resources by type in the stored form.
+//
+// ListRaw supports the same filtering options as List; unmarshal options are ignored.
+func (st *State) ListRaw(ctx context.Context, resourceKind resource.Kind, opts ...state.ListOption) ([]*RawResource, error) {
+	var options state.ListOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := st.checkNamespace(resourceKind.Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to list: %w", err)
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("taking connection for list: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	var result []*RawResource
+
+	q, err := st.newExplainedQuery(conn,
+		`SELECT `+rawResourceColumns+`
+		FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND `+filter.CompileLabelQueries(options.LabelQueries),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("preparing query for resources of kind %q: %w", resourceKind, err)
+	}
+
+	err = q.
+		BindString("$namespace", resourceKind.Namespace()).
+		BindString("$type", resourceKind.Type()).
+		QueryAll(
+			func(stmt *sqlite.Stmt) error {
+				raw, scanErr := st.scanRawResource(stmt)
+				if scanErr != nil {
+					return scanErr
+				}
+
+				if !options.LabelQueries.Matches(*raw.Metadata.Labels()) || !options.IDQuery.Matches(raw.Metadata) {
+					return nil
+				}
+
+				result = append(result, raw)
+
+				return nil
+			},
+		)
+	if err != nil {
+		return nil, fmt.Errorf("error querying resources of kind %q: %w", resourceKind, err)
+	}
+
+	return result, nil
+}
+
+// scanRawResource builds the raw resource from the row selected with rawResourceColumns.
+//
+// Encrypted specs are decrypted, so the raw spec is always the marshaled resource.
+func (st *State) scanRawResource(stmt *sqlite.Stmt) (*RawResource, error) {
+	version, err := resource.ParseVersion(strconv.FormatUint(uint64(stmt.GetInt64("version")), 10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse version: %w", err)
+	}
+
+	md := resource.NewMetadata(stmt.GetText("namespace"), stmt.GetText("type"), stmt.GetText("id"), version)
+	md.SetCreated(time.Unix(stmt.GetInt64("created_at"), 0))
+	md.SetUpdated(time.Unix(stmt.GetInt64("updated_at"), 0))
+	md.SetPhase(resource.Phase(stmt.GetInt64("phase")))
+
+	if err = md.SetOwner(stmt.GetText("owner")); err != nil {
+		return nil, fmt.Errorf("failed to set owner: %w", err)
+	}
+
+	if labels := stmt.GetText("labels"); labels != "" {
+		var rawLabels map[string]string
+
+		if err = json.Unmarshal([]byte(labels), &rawLabels); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal labels: %w", err)
+		}
+
+		for k, v := range rawLabels {
+			md.Labels().Set(k, v)
+		}
+	}
+
+	if finalizers := stmt.GetText("finalizers"); finalizers != "" {
+		var fins resource.Finalizers
+
+		if err = json.Unmarshal([]byte(finalizers), &fins); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal finalizers: %w", err)
+		}
+
+		md.Finalizers().Set(fins)
+	}
+
+	spec := make([]byte, stmt.GetLen("spec"))
+	stmt.GetBytes("spec", spec)
+
+	if spec, err = st.decryptSpec(spec); err != nil {
+		return nil, fmt.Errorf("failed to decrypt spec: %w", err)
+	}
+
+	return &RawResource{
+		Metadata:   md,
+		Spec:       spec,
+		Generation: uint64(stmt.GetInt64("generation")),
+	}, nil
+}
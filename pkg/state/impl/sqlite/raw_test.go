@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestRaw(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		res.Metadata().Labels().Set("app", "foo")
+		res.Metadata().Finalizers().Add("fin")
+
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("ctrl")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "b")))
+
+		raw, err := st.GetRaw(ctx, res.Metadata())
+		require.NoError(t, err)
+
+		assert.Equal(t, "a", raw.Metadata.ID())
+		assert.Equal(t, res.Metadata().Version(), raw.Metadata.Version())
+		assert.Equal(t, "ctrl", raw.Metadata.Owner())
+		assert.Equal(t, resource.PhaseRunning, raw.Metadata.Phase())
+		assert.True(t, raw.Metadata.Labels().Equal(*res.Metadata().Labels()))
+		assert.True(t, raw.Metadata.Finalizers().Has("fin"))
+
+		unmarshaled, err := store.ProtobufMarshaler{}.UnmarshalResource(raw.Spec)
+		require.NoError(t, err)
+		assert.Equal(t, res.Metadata().ID(), unmarshaled.Metadata().ID())
+
+		_, err = st.GetRaw(ctx, conformance.NewPathResource("ns1", "c").Metadata())
+		assert.True(t, state.IsNotFoundError(err))
+
+		list, err := st.ListRaw(ctx, conformance.NewPathResource("ns1", "").Metadata())
+		require.NoError(t, err)
+		assert.Len(t, list, 2)
+
+		list, err = st.ListRaw(ctx, conformance.NewPathResource("ns1", "").Metadata(), state.WithLabelQuery(resource.LabelEqual("app", "foo")))
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, "a", list[0].Metadata.ID())
+	})
+}
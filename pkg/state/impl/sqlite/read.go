@@ -5,9 +5,11 @@
 package sqlite
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/state"
@@ -21,18 +23,56 @@ import (
 //
 // If a resource is not found, error is returned.
 func (st *State) Get(ctx context.Context, ptr resource.Pointer, opts ...state.GetOption) (resource.Resource, error) {
+	return st.get(ctx, st.readDB, ptr, opts)
+}
+
+// get is Get reading from the pool (the read replica or the primary database).
+func (st *State) get(ctx context.Context, pool SqlitexPool, ptr resource.Pointer, opts []state.GetOption) (resource.Resource, error) {
 	var options state.GetOptions
 
 	for _, opt := range opts {
 		opt(&options)
 	}
 
-	conn, err := st.db.Take(ctx)
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	if m := st.mirrorFor(ptr.Namespace(), ptr.Type()); m != nil && !options.UnmarshalOptions.SkipProtobufUnmarshal {
+		res, err := st.mirrorGet(ctx, m, ptr)
+		if err == nil {
+			if res == nil {
+				return nil, fmt.Errorf("failed to get: %w", ErrNotFound(ptr))
+			}
+
+			return res, nil
+		}
+
+		st.logMirrorError(m, err)
+	}
+
+	// the cache holds the fully unmarshaled resources only
+	cacheable := st.getCache != nil && !options.UnmarshalOptions.SkipProtobufUnmarshal
+
+	var generation uint64
+
+	if cacheable {
+		var (
+			cached resource.Resource
+			ok     bool
+		)
+
+		if cached, generation, ok = st.getCache.get(ptr); ok {
+			return cached, nil
+		}
+	}
+
+	conn, err := pool.Take(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("taking connection for get: %w", err)
 	}
 
-	defer st.db.Put(conn)
+	defer pool.Put(conn)
 
 	var spec []byte
 
@@ -65,48 +105,118 @@ func (st *State) Get(ctx context.Context, ptr resource.Pointer, opts ...state.Ge
 		return nil, fmt.Errorf("error querying resource %q: %w", ptr, err)
 	}
 
-	res, err := st.marshaler.UnmarshalResource(spec)
+	res, err := st.unmarshalResource(spec, options.UnmarshalOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal resource %q: %w", ptr, err)
 	}
 
+	if cacheable {
+		st.getCache.put(res, generation)
+	}
+
 	return res, nil
 }
 
 // List resources by type.
+//
+// If the type of the kind is empty, resources of all types in the namespace are listed.
+//
+// The resources are listed ordered by the type and ID.
 func (st *State) List(ctx context.Context, resourceKind resource.Kind, opts ...state.ListOption) (resource.List, error) {
+	if m := st.mirrorFor(resourceKind.Namespace(), resourceKind.Type()); m != nil {
+		var options state.ListOptions
+
+		for _, opt := range opts {
+			opt(&options)
+		}
+
+		ext := takeListExtensions(&options)
+
+		if !options.UnmarshalOptions.SkipProtobufUnmarshal {
+			list, err := st.mirrorList(ctx, m, resourceKind, options, ext.owner)
+			if err == nil {
+				return list, nil
+			}
+
+			st.logMirrorError(m, err)
+		}
+	}
+
+	return st.list(ctx, resourceKind, ListFilter{}, opts)
+}
+
+// ListOrderedByLabel lists resources like List does, ordering the results by the value of the label.
+//
+// Resources without the label are listed last, ties are broken by the resource ID.
+// Ordering is done by the database, so it's cheap for UIs listing sorted resources (e.g. by hostname).
+func (st *State) ListOrderedByLabel(ctx context.Context, resourceKind resource.Kind, labelKey string, opts ...state.ListOption) (resource.List, error) {
+	return st.list(ctx, resourceKind, ListFilter{OrderByLabel: labelKey}, opts)
+}
+
+// ListFiltered lists resources like List does, applying additional conditions from the filter.
+func (st *State) ListFiltered(ctx context.Context, resourceKind resource.Kind, listFilter ListFilter, opts ...state.ListOption) (resource.List, error) {
+	return st.list(ctx, resourceKind, listFilter, opts)
+}
+
+func (st *State) list(ctx context.Context, resourceKind resource.Kind, listFilter ListFilter, opts []state.ListOption) (resource.List, error) {
 	var options state.ListOptions
 
 	for _, opt := range opts {
 		opt(&options)
 	}
 
+	if ext := takeListExtensions(&options); ext.owner != nil && listFilter.Owner == nil {
+		listFilter.Owner = ext.owner
+	}
+
+	if err := st.checkNamespace(resourceKind.Namespace()); err != nil {
+		return resource.List{}, fmt.Errorf("failed to list: %w", err)
+	}
+
 	matches := func(res resource.Resource) bool {
 		return options.LabelQueries.Matches(*res.Metadata().Labels()) && options.IDQuery.Matches(*res.Metadata())
 	}
 
-	conn, err := st.db.Take(ctx)
+	conn, err := st.readDB.Take(ctx)
 	if err != nil {
 		return resource.List{}, fmt.Errorf("taking connection for get: %w", err)
 	}
 
-	defer st.db.Put(conn)
+	defer st.readDB.Put(conn)
 
 	var result resource.List
 
-	q, err := sqlitexx.NewQuery(
-		conn,
-		`SELECT spec
-		FROM `+st.options.TablePrefix+`resources
-		WHERE namespace = $namespace AND type = $type AND `+filter.CompileLabelQueries(options.LabelQueries),
-	)
+	query := `SELECT spec
+		FROM ` + st.options.TablePrefix + `resources` + listFilter.indexHint(st.options.TablePrefix) + `
+		WHERE ` + kindCondition(resourceKind) + ` AND ` + filter.CompileLabelQueries(options.LabelQueries) +
+		listFilter.compile()
+
+	// labels which can't be ordered by the database are ordered after fetching the results
+	var orderInMemory bool
+
+	if listFilter.OrderByLabel != "" {
+		if order := filter.CompileLabelOrder(listFilter.OrderByLabel); order != "" {
+			query += ` ORDER BY ` + order + `, id`
+		} else {
+			orderInMemory = true
+		}
+	}
+
+	// the order doesn't depend on the index picked by the query planner (e.g. after Optimize)
+	if listFilter.OrderByLabel == "" || orderInMemory {
+		query += ` ORDER BY type, id`
+	}
+
+	q, err := st.newExplainedQuery(conn, query)
 	if err != nil {
 		return resource.List{}, fmt.Errorf("preparing query for resources of kind %q: %w", resourceKind, err)
 	}
 
+	listFilter.bind(q)
+
 	err = q.
 		BindString("$namespace", resourceKind.Namespace()).
-		BindString("$type", resourceKind.Type()).
+		BindStringIfSet("$type", resourceKind.Type()).
 		QueryAll(
 			func(stmt *sqlite.Stmt) error {
 				spec := make([]byte, stmt.GetLen("spec"))
@@ -114,7 +224,7 @@ func (st *State) List(ctx context.Context, resourceKind resource.Kind, opts ...s
 
 				var res resource.Resource
 
-				res, err = st.marshaler.UnmarshalResource(spec)
+				res, err = st.unmarshalResource(spec, options.UnmarshalOptions)
 				if err != nil {
 					return fmt.Errorf("failed to unmarshal resource of kind %q: %w", resourceKind, err)
 				}
@@ -132,5 +242,40 @@ func (st *State) List(ctx context.Context, resourceKind resource.Kind, opts ...s
 		return resource.List{}, fmt.Errorf("error querying resources of kind %q: %w", resourceKind, err)
 	}
 
+	if orderInMemory {
+		sortByLabel(result.Items, listFilter.OrderByLabel)
+	}
+
 	return result, nil
 }
+
+// kindCondition returns the SQL condition selecting the resources of the kind.
+//
+// An empty type selects the resources of all types in the namespace;
+// the type parameter should be bound with BindStringIfSet.
+func kindCondition(resourceKind resource.Kind) string {
+	if resourceKind.Type() == "" {
+		return `namespace = $namespace`
+	}
+
+	return `namespace = $namespace AND type = $type`
+}
+
+// sortByLabel orders the resources by the value of the label, resources without the label go last.
+//
+// The sort is stable, so the database order is preserved for equal values.
+func sortByLabel(items []resource.Resource, labelKey string) {
+	slices.SortStableFunc(items, func(a, b resource.Resource) int {
+		aValue, aOk := a.Metadata().Labels().Get(labelKey)
+		bValue, bOk := b.Metadata().Labels().Get(labelKey)
+
+		switch {
+		case aOk && !bOk:
+			return -1
+		case !aOk && bOk:
+			return 1
+		}
+
+		return cmp.Compare(aValue, bValue)
+	})
+}
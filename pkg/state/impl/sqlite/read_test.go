@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/protobuf"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/siderolabs/gen/xslices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestListOrderedByLabel(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for id, hostname := range map[string]string{
+			"a": "charlie",
+			"b": "alpha",
+			"c": "",
+			"d": "bravo",
+			"e": "alpha",
+		} {
+			res := conformance.NewPathResource("ns1", id)
+
+			if hostname != "" {
+				res.Metadata().Labels().Set("hostname", hostname)
+				res.Metadata().Labels().Set(`host"name`, hostname)
+			}
+
+			require.NoError(t, st.Create(ctx, res))
+		}
+
+		kind := conformance.NewPathResource("ns1", "").Metadata()
+		ids := func(list resource.List) []string {
+			return xslices.Map(list.Items, func(r resource.Resource) string { return r.Metadata().ID() })
+		}
+
+		list, err := st.ListOrderedByLabel(ctx, kind, "hostname")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "e", "d", "a", "c"}, ids(list))
+
+		// label key which can't be ordered by the database
+		list, err = st.ListOrderedByLabel(ctx, kind, `host"name`)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "e", "d", "a", "c"}, ids(list))
+
+		list, err = st.ListOrderedByLabel(ctx, kind, "hostname", state.WithLabelQuery(resource.LabelExists("hostname")))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "e", "d", "a"}, ids(list))
+	})
+}
+
+func TestListFiltered(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "a")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "b"), state.WithCreateOwner("ctrl")))
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "c"), state.WithCreateOwner("ctrl")))
+
+		_, err := state.WrapCore(st).Teardown(ctx, conformance.NewPathResource("ns1", "c").Metadata(), state.WithTeardownOwner("ctrl"))
+		require.NoError(t, err)
+
+		kind := conformance.NewPathResource("ns1", "").Metadata()
+		ids := func(list resource.List) []string {
+			return xslices.Map(list.Items, func(r resource.Resource) string { return r.Metadata().ID() })
+		}
+
+		owner, noOwner := "ctrl", ""
+		phase := resource.PhaseTearingDown
+
+		for _, test := range []struct { //nolint:govet
+			name     string
+			filter   sqlite.ListFilter
+			expected []string
+		}{
+			{
+				name:     "owner",
+				filter:   sqlite.ListFilter{Owner: &owner},
+				expected: []string{"b", "c"},
+			},
+			{
+				name:     "no owner",
+				filter:   sqlite.ListFilter{Owner: &noOwner},
+				expected: []string{"a"},
+			},
+			{
+				name:     "phase",
+				filter:   sqlite.ListFilter{Phase: &phase},
+				expected: []string{"c"},
+			},
+			{
+				name:     "updated within",
+				filter:   sqlite.ListFilter{UpdatedWithin: time.Hour},
+				expected: []string{"a", "b", "c"},
+			},
+			{
+				name:     "owner and phase",
+				filter:   sqlite.ListFilter{Owner: &noOwner, Phase: &phase},
+				expected: nil,
+			},
+		} {
+			list, err := st.ListFiltered(ctx, kind, test.filter)
+			require.NoError(t, err, test.name)
+			assert.Equal(t, test.expected, ids(list), test.name)
+		}
+
+		// the list option variant passes through the state wrappers
+		list, err := state.WrapCore(st).List(ctx, kind, sqlite.WithOwner("ctrl"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "c"}, ids(list))
+
+		list, err = st.List(ctx, kind, sqlite.WithOwner(""))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, ids(list))
+	})
+}
+
+func TestSkipProtobufUnmarshal(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		require.NoError(t, st.Create(ctx, res))
+
+		got, err := st.Get(ctx, res.Metadata(), state.WithGetUnmarshalOptions(state.WithSkipProtobufUnmarshal()))
+		require.NoError(t, err)
+		require.IsType(t, &protobuf.Resource{}, got)
+		assert.Equal(t, res.Metadata().ID(), got.Metadata().ID())
+		assert.Equal(t, res.Metadata().Version(), got.Metadata().Version())
+
+		list, err := st.List(ctx, res.Metadata(), state.WithListUnmarshalOptions(state.WithSkipProtobufUnmarshal()))
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		require.IsType(t, &protobuf.Resource{}, list.Items[0])
+
+		got, err = st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		require.IsType(t, &conformance.PathResource{}, got)
+	})
+}
@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Registry tracks the states of the process, see WithRegistry.
+//
+// Embedders running several states in one binary (e.g. one per table prefix) can publish a single expvar
+// (see Var) or serve a single debug handler covering all of them, instead of wiring every state separately.
+// The states are removed from the registry when they are closed.
+type Registry struct {
+	states map[*State]struct{}
+	mu     sync.Mutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		states: map[*State]struct{}{},
+	}
+}
+
+func (r *Registry) add(st *State) {
+	r.mu.Lock()
+	r.states[st] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *Registry) remove(st *State) {
+	r.mu.Lock()
+	delete(r.states, st)
+	r.mu.Unlock()
+}
+
+// States returns the registered states, ordered by the table prefix.
+func (r *Registry) States() []*State {
+	r.mu.Lock()
+
+	states := make([]*State, 0, len(r.states))
+
+	for st := range r.states {
+		states = append(states, st)
+	}
+
+	r.mu.Unlock()
+
+	slices.SortFunc(states, func(a, b *State) int {
+		return cmp.Compare(a.options.TablePrefix, b.options.TablePrefix)
+	})
+
+	return states
+}
+
+// RegistryReport is the summary of the registered states, see Registry.Report.
+type RegistryReport struct {
+	// States are the summaries of the states, ordered by the table prefix.
+	States []StateReport `json:"states"`
+
+	// DBSize is the total size of the tables of the states, see DBSize.
+	DBSize int64 `json:"db_size"`
+
+	// Watches is the total number of the active watches.
+	Watches int `json:"watches"`
+
+	// EventRate is the total rate of the events written via the states, in events per second.
+	EventRate float64 `json:"event_rate"`
+}
+
+// StateReport is the summary of a registered state.
+type StateReport struct {
+	// LastCompaction is the time the last compaction finished.
+	LastCompaction time.Time `json:"last_compaction,omitzero"`
+
+	// Error is the error of the last compaction, or of the size query.
+	Error string `json:"error,omitempty"`
+
+	// TablePrefix is the table prefix of the state.
+	TablePrefix string `json:"table_prefix"`
+
+	// DBSize is the size of the tables of the state, see DBSize.
+	//
+	// It is only reported by Report with the sizes requested.
+	DBSize int64 `json:"db_size,omitempty"`
+
+	// Watches is the number of the active watches.
+	Watches int `json:"watches"`
+
+	// EventRate is the rate of the events written via the state, in events per second.
+	EventRate float64 `json:"event_rate"`
+
+	// RemainingEvents is the number of events left after the last compaction.
+	RemainingEvents int64 `json:"remaining_events"`
+
+	// CompactionRunning is true if a compaction is running.
+	CompactionRunning bool `json:"compaction_running"`
+}
+
+// Report returns the summary of the registered states.
+//
+// The table sizes are calculated with the dbstat virtual table, which reads all the pages of the tables,
+// so they are only reported if withSizes is set.
+func (r *Registry) Report(ctx context.Context, withSizes bool) RegistryReport {
+	var report RegistryReport
+
+	for _, st := range r.States() {
+		stats := st.Stats()
+		compaction := st.CompactionStatus()
+
+		stateReport := StateReport{
+			TablePrefix:       st.options.TablePrefix,
+			Watches:           stats.Watches,
+			CompactionRunning: compaction.Running(),
+			LastCompaction:    compaction.LastFinished,
+		}
+
+		for _, kind := range stats.Kinds {
+			stateReport.EventRate += kind.EventRate
+		}
+
+		if compaction.LastInfo != nil {
+			stateReport.RemainingEvents = compaction.LastInfo.RemainingEvents
+		}
+
+		if compaction.LastError != nil {
+			stateReport.Error = compaction.LastError.Error()
+		}
+
+		if withSizes {
+			size, err := st.DBSize(ctx)
+			if err != nil {
+				stateReport.Error = err.Error()
+			}
+
+			stateReport.DBSize = size
+		}
+
+		report.States = append(report.States, stateReport)
+		report.DBSize += stateReport.DBSize
+		report.Watches += stateReport.Watches
+		report.EventRate += stateReport.EventRate
+	}
+
+	return report
+}
+
+// Var returns the expvar variable reporting the registered states (without the table sizes), e.g.:
+//
+//	expvar.Publish("sqlite_states", registry.Var())
+func (r *Registry) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return r.Report(context.Background(), false)
+	})
+}
+
+// ServeHTTP implements http.Handler, it serves the report of the registered states (with the table sizes) as JSON.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(r.Report(req.Context(), true))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data) //nolint:errcheck
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+	registry := sqlite.NewRegistry()
+
+	tenant1 := newSqliteState(t, path, sqlite.WithTablePrefix("tenant1_"), sqlite.WithRegistry(registry))
+
+	// closed by the test
+	tenant2, err := sqlite.NewState(ctx, newSqlitePool(t, path), store.ProtobufMarshaler{},
+		sqlite.WithTablePrefix("tenant2_"), sqlite.WithRegistry(registry))
+	require.NoError(t, err)
+
+	require.NoError(t, tenant1.Create(ctx, conformance.NewPathResource("default", "path")))
+	require.NoError(t, tenant2.WatchKind(ctx, conformance.NewPathResource("default", "").Metadata(), make(chan state.Event, 1)))
+
+	assert.Equal(t, []*sqlite.State{tenant1, tenant2}, registry.States())
+
+	report := registry.Report(ctx, false)
+	require.Len(t, report.States, 2)
+	assert.Equal(t, "tenant1_", report.States[0].TablePrefix)
+	assert.Positive(t, report.States[0].EventRate)
+	assert.Equal(t, 1, report.States[1].Watches)
+	assert.Equal(t, 1, report.Watches)
+	assert.Zero(t, report.DBSize)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/debug/sqlite", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var served sqlite.RegistryReport
+
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	require.Len(t, served.States, 2)
+	assert.Positive(t, served.States[0].DBSize)
+	assert.Equal(t, served.States[0].DBSize+served.States[1].DBSize, served.DBSize)
+
+	assert.Contains(t, registry.Var().String(), `"table_prefix":"tenant2_"`)
+
+	tenant2.Close()
+
+	assert.Equal(t, []*sqlite.State{tenant1}, registry.States())
+}
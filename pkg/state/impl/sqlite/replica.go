@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/siderolabs/gen/panicsafe"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+)
+
+// RefreshReadReplica copies the primary database to the read replica (see ReadReplica).
+//
+// The copy is done with the SQLite online backup API in a single step, so the readers of the replica
+// see either the previous or the new copy of the database.
+// The replica is refreshed periodically in the background, RefreshReadReplica can be called
+// to make recent writes visible to the reads immediately.
+func (st *State) RefreshReadReplica(ctx context.Context) error {
+	if st.options.ReadReplica == nil {
+		return errors.New("read replica is not configured")
+	}
+
+	start := time.Now()
+
+	src, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking connection for read replica refresh: %w", err)
+	}
+
+	defer st.db.Put(src)
+
+	dst, err := st.options.ReadReplica.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking read replica connection: %w", err)
+	}
+
+	defer st.options.ReadReplica.Put(dst)
+
+	backup, err := sqlite.NewBackup(dst, "main", src, "main")
+	if err != nil {
+		return fmt.Errorf("error starting read replica refresh: %w", err)
+	}
+
+	_, err = backup.Step(-1)
+
+	if closeErr := backup.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("error refreshing read replica: %w", err)
+	}
+
+	st.options.Logger.Debug("read replica refreshed", zap.Duration("duration", time.Since(start)))
+
+	return nil
+}
+
+func (st *State) runReadReplica() {
+	defer st.wg.Done()
+
+	ticker := time.NewTicker(st.options.ReadReplicaRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-st.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		if err := panicsafe.RunErrF(func() error {
+			return st.RefreshReadReplica(st.compactionCtx)
+		})(); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+
+			st.options.Logger.Error("failed to refresh read replica", zap.Error(err))
+		}
+	}
+}
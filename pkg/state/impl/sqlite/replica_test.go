@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestReadReplica(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	replica := newSqlitePool(t, "file:"+filepath.Join(dir, "replica.db"))
+
+	st := newSqliteState(t, "file:"+filepath.Join(dir, "state.db"), sqlite.WithReadReplica(replica, time.Hour))
+	ctx := t.Context()
+
+	res := conformance.NewPathResource("ns1", "a")
+
+	require.NoError(t, st.Create(ctx, res))
+
+	// the write is not visible until the replica is refreshed
+	_, err := st.Get(ctx, res.Metadata())
+	require.Error(t, err)
+	assert.True(t, state.IsNotFoundError(err))
+
+	// writes are still checked against the primary database
+	require.True(t, state.IsConflictError(st.Create(ctx, res)))
+
+	require.NoError(t, st.RefreshReadReplica(ctx))
+
+	_, err = st.Get(ctx, res.Metadata())
+	require.NoError(t, err)
+
+	list, err := st.List(ctx, res.Metadata())
+	require.NoError(t, err)
+	assert.Len(t, list.Items, 1)
+}
+
+func TestReadReplicaBackground(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	replica := newSqlitePool(t, "file:"+filepath.Join(dir, "replica.db"))
+
+	st := newSqliteState(t, "file:"+filepath.Join(dir, "state.db"), sqlite.WithReadReplica(replica, 10*time.Millisecond))
+	ctx := t.Context()
+
+	res := conformance.NewPathResource("ns1", "a")
+
+	require.NoError(t, st.Create(ctx, res))
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		_, err := st.Get(ctx, res.Metadata())
+		assert.NoError(collect, err)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,255 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/siderolabs/gen/channel"
+)
+
+// ResilientWatchOptions configures ResilientWatchKind.
+type ResilientWatchOptions struct {
+	// OnRestart is called (from the watch goroutine) with the error which made the watch restart.
+	//
+	// Default is nil.
+	OnRestart func(err error)
+
+	// WatchKindOptions are passed to WatchKind when the watch is (re-)established.
+	//
+	// The bootstrap contents are always enabled, so StartFromBookmark should not be used.
+	//
+	// Default is empty.
+	WatchKindOptions []state.WatchKindOption
+
+	// MinBackoff is the delay before the first attempt to re-establish the watch.
+	//
+	// The delay is doubled on each failed attempt up to MaxBackoff, and reset once the watch is bootstrapped.
+	//
+	// Default is 100 milliseconds.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum delay between the attempts to re-establish the watch.
+	//
+	// Default is 30 seconds.
+	MaxBackoff time.Duration
+}
+
+// ResilientWatchOption configures ResilientWatchKind.
+type ResilientWatchOption func(*ResilientWatchOptions)
+
+// DefaultResilientWatchOptions returns default ResilientWatchKind options.
+func DefaultResilientWatchOptions() ResilientWatchOptions {
+	return ResilientWatchOptions{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// WithRestartHandler sets the function called when the watch restarts.
+func WithRestartHandler(fn func(err error)) ResilientWatchOption {
+	return func(opts *ResilientWatchOptions) {
+		opts.OnRestart = fn
+	}
+}
+
+// WithWatchKindOptions sets the options of the underlying WatchKind.
+func WithWatchKindOptions(opts ...state.WatchKindOption) ResilientWatchOption {
+	return func(options *ResilientWatchOptions) {
+		options.WatchKindOptions = append(options.WatchKindOptions, opts...)
+	}
+}
+
+// WithRestartBackoff sets the bounds of the delay between the attempts to re-establish the watch.
+func WithRestartBackoff(minBackoff, maxBackoff time.Duration) ResilientWatchOption {
+	return func(opts *ResilientWatchOptions) {
+		opts.MinBackoff = minBackoff
+		opts.MaxBackoff = maxBackoff
+	}
+}
+
+// ResilientWatchKind watches the resource kind, transparently re-establishing the watch after errors.
+//
+// The watch starts with the bootstrap contents (the Created events followed by Bootstrapped).
+// When the underlying watch fails (e.g. it fell behind the compaction, Import requested a resync,
+// or the state was unavailable), it is established again with the bootstrap contents after a backoff,
+// and the new bootstrap is reconciled with the resources delivered before: the unchanged resources are skipped,
+// the changed ones are delivered as Updated, and the missing ones as Destroyed. The consumer sees
+// a single Bootstrapped event and no Errored events, the errors are reported to OnRestart instead.
+//
+// The last delivered version of each resource is kept in memory for the reconciliation.
+// The watch stops when ctx is canceled. It works with any state implementation.
+func ResilientWatchKind(ctx context.Context, st state.CoreState, kind resource.Kind, ch chan<- state.Event, opts ...ResilientWatchOption) error {
+	options := DefaultResilientWatchOptions()
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	w := &resilientWatch{
+		st:      st,
+		kind:    kind,
+		ch:      ch,
+		options: options,
+		known:   map[resilientKey]resource.Resource{},
+	}
+
+	innerCh, cancel, err := w.start(ctx)
+	if err != nil {
+		return err
+	}
+
+	go w.run(ctx, innerCh, cancel)
+
+	return nil
+}
+
+type resilientKey struct {
+	typ resource.Type
+	id  resource.ID
+}
+
+func resilientKeyOf(res resource.Resource) resilientKey {
+	return resilientKey{typ: res.Metadata().Type(), id: res.Metadata().ID()}
+}
+
+type resilientWatch struct {
+	st           state.CoreState
+	kind         resource.Kind
+	ch           chan<- state.Event
+	known        map[resilientKey]resource.Resource
+	options      ResilientWatchOptions
+	backoff      time.Duration
+	bootstrapped bool
+}
+
+// start establishes the underlying watch with the bootstrap contents.
+func (w *resilientWatch) start(ctx context.Context) (<-chan state.Event, context.CancelFunc, error) {
+	watchCtx, cancel := context.WithCancel(ctx)
+
+	innerCh := make(chan state.Event)
+
+	opts := append(append([]state.WatchKindOption(nil), w.options.WatchKindOptions...), state.WithBootstrapContents(true))
+
+	if err := w.st.WatchKind(watchCtx, w.kind, innerCh, opts...); err != nil {
+		cancel()
+
+		return nil, nil, err
+	}
+
+	return innerCh, cancel, nil
+}
+
+func (w *resilientWatch) run(ctx context.Context, innerCh <-chan state.Event, cancel context.CancelFunc) {
+	w.backoff = w.options.MinBackoff
+
+	for {
+		err := w.forward(ctx, innerCh)
+
+		cancel()
+
+		if err == nil {
+			return
+		}
+
+		for {
+			if w.options.OnRestart != nil {
+				w.options.OnRestart(err)
+			}
+
+			timer := time.NewTimer(w.backoff)
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+
+				return
+			case <-timer.C:
+			}
+
+			w.backoff = min(w.backoff*2, w.options.MaxBackoff)
+
+			if innerCh, cancel, err = w.start(ctx); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// forward delivers the events of the underlying watch until it fails, the error is nil if ctx is canceled.
+//
+//nolint:gocognit
+func (w *resilientWatch) forward(ctx context.Context, innerCh <-chan state.Event) error {
+	// the resources listed by the current bootstrap
+	listed := map[resilientKey]struct{}{}
+	bootstrapping := true
+
+	for {
+		var event state.Event
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case event = <-innerCh:
+		}
+
+		switch event.Type {
+		case state.Errored:
+			return event.Error
+		case state.Bootstrapped:
+			bootstrapping = false
+			w.backoff = w.options.MinBackoff
+
+			if !w.bootstrapped {
+				w.bootstrapped = true
+
+				break
+			}
+
+			// the resources destroyed while the watch was down
+			for key, res := range w.known {
+				if _, ok := listed[key]; ok {
+					continue
+				}
+
+				delete(w.known, key)
+
+				if !channel.SendWithContext(ctx, w.ch, state.Event{Type: state.Destroyed, Resource: res}) {
+					return nil
+				}
+			}
+
+			continue
+		case state.Created, state.Updated:
+			key := resilientKeyOf(event.Resource)
+
+			if bootstrapping {
+				listed[key] = struct{}{}
+			}
+
+			old, known := w.known[key]
+			if known && old.Metadata().Version().Equal(event.Resource.Metadata().Version()) {
+				// replayed by the bootstrap
+				continue
+			}
+
+			w.known[key] = event.Resource
+
+			if known && event.Type == state.Created {
+				event = state.Event{Type: state.Updated, Resource: event.Resource, Old: old, Bookmark: event.Bookmark}
+			}
+		case state.Destroyed:
+			delete(w.known, resilientKeyOf(event.Resource))
+		case state.Noop:
+		}
+
+		if !channel.SendWithContext(ctx, w.ch, event) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestResilientWatchKind(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+		s := state.WrapCore(st)
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		a := conformance.NewPathResource("default", "a")
+		b := conformance.NewPathResource("default", "b")
+
+		require.NoError(t, s.Create(ctx, a))
+		require.NoError(t, s.Create(ctx, b))
+
+		var restarts []error
+
+		ch := make(chan state.Event, 16)
+
+		require.NoError(t, sqlite.ResilientWatchKind(ctx, st, kind, ch,
+			sqlite.WithRestartBackoff(10*time.Millisecond, 100*time.Millisecond),
+			sqlite.WithRestartHandler(func(err error) {
+				restarts = append(restarts, err)
+
+				// change the resources while the watch is down
+				if len(restarts) == 1 {
+					a.Metadata().Annotations().Set("updated", "true")
+
+					require.NoError(t, s.Update(ctx, a))
+					require.NoError(t, s.Destroy(ctx, b.Metadata()))
+				}
+			}),
+		))
+
+		receive := func() state.Event {
+			t.Helper()
+
+			select {
+			case ev := <-ch:
+				return ev
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+
+			return state.Event{}
+		}
+
+		for _, id := range []resource.ID{"a", "b"} {
+			ev := receive()
+			require.Equal(t, state.Created, ev.Type)
+			assert.Equal(t, id, ev.Resource.Metadata().ID())
+		}
+
+		require.Equal(t, state.Bootstrapped, receive().Type)
+
+		// the resync marker fails the underlying watch
+		require.NoError(t, st.Import(ctx, []resource.Resource{conformance.NewPathResource("default", "c")}))
+
+		events := map[resource.ID]state.Event{}
+
+		for range 3 {
+			ev := receive()
+			events[ev.Resource.Metadata().ID()] = ev
+		}
+
+		assert.Equal(t, state.Updated, events["a"].Type)
+		assert.Equal(t, "1", events["a"].Old.Metadata().Version().String())
+		assert.Equal(t, state.Destroyed, events["b"].Type)
+		assert.Equal(t, state.Created, events["c"].Type)
+
+		// the watch keeps going without extra events
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "d")))
+
+		ev := receive()
+		require.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, "d", ev.Resource.Metadata().ID())
+
+		require.Len(t, restarts, 1)
+		assert.True(t, sqlite.IsResyncRequiredError(restarts[0]))
+	})
+}
@@ -0,0 +1,193 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// keyRotationBatchSize is the number of specs re-encrypted in a single transaction.
+const keyRotationBatchSize = 100
+
+// specColumn is a column storing the marshaled resources.
+type specColumn struct {
+	table  string
+	column string
+	key    []string // primary key columns
+}
+
+var specColumns = []specColumn{
+	{table: "resources", column: "spec", key: []string{"namespace", "type", "id"}},
+	{table: "events", column: "spec_before", key: []string{"event_id"}},
+	{table: "events", column: "spec_after", key: []string{"event_id"}},
+	{table: "versions", column: "spec", key: []string{"namespace", "type", "id", "version"}},
+	{table: "graveyard", column: "spec", key: []string{"namespace", "type", "id"}},
+}
+
+// RotateKeys re-encrypts the stored specs encrypted with other keys with the key newKeyID.
+//
+// The resources, the events, the version history and the graveyard are re-encrypted in place
+// in small batches, each batch is a separate transaction, so the writers are not blocked for long.
+// The progress is logged after each batch, and the number of re-encrypted specs is returned.
+// Re-encryption doesn't change the resource versions and doesn't generate events.
+//
+// The KeyProvider should return the key for newKeyID, and it should return newKeyID for the new writes
+// before the rotation is started; otherwise some specs might be written with the old key during the rotation.
+// RotateKeys can be safely interrupted and run again.
+func (st *State) RotateKeys(ctx context.Context, newKeyID string) (int, error) {
+	if st.options.KeyProvider == nil {
+		return 0, errors.New("key provider is not configured")
+	}
+
+	if len(newKeyID) > encryptedSpecMaxKeyIDLen {
+		return 0, fmt.Errorf("key ID %q is too long", newKeyID)
+	}
+
+	// verify the key before touching the data
+	if _, err := st.cipher(newKeyID); err != nil {
+		return 0, err
+	}
+
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error taking connection for key rotation: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	var rotated int
+
+	for _, col := range specColumns {
+		for {
+			n, err := st.rotateKeysBatch(conn, col, newKeyID)
+			if err != nil {
+				return rotated, fmt.Errorf("error rotating keys in %s.%s: %w", col.table, col.column, err)
+			}
+
+			rotated += n
+
+			if n < keyRotationBatchSize {
+				break
+			}
+
+			st.options.Logger.Info("key rotation in progress",
+				zap.String("table", col.table),
+				zap.String("column", col.column),
+				zap.Int("rotated", rotated),
+			)
+
+			if err = ctx.Err(); err != nil {
+				return rotated, fmt.Errorf("key rotation canceled: %w", err)
+			}
+		}
+	}
+
+	st.options.Logger.Info("key rotation completed", zap.String("key_id", newKeyID), zap.Int("rotated", rotated))
+
+	return rotated, nil
+}
+
+// rotateKeysBatch re-encrypts the next batch of specs in the column.
+func (st *State) rotateKeysBatch(conn *sqlite.Conn, col specColumn, newKeyID string) (n int, err error) {
+	endFn, err := sqlitexx.Begin(conn)
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %w", err)
+	}
+
+	defer endFn(&err)
+
+	table := st.options.TablePrefix + col.table
+	newPrefix := encryptedSpecMagic + string([]byte{byte(len(newKeyID))}) + newKeyID
+
+	q, err := sqlitexx.NewQuery(conn,
+		`SELECT `+strings.Join(col.key, ", ")+`, `+col.column+` AS spec FROM `+table+`
+		WHERE substr(`+col.column+`, 1, length($magic)) = $magic AND substr(`+col.column+`, 1, length($prefix)) != $prefix
+		LIMIT $batch_size`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query: %w", err)
+	}
+
+	type row struct {
+		key  []any
+		spec []byte
+	}
+
+	var rows []row
+
+	if err = q.
+		BindBytes("$magic", []byte(encryptedSpecMagic)).
+		BindBytes("$prefix", []byte(newPrefix)).
+		BindInt("$batch_size", keyRotationBatchSize).
+		QueryAll(func(stmt *sqlite.Stmt) error {
+			r := row{key: make([]any, len(col.key))}
+
+			for i := range col.key {
+				if stmt.ColumnType(i) == sqlite.TypeInteger {
+					r.key[i] = stmt.ColumnInt64(i)
+				} else {
+					r.key[i] = stmt.ColumnText(i)
+				}
+			}
+
+			r.spec = make([]byte, stmt.GetLen("spec"))
+			stmt.GetBytes("spec", r.spec)
+
+			rows = append(rows, r)
+
+			return nil
+		}); err != nil {
+		return 0, fmt.Errorf("querying specs: %w", err)
+	}
+
+	conditions := make([]string, 0, len(col.key))
+
+	for _, key := range col.key {
+		conditions = append(conditions, key+` = $`+key)
+	}
+
+	for _, r := range rows {
+		spec, err := st.decryptSpec(r.spec)
+		if err != nil {
+			return 0, err
+		}
+
+		if spec, err = st.encryptSpecWithKey(newKeyID, spec); err != nil {
+			return 0, err
+		}
+
+		q, err := sqlitexx.NewQuery(conn,
+			`UPDATE `+table+` SET `+col.column+` = $spec WHERE `+strings.Join(conditions, " AND "),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("preparing update statement: %w", err)
+		}
+
+		q.BindBytes("$spec", spec)
+
+		for i, key := range col.key {
+			switch v := r.key[i].(type) {
+			case int64:
+				q.BindInt64("$"+key, v)
+			case string:
+				q.BindString("$"+key, v)
+			}
+		}
+
+		if err = q.Exec(); err != nil {
+			return 0, fmt.Errorf("updating spec: %w", err)
+		}
+	}
+
+	return len(rows), nil
+}
@@ -0,0 +1,14 @@
+-- Secondary indexes of the resources table.
+--
+-- The indexes only support the optional queries, so their creation can be deferred
+-- to the background on the cold start (see WithDeferredIndexes).
+
+-- supports cross-kind queries by phase (see FindAll)
+CREATE INDEX IF NOT EXISTS %[1]sresources_namespace_phase ON %[1]sresources (namespace, phase);
+
+-- supports listing the resources of an owner (see ListFilter.Owner and WithOwner),
+-- most resources have no owner, so they are left out of the index
+CREATE INDEX IF NOT EXISTS %[1]sresources_owner ON %[1]sresources (owner, namespace, type) WHERE owner != '';
+
+-- supports finding the resources not updated for a while (see FindStale)
+CREATE INDEX IF NOT EXISTS %[1]sresources_updated ON %[1]sresources (namespace, type, updated_at);
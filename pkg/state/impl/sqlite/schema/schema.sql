@@ -1,9 +1,17 @@
--- There are two tables:
+-- There are two main tables:
 -- 1. resources: stores the actual resource data
 -- 2. events: stores events as they happened to resources
 --
+-- Auxiliary tables:
+-- - lease: coordinates multiple state instances sharing the same tables
+-- - versions: keeps the history of the selected resource kinds
+-- - graveyard: keeps the destroyed resources for recovery
+-- - meta: records the schema version (see checkSchemaVersion)
+--
 -- Tables can be prefixed with a custom prefix to allow multiple COSI
 -- state instances to share the same database.
+--
+-- The secondary indexes are created by indexes.sql (see WithDeferredIndexes).
 
 CREATE TABLE IF NOT EXISTS %[1]sresources (
     namespace TEXT NOT NULL,
@@ -18,37 +26,91 @@ CREATE TABLE IF NOT EXISTS %[1]sresources (
     phase INTEGER NOT NULL, -- stored as integer value of Phase enum
     owner TEXT NOT NULL, -- stored as string
     spec BLOB NOT NULL, -- marshalled full resource contents
+    generation INTEGER NOT NULL DEFAULT 1, -- bumped by the updates changing the spec (see GetGeneration)
     PRIMARY KEY (namespace, type, id) -- not using ROWID, this is real primary key
 ) WITHOUT ROWID, STRICT;
 
 CREATE TABLE IF NOT EXISTS %[1]sevents (
-    event_id INTEGER NOT NULL PRIMARY KEY, -- eventid is going to be ROWID
+    -- event_id is the ROWID; AUTOINCREMENT keeps the IDs growing when the latest events are deleted
+    -- (e.g. by the compaction), as the reused IDs would make the watches and bookmarks skip the new events
+    event_id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
     namespace TEXT NOT NULL,
     type TEXT NOT NULL,
     id TEXT NOT NULL,
     event_timestamp INTEGER NOT NULL, -- time the event got inserted
-    event_type INTEGER NOT NULL, -- 1 = create, 2 = update, 3 = delete
+    event_type INTEGER NOT NULL, -- 1 = create, 2 = update, 3 = delete, 4 = custom (see AppendEvent), 5 = resync (see Import)
     spec_before BLOB NULL, -- full resource contents before the event
-    spec_after BLOB NULL -- full resource contents after the event
+    spec_after BLOB NULL, -- full resource contents after the event
+    generation_changed INTEGER NOT NULL DEFAULT 1, -- 0 for the updates which didn't change the spec (see WithGenerationChanges)
+    -- resource metadata after the event (before it for the deletes) is pulled up for the watch filters,
+    -- NULL for the custom and resync events, and for the events written before the columns were added
+    labels BLOB NULL, -- stored as JSONB
+    phase INTEGER NULL, -- stored as integer value of Phase enum
+    owner TEXT NULL,
+    -- resource metadata before the updates, so the filters match the updates changing the match
+    labels_before BLOB NULL,
+    phase_before INTEGER NULL
 ) STRICT;
 
+-- last versions of the destroyed resources (see WithGraveyardRetention)
+CREATE TABLE IF NOT EXISTS %[1]sgraveyard (
+    namespace TEXT NOT NULL,
+    type TEXT NOT NULL,
+    id TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    destroyed_at INTEGER NOT NULL, -- unix epoch timestamp
+    spec BLOB NOT NULL, -- marshalled full resource contents
+    PRIMARY KEY (namespace, type, id)
+) WITHOUT ROWID, STRICT;
+
+-- key-value metadata of the database
+CREATE TABLE IF NOT EXISTS %[1]smeta (
+    key TEXT NOT NULL PRIMARY KEY,
+    value ANY NOT NULL
+) WITHOUT ROWID, STRICT;
+
+-- ownership lease of the state instance running the background tasks (see WithOwnership)
+CREATE TABLE IF NOT EXISTS %[1]slease (
+    id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1), -- there is a single lease row
+    owner TEXT NOT NULL,
+    expires_at INTEGER NOT NULL -- unix epoch timestamp in milliseconds
+) STRICT;
+
+-- previous versions of the resources of the kinds with version history enabled (see WithVersionHistory)
+CREATE TABLE IF NOT EXISTS %[1]sversions (
+    namespace TEXT NOT NULL,
+    type TEXT NOT NULL,
+    id TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    archived_at INTEGER NOT NULL, -- unix epoch timestamp
+    spec BLOB NOT NULL, -- marshalled full resource contents
+    PRIMARY KEY (namespace, type, id, version)
+) WITHOUT ROWID, STRICT;
+
 CREATE TRIGGER IF NOT EXISTS trg_%[1]sresources_after_insert
 AFTER INSERT ON %[1]sresources
 BEGIN
-    INSERT INTO %[1]sevents (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
-    VALUES (NEW.namespace, NEW.type, NEW.id, unixepoch(), 1, NULL, NEW.spec);
+    INSERT INTO %[1]sevents (namespace, type, id, event_timestamp, event_type, spec_before, spec_after, labels, phase, owner)
+    VALUES (NEW.namespace, NEW.type, NEW.id, unixepoch(), 1, NULL, NEW.spec, NEW.labels, NEW.phase, NEW.owner);
 END;
 
 CREATE TRIGGER IF NOT EXISTS trg_%[1]sresources_after_update
 AFTER UPDATE ON %[1]sresources
+WHEN OLD.version != NEW.version -- rewrites of the stored spec (see RotateKeys) are not events
 BEGIN
-    INSERT INTO %[1]sevents (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
-    VALUES (NEW.namespace, NEW.type, NEW.id, unixepoch(), 2, OLD.spec, NEW.spec);
+    INSERT INTO %[1]sevents (
+        namespace, type, id, event_timestamp, event_type, spec_before, spec_after, generation_changed,
+        labels, phase, owner, labels_before, phase_before
+    )
+    VALUES (
+        NEW.namespace, NEW.type, NEW.id, unixepoch(), 2, OLD.spec, NEW.spec, OLD.generation != NEW.generation,
+        NEW.labels, NEW.phase, NEW.owner, OLD.labels, OLD.phase
+    );
 END;
 
 CREATE TRIGGER IF NOT EXISTS trg_%[1]sresources_after_delete
 AFTER DELETE ON %[1]sresources
 BEGIN
-    INSERT INTO %[1]sevents (namespace, type, id, event_timestamp, event_type, spec_before, spec_after)
-    VALUES (OLD.namespace, OLD.type, OLD.id, unixepoch(), 3, OLD.spec, NULL);
+    INSERT INTO %[1]sevents (namespace, type, id, event_timestamp, event_type, spec_before, spec_after, labels, phase, owner)
+    VALUES (OLD.namespace, OLD.type, OLD.id, unixepoch(), 3, OLD.spec, NULL, OLD.labels, OLD.phase, OLD.owner);
 END;
@@ -0,0 +1,59 @@
+-- Read-only views decoding the metadata for ad-hoc analysis (see WithMetadataViews).
+--
+-- The views are recreated every time the schema is applied, so they follow the schema changes.
+-- Timestamps are ISO 8601 in UTC, labels and finalizers are JSON text.
+
+DROP VIEW IF EXISTS %[1]sresources_meta;
+
+CREATE VIEW %[1]sresources_meta AS
+SELECT
+    namespace,
+    type,
+    id,
+    version,
+    generation,
+    CASE phase WHEN 0 THEN 'running' WHEN 1 THEN 'tearingDown' ELSE phase END AS phase,
+    owner,
+    json(coalesce(labels, jsonb('{}'))) AS labels,
+    json(coalesce(finalizers, jsonb('[]'))) AS finalizers,
+    strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', created_at, 'unixepoch') AS created,
+    strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', updated_at, 'unixepoch') AS updated,
+    length(spec) AS spec_size
+FROM %[1]sresources;
+
+DROP VIEW IF EXISTS %[1]sevents_meta;
+
+CREATE VIEW %[1]sevents_meta AS
+SELECT
+    event_id,
+    namespace,
+    type,
+    id,
+    CASE event_type
+        WHEN 1 THEN 'created'
+        WHEN 2 THEN 'updated'
+        WHEN 3 THEN 'destroyed'
+        WHEN 4 THEN 'custom'
+        WHEN 5 THEN 'resync'
+        ELSE event_type
+    END AS event_type,
+    generation_changed,
+    CASE phase WHEN 0 THEN 'running' WHEN 1 THEN 'tearingDown' ELSE phase END AS phase,
+    owner,
+    json(labels) AS labels,
+    strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', event_timestamp, 'unixepoch') AS event_time,
+    length(spec_before) AS spec_before_size,
+    length(spec_after) AS spec_after_size
+FROM %[1]sevents;
+
+DROP VIEW IF EXISTS %[1]sgraveyard_meta;
+
+CREATE VIEW %[1]sgraveyard_meta AS
+SELECT
+    namespace,
+    type,
+    id,
+    version,
+    strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', destroyed_at, 'unixepoch') AS destroyed,
+    length(spec) AS spec_size
+FROM %[1]sgraveyard;
@@ -18,6 +18,9 @@ import (
 // It uses SQLite's dbstat virtual table to calculate the size of the
 // resources and events tables within the main database file (logical
 // table page usage), which does not include any separate WAL/SHM files.
+//
+// Only the tables with the state's table prefix are counted, see DBSizeByPrefix
+// for the sizes of all states sharing the database.
 func (st *State) DBSize(ctx context.Context) (int64, error) {
 	conn, err := st.db.Take(ctx)
 	if err != nil {
@@ -26,6 +29,68 @@ func (st *State) DBSize(ctx context.Context) (int64, error) {
 
 	defer st.db.Put(conn)
 
+	return dbSize(conn, st.options.TablePrefix)
+}
+
+// DBSizeByPrefix returns the sizes of the tables of all states sharing the database, by the table prefix.
+//
+// The sizes are calculated as in DBSize, the prefixes are found by the resources and events tables
+// in the database schema. This allows multi-tenant deployments (one table prefix per tenant)
+// to bill and alert per tenant without opening a State for each of them.
+func DBSizeByPrefix(ctx context.Context, db SqlitexPool) (map[string]int64, error) {
+	conn, err := db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error taking connection for db size: %w", err)
+	}
+
+	defer db.Put(conn)
+
+	prefixes, err := tablePrefixes(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64, len(prefixes))
+
+	for _, prefix := range prefixes {
+		if sizes[prefix], err = dbSize(conn, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return sizes, nil
+}
+
+// tablePrefixes returns the table prefixes of the states in the database.
+func tablePrefixes(conn *sqlite.Conn) ([]string, error) {
+	var prefixes []string
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT substr(name, 1, length(name) - length('resources')) AS prefix FROM sqlite_schema AS r
+		WHERE type = 'table' AND name GLOB '*resources' AND EXISTS (
+			SELECT 1 FROM sqlite_schema WHERE type = 'table' AND name = substr(r.name, 1, length(r.name) - length('resources')) || 'events'
+		)
+		ORDER BY name`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("preparing query for table prefixes: %w", err)
+	}
+
+	if err = q.QueryAll(
+		func(stmt *sqlite.Stmt) error {
+			prefixes = append(prefixes, stmt.GetText("prefix"))
+
+			return nil
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to get table prefixes: %w", err)
+	}
+
+	return prefixes, nil
+}
+
+func dbSize(conn *sqlite.Conn, prefix string) (int64, error) {
 	var size int64
 
 	q, err := sqlitexx.NewQuery(
@@ -37,8 +102,8 @@ func (st *State) DBSize(ctx context.Context) (int64, error) {
 	}
 
 	if err = q.
-		BindString("$table1", st.options.TablePrefix+"resources").
-		BindString("$table2", st.options.TablePrefix+"events").
+		BindString("$table1", prefix+"resources").
+		BindString("$table2", prefix+"events").
 		QueryRow(
 			func(stmt *sqlite.Stmt) error {
 				size = stmt.GetInt64("total_size")
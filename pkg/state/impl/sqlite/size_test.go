@@ -5,8 +5,12 @@
 package sqlite_test
 
 import (
+	"math"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/cosi-project/runtime/pkg/state/conformance"
 	"github.com/stretchr/testify/assert"
@@ -42,3 +46,111 @@ func TestDBSizeGrowsWithData(t *testing.T) {
 		assert.Greater(t, sizeAfter, sizeBefore, "size should grow after inserting resources")
 	})
 }
+
+func TestMaxDatabaseSize(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		err := st.Create(t.Context(), conformance.NewPathResource("ns1", "a"))
+		require.Error(t, err)
+		assert.True(t, sqlite.IsDatabaseFullError(err))
+
+		_, err = st.AppendEvent(t.Context(), conformance.NewPathResource("ns1", "a"))
+		assert.True(t, sqlite.IsDatabaseFullError(err))
+
+		// destroy is not subject to the limit
+		err = st.Destroy(t.Context(), conformance.NewPathResource("ns1", "a").Metadata())
+		require.Error(t, err)
+		assert.False(t, sqlite.IsDatabaseFullError(err))
+	}, sqlite.WithMaxDatabaseSize(1))
+}
+
+func TestMaxDatabaseSizeNotExceeded(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "a")))
+	}, sqlite.WithMaxDatabaseSize(1<<30))
+}
+
+func TestMinFreeDiskSpace(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("disk space check is not supported on this platform")
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		err := st.Create(t.Context(), conformance.NewPathResource("ns1", "a"))
+		require.Error(t, err)
+		assert.True(t, sqlite.IsInsufficientDiskSpaceError(err))
+	}, sqlite.WithMinFreeDiskSpace(math.MaxInt64/2))
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "a")))
+	}, sqlite.WithMinFreeDiskSpace(1))
+}
+
+func TestWriteCheckInterval(t *testing.T) {
+	t.Parallel()
+
+	const sizeQuery = "SELECT (page_count - freelist_count) * page_size AS size FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()"
+
+	for _, test := range []struct {
+		name     string
+		interval time.Duration
+		expected int
+	}{
+		{name: "cached", interval: time.Hour, expected: 1},
+		{name: "disabled", expected: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var counter sqlite.StatementCounter
+
+			withSqliteCore(t, func(st *sqlite.State) {
+				counter.Measure(func() {
+					for i := range 10 {
+						require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+					}
+				})
+
+				assert.Equal(t, test.expected, counter.Statements()[sizeQuery])
+			},
+				sqlite.WithMaxDatabaseSize(1<<30),
+				sqlite.WithWriteCheckInterval(test.interval),
+				sqlite.WithStatementCounter(&counter),
+				sqlite.WithCompactionInterval(0),
+			)
+		})
+	}
+}
+
+func TestDBSizeByPrefix(t *testing.T) {
+	t.Parallel()
+
+	path := "file:" + filepath.Join(t.TempDir(), "state.db")
+	pool := newSqlitePool(t, path)
+
+	tenantA := newSqliteState(t, path, sqlite.WithTablePrefix("a_"))
+	tenantB := newSqliteState(t, path, sqlite.WithTablePrefix("b_"))
+
+	for i := range 100 {
+		require.NoError(t, tenantA.Create(t.Context(), conformance.NewPathResource("ns1", strconv.Itoa(i))))
+	}
+
+	sizes, err := sqlite.DBSizeByPrefix(t.Context(), pool)
+	require.NoError(t, err)
+	require.Len(t, sizes, 2)
+
+	sizeA, err := tenantA.DBSize(t.Context())
+	require.NoError(t, err)
+
+	sizeB, err := tenantB.DBSize(t.Context())
+	require.NoError(t, err)
+
+	assert.Equal(t, sizeA, sizes["a_"])
+	assert.Equal(t, sizeB, sizes["b_"])
+	assert.Greater(t, sizes["a_"], sizes["b_"])
+}
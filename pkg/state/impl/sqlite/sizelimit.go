@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+var databaseFullRejections expvar.Int
+
+func init() {
+	expvar.Publish("sqlite_state_database_full_rejections", &databaseFullRejections)
+}
+
+// checkDatabaseSize verifies that the (estimated) size of the database (plus WAL) is within the configured size limit.
+func (st *State) checkDatabaseSize(size int64) error {
+	if st.options.MaxDatabaseSize <= 0 {
+		return nil
+	}
+
+	if size <= st.options.MaxDatabaseSize {
+		return nil
+	}
+
+	databaseFullRejections.Add(1)
+
+	st.options.Logger.Warn("database size limit exceeded, refusing write",
+		zap.Int64("size", size),
+		zap.Int64("limit", st.options.MaxDatabaseSize),
+	)
+
+	return ErrDatabaseFull(size, st.options.MaxDatabaseSize)
+}
+
+// databaseFileSize returns the size of the database file (excluding free pages) plus the size of the WAL file.
+//
+// Unlike DBSize, it covers the whole database, not only the tables used by this package.
+func databaseFileSize(conn *sqlite.Conn) (int64, error) {
+	var size int64
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT (page_count - freelist_count) * page_size AS size FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("preparing query for database size: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			size = stmt.GetInt64("size")
+
+			return nil
+		},
+	); err != nil {
+		return 0, fmt.Errorf("failed to get database size: %w", err)
+	}
+
+	filename, err := databaseFilename(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	// in-memory databases have no file
+	if filename == "" {
+		return size, nil
+	}
+
+	walInfo, err := os.Stat(filename + "-wal")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return size, nil
+		}
+
+		return 0, fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+
+	return size + walInfo.Size(), nil
+}
+
+// databaseFilename returns the path to the main database file.
+//
+// It returns an empty string for in-memory databases.
+func databaseFilename(conn *sqlite.Conn) (string, error) {
+	var filename string
+
+	q, err := sqlitexx.NewQuery(
+		conn,
+		`SELECT file FROM pragma_database_list WHERE name = 'main'`,
+	)
+	if err != nil {
+		return "", fmt.Errorf("preparing query for database file: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			filename = stmt.GetText("file")
+
+			return nil
+		},
+	); err != nil {
+		return "", fmt.Errorf("failed to get database file: %w", err)
+	}
+
+	return filename, nil
+}
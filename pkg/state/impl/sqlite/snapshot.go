@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// Snapshot is an active database snapshot, see BeginSnapshot.
+type Snapshot struct {
+	conn  *sqlite.Conn
+	endFn func(*error)
+}
+
+// BeginSnapshot prepares the database files to be copied by external tools (e.g. tar, rsync, Litestream).
+//
+// While the snapshot is active, a read transaction is held open, so that checkpoints
+// can't reset the WAL, and the compaction is paused, so the database and WAL files form a consistent set.
+// Writes are still allowed, they are appended to the WAL.
+//
+// EndSnapshot must be called to release the snapshot.
+func (st *State) BeginSnapshot(ctx context.Context) (*Snapshot, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("taking connection for snapshot: %w", err)
+	}
+
+	endFn := sqlitex.Transaction(conn)
+
+	// the read transaction starts with the first read
+	q, err := sqlitexx.NewQuery(conn, `SELECT count(*) FROM `+st.options.TablePrefix+`resources`)
+	if err == nil {
+		err = q.QueryRow(func(*sqlite.Stmt) error { return nil })
+	}
+
+	if err != nil {
+		endFn(&err)
+		st.db.Put(conn)
+
+		return nil, fmt.Errorf("starting read transaction for snapshot: %w", err)
+	}
+
+	// wait for the running compaction to finish
+	st.compactSem <- struct{}{}
+	st.snapshots++
+	<-st.compactSem
+
+	return &Snapshot{
+		conn:  conn,
+		endFn: endFn,
+	}, nil
+}
+
+// EndSnapshot releases the snapshot started with BeginSnapshot.
+func (st *State) EndSnapshot(snapshot *Snapshot) error {
+	if snapshot.conn == nil {
+		return errors.New("snapshot already ended")
+	}
+
+	var err error
+
+	snapshot.endFn(&err)
+	st.db.Put(snapshot.conn)
+	snapshot.conn = nil
+
+	st.compactSem <- struct{}{}
+	st.snapshots--
+	<-st.compactSem
+
+	if err != nil {
+		return fmt.Errorf("ending read transaction for snapshot: %w", err)
+	}
+
+	return nil
+}
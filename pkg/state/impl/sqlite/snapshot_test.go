@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for i := range 20 {
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+		}
+
+		snapshot, err := st.BeginSnapshot(ctx)
+		require.NoError(t, err)
+
+		// compaction is paused
+		result, err := st.Compact(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, result.EventsCompacted)
+
+		// writes are still allowed
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "new")))
+
+		require.NoError(t, st.EndSnapshot(snapshot))
+		require.Error(t, st.EndSnapshot(snapshot))
+
+		result, err = st.Compact(ctx)
+		require.NoError(t, err)
+		assert.EqualValues(t, 11, result.EventsCompacted)
+	}, sqlite.WithCompactKeepEvents(10), sqlite.WithCompactMinAge(-time.Minute), sqlite.WithCompactionInterval(0))
+}
@@ -8,8 +8,10 @@ package sqlite
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/cosi-project/runtime/pkg/state/impl/store"
 	"go.uber.org/zap"
@@ -27,14 +29,38 @@ type SqlitexPool interface {
 // State implements state storage in sqlite database.
 type State struct {
 	db                  SqlitexPool
+	readDB              SqlitexPool
+	txTracker           *trackingPool // set if LongTransactionThreshold is enabled
+	getCache            *getCache     // set if GetCacheSize is enabled
+	fanout              *fanout       // set if FanoutWorkers is enabled
+	mirrors             []*mirror     // one per CachedKinds
 	marshaler           store.Marshaler
 	sub                 *sub.Manager
 	shutdown            chan struct{}
+	compactionTrigger   chan struct{}
 	compactionCtx       context.Context //nolint:containedctx
 	compactionCtxCancel context.CancelFunc
+	watches             map[*watchPosition]struct{}
+	pruneQueue          map[resource.Namespace]struct{} // guarded by pruneQueueMu
+	kindLocks           map[kindKey]*kindLock           // guarded by kindLocksMu
 	options             StateOptions
+	explainedQueries    explainedQueries
+	pageSize            int64
+	localEvents         localEventCounter
+	writeCheck          writeCheck
+	eventRates          eventRates
+	ciphers             ciphers
+	leader              atomic.Bool
+	leaseOwner          string
+	closePool           func() error // set if the pool is owned by the state
+	snapshots           int          // guarded by compactSem
+	compactSem          chan struct{}
+	compactStatus       CompactionStatus // guarded by compactStatusMu
 	wg                  sync.WaitGroup
-	compactMu           sync.Mutex
+	compactStatusMu     sync.Mutex
+	watchesMu           sync.Mutex
+	pruneQueueMu        sync.Mutex
+	kindLocksMu         sync.Mutex
 }
 
 // StateOptions configures sqlite state.
@@ -48,6 +74,27 @@ type StateOptions struct {
 	// Setting a table prefix allows multiple independent states to share the same database.
 	TablePrefix string
 
+	// ExtraSchema is the SQL script applied after the schema of the state, so the embedders can keep
+	// auxiliary tables, indexes and views in the same database.
+	//
+	// The script is applied every time the state is created (in the same transaction as the schema),
+	// so it should be idempotent (e.g. CREATE TABLE IF NOT EXISTS).
+	// The %[1]s placeholders are replaced with the TablePrefix, as in the schema of the state, so the
+	// objects are prefixed consistently.
+	//
+	// Default is empty string.
+	ExtraSchema string
+
+	// MetadataViews creates the read-only views with the decoded metadata of the resources, events and
+	// the graveyard (<prefix>resources_meta, <prefix>events_meta, <prefix>graveyard_meta).
+	//
+	// The views expose the labels and finalizers as JSON text, the phases and event types by name, and
+	// the timestamps in ISO 8601, so the database can be inspected with the generic tools (e.g. sqlite3).
+	// The views are not used by the state.
+	//
+	// Default is false.
+	MetadataViews bool
+
 	// CompactionInterval is the interval between automatic database compactions.
 	//
 	// Default is 30 minutes.
@@ -68,6 +115,499 @@ type StateOptions struct {
 	//
 	// Default is 1 hour.
 	CompactMinAge time.Duration
+
+	// CompactRetention sizes the number of events kept by the compaction to cover the duration at the observed
+	// insert rate, instead of the fixed CompactKeepEvents.
+	//
+	// The insert rate is averaged over the events in the log, so the retention follows the load:
+	// the busy databases keep more events, and the quiet ones fewer. CompactKeepEvents is the lower bound
+	// of the number of events kept, and CompactMaxKeepEvents is the upper one.
+	// Zero value disables the adaptive retention.
+	//
+	// Default is 0.
+	CompactRetention time.Duration
+
+	// CompactMaxKeepEvents is the maximum number of events kept with CompactRetention.
+	//
+	// It bounds the database size during the bursts of events.
+	// CompactKeepEvents takes precedence: if CompactMaxKeepEvents is lower, CompactKeepEvents events are kept.
+	// Zero value means no limit.
+	//
+	// Default is 0.
+	CompactMaxKeepEvents int
+
+	// CompactBatchSize is the number of events deleted in a single batch during compaction.
+	//
+	// Each batch is a separate transaction, so smaller batches hold the write lock for a shorter time.
+	// The batch size should be positive, see WithCompactBatchSize.
+	//
+	// Default is 1000.
+	CompactBatchSize int
+
+	// CompactBatchPause is the pause between the compaction batches.
+	//
+	// The pause lets other writers acquire the write lock, so that large purges don't starve them.
+	//
+	// Default is 5 milliseconds.
+	CompactBatchPause time.Duration
+
+	// CompactTimeBudget is the maximum duration of deleting events in a single compaction run.
+	//
+	// If the budget is exhausted, compaction stops and the remaining events are compacted on the next run.
+	// Zero value means no limit.
+	//
+	// Default is 0.
+	CompactTimeBudget time.Duration
+
+	// CompactMaxWatchHold is the maximum age of unconsumed events an active watch can keep from compaction.
+	//
+	// Compaction doesn't delete events which active watches haven't consumed yet.
+	// If a watch falls behind more than this duration, it is terminated with an error instead.
+	// Zero value allows watches to hold back compaction indefinitely.
+	//
+	// Default is 24 hours.
+	CompactMaxWatchHold time.Duration
+
+	// OptimizeInterval is the interval between refreshes of the query planner statistics (see Optimize).
+	//
+	// Statistics are refreshed by the background compaction loop, so they are not refreshed
+	// automatically if CompactionInterval is zero.
+	// Zero value disables automatic refreshes.
+	//
+	// Default is 1 hour.
+	OptimizeInterval time.Duration
+
+	// ExternalChangesPollInterval is the interval between checks for external modifications of the database.
+	//
+	// If another process (or a manual sqlite3 session) writes to the database, in-process watches
+	// are not notified and miss the changes until something else wakes them up.
+	// When enabled, the state periodically looks for events it hasn't written itself,
+	// notifies the watches and logs a warning.
+	// Zero value disables the check.
+	//
+	// Default is 0.
+	ExternalChangesPollInterval time.Duration
+
+	// ExternalChangesMaxPollInterval enables adaptive polling for external modifications of the database.
+	//
+	// The poll interval follows the observed rate of the external modifications (see Stats):
+	// the database is polled every ExternalChangesPollInterval while the external writes are frequent,
+	// and the interval grows up to ExternalChangesMaxPollInterval while there are none.
+	// Zero value polls every ExternalChangesPollInterval.
+	//
+	// Default is 0.
+	ExternalChangesMaxPollInterval time.Duration
+
+	// MarshalerIdentity identifies the resource encoding of the marshaler (e.g. "protobuf-v1").
+	//
+	// The identity is recorded in the database, and NewState fails with ErrMarshalerMismatch
+	// if the database was written with a different marshaler.
+	// The identity should be changed when the marshaler changes the encoding incompatibly.
+	//
+	// Default is "protobuf-v1" for store.ProtobufMarshaler, and the Go type name for other marshalers.
+	MarshalerIdentity string
+
+	// PageSize is the database page size in bytes (a power of two between 512 and 65536).
+	//
+	// The page size is applied when the state is created. Changing the page size of an existing database
+	// rebuilds it with VACUUM, which might take a while, and requires that no other connections
+	// to the database are open.
+	// Matching the page size to the flash erase-block size might reduce write amplification on some devices.
+	// Zero value keeps the current page size.
+	//
+	// Default is 0.
+	PageSize int
+
+	// CacheSize is the page cache size of each connection, with the same meaning as PRAGMA cache_size:
+	// positive values are the number of pages, negative values are the size in KiB.
+	//
+	// Zero value keeps the SQLite default.
+	//
+	// Default is 0.
+	CacheSize int
+
+	// BusyTimeout is the time a connection waits for the database lock held by another connection
+	// (with the same meaning as PRAGMA busy_timeout), applied to each connection taken from the pools
+	// (including the ReadReplica).
+	//
+	// The busy timeout is usually set when opening the database (see DSN), but the pragmas in the DSN
+	// are easy to get wrong (e.g. they are silently ignored without the URI flag), and without the busy
+	// timeout the concurrent writes fail immediately with SQLITE_BUSY.
+	// Zero value keeps the busy timeout of the connections.
+	//
+	// Default is 0.
+	BusyTimeout time.Duration
+
+	// DeferIndexes creates the secondary indexes of the resources table in the background once the state
+	// is created, instead of while the schema is migrated.
+	//
+	// Building the indexes of a huge database (e.g. the ones added by a schema upgrade) dominates the time
+	// it takes to create the state. The indexes only support the optional queries (e.g. FindAll, FindStale
+	// and WithOwner), which scan the table until the indexes are built. The writes wait for each index build.
+	//
+	// Default is false.
+	DeferIndexes bool
+
+	// WarmupCache reads the resources table in the background once the state is created, so the first
+	// queries don't wait for the disk reads of a cold database.
+	//
+	// The table is read via a single connection, so this mostly warms up the OS page cache.
+	//
+	// Default is false.
+	WarmupCache bool
+
+	// ExplainQueries enables logging of the query plans for List and Watch queries.
+	//
+	// The query plan (EXPLAIN QUERY PLAN) is logged the first time each query is executed.
+	// Only the most recently executed queries are remembered, so the plan of a rarely executed query
+	// might be logged again.
+	// This is a debugging aid to verify that label queries hit indexes.
+	//
+	// Default is false.
+	ExplainQueries bool
+
+	// MaxDatabaseSize is the maximum size of the database in bytes (including the WAL file).
+	//
+	// When the database exceeds the limit, Create, Update and AppendEvent fail with ErrDatabaseFull.
+	// Destroy is still allowed, so that the space can be reclaimed.
+	// The size is measured periodically, see WriteCheckInterval.
+	// Zero value disables the limit.
+	//
+	// Default is 0.
+	MaxDatabaseSize int64
+
+	// MinFreeDiskSpace is the free disk space headroom in bytes to keep on the filesystem holding the database.
+	//
+	// Before each write, the state verifies that the filesystem has enough free space for the write
+	// plus the headroom, and fails early with ErrInsufficientDiskSpace otherwise, rather than running
+	// into ENOSPC in the middle of a transaction. The free space is measured periodically, see WriteCheckInterval.
+	// The check is only supported on Linux and macOS.
+	// Zero value disables the check.
+	//
+	// Default is 0.
+	MinFreeDiskSpace int64
+
+	// WriteCheckInterval is how long the measurements of the database size and of the free disk space
+	// (see MaxDatabaseSize, MinFreeDiskSpace) are reused by the writes.
+	//
+	// The measurements are also refreshed every 100 writes, and the writes done since the last measurement
+	// are accounted in the estimate, so the limits are enforced with a small lag only.
+	// Zero value measures before each write.
+	//
+	// Default is 1 second.
+	WriteCheckInterval time.Duration
+
+	// Namespaces is the list of namespaces the state accepts.
+	//
+	// Operations on other namespaces fail with ErrNamespaceNotAllowed.
+	// This prevents typos from silently creating new namespaces.
+	//
+	// Default is empty, which allows any namespace.
+	Namespaces []resource.Namespace
+
+	// UndecodableEvents defines how watches handle events which can't be decoded.
+	//
+	// E.g. a resource might be written by a newer version of the program with an incompatible spec.
+	// By default, the watch is terminated with an error, which might break a shared watch
+	// because of a single resource.
+	//
+	// Default is UndecodableEventsError.
+	UndecodableEvents UndecodableEventsPolicy
+
+	// SynchronousEventDelivery makes mutations wait for the in-process watches to pick up the resulting events.
+	//
+	// When enabled, Create/Update/Destroy return only after every matching watch has fetched the new events
+	// and sent them to the watch channel (if the channel has enough buffer space).
+	// This makes watch-based tests deterministic, but it slows down mutations, so it should
+	// only be used in tests.
+	//
+	// Default is false.
+	SynchronousEventDelivery bool
+
+	// SkipNoopUpdates makes Update skip the updates which don't change the resource.
+	//
+	// The spec, labels, annotations, finalizers, phase and owner are compared with the stored resource,
+	// and if nothing changes, Update returns success without bumping the version and without generating an event.
+	// This removes the event noise from the reconcilers which write the resources unconditionally,
+	// at the cost of reading and unmarshaling the stored resource on every update.
+	// The result of the mutation (see WithMutationResult) is not recorded for the skipped updates.
+	//
+	// Default is false.
+	SkipNoopUpdates bool
+
+	// SkipOldResource makes the watches deliver the update events without the previous version of the resource.
+	//
+	// Decoding Old doubles the allocations for the update events, which is wasted for the consumers ignoring it
+	// (e.g. controllers reacting to the current state only). With the option enabled, Event.Old is nil,
+	// and the stored previous version is not even read from the database.
+	// WatchKind with label or ID queries still decodes Old, as it is required to filter the update events.
+	// See WithoutOld to enable this for a single watch.
+	//
+	// Default is false.
+	SkipOldResource bool
+
+	// Ownership defines how the state coordinates with other state instances sharing the same tables.
+	//
+	// With ownership enabled, state instances compete for a lease stored in the database,
+	// only the lease holder runs the background tasks (compaction).
+	//
+	// Default is OwnershipDisabled.
+	Ownership OwnershipMode
+
+	// LeaseDuration is the duration of the ownership lease.
+	//
+	// The lease is renewed every third of the duration, if the holder stops renewing it,
+	// another state instance takes over after the lease expires.
+	//
+	// Default is 30 seconds.
+	LeaseDuration time.Duration
+
+	// Mutators are called before Create and Update store the resource (see Mutator).
+	//
+	// Mutators apply the defaults consistently, regardless of the code path doing the write.
+	//
+	// Default is empty.
+	Mutators []Mutator
+
+	// Validators are called before Create and Update commit the resource (see Validator).
+	//
+	// A write rejected by a validator fails with an error matching IsValidationError.
+	// This allows to enforce invariants (e.g. schema validation, immutable fields) at the storage layer,
+	// regardless of the code path doing the write.
+	//
+	// Default is empty.
+	Validators []Validator
+
+	// PostCommitHooks are called after the writes are committed (see PostCommitHook).
+	//
+	// The hooks allow to keep secondary caches or legacy systems in sync without running a watch.
+	//
+	// Default is empty.
+	PostCommitHooks []PostCommitHook
+
+	// AuditLogger logs a line for each committed write (see WithAuditLogger).
+	//
+	// The line carries the operation, the namespace, type and ID, the owner, and the versions
+	// before and after the write, but not the spec, so it is a lightweight audit trail of the writes
+	// made via the state, without exporting the events.
+	//
+	// Default is nil (no audit logging).
+	AuditLogger *zap.Logger
+
+	// VersionHistory enables the version history retention for the selected resource kinds.
+	//
+	// On Update and Destroy, the previous version of the resource is kept in a separate table,
+	// up to the configured number of versions per resource; the versions can be read with GetVersion.
+	// Unlike the events, the history is not affected by the compaction, so it's suitable for audit-critical kinds.
+	//
+	// Default is empty.
+	VersionHistory []VersionHistory
+
+	// GraveyardRetention enables keeping the destroyed resources for recovery (see Recover).
+	//
+	// The destroy events keep the last copy of the resource only until they are compacted;
+	// with the graveyard enabled, the last version of each destroyed resource is kept in a separate table
+	// for the retention period. The expired resources are removed by the background compaction loop.
+	// Zero value disables the graveyard.
+	//
+	// Default is 0.
+	GraveyardRetention time.Duration
+
+	// ReadReplica is the pool of connections to the read replica database.
+	//
+	// When set, Get, List and FindAll are served from the replica, and writes and watches go to the primary database.
+	// The replica is a separate database file which is refreshed from the primary database every
+	// ReadReplicaRefreshInterval, so heavy read-only consumers (e.g. dashboards) don't compete
+	// with the writers for the primary database.
+	// The reads see the state as of the last refresh, so this is not suitable for controllers,
+	// which expect to read their own writes.
+	// The replica should be opened with the same page size as the primary database.
+	//
+	// Default is nil (reads go to the primary database).
+	ReadReplica SqlitexPool
+
+	// ReadReplicaRefreshInterval is the interval between refreshes of the read replica.
+	//
+	// Default is 10 seconds.
+	ReadReplicaRefreshInterval time.Duration
+
+	// Webhooks are the HTTP endpoints notified about the events.
+	//
+	// Each event of the configured kinds is posted as JSON, failed deliveries are retried
+	// with exponential backoff.
+	// This allows non-Go systems to integrate with state changes without speaking the COSI gRPC protocol.
+	//
+	// Default is empty.
+	Webhooks []Webhook
+
+	// KeyProvider provides the keys to encrypt the specs of EncryptedKinds.
+	//
+	// Default is nil (no encryption).
+	KeyProvider KeyProvider
+
+	// EncryptedKinds are the resource kinds which specs are encrypted at rest.
+	//
+	// A kind with an empty type matches all types in the namespace.
+	// Only the marshaled resources are encrypted: the metadata columns (labels, finalizers, phase, owner)
+	// stay in plaintext, so the filtering by labels keeps working, and the other kinds are not affected.
+	// Existing plaintext resources of the encrypted kinds are still readable, and get encrypted on the next write.
+	//
+	// Default is empty.
+	EncryptedKinds []resource.Kind
+
+	// LongTransactionThreshold enables tracking of the connections held by the state (see OpenTransactions),
+	// and logs the ones held longer than the threshold with the stack trace of the holder.
+	//
+	// A long-lived read transaction keeps the WAL from being checkpointed, so the WAL grows without bounds.
+	// Tracking captures a stack trace on every connection checkout, so it has some overhead.
+	//
+	// Default is 0 (disabled).
+	LongTransactionThreshold time.Duration
+
+	// WatchPanicRestarts is the number of times a watch restarts after a panic while fetching its events.
+	//
+	// A panic while fetching the events (e.g. in the marshaler) is recovered and delivered as an Errored event
+	// with the error matching panicsafe.IsPanic. With restarts enabled, the panic is logged instead,
+	// and the events are fetched again starting after the last delivered event; the counter is reset
+	// once the events are fetched successfully.
+	//
+	// Default is 0 (the panic is delivered as an Errored event).
+	WatchPanicRestarts int
+
+	// WatchSendTimeout is the time a watch waits for the consumer to receive an event.
+	//
+	// A consumer which stops receiving blocks the watch goroutine, which keeps the pending events in memory
+	// and holds back the compaction (up to CompactMaxWatchHold). With the timeout set, such a watch is terminated:
+	// the Errored event is delivered whenever the consumer receives again, and the watch position is released.
+	// The blocked and timed out sends are counted in the sqlite_state_watch_sends expvar.
+	//
+	// Default is 0 (wait forever).
+	WatchSendTimeout time.Duration
+
+	// Registry is the registry the state is added to, see Registry.
+	//
+	// Default is nil.
+	Registry *Registry
+
+	// GetCacheSize enables the cache of the resources returned by Get, up to the given number of resources.
+	//
+	// Controllers frequently read the same unchanged resources, the cached ones are returned without
+	// querying the database and unmarshaling them. The entries are invalidated when the resources change,
+	// so the cache only sees the changes made by other processes if ExternalChangesPollInterval is set,
+	// and it's disabled with ReadReplica. The hits and misses are counted in the sqlite_state_get_cache expvar.
+	//
+	// Default is 0 (disabled).
+	GetCacheSize int
+
+	// CachedKinds are the kinds kept in memory, Get and List of these kinds don't query the database.
+	//
+	// The mirror of each kind is loaded on start, and brought up to date from the events on every read,
+	// so the reads see all the writes made via the state before them. Like the watches, the mirrors
+	// hold back the compaction of the events they haven't applied yet, and they only see the changes made
+	// by other processes if ExternalChangesPollInterval is set. A kind with an empty type mirrors the whole namespace.
+	//
+	// Default is empty.
+	CachedKinds []resource.Kind
+
+	// PruneEmptyNamespaces prunes the events of the namespaces which resources were all destroyed.
+	//
+	// The pruning (see PruneNamespaceEvents) is done by the background compaction, which is triggered
+	// by the destroy of the last resource of the namespace, so it requires CompactionInterval to be set.
+	//
+	// Default is false.
+	PruneEmptyNamespaces bool
+
+	// Faults injects storage errors into the statements run by the state, see Faults.
+	//
+	// It should only be set in tests.
+	//
+	// Default is nil.
+	Faults *Faults
+
+	// StrictConfiguration makes NewState fail if the database settings need adjusting (e.g. the journal mode is not WAL).
+	//
+	// By default, such settings are adjusted with a warning. The settings which can't work are always rejected.
+	//
+	// Default is false.
+	StrictConfiguration bool
+
+	// CanceledErrors makes the writes stopped by the context cancellation fail with an error matching IsCanceledError.
+	//
+	// The option applies to Create, Update, Destroy, Apply, ApplyManifests and Import.
+	// A write canceled mid-transaction is rolled back, so neither the resource nor the event is written.
+	// By default, the error is the storage error the cancellation caused (e.g. the interrupted statement),
+	// which can't be told from a storage failure; with the option, the error also unwraps to the context error.
+	//
+	// Default is false.
+	CanceledErrors bool
+
+	// SerializeKindWrites serializes the writes of each kind (namespace and type) within the process.
+	//
+	// Concurrent writers of the same kind (e.g. the controller replicas) otherwise compete for the database
+	// write lock, waiting for it with the busy handler backoff. With the option enabled, they wait in-process
+	// for each other instead, which keeps the latency of the writes predictable under contention.
+	// The writes of different kinds and the writes of other processes still compete for the database lock.
+	//
+	// Default is false.
+	SerializeKindWrites bool
+
+	// FanoutWorkers enables the shared event reader for the kind watches (WatchKind and WatchKindAggregated),
+	// and sets the number of workers converting the events for the watches.
+	//
+	// Each kind watch otherwise reads the events of its kind on its own after each write, so with many watches
+	// a single write results in as many queries. With the option enabled, a single reader reads the new events once,
+	// and queues them for the watches of their kinds, while the workers decode and filter the events for each watch.
+	// A watch falling behind (e.g. with a slow consumer) doesn't hold the others back: once its queue overflows
+	// (see FanoutQueueSize), the queue is dropped, and the watch reads the missed events from the database on its own.
+	//
+	// Default is 0 (disabled).
+	FanoutWorkers int
+
+	// FanoutQueueSize is the number of events queued for each kind watch, see FanoutWorkers.
+	//
+	// Default is 1024.
+	FanoutQueueSize int
+
+	// WatchScanShards splits the scan of the new events of a kind watch into the given number of ranges of event IDs,
+	// which are read concurrently and merged in order.
+	//
+	// A watch of a very hot kind might fall behind by many events between the polls (e.g. after a burst of writes),
+	// and a single scan reading them all grows the latency of the poll. With the option set, a scan of at least
+	// WatchScanShards * WatchScanShardEvents events is split, each range is read on its own connection,
+	// so the pool should have enough connections for the concurrent scans.
+	// The shorter scans are not split.
+	//
+	// Default is 0 (disabled).
+	WatchScanShards int
+
+	// WatchScanShardEvents is the minimum number of events (of any kind) in each range of the split scan, see WatchScanShards.
+	//
+	// Default is 1000.
+	WatchScanShardEvents int
+
+	// LogStatements logs the SQL statements run by the state with their parameters at the debug level.
+	//
+	// The specs of RedactedKinds are masked in the log. Recording the parameters slows the statements down,
+	// so the option is meant for debugging.
+	//
+	// Default is false.
+	LogStatements bool
+
+	// RedactedKinds are the kinds whose specs might carry secrets (e.g. the credentials).
+	//
+	// Their specs are masked in the statement log (see LogStatements) and in the events exported as JSON
+	// (see State.MarshalEventJSON), so the debug logging and the exports are safe to enable in production.
+	// A kind with an empty type covers the whole namespace.
+	//
+	// Default is none.
+	RedactedKinds []resource.Kind
+
+	// StatementCounter counts the SQL statements run by the state, see StatementCounter.
+	//
+	// It should only be set in tests.
+	//
+	// Default is nil.
+	StatementCounter *StatementCounter
 }
 
 // StateOption configures sqlite state.
@@ -76,11 +616,21 @@ type StateOption func(*StateOptions)
 // DefaultStateOptions returns default sqlite state options.
 func DefaultStateOptions() StateOptions {
 	return StateOptions{
-		Logger:             zap.NewNop(),
-		TablePrefix:        "",
-		CompactionInterval: 30 * time.Minute,
-		CompactKeepEvents:  1000,
-		CompactMinAge:      time.Hour,
+		Logger:               zap.NewNop(),
+		TablePrefix:          "",
+		CompactionInterval:   30 * time.Minute,
+		CompactKeepEvents:    1000,
+		CompactMinAge:        time.Hour,
+		CompactMaxWatchHold:  24 * time.Hour,
+		FanoutQueueSize:      1024,
+		WatchScanShardEvents: 1000,
+		CompactBatchSize:     1000,
+		CompactBatchPause:    5 * time.Millisecond,
+		OptimizeInterval:     time.Hour,
+		LeaseDuration:        30 * time.Second,
+		WriteCheckInterval:   time.Second,
+
+		ReadReplicaRefreshInterval: 10 * time.Second,
 	}
 }
 
@@ -91,6 +641,20 @@ func WithTablePrefix(prefix string) StateOption {
 	}
 }
 
+// WithExtraSchema sets the SQL script applied after the schema of the state.
+func WithExtraSchema(sql string) StateOption {
+	return func(opts *StateOptions) {
+		opts.ExtraSchema = sql
+	}
+}
+
+// WithMetadataViews creates the read-only views with the decoded metadata for ad-hoc analysis.
+func WithMetadataViews(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.MetadataViews = enabled
+	}
+}
+
 // WithCompactionInterval sets the interval between automatic database compactions.
 func WithCompactionInterval(interval time.Duration) StateOption {
 	return func(opts *StateOptions) {
@@ -112,6 +676,389 @@ func WithCompactMinAge(minAge time.Duration) StateOption {
 	}
 }
 
+// WithCompactRetention sizes the number of events kept by the compaction to cover the retention at the observed insert rate,
+// keeping at most maxKeepEvents (zero means no limit).
+func WithCompactRetention(retention time.Duration, maxKeepEvents int) StateOption {
+	return func(opts *StateOptions) {
+		opts.CompactRetention = retention
+		opts.CompactMaxKeepEvents = maxKeepEvents
+	}
+}
+
+// WithCompactBatchSize sets the number of events deleted in a single batch during compaction.
+//
+// The batch size which is not positive is ignored, and the default is used.
+func WithCompactBatchSize(batchSize int) StateOption {
+	return func(opts *StateOptions) {
+		if batchSize <= 0 {
+			batchSize = DefaultStateOptions().CompactBatchSize
+		}
+
+		opts.CompactBatchSize = batchSize
+	}
+}
+
+// WithCompactBatchPause sets the pause between the compaction batches.
+func WithCompactBatchPause(pause time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.CompactBatchPause = pause
+	}
+}
+
+// WithCompactTimeBudget sets the maximum duration of deleting events in a single compaction run.
+func WithCompactTimeBudget(budget time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.CompactTimeBudget = budget
+	}
+}
+
+// WithCompactMaxWatchHold sets the maximum age of unconsumed events an active watch can keep from compaction.
+func WithCompactMaxWatchHold(maxHold time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.CompactMaxWatchHold = maxHold
+	}
+}
+
+// WithOptimizeInterval sets the interval between refreshes of the query planner statistics.
+func WithOptimizeInterval(interval time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.OptimizeInterval = interval
+	}
+}
+
+// WithExternalChangesMaxPollInterval sets the maximum interval between adaptive checks for external modifications.
+func WithExternalChangesMaxPollInterval(interval time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.ExternalChangesMaxPollInterval = interval
+	}
+}
+
+// WithExternalChangesPollInterval enables periodic checks for external modifications of the database.
+func WithExternalChangesPollInterval(interval time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.ExternalChangesPollInterval = interval
+	}
+}
+
+// WithMarshalerIdentity sets the identity of the marshaler recorded in the database.
+func WithMarshalerIdentity(identity string) StateOption {
+	return func(opts *StateOptions) {
+		opts.MarshalerIdentity = identity
+	}
+}
+
+// WithPageSize sets the database page size in bytes.
+func WithPageSize(pageSize int) StateOption {
+	return func(opts *StateOptions) {
+		opts.PageSize = pageSize
+	}
+}
+
+// WithCacheSize sets the page cache size of each connection (see PRAGMA cache_size).
+func WithCacheSize(cacheSize int) StateOption {
+	return func(opts *StateOptions) {
+		opts.CacheSize = cacheSize
+	}
+}
+
+// WithBusyTimeout sets the busy timeout of each connection (see PRAGMA busy_timeout).
+func WithBusyTimeout(timeout time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.BusyTimeout = timeout
+	}
+}
+
+// WithDeferredIndexes creates the secondary indexes in the background once the state is created.
+func WithDeferredIndexes(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.DeferIndexes = enabled
+	}
+}
+
+// WithCacheWarmup reads the resources table in the background once the state is created.
+func WithCacheWarmup(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.WarmupCache = enabled
+	}
+}
+
+// WithExplainQueries enables logging of the query plans for List and Watch queries.
+func WithExplainQueries(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.ExplainQueries = enabled
+	}
+}
+
+// WithMaxDatabaseSize sets the maximum size of the database in bytes.
+func WithMaxDatabaseSize(size int64) StateOption {
+	return func(opts *StateOptions) {
+		opts.MaxDatabaseSize = size
+	}
+}
+
+// WithMinFreeDiskSpace sets the free disk space headroom in bytes.
+func WithMinFreeDiskSpace(headroom int64) StateOption {
+	return func(opts *StateOptions) {
+		opts.MinFreeDiskSpace = headroom
+	}
+}
+
+// WithWriteCheckInterval sets how long the measurements of the database size and of the free disk space are reused.
+func WithWriteCheckInterval(interval time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.WriteCheckInterval = interval
+	}
+}
+
+// WithNamespaces restricts the state to the given list of namespaces.
+func WithNamespaces(namespaces ...resource.Namespace) StateOption {
+	return func(opts *StateOptions) {
+		opts.Namespaces = namespaces
+	}
+}
+
+// WithUndecodableEvents sets the policy for events which can't be decoded.
+func WithUndecodableEvents(policy UndecodableEventsPolicy) StateOption {
+	return func(opts *StateOptions) {
+		opts.UndecodableEvents = policy
+	}
+}
+
+// WithSynchronousEventDelivery enables synchronous delivery of events to the in-process watches.
+func WithSynchronousEventDelivery(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.SynchronousEventDelivery = enabled
+	}
+}
+
+// WithSkipNoopUpdates makes Update skip the updates which don't change the resource.
+func WithSkipNoopUpdates(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.SkipNoopUpdates = enabled
+	}
+}
+
+// WithSkipOldResource makes the watches deliver the update events without the previous version of the resource.
+func WithSkipOldResource(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.SkipOldResource = enabled
+	}
+}
+
+// WithOwnership sets the ownership mode for the state instances sharing the same tables.
+func WithOwnership(mode OwnershipMode) StateOption {
+	return func(opts *StateOptions) {
+		opts.Ownership = mode
+	}
+}
+
+// WithLeaseDuration sets the duration of the ownership lease.
+func WithLeaseDuration(duration time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.LeaseDuration = duration
+	}
+}
+
+// WithMutator adds a mutator called before Create and Update store the resource.
+func WithMutator(mutator Mutator) StateOption {
+	return func(opts *StateOptions) {
+		opts.Mutators = append(opts.Mutators, mutator)
+	}
+}
+
+// WithValidator adds a validator called before Create and Update commit the resource.
+func WithValidator(validator Validator) StateOption {
+	return func(opts *StateOptions) {
+		opts.Validators = append(opts.Validators, validator)
+	}
+}
+
+// WithAuditLogger logs a line for each committed Create, Update and Destroy with the logger.
+func WithAuditLogger(logger *zap.Logger) StateOption {
+	return func(opts *StateOptions) {
+		opts.AuditLogger = logger
+	}
+}
+
+// WithPostCommitHook adds a hook called after Create, Update and Destroy are committed.
+func WithPostCommitHook(hook PostCommitHook) StateOption {
+	return func(opts *StateOptions) {
+		opts.PostCommitHooks = append(opts.PostCommitHooks, hook)
+	}
+}
+
+// WithVersionHistory keeps the last keep previous versions of each resource of the kind.
+func WithVersionHistory(kind resource.Kind, keep int) StateOption {
+	return func(opts *StateOptions) {
+		opts.VersionHistory = append(opts.VersionHistory, VersionHistory{
+			Kind: kind,
+			Keep: keep,
+		})
+	}
+}
+
+// WithGraveyardRetention keeps the destroyed resources for recovery for the retention period.
+func WithGraveyardRetention(retention time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.GraveyardRetention = retention
+	}
+}
+
+// WithReadReplica serves the reads from the read replica database, refreshed every interval.
+func WithReadReplica(replica SqlitexPool, refreshInterval time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.ReadReplica = replica
+		opts.ReadReplicaRefreshInterval = refreshInterval
+	}
+}
+
+// WithEncryption encrypts the specs of the resource kinds with the keys from the provider.
+func WithEncryption(provider KeyProvider, kinds ...resource.Kind) StateOption {
+	return func(opts *StateOptions) {
+		opts.KeyProvider = provider
+		opts.EncryptedKinds = append(opts.EncryptedKinds, kinds...)
+	}
+}
+
+// WithWebhook adds a webhook which is notified about the events of the given resource kinds.
+//
+// The filter might be nil to post all events.
+func WithWebhook(url string, kinds []resource.Kind, filter WebhookFilter) StateOption {
+	return func(opts *StateOptions) {
+		opts.Webhooks = append(opts.Webhooks, Webhook{
+			URL:    url,
+			Kinds:  kinds,
+			Filter: filter,
+		})
+	}
+}
+
+// WithLongTransactionThreshold logs the connections held by the state longer than the threshold.
+func WithLongTransactionThreshold(threshold time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.LongTransactionThreshold = threshold
+	}
+}
+
+// WithWatchPanicRestarts sets the number of times a watch restarts after a panic.
+func WithWatchPanicRestarts(restarts int) StateOption {
+	return func(opts *StateOptions) {
+		opts.WatchPanicRestarts = restarts
+	}
+}
+
+// WithWatchSendTimeout sets the time a watch waits for the consumer to receive an event.
+func WithWatchSendTimeout(timeout time.Duration) StateOption {
+	return func(opts *StateOptions) {
+		opts.WatchSendTimeout = timeout
+	}
+}
+
+// WithRegistry adds the state to the registry until it is closed.
+func WithRegistry(registry *Registry) StateOption {
+	return func(opts *StateOptions) {
+		opts.Registry = registry
+	}
+}
+
+// WithGetCacheSize enables the cache of the resources returned by Get.
+func WithGetCacheSize(size int) StateOption {
+	return func(opts *StateOptions) {
+		opts.GetCacheSize = size
+	}
+}
+
+// WithCachedKinds keeps the resources of the kinds in memory.
+func WithCachedKinds(kinds ...resource.Kind) StateOption {
+	return func(opts *StateOptions) {
+		opts.CachedKinds = append(opts.CachedKinds, kinds...)
+	}
+}
+
+// WithPruneEmptyNamespaces enables the pruning of the events of the namespaces which resources were all destroyed.
+func WithPruneEmptyNamespaces(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.PruneEmptyNamespaces = enabled
+	}
+}
+
+// WithCanceledErrors makes the writes stopped by the context cancellation fail with an error matching IsCanceledError.
+func WithCanceledErrors(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.CanceledErrors = enabled
+	}
+}
+
+// WithFaults injects the storage errors set up in faults into the statements run by the state.
+func WithFaults(faults *Faults) StateOption {
+	return func(opts *StateOptions) {
+		opts.Faults = faults
+	}
+}
+
+// WithStrictConfiguration makes NewState fail instead of adjusting the database settings.
+func WithStrictConfiguration(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.StrictConfiguration = enabled
+	}
+}
+
+// WithSerializedKindWrites enables the in-process serialization of the writes of each kind.
+func WithSerializedKindWrites(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.SerializeKindWrites = enabled
+	}
+}
+
+// WithEventFanout enables the shared event reader for the kind watches with the number of workers.
+func WithEventFanout(workers int) StateOption {
+	return func(opts *StateOptions) {
+		opts.FanoutWorkers = workers
+	}
+}
+
+// WithEventFanoutQueueSize sets the number of events queued for each kind watch by the shared event reader.
+func WithEventFanoutQueueSize(size int) StateOption {
+	return func(opts *StateOptions) {
+		opts.FanoutQueueSize = size
+	}
+}
+
+// WithWatchScanShards splits the scan of the new events of a kind watch into the number of concurrently read ranges.
+func WithWatchScanShards(shards int) StateOption {
+	return func(opts *StateOptions) {
+		opts.WatchScanShards = shards
+	}
+}
+
+// WithWatchScanShardEvents sets the minimum number of events in each range of the split scan of the kind watch events.
+func WithWatchScanShardEvents(events int) StateOption {
+	return func(opts *StateOptions) {
+		opts.WatchScanShardEvents = events
+	}
+}
+
+// WithStatementLogging enables logging of the SQL statements at the debug level.
+func WithStatementLogging(enabled bool) StateOption {
+	return func(opts *StateOptions) {
+		opts.LogStatements = enabled
+	}
+}
+
+// WithRedactedKinds sets the kinds whose specs are masked in the statement log and the exported events.
+func WithRedactedKinds(kinds ...resource.Kind) StateOption {
+	return func(opts *StateOptions) {
+		opts.RedactedKinds = append(opts.RedactedKinds, kinds...)
+	}
+}
+
+// WithStatementCounter counts the SQL statements run by the state with the counter.
+func WithStatementCounter(counter *StatementCounter) StateOption {
+	return func(opts *StateOptions) {
+		opts.StatementCounter = counter
+	}
+}
+
 // WithLogger sets the logger for the sqlite state.
 func WithLogger(logger *zap.Logger) StateOption {
 	return func(opts *StateOptions) {
@@ -129,7 +1076,15 @@ var _ state.CoreState = &State{}
 //   - busy_timeout pragma should be set to a reasonable value (e.g. 5000 ms)
 //   - journal_mode pragma should be set to WAL
 //   - txlock=immediate should be set in the DSN to avoid busy errors on concurrent writes.
+//
+// With sqlitexx.Pool, the pragmas can be applied to each connection via PoolOptions.Pragmas.
+// DSN and DSNPragmas build the database URI and the pragmas with these settings for the supported drivers.
+// The settings are checked when the state is created: the journal mode is switched to WAL with a warning
+// (see StrictConfiguration), and the databases which can't work (e.g. the URI with the pragmas of another driver
+// opened as a file name) are rejected with ErrUnsupportedConfiguration.
 func NewState(ctx context.Context, db SqlitexPool, marshaler store.Marshaler, opts ...StateOption) (*State, error) {
+	start := time.Now()
+
 	compactionCtx, compactionCtxCancel := context.WithCancel(context.Background())
 
 	st := &State{
@@ -138,6 +1093,11 @@ func NewState(ctx context.Context, db SqlitexPool, marshaler store.Marshaler, op
 		sub:                 sub.NewManager(),
 		options:             DefaultStateOptions(),
 		shutdown:            make(chan struct{}),
+		compactionTrigger:   make(chan struct{}, 1),
+		compactSem:          make(chan struct{}, 1),
+		watches:             make(map[*watchPosition]struct{}),
+		pruneQueue:          make(map[resource.Namespace]struct{}),
+		kindLocks:           make(map[kindKey]*kindLock),
 		compactionCtx:       compactionCtx,
 		compactionCtxCancel: compactionCtxCancel,
 	}
@@ -146,22 +1106,176 @@ func NewState(ctx context.Context, db SqlitexPool, marshaler store.Marshaler, op
 		opt(&st.options)
 	}
 
+	// the goroutines started before a failure are stopped, and the compaction context is released
+	opened := false
+
+	defer func() {
+		if !opened {
+			st.Close()
+		}
+	}()
+
+	if st.options.Faults != nil {
+		st.db = &faultyPool{SqlitexPool: st.db, faults: st.options.Faults}
+	}
+
+	var statementTracers tracers
+
+	if st.options.LogStatements {
+		statementTracers = append(statementTracers, &statementLogger{st: st, logger: st.options.Logger})
+	}
+
+	if st.options.StatementCounter != nil {
+		statementTracers = append(statementTracers, st.options.StatementCounter)
+	}
+
+	if len(statementTracers) > 0 {
+		st.db = &tracingPool{SqlitexPool: st.db, tracer: statementTracers}
+	}
+
+	if pragmas := st.options.connectionPragmas(); len(pragmas) > 0 {
+		st.db = newPragmaPool(st.db, pragmas)
+	}
+
+	if st.options.ReadReplica != nil && st.options.BusyTimeout > 0 {
+		// the replica is locked while it's refreshed, so the readers wait for the refresh as well
+		st.options.ReadReplica = newPragmaPool(st.options.ReadReplica, []string{st.options.busyTimeoutPragma()})
+	}
+
+	if st.options.LongTransactionThreshold > 0 {
+		st.txTracker = newTrackingPool(st.db)
+		st.db = st.txTracker
+	}
+
+	st.readDB = st.db
+
+	if st.options.GetCacheSize > 0 && st.options.ReadReplica == nil {
+		st.getCache = newGetCache(st.options.GetCacheSize)
+	}
+
+	if st.options.PageSize != 0 {
+		if err := st.applyPageSize(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := st.checkConfiguration(ctx); err != nil {
+		return nil, err
+	}
+
+	migrationStart := time.Now()
+
 	if err := st.migrate(ctx); err != nil {
 		return nil, err
 	}
 
+	migrationDuration := time.Since(migrationStart)
+
+	if err := st.loadPageSize(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := st.startMirrors(ctx); err != nil {
+		return nil, err
+	}
+
+	if st.options.ReadReplica != nil {
+		if err := st.RefreshReadReplica(ctx); err != nil {
+			return nil, err
+		}
+
+		st.readDB = st.options.ReadReplica
+
+		st.wg.Add(1)
+
+		go st.runReadReplica() //nolint:contextcheck
+	}
+
+	if st.options.Ownership != OwnershipDisabled {
+		if err := st.initLease(ctx); err != nil {
+			return nil, err
+		}
+
+		st.wg.Add(1)
+
+		go st.runLease() //nolint:contextcheck
+	}
+
+	if st.txTracker != nil {
+		st.wg.Add(1)
+
+		go st.runLongTransactions()
+	}
+
 	if st.options.CompactionInterval > 0 {
 		st.wg.Add(1)
 
 		go st.runCompaction() //nolint:contextcheck
 	}
 
+	if st.options.FanoutWorkers > 0 {
+		if err := st.startFanout(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if st.options.ExternalChangesPollInterval > 0 {
+		ec, err := st.initExternalChanges(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		st.wg.Add(1)
+
+		go st.runExternalChanges(ec) //nolint:contextcheck
+	}
+
+	if err := st.startWebhooks(); err != nil { //nolint:contextcheck
+		return nil, err
+	}
+
+	if st.options.DeferIndexes || st.options.WarmupCache {
+		st.wg.Add(1)
+
+		go st.runColdStart() //nolint:contextcheck
+	}
+
+	if st.options.Registry != nil {
+		st.options.Registry.add(st)
+	}
+
+	st.options.Logger.Info("state opened",
+		zap.Duration("duration", time.Since(start)),
+		zap.Duration("migration", migrationDuration),
+	)
+
+	opened = true
+
 	return st, nil
 }
 
 // Close shuts down the state and releases all resources.
 func (st *State) Close() {
+	if st.options.Registry != nil {
+		st.options.Registry.remove(st)
+	}
+
 	st.compactionCtxCancel()
 	close(st.shutdown)
 	st.wg.Wait()
+
+	st.stopMirrors()
+
+	// release the lease, so that a follower can take over without waiting for the lease to expire
+	if st.options.Ownership != OwnershipDisabled && st.leader.Load() {
+		if err := st.releaseLease(context.Background()); err != nil {
+			st.options.Logger.Error("failed to release ownership lease", zap.Error(err))
+		}
+	}
+
+	if st.closePool != nil {
+		if err := st.closePool(); err != nil {
+			st.options.Logger.Error("failed to close database", zap.Error(err))
+		}
+	}
 }
@@ -44,6 +44,12 @@ func withSqlite(t testing.TB, fn func(state.State), opts ...sqlite.StateOption)
 func withSqliteCore(t testing.TB, fn func(*sqlite.State), opts ...sqlite.StateOption) {
 	t.Helper()
 
+	withSqliteMarshaler(t, store.ProtobufMarshaler{}, fn, opts...)
+}
+
+func withSqliteMarshaler(t testing.TB, marshaler store.Marshaler, fn func(*sqlite.State), opts ...sqlite.StateOption) {
+	t.Helper()
+
 	dir := t.TempDir()
 
 	pool, err := sqlitexx.NewPool("file:"+filepath.Join(dir, "state.db"),
@@ -59,7 +65,7 @@ func withSqliteCore(t testing.TB, fn func(*sqlite.State), opts ...sqlite.StateOp
 		require.NoError(t, pool.Close())
 	})
 
-	coreState, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{},
+	coreState, err := sqlite.NewState(t.Context(), pool, marshaler,
 		append(
 			[]sqlite.StateOption{
 				sqlite.WithTablePrefix("test_"),
@@ -84,6 +90,40 @@ func withSqliteCore(t testing.TB, fn func(*sqlite.State), opts ...sqlite.StateOp
 	fn(coreState)
 }
 
+// newSqlitePool opens a pool for the database at the path.
+func newSqlitePool(t testing.TB, path string) *sqlitexx.Pool {
+	t.Helper()
+
+	pool, err := sqlitexx.NewPool(path,
+		sqlitexx.PoolOptions{
+			Flags:         zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenWAL | zombiesqlite.OpenURI,
+			LowWatermark:  2,
+			HighWatermark: 16,
+		},
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, pool.Close())
+	})
+
+	return pool
+}
+
+// newSqliteState creates a state on the database at the path, several states might share the same database.
+func newSqliteState(t testing.TB, path string, opts ...sqlite.StateOption) *sqlite.State {
+	t.Helper()
+
+	st, err := sqlite.NewState(t.Context(), newSqlitePool(t, path), store.ProtobufMarshaler{},
+		append([]sqlite.StateOption{sqlite.WithLogger(zaptest.NewLogger(t))}, opts...)...,
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	return st
+}
+
 func TestMain(m *testing.M) {
 	goleak.VerifyTestMain(m)
 }
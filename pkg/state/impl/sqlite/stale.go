@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+)
+
+// FindStale returns the resources of the kind which were not updated within the duration,
+// ordered by the update time (the oldest first).
+//
+// The resources are looked up by the update time index, so the cleanup controllers can reap
+// the abandoned resources (e.g. left by the clients which went away) without listing the whole kind.
+// The update time is the Updated field of the metadata, which is stored with the second precision.
+func (st *State) FindStale(ctx context.Context, kind resource.Kind, olderThan time.Duration, opts ...state.GetOption) (resource.List, error) {
+	var options state.GetOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := st.checkNamespace(kind.Namespace()); err != nil {
+		return resource.List{}, fmt.Errorf("failed to find stale: %w", err)
+	}
+
+	// the read replica lags behind, so the resources updated since the refresh would be reported as stale
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return resource.List{}, fmt.Errorf("taking connection for find stale: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := st.newExplainedQuery(conn,
+		`SELECT spec FROM `+st.options.TablePrefix+`resources
+		WHERE namespace = $namespace AND type = $type AND updated_at < $updated_before
+		ORDER BY updated_at, id`,
+	)
+	if err != nil {
+		return resource.List{}, fmt.Errorf("preparing query for find stale: %w", err)
+	}
+
+	var result resource.List
+
+	err = q.
+		BindString("$namespace", kind.Namespace()).
+		BindString("$type", kind.Type()).
+		BindInt64("$updated_before", time.Now().Add(-olderThan).Unix()).
+		QueryAll(
+			func(stmt *sqlite.Stmt) error {
+				spec := make([]byte, stmt.GetLen("spec"))
+				stmt.GetBytes("spec", spec)
+
+				res, err := st.unmarshalResource(spec, options.UnmarshalOptions)
+				if err != nil {
+					return fmt.Errorf("failed to unmarshal resource: %w", err)
+				}
+
+				result.Items = append(result.Items, res)
+
+				return nil
+			},
+		)
+	if err != nil {
+		return resource.List{}, fmt.Errorf("error querying resources for find stale: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestFindStale(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	core, logs := observer.New(zapcore.InfoLevel)
+	pool := newSqlitePool(t, "file:"+filepath.Join(t.TempDir(), "state.db"))
+
+	st, err := sqlite.NewState(ctx, pool, store.ProtobufMarshaler{}, sqlite.WithExplainQueries(true), sqlite.WithLogger(zap.New(core)))
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", id)))
+	}
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "a")))
+
+	// age the resources, as the update time is set by the state (the column is enough, the spec is not checked)
+	conn, err := pool.Take(ctx)
+	require.NoError(t, err)
+
+	for id, age := range map[string]time.Duration{"a": 2 * time.Hour, "b": 3 * time.Hour} {
+		require.NoError(t, sqlitex.Execute(conn, `UPDATE resources SET updated_at = ? WHERE namespace = 'ns1' AND id = ?`, &sqlitex.ExecOptions{
+			Args: []any{time.Now().Add(-age).Unix(), id},
+		}))
+	}
+
+	pool.Put(conn)
+
+	ids := func(list resource.List) []string {
+		result := make([]string, 0, len(list.Items))
+
+		for _, res := range list.Items {
+			result = append(result, res.Metadata().ID())
+		}
+
+		return result
+	}
+
+	kind := conformance.NewPathResource("ns1", "").Metadata()
+
+	stale, err := st.FindStale(ctx, kind, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "a"}, ids(stale))
+
+	stale, err = st.FindStale(ctx, kind, 150*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, ids(stale))
+
+	stale, err = st.FindStale(ctx, conformance.NewPathResource("ns2", "").Metadata(), time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, stale.Items)
+
+	plans := logs.FilterMessage("query plan").All()
+	require.NotEmpty(t, plans)
+	assert.Contains(t, plans[0].ContextMap()["plan"], "SEARCH resources USING INDEX resources_updated (namespace=? AND type=? AND updated_at<?)")
+}
@@ -10,7 +10,12 @@ import (
 	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
 )
 
 func TestSqliteConformance(t *testing.T) {
@@ -23,3 +28,39 @@ func TestSqliteConformance(t *testing.T) {
 		})
 	})
 }
+
+func TestSqliteConformanceMemory(t *testing.T) {
+	t.Parallel()
+
+	st, err := sqlite.NewMemoryState(t.Context(), store.ProtobufMarshaler{}, sqlite.WithLogger(zaptest.NewLogger(t)))
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	suite.Run(t, &conformance.StateSuite{
+		State:      state.WrapCore(st),
+		Namespaces: []resource.Namespace{"default", "controller", "system", "runtime"},
+	})
+}
+
+func TestSqliteConformanceSynchronousEventDelivery(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		suite.Run(t, &conformance.StateSuite{
+			State:      s,
+			Namespaces: []resource.Namespace{"default", "controller", "system", "runtime"},
+		})
+	}, sqlite.WithSynchronousEventDelivery(true))
+}
+
+func TestSqliteConformanceEventFanout(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		suite.Run(t, &conformance.StateSuite{
+			State:      s,
+			Namespaces: []resource.Namespace{"default", "controller", "system", "runtime"},
+		})
+	}, sqlite.WithEventFanout(4), sqlite.WithEventFanoutQueueSize(16))
+}
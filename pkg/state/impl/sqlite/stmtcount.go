@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// StatementCounter counts the SQL statements run by the State, see WithStatementCounter.
+//
+// It lets the tests pin the number of statements the API calls run, so that the accidental N+1 queries
+// are caught as the features land. The statements of all the goroutines are counted (e.g. the watches
+// and the background tasks), and the transaction control statements (BEGIN, COMMIT) are not.
+//
+// StatementCounter is meant for tests only. The zero value is ready to use and is safe for concurrent use.
+type StatementCounter struct {
+	statements map[string]int
+	count      int
+	mu         sync.Mutex
+}
+
+// TraceStatement implements sqlitexx.Tracer.
+func (c *StatementCounter) TraceStatement(query string, _ []sqlitexx.Param) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.statements == nil {
+		c.statements = map[string]int{}
+	}
+
+	c.statements[strings.Join(strings.Fields(query), " ")]++
+	c.count++
+}
+
+// Count returns the number of statements run since the counter was created or reset.
+func (c *StatementCounter) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.count
+}
+
+// Statements returns the number of runs of each statement (with the whitespace collapsed)
+// since the counter was created or reset.
+func (c *StatementCounter) Statements() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return maps.Clone(c.statements)
+}
+
+// Reset sets the counts to zero.
+func (c *StatementCounter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statements = nil
+	c.count = 0
+}
+
+// Measure resets the counter, and returns the number of statements run while fn runs.
+func (c *StatementCounter) Measure(fn func()) int {
+	c.Reset()
+
+	fn()
+
+	return c.Count()
+}
@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestStatementBudgets(t *testing.T) {
+	t.Parallel()
+
+	var counter sqlite.StatementCounter
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("default", "path")
+
+		assert.LessOrEqual(t, counter.Measure(func() {
+			require.NoError(t, st.Create(ctx, res))
+		}), 1, "create: %v", counter.Statements())
+
+		assert.LessOrEqual(t, counter.Measure(func() {
+			_, err := st.Get(ctx, res.Metadata())
+			require.NoError(t, err)
+		}), 1, "get: %v", counter.Statements())
+
+		assert.LessOrEqual(t, counter.Measure(func() {
+			_, err := st.List(ctx, res.Metadata())
+			require.NoError(t, err)
+		}), 1, "list: %v", counter.Statements())
+
+		res.Metadata().Labels().Set("app", "foo")
+
+		assert.LessOrEqual(t, counter.Measure(func() {
+			require.NoError(t, st.Update(ctx, res))
+		}), 3, "update: %v", counter.Statements())
+	}, sqlite.WithStatementCounter(&counter), sqlite.WithCompactionInterval(0))
+}
+
+func TestStatementBudgetsWatch(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name string
+		opts []sqlite.StateOption
+
+		// statements per write, on top of the write itself
+		perWatch, perWrite int
+	}{
+		{
+			name:     "default",
+			perWatch: 1,
+		},
+		{
+			name:     "fanout",
+			opts:     []sqlite.StateOption{sqlite.WithEventFanout(2)},
+			perWrite: 1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			const numWatches = 3
+
+			var counter sqlite.StatementCounter
+
+			withSqliteCore(t, func(st *sqlite.State) {
+				ctx, cancel := context.WithCancel(t.Context())
+				defer cancel()
+
+				write := func(id string) int {
+					return counter.Measure(func() {
+						require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", id)))
+					})
+				}
+
+				baseline := write("baseline")
+
+				for i := range numWatches {
+					kind := resource.NewMetadata(fmt.Sprintf("watched-%d", i), conformance.PathResourceType, "", resource.VersionUndefined)
+
+					require.NoError(t, st.WatchKind(ctx, &kind, make(chan state.Event, 16)))
+				}
+
+				counts := make([]int, 0, numWatches)
+
+				for i := range numWatches {
+					// the write of each watched kind is polled by the watches of this kind only
+					counts = append(counts, counter.Measure(func() {
+						require.NoError(t, st.Create(ctx, conformance.NewPathResource(fmt.Sprintf("watched-%d", i), "path")))
+					}))
+				}
+
+				for _, count := range counts {
+					assert.LessOrEqual(t, count, baseline+test.perWatch+test.perWrite, "%v", counter.Statements())
+				}
+			}, append(test.opts,
+				sqlite.WithStatementCounter(&counter),
+				sqlite.WithCompactionInterval(0),
+				sqlite.WithSynchronousEventDelivery(true),
+			)...)
+		})
+	}
+}
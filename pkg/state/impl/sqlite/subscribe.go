@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/sub"
+)
+
+// Subscription delivers lightweight change notifications.
+//
+// Notifications carry no payload and are coalesced: a single notification
+// might correspond to any number of changes since the previous one.
+// Only changes performed via this State instance are reported.
+type Subscription interface {
+	// NotifyCh returns a channel which receives a value when something changes.
+	NotifyCh() <-chan struct{}
+	// Unsubscribe releases the subscription.
+	Unsubscribe()
+}
+
+// Subscribe returns a subscription notified on every change to resources of the given kind.
+//
+// Unlike WatchKind, Subscribe doesn't query the database, so it's a cheap way to get
+// "something changed" signals, e.g. for cache invalidation.
+// Subscription should be released with Unsubscribe.
+func (st *State) Subscribe(resourceKind resource.Kind) Subscription {
+	return st.sub.Subscribe(resourceKind)
+}
+
+// SubscribeNamespace returns a subscription notified on every change to resources in the namespace.
+func (st *State) SubscribeNamespace(ns resource.Namespace) Subscription {
+	return st.sub.SubscribeNamespace(ns)
+}
+
+// SubscribeAll returns a subscription notified on every change to any resource.
+func (st *State) SubscribeAll() Subscription {
+	return st.sub.SubscribeAll()
+}
+
+// notify notifies subscribers about a change to the resource.
+//
+// With synchronous event delivery, notify waits for the watches to process the change.
+func (st *State) notify(ctx context.Context, ptr resource.Pointer) {
+	st.eventRates.recordLocal(time.Now(), ptr)
+
+	if st.getCache != nil {
+		st.getCache.invalidate(ptr)
+	}
+
+	if st.options.SynchronousEventDelivery {
+		st.sub.NotifyWait(ctx, ptr)
+
+		return
+	}
+
+	st.sub.Notify(ptr)
+}
+
+// watchSubscribeOptions returns subscription options for watches.
+func (st *State) watchSubscribeOptions() []sub.SubscribeOption {
+	if st.options.SynchronousEventDelivery {
+		return []sub.SubscribeOption{sub.WithAck()}
+	}
+
+	return nil
+}
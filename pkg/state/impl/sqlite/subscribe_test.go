@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		kindSub := st.Subscribe(conformance.NewPathResource("ns1", "").Metadata())
+		defer kindSub.Unsubscribe()
+
+		allSub := st.SubscribeAll()
+		defer allSub.Unsubscribe()
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "a")))
+
+		select {
+		case <-allSub.NotifyCh():
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+
+		select {
+		case <-kindSub.NotifyCh():
+			t.Fatal("unexpected notification")
+		default:
+		}
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "a")))
+
+		select {
+		case <-kindSub.NotifyCh():
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+	})
+}
@@ -0,0 +1,221 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// TransferOwner changes the owner of the resource from fromOwner to toOwner.
+//
+// The resource metadata can't be updated with a different owner (the owner can only be set once),
+// and Update checks the owner of the stored resource against the one passed with the options,
+// so the owner change is done by TransferOwner instead. The change is a regular update: the version
+// is bumped, the validators and post-commit hooks are run, and the Updated event is generated.
+// The mutators are not run, as nothing but the owner changes.
+//
+// The resource is read and updated in a single transaction, the update applies only if the resource
+// is still owned by fromOwner. If it is not, an error matching state.IsOwnerConflictError is returned.
+// The updated resource is returned.
+func (st *State) TransferOwner(ctx context.Context, ptr resource.Pointer, fromOwner, toOwner resource.Owner) (_ resource.Resource, err error) {
+	defer st.convertCanceled(ctx, &err)
+
+	if err = st.checkNamespace(ptr.Namespace()); err != nil {
+		return nil, fmt.Errorf("failed to transfer owner: %w", err)
+	}
+
+	unlock, err := st.lockKind(ctx, ptr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer owner: %w", err)
+	}
+
+	defer unlock()
+
+	var (
+		res      resource.Resource
+		result   = mutationResultFromContext(ctx)
+		rowBytes int64
+		eventID  int64
+		noop     bool
+	)
+
+	st.localEvents.Add(ptr, 1)
+
+	err = func() (err error) {
+		var conn *sqlite.Conn
+
+		conn, err = st.db.Take(ctx)
+		if err != nil {
+			return fmt.Errorf("error taking connection for owner transfer: %w", err)
+		}
+
+		defer st.db.Put(conn)
+
+		doneFn, err := sqlitexx.BeginWithRetry(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("starting transaction for owner transfer: %w", err)
+		}
+
+		defer doneFn(&err)
+
+		var (
+			currentOwner string
+			currentSpec  []byte
+		)
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`SELECT owner, spec
+			FROM `+st.options.TablePrefix+`resources
+			WHERE namespace = $namespace AND type = $type AND id = $id`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for current resource state: %w", err)
+		}
+
+		if err = q.
+			BindString("$namespace", ptr.Namespace()).
+			BindString("$type", ptr.Type()).
+			BindString("$id", ptr.ID()).
+			QueryRow(func(stmt *sqlite.Stmt) error {
+				currentOwner = stmt.GetText("owner")
+				currentSpec = make([]byte, stmt.GetLen("spec"))
+				stmt.GetBytes("spec", currentSpec)
+
+				return nil
+			}); err != nil {
+			if errors.Is(err, sqlitexx.ErrNoRows) {
+				return fmt.Errorf("failed to transfer owner: %w", ErrNotFound(ptr))
+			}
+
+			return fmt.Errorf("error querying current resource state: %w", err)
+		}
+
+		if currentOwner != fromOwner {
+			return fmt.Errorf("failed to transfer owner: %w", ErrOwnerConflict(ptr, currentOwner))
+		}
+
+		res, err = st.unmarshalResource(currentSpec, state.UnmarshalOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal resource %q: %w", ptr, err)
+		}
+
+		if fromOwner == toOwner {
+			noop = true
+
+			return nil
+		}
+
+		*res.Metadata() = withOwner(res.Metadata(), toOwner)
+
+		res.Metadata().SetUpdated(time.Now())
+		res.Metadata().SetVersion(res.Metadata().Version().Next())
+
+		if err = st.validate(ctx, OperationUpdate, res); err != nil {
+			return fmt.Errorf("failed to transfer owner: %w", err)
+		}
+
+		m, err := st.marshalResource(res)
+		if err != nil {
+			return fmt.Errorf("failed to marshal resource: %w", err)
+		}
+
+		if err = st.checkWrite(conn, len(m)); err != nil {
+			return fmt.Errorf("failed to transfer owner: %w", err)
+		}
+
+		// resource row and the update event with the spec before and after
+		rowBytes = int64(3 * len(m))
+
+		if err = st.archiveVersion(conn, ptr); err != nil {
+			return fmt.Errorf("failed to transfer owner: %w", err)
+		}
+
+		q, err = sqlitexx.NewQuery(
+			conn,
+			`UPDATE `+st.options.TablePrefix+`resources
+				SET
+					owner = $to,
+					version = version + 1,
+					updated_at = $updated_at,
+					spec = $spec
+				WHERE
+					namespace = $namespace AND type = $type AND id = $id AND owner = $from`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing owner transfer statement: %w", err)
+		}
+
+		if err = q.
+			BindString("$to", toOwner).
+			BindInt64("$updated_at", res.Metadata().Updated().Unix()).
+			BindBytes("$spec", m).
+			BindString("$namespace", ptr.Namespace()).
+			BindString("$type", ptr.Type()).
+			BindString("$id", ptr.ID()).
+			BindString("$from", fromOwner).
+			Exec(); err != nil {
+			return fmt.Errorf("error transferring owner in database: %w", err)
+		}
+
+		if conn.Changes() != 1 {
+			return fmt.Errorf("failed to transfer owner: %w", ErrOwnerConflict(ptr, currentOwner))
+		}
+
+		if result != nil {
+			eventID, err = st.lastEventID(conn)
+		}
+
+		return err
+	}()
+	if err != nil || noop {
+		st.localEvents.Add(ptr, -1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	if result != nil {
+		result.Bookmark = encodeBookmark(eventID)
+	}
+
+	st.recordWrite("update", rowBytes, 2)
+
+	st.notify(ctx, res.Metadata())
+
+	st.audit(OperationUpdate, res.Metadata())
+
+	st.runPostCommitHooks(OperationUpdate, res)
+
+	return res, nil
+}
+
+// withOwner returns the copy of the metadata with the owner replaced.
+func withOwner(md *resource.Metadata, owner resource.Owner) resource.Metadata {
+	transferred := resource.NewMetadata(md.Namespace(), md.Type(), md.ID(), md.Version())
+
+	transferred.SetCreated(md.Created())
+	transferred.SetUpdated(md.Updated())
+	transferred.SetPhase(md.Phase())
+	*transferred.Labels() = *md.Labels()
+	*transferred.Annotations() = *md.Annotations()
+	*transferred.Finalizers() = *md.Finalizers()
+
+	transferred.SetOwner(owner) //nolint:errcheck // the owner of the new metadata is empty
+
+	return transferred
+}
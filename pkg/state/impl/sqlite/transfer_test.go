@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestTransferOwner(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("default", "path")
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("controller-a")))
+
+		ch := make(chan state.Event, 1)
+
+		require.NoError(t, st.Watch(ctx, res.Metadata(), ch))
+
+		<-ch
+
+		transferred, err := st.TransferOwner(ctx, res.Metadata(), "controller-a", "controller-b")
+		require.NoError(t, err)
+		assert.Equal(t, "controller-b", transferred.Metadata().Owner())
+		assert.Equal(t, res.Metadata().Version().Next(), transferred.Metadata().Version())
+		assert.Equal(t, "foo", transferred.Metadata().Labels().Raw()["app"])
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Updated, ev.Type)
+			assert.Equal(t, "controller-a", ev.Old.Metadata().Owner())
+			assert.Equal(t, "controller-b", ev.Resource.Metadata().Owner())
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// the previous owner can't modify the resource anymore
+		err = st.Update(ctx, transferred.DeepCopy(), state.WithUpdateOwner("controller-a"))
+		assert.True(t, state.IsOwnerConflictError(err), "unexpected error: %v", err)
+
+		require.NoError(t, st.Update(ctx, transferred.DeepCopy(), state.WithUpdateOwner("controller-b")))
+
+		_, err = st.TransferOwner(ctx, res.Metadata(), "controller-a", "controller-c")
+		assert.True(t, state.IsOwnerConflictError(err), "unexpected error: %v", err)
+
+		_, err = st.TransferOwner(ctx, conformance.NewPathResource("default", "missing").Metadata(), "", "controller-c")
+		assert.True(t, state.IsNotFoundError(err), "unexpected error: %v", err)
+
+		// the resource can be released
+		transferred, err = st.TransferOwner(ctx, res.Metadata(), "controller-b", "")
+		require.NoError(t, err)
+		assert.Empty(t, transferred.Metadata().Owner())
+	})
+}
+
+func TestTransferOwnerHooks(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	var (
+		mu     sync.Mutex
+		owners []string
+	)
+
+	hook := func(op sqlite.Operation, res resource.Resource) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		owners = append(owners, op.String()+" "+res.Metadata().Owner())
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("default", "path")
+
+		require.NoError(t, st.Create(ctx, res, state.WithCreateOwner("controller-a")))
+
+		_, err := st.TransferOwner(ctx, res.Metadata(), "controller-a", "controller-b")
+		require.NoError(t, err)
+
+		// the stored resource is transferred as well
+		stored, err := st.Get(ctx, res.Metadata())
+		require.NoError(t, err)
+		assert.Equal(t, "controller-b", stored.Metadata().Owner())
+		assert.Equal(t, res.Metadata().Version().Next(), stored.Metadata().Version())
+
+		mu.Lock()
+		assert.Equal(t, []string{"create controller-a", "update controller-b"}, owners)
+		mu.Unlock()
+
+		entries := logs.FilterMessage("resource write").All()
+		require.Len(t, entries, 2)
+
+		fields := entries[1].ContextMap()
+		assert.Equal(t, "update", fields["op"])
+		assert.Equal(t, "controller-b", fields["owner"])
+		assert.Equal(t, uint64(2), fields["new_version"])
+	}, sqlite.WithPostCommitHook(hook), sqlite.WithAuditLogger(zap.New(core)))
+}
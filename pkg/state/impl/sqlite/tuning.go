@@ -0,0 +1,168 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"weak"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// pragmaPool applies the per-connection pragmas (see CacheSize, BusyTimeout) to the connections taken from the pool.
+//
+// The pool is managed outside of the state, so the pragmas are applied on the first Take of each connection,
+// and the connections are tracked with weak pointers, so the connections closed by the pool are forgotten.
+type pragmaPool struct {
+	SqlitexPool
+
+	pragmas []string
+
+	mu       sync.Mutex
+	prepared map[weak.Pointer[sqlite.Conn]]struct{}
+}
+
+func newPragmaPool(db SqlitexPool, pragmas []string) *pragmaPool {
+	return &pragmaPool{
+		SqlitexPool: db,
+		pragmas:     pragmas,
+		prepared:    map[weak.Pointer[sqlite.Conn]]struct{}{},
+	}
+}
+
+// connectionPragmas returns the pragmas applied to each connection, for the options which are set.
+func (opts *StateOptions) connectionPragmas() []string {
+	var pragmas []string
+
+	if opts.BusyTimeout > 0 {
+		pragmas = append(pragmas, opts.busyTimeoutPragma())
+	}
+
+	if opts.CacheSize != 0 {
+		pragmas = append(pragmas, "PRAGMA cache_size = "+strconv.Itoa(opts.CacheSize))
+	}
+
+	return pragmas
+}
+
+func (opts *StateOptions) busyTimeoutPragma() string {
+	// the timeouts below a millisecond are rounded up, as zero disables the busy handler
+	return "PRAGMA busy_timeout = " + strconv.FormatInt(max(opts.BusyTimeout.Milliseconds(), 1), 10)
+}
+
+// Take implements SqlitexPool.
+func (p *pragmaPool) Take(ctx context.Context) (*sqlite.Conn, error) {
+	conn, err := p.SqlitexPool.Take(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := weak.Make(conn)
+
+	p.mu.Lock()
+	_, prepared := p.prepared[ptr]
+	p.mu.Unlock()
+
+	if prepared {
+		return conn, nil
+	}
+
+	for _, pragma := range p.pragmas {
+		if err = sqlitex.Execute(conn, pragma, nil); err != nil {
+			p.Put(conn)
+
+			return nil, fmt.Errorf("error applying %q: %w", pragma, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.prepared[ptr] = struct{}{}
+	p.mu.Unlock()
+
+	runtime.AddCleanup(conn, p.forget, ptr)
+
+	return conn, nil
+}
+
+func (p *pragmaPool) forget(ptr weak.Pointer[sqlite.Conn]) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.prepared, ptr)
+}
+
+// applyPageSize changes the page size of the database if it doesn't match the configured one.
+//
+// Changing the page size of an existing database requires rebuilding it with VACUUM,
+// which is not supported in WAL mode, so the journal mode is switched temporarily.
+func (st *State) applyPageSize(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for page size: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	var (
+		pageSize    int
+		journalMode string
+	)
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT page_size, journal_mode FROM pragma_page_size(), pragma_journal_mode()`)
+	if err != nil {
+		return fmt.Errorf("preparing query for page size: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			pageSize = int(stmt.GetInt64("page_size"))
+			journalMode = stmt.GetText("journal_mode")
+
+			return nil
+		},
+	); err != nil {
+		return fmt.Errorf("failed to get page size: %w", err)
+	}
+
+	if pageSize == st.options.PageSize {
+		return nil
+	}
+
+	st.options.Logger.Info("changing database page size",
+		zap.Int("from", pageSize),
+		zap.Int("to", st.options.PageSize),
+	)
+
+	// the statements can't run in a transaction, so they are executed one by one
+	script := []string{
+		`PRAGMA page_size = ` + strconv.Itoa(st.options.PageSize),
+		`VACUUM`,
+	}
+
+	if journalMode == "wal" {
+		script = []string{
+			`PRAGMA journal_mode = DELETE`,
+			script[0],
+			script[1],
+			`PRAGMA journal_mode = WAL`,
+		}
+	}
+
+	for _, query := range script {
+		if err = sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			return fmt.Errorf("error changing page size: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestPageSize(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	pragmas := func() (pageSize int, journalMode string) {
+		conn, err := zombiesqlite.OpenConn(dbPath, zombiesqlite.OpenReadOnly)
+		require.NoError(t, err)
+
+		defer conn.Close() //nolint:errcheck
+
+		require.NoError(t, sqlitex.ExecuteTransient(conn, `SELECT page_size, journal_mode FROM pragma_page_size(), pragma_journal_mode()`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+				pageSize = stmt.ColumnInt(0)
+				journalMode = stmt.ColumnText(1)
+
+				return nil
+			},
+		}))
+
+		return pageSize, journalMode
+	}
+
+	// create a database with the default page size
+	pool, err := sqlitexx.NewPool("file:"+dbPath,
+		sqlitexx.PoolOptions{
+			Flags: zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenWAL | zombiesqlite.OpenURI,
+		},
+	)
+	require.NoError(t, err)
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{}, sqlite.WithLogger(zaptest.NewLogger(t)))
+	require.NoError(t, err)
+
+	require.NoError(t, st.Create(t.Context(), conformance.NewPathResource("ns1", "a")))
+
+	st.Close()
+	require.NoError(t, pool.Close())
+
+	pageSize, _ := pragmas()
+	assert.Equal(t, 4096, pageSize)
+
+	// reopen with a different page size
+	st = newSqliteState(t, "file:"+dbPath, sqlite.WithPageSize(16384))
+
+	_, err = st.Get(t.Context(), conformance.NewPathResource("ns1", "a").Metadata())
+	require.NoError(t, err)
+
+	pageSize, journalMode := pragmas()
+	assert.Equal(t, 16384, pageSize)
+	assert.Equal(t, "wal", journalMode)
+}
+
+func TestCacheSize(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		cacheSize, err := st.CacheSize(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, -8192, cacheSize)
+	}, sqlite.WithCacheSize(-8192))
+}
+
+func TestConnectionPragmasOnce(t *testing.T) {
+	t.Parallel()
+
+	// a single connection, so the state takes the same connection every time
+	pool, err := sqlitexx.NewPool("file:"+filepath.Join(t.TempDir(), "state.db"),
+		sqlitexx.PoolOptions{
+			Flags:         zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenWAL | zombiesqlite.OpenURI,
+			LowWatermark:  1,
+			HighWatermark: 1,
+		},
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, pool.Close())
+	})
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{},
+		sqlite.WithLogger(zaptest.NewLogger(t)),
+		sqlite.WithCompactionInterval(0),
+		sqlite.WithCacheSize(-8192),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	cacheSize, err := st.CacheSize(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, -8192, cacheSize)
+
+	conn, err := pool.Take(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `PRAGMA cache_size = -100`, nil))
+	pool.Put(conn)
+
+	// the pragmas are not applied again to the connection
+	cacheSize, err = st.CacheSize(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, -100, cacheSize)
+}
+
+func TestBusyTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the pool doesn't set the busy timeout, so the connections have none
+	withSqliteCore(t, func(st *sqlite.State) {
+		timeout, err := st.BusyTimeout(t.Context())
+		require.NoError(t, err)
+		assert.Zero(t, timeout)
+	})
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		timeout, err := st.BusyTimeout(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, 1500*time.Millisecond, timeout)
+
+		cacheSize, err := st.CacheSize(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, -8192, cacheSize)
+	}, sqlite.WithBusyTimeout(1500*time.Millisecond), sqlite.WithCacheSize(-8192))
+}
+
+func TestBusyRetry(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	// no busy handler, so the statements fail right away while another process holds the write lock
+	pool, err := sqlitexx.NewPool("file:"+dbPath,
+		sqlitexx.PoolOptions{
+			Flags:   zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenWAL | zombiesqlite.OpenURI,
+			Pragmas: []string{"PRAGMA busy_timeout = 0"},
+		},
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, pool.Close())
+	})
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{},
+		sqlite.WithLogger(zaptest.NewLogger(t)),
+		sqlite.WithCompactionInterval(0),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	conn, err := zombiesqlite.OpenConn(dbPath, zombiesqlite.OpenReadWrite)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `PRAGMA busy_timeout = 0`, nil))
+
+	lock := func() <-chan error {
+		require.NoError(t, sqlitex.ExecuteTransient(conn, `BEGIN IMMEDIATE`, nil))
+
+		errCh := make(chan error, 1)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+
+			errCh <- sqlitex.ExecuteTransient(conn, `COMMIT`, nil)
+		}()
+
+		return errCh
+	}
+
+	res := conformance.NewPathResource("ns1", "a")
+
+	// the writes wait for the lock to be released: the single statement ones, and the transactions
+	errCh := lock()
+
+	require.NoError(t, st.Create(t.Context(), res))
+	require.NoError(t, <-errCh)
+
+	errCh = lock()
+
+	res.Metadata().Labels().Set("app", "foo")
+
+	require.NoError(t, st.Update(t.Context(), res))
+	require.NoError(t, <-errCh)
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"expvar"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+)
+
+// longTransactions counts the transactions which were open longer than LongTransactionThreshold.
+var longTransactions expvar.Int
+
+func init() {
+	expvar.Publish("sqlite_state_long_transactions", &longTransactions)
+}
+
+// OpenTransaction is a connection held by the state, see OpenTransactions.
+type OpenTransaction struct {
+	// Started is the time the connection was taken from the pool.
+	Started time.Time
+
+	// Stack is the stack trace of the goroutine which took the connection.
+	Stack string
+}
+
+// trackingPool records the connections taken from the pool along with the stacks of the callers.
+//
+// A read transaction can only be open on a connection taken from the pool, so the connections
+// held for too long point to the readers which prevent the WAL checkpoints.
+type trackingPool struct {
+	SqlitexPool
+
+	held map[*sqlite.Conn]*trackedConn
+	mu   sync.Mutex
+}
+
+type trackedConn struct {
+	OpenTransaction
+
+	reported bool
+}
+
+func newTrackingPool(db SqlitexPool) *trackingPool {
+	return &trackingPool{
+		SqlitexPool: db,
+		held:        map[*sqlite.Conn]*trackedConn{},
+	}
+}
+
+// Take implements SqlitexPool.
+func (p *trackingPool) Take(ctx context.Context) (*sqlite.Conn, error) {
+	conn, err := p.SqlitexPool.Take(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedConn{
+		OpenTransaction: OpenTransaction{
+			Started: time.Now(),
+			Stack:   string(debug.Stack()),
+		},
+	}
+
+	p.mu.Lock()
+	p.held[conn] = tracked
+	p.mu.Unlock()
+
+	return conn, nil
+}
+
+// Put implements SqlitexPool.
+func (p *trackingPool) Put(conn *sqlite.Conn) {
+	p.mu.Lock()
+	delete(p.held, conn)
+	p.mu.Unlock()
+
+	p.SqlitexPool.Put(conn)
+}
+
+// OpenTransactions returns the connections currently held by the state, the oldest first.
+//
+// Every operation holds a connection for its duration, and a read transaction might be open on it,
+// which keeps the WAL from being checkpointed. Snapshots (see BeginSnapshot) and slow consumers
+// of iterators hold the connections the longest.
+// The connections are only tracked with LongTransactionThreshold set, otherwise nil is returned.
+func (st *State) OpenTransactions() []OpenTransaction {
+	if st.txTracker == nil {
+		return nil
+	}
+
+	st.txTracker.mu.Lock()
+
+	open := make([]OpenTransaction, 0, len(st.txTracker.held))
+
+	for _, tracked := range st.txTracker.held {
+		open = append(open, tracked.OpenTransaction)
+	}
+
+	st.txTracker.mu.Unlock()
+
+	slices.SortFunc(open, func(a, b OpenTransaction) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	return open
+}
+
+// reportLongTransactions logs the connections held longer than the threshold, once per connection.
+func (st *State) reportLongTransactions(now time.Time) {
+	var long []OpenTransaction
+
+	st.txTracker.mu.Lock()
+
+	for _, tracked := range st.txTracker.held {
+		if !tracked.reported && now.Sub(tracked.Started) > st.options.LongTransactionThreshold {
+			tracked.reported = true
+
+			long = append(long, tracked.OpenTransaction)
+		}
+	}
+
+	st.txTracker.mu.Unlock()
+
+	for _, tx := range long {
+		longTransactions.Add(1)
+
+		st.options.Logger.Warn("long-running transaction blocks WAL checkpoints",
+			zap.Duration("duration", now.Sub(tx.Started)),
+			zap.String("stack", tx.Stack),
+		)
+	}
+}
+
+func (st *State) runLongTransactions() {
+	defer st.wg.Done()
+
+	ticker := time.NewTicker(max(st.options.LongTransactionThreshold/2, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-st.shutdown:
+			return
+		case now := <-ticker.C:
+			st.reportLongTransactions(now)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestOpenTransactions(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	// other operations might be slow as well, so only the snapshot reports are counted
+	snapshotReports := func() int {
+		return logs.FilterMessage("long-running transaction blocks WAL checkpoints").Filter(func(entry observer.LoggedEntry) bool {
+			stack, _ := entry.ContextMap()["stack"].(string) //nolint:errcheck
+
+			return strings.Contains(stack, "BeginSnapshot")
+		}).Len()
+	}
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		assert.Empty(t, st.OpenTransactions())
+
+		snapshot, err := st.BeginSnapshot(ctx)
+		require.NoError(t, err)
+
+		open := st.OpenTransactions()
+		require.Len(t, open, 1)
+		assert.Contains(t, open[0].Stack, "BeginSnapshot")
+
+		assert.Eventually(t, func() bool {
+			return snapshotReports() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, st.EndSnapshot(snapshot))
+
+		assert.Empty(t, st.OpenTransactions())
+
+		// each transaction is reported once
+		time.Sleep(50 * time.Millisecond)
+
+		assert.Equal(t, 1, snapshotReports())
+	}, sqlite.WithLongTransactionThreshold(20*time.Millisecond), sqlite.WithLogger(zap.New(core)))
+}
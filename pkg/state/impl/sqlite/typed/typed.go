@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package typed provides strongly-typed access to the resources stored in the sqlite state.
+//
+// The functions are thin wrappers around sqlite.State, which check the type of the unmarshaled
+// resources, so that the callers don't have to type-assert each resource.
+package typed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/siderolabs/gen/channel"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+// Event is a typed state event.
+//
+// Resource and Old are zero values if they are not set in the underlying event,
+// or if the resource is a tombstone.
+type Event[T resource.Resource] struct {
+	Resource T
+	Old      T
+	Error    error
+	Bookmark state.Bookmark
+	Type     state.EventType
+}
+
+// Get a resource by pointer.
+func Get[T resource.Resource](ctx context.Context, st *sqlite.State, ptr resource.Pointer, opts ...state.GetOption) (T, error) { //nolint:ireturn
+	var zero T
+
+	res, err := st.Get(ctx, ptr, opts...)
+	if err != nil {
+		return zero, err
+	}
+
+	return cast[T](res)
+}
+
+// List resources of the kind.
+func List[T resource.Resource](ctx context.Context, st *sqlite.State, kind resource.Kind, opts ...state.ListOption) ([]T, error) {
+	list, err := st.List(ctx, kind, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return castList[T](list)
+}
+
+// ListFiltered lists resources of the kind, applying additional conditions from the filter (see sqlite.State.ListFiltered).
+func ListFiltered[T resource.Resource](
+	ctx context.Context, st *sqlite.State, kind resource.Kind, listFilter sqlite.ListFilter, opts ...state.ListOption,
+) ([]T, error) {
+	list, err := st.ListFiltered(ctx, kind, listFilter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return castList[T](list)
+}
+
+// Watch watches resources of the kind, sending typed events to the channel.
+//
+// Events with resources of an unexpected type are converted to state.Errored events.
+func Watch[T resource.Resource](ctx context.Context, st *sqlite.State, kind resource.Kind, ch chan<- Event[T], opts ...state.WatchKindOption) error {
+	untypedCh := make(chan state.Event)
+
+	if err := st.WatchKind(ctx, kind, untypedCh, opts...); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			var event state.Event
+
+			select {
+			case <-ctx.Done():
+				return
+			case event = <-untypedCh:
+			}
+
+			if !channel.SendWithContext(ctx, ch, convertEvent[T](event)) {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func convertEvent[T resource.Resource](event state.Event) Event[T] {
+	res, err := castEventResource[T](event.Resource)
+	if err != nil {
+		return Event[T]{Type: state.Errored, Error: err}
+	}
+
+	old, err := castEventResource[T](event.Old)
+	if err != nil {
+		return Event[T]{Type: state.Errored, Error: err}
+	}
+
+	return Event[T]{
+		Resource: res,
+		Old:      old,
+		Error:    event.Error,
+		Bookmark: event.Bookmark,
+		Type:     event.Type,
+	}
+}
+
+func castEventResource[T resource.Resource](res resource.Resource) (T, error) { //nolint:ireturn
+	if res == nil || resource.IsTombstone(res) {
+		var zero T
+
+		return zero, nil
+	}
+
+	return cast[T](res)
+}
+
+func castList[T resource.Resource](list resource.List) ([]T, error) {
+	result := make([]T, 0, len(list.Items))
+
+	for _, res := range list.Items {
+		typed, err := cast[T](res)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, typed)
+	}
+
+	return result, nil
+}
+
+func cast[T resource.Resource](res resource.Resource) (T, error) { //nolint:ireturn
+	typed, ok := res.(T)
+	if !ok {
+		return typed, fmt.Errorf("unexpected resource type %T for %q, expected %T", res, res.Metadata(), typed)
+	}
+
+	return typed, nil
+}
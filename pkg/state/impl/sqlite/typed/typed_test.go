@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package typed_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/controller/conformance"
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/protobuf"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/siderolabs/gen/xslices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"go.uber.org/zap/zaptest"
+	zombiesqlite "zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/typed"
+)
+
+func init() {
+	if err := protobuf.RegisterResource(conformance.IntResourceType, &conformance.IntResource{}); err != nil {
+		panic(err)
+	}
+}
+
+func newState(t *testing.T) *sqlite.State {
+	t.Helper()
+
+	pool, err := sqlitexx.NewPool("file:"+filepath.Join(t.TempDir(), "state.db"),
+		sqlitexx.PoolOptions{
+			Flags: zombiesqlite.OpenReadWrite | zombiesqlite.OpenCreate | zombiesqlite.OpenWAL | zombiesqlite.OpenURI,
+		},
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, pool.Close())
+	})
+
+	st, err := sqlite.NewState(t.Context(), pool, store.ProtobufMarshaler{}, sqlite.WithLogger(zaptest.NewLogger(t)))
+	require.NoError(t, err)
+
+	t.Cleanup(st.Close)
+
+	return st
+}
+
+func TestTyped(t *testing.T) {
+	t.Parallel()
+
+	st := newState(t)
+	ctx := t.Context()
+
+	kind := conformance.NewIntResource("default", "", 0).Metadata()
+
+	ch := make(chan typed.Event[*conformance.IntResource])
+
+	require.NoError(t, typed.Watch(ctx, st, kind, ch))
+
+	for i, id := range []string{"one", "two", "three"} {
+		require.NoError(t, st.Create(ctx, conformance.NewIntResource("default", id, i+1)))
+	}
+
+	for _, expected := range []int{1, 2, 3} {
+		select {
+		case event := <-ch:
+			require.Equal(t, state.Created, event.Type)
+			assert.Equal(t, expected, event.Resource.Value())
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+
+	res, err := typed.Get[*conformance.IntResource](ctx, st, resource.NewMetadata("default", conformance.IntResourceType, "two", resource.VersionUndefined))
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Value())
+
+	list, err := typed.List[*conformance.IntResource](ctx, st, kind)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3, 2}, xslices.Map(list, (*conformance.IntResource).Value))
+
+	_, err = state.WrapCore(st).Teardown(ctx, res.Metadata())
+	require.NoError(t, err)
+
+	running := resource.PhaseRunning
+
+	list, err = typed.ListFiltered[*conformance.IntResource](ctx, st, kind, sqlite.ListFilter{Phase: &running})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, xslices.Map(list, (*conformance.IntResource).Value))
+
+	_, err = typed.Get[*conformance.StrResource](ctx, st, res.Metadata())
+	require.ErrorContains(t, err, "unexpected resource type")
+}
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
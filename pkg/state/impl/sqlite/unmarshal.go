@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"expvar"
+
+	"github.com/cosi-project/runtime/api/v1alpha1"
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/protobuf"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+)
+
+// skippedEvents counts events skipped by watches because they couldn't be decoded (see UndecodableEventsSkip).
+var skippedEvents expvar.Int
+
+func init() {
+	expvar.Publish("sqlite_state_skipped_events", &skippedEvents)
+}
+
+// UndecodableEventsPolicy defines how watches handle events which can't be decoded.
+type UndecodableEventsPolicy int
+
+// Undecodable events policies.
+const (
+	// UndecodableEventsError terminates the watch with an error.
+	UndecodableEventsError UndecodableEventsPolicy = iota
+	// UndecodableEventsRaw delivers the event resource as a generic *protobuf.Resource,
+	// if the state uses protobuf marshaling; otherwise the watch is terminated with an error.
+	UndecodableEventsRaw
+	// UndecodableEventsSkip skips the event, incrementing the sqlite_state_skipped_events counter.
+	UndecodableEventsSkip
+)
+
+// unmarshalResource unmarshals the stored resource honoring the unmarshal options.
+//
+// With SkipProtobufUnmarshal, if the state uses protobuf marshaling, the resource is returned
+// as a generic *protobuf.Resource wrapping the raw spec, so that the spec is not decoded
+// into the registered resource type. This is useful for proxies which pass the resources through.
+// Other marshalers always unmarshal the resource fully.
+func (st *State) unmarshalResource(spec []byte, opts state.UnmarshalOptions) (resource.Resource, error) { //nolint:ireturn
+	spec, err := st.decryptSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.SkipProtobufUnmarshal {
+		switch st.marshaler.(type) {
+		case store.ProtobufMarshaler, *store.ProtobufMarshaler:
+			var protoD v1alpha1.Resource
+
+			if err := protobuf.ProtoUnmarshal(spec, &protoD); err != nil {
+				return nil, err
+			}
+
+			return protobuf.Unmarshal(&protoD)
+		}
+	}
+
+	return st.marshaler.UnmarshalResource(spec)
+}
+
+// marshalResource marshals the resource for storage, encrypting it if the kind is encrypted (see EncryptedKinds).
+func (st *State) marshalResource(res resource.Resource) ([]byte, error) {
+	spec, err := st.marshaler.MarshalResource(res)
+	if err != nil {
+		return nil, err
+	}
+
+	return st.encryptSpec(res.Metadata(), spec)
+}
+
+// unmarshalEventResource unmarshals the resource of an event honoring the UndecodableEvents policy.
+func (st *State) unmarshalEventResource(spec []byte, opts state.UnmarshalOptions) (resource.Resource, error) { //nolint:ireturn
+	res, err := st.unmarshalResource(spec, opts)
+	if err == nil || st.options.UndecodableEvents != UndecodableEventsRaw || opts.SkipProtobufUnmarshal {
+		return res, err
+	}
+
+	return st.unmarshalResource(spec, state.UnmarshalOptions{SkipProtobufUnmarshal: true})
+}
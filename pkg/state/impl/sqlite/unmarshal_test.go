@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/api/v1alpha1"
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/protobuf"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	zombiesqlite "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+// brokenMarshaler fails to unmarshal resources with the "bad" ID.
+type brokenMarshaler struct {
+	store.ProtobufMarshaler
+}
+
+func (m brokenMarshaler) UnmarshalResource(b []byte) (resource.Resource, error) { //nolint:ireturn
+	res, err := m.ProtobufMarshaler.UnmarshalResource(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Metadata().ID() == "bad" {
+		return nil, errors.New("unsupported spec")
+	}
+
+	return res, nil
+}
+
+func TestUndecodableEvents(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name   string
+		policy sqlite.UndecodableEventsPolicy
+	}{
+		{
+			name:   "error",
+			policy: sqlite.UndecodableEventsError,
+		},
+		{
+			name:   "skip",
+			policy: sqlite.UndecodableEventsSkip,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			withSqliteMarshaler(t, brokenMarshaler{}, func(st *sqlite.State) {
+				ctx, cancel := context.WithCancel(t.Context())
+				defer cancel()
+
+				watchCh := make(chan state.Event, 3)
+
+				require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), watchCh))
+
+				for _, id := range []string{"good1", "bad", "good2"} {
+					require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", id)))
+				}
+
+				var ids []string
+
+				for {
+					select {
+					case ev := <-watchCh:
+						if ev.Type == state.Errored {
+							// the bad event fails the watch, possibly with the events fetched together with it
+							assert.Equal(t, sqlite.UndecodableEventsError, test.policy)
+
+							return
+						}
+
+						ids = append(ids, ev.Resource.Metadata().ID())
+					case <-time.After(time.Second):
+						t.Fatal("timeout waiting for event")
+					}
+
+					if len(ids) == 2 {
+						assert.Equal(t, sqlite.UndecodableEventsSkip, test.policy)
+						assert.Equal(t, []string{"good1", "good2"}, ids)
+
+						return
+					}
+				}
+			}, sqlite.WithUndecodableEvents(test.policy))
+		})
+	}
+}
+
+func TestUndecodableEventsRaw(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	st := newSqliteState(t, "file:"+path, sqlite.WithUndecodableEvents(sqlite.UndecodableEventsRaw))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "bad")))
+
+	watchCh := make(chan state.Event, 3)
+
+	require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), watchCh))
+
+	// the stored resource gets a spec the registered resource type can't decode
+	conn, err := zombiesqlite.OpenConn(path, zombiesqlite.OpenReadWrite)
+	require.NoError(t, err)
+
+	defer conn.Close() //nolint:errcheck
+
+	var spec []byte
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `SELECT spec FROM resources WHERE id = 'bad'`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *zombiesqlite.Stmt) error {
+			spec = make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, spec)
+
+			return nil
+		},
+	}))
+
+	var protoD v1alpha1.Resource
+
+	require.NoError(t, protobuf.ProtoUnmarshal(spec, &protoD))
+
+	protoD.Spec.ProtoSpec = []byte("unsupported")
+
+	spec, err = protobuf.ProtoMarshal(&protoD)
+	require.NoError(t, err)
+
+	require.NoError(t, sqlitex.ExecuteTransient(conn, `UPDATE resources SET spec = ?, version = version + 1 WHERE id = 'bad'`, &sqlitex.ExecOptions{
+		Args: []any{spec},
+	}))
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "good")))
+
+	for _, expected := range []struct {
+		id      string
+		evType  state.EventType
+		generic bool
+	}{
+		{id: "bad", evType: state.Updated, generic: true},
+		{id: "good", evType: state.Created},
+	} {
+		select {
+		case ev := <-watchCh:
+			require.Equal(t, expected.evType, ev.Type, "%v", ev.Error)
+			assert.Equal(t, expected.id, ev.Resource.Metadata().ID())
+
+			// the undecodable resource is delivered as the generic protobuf resource
+			_, generic := ev.Resource.(*protobuf.Resource)
+			assert.Equal(t, expected.generic, generic)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+}
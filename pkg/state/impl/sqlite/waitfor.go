@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+)
+
+// WaitForCondition is a condition checked by WaitFor.
+//
+// The resource is nil if the resource doesn't exist.
+type WaitForCondition func(res resource.Resource) (bool, error)
+
+// WaitFor blocks until the resource satisfies the condition, and returns the resource.
+//
+// The condition is checked immediately, and then again each time the resource changes.
+// WaitFor returns an error if the condition returns an error or the context is canceled.
+//
+// The resource is read from the primary database even if ReadReplica is set, as the change notifications
+// come from the primary database and the replica might not have caught up yet.
+func (st *State) WaitFor(ctx context.Context, ptr resource.Pointer, condFn WaitForCondition, opts ...state.GetOption) (resource.Resource, error) {
+	// subscribe before reading the resource, so that no change is missed
+	subscription := st.sub.SubscribeResource(ptr)
+	defer subscription.Unsubscribe()
+
+	for {
+		res, err := st.get(ctx, st.db, ptr, opts)
+		if err != nil {
+			if !state.IsNotFoundError(err) {
+				return nil, fmt.Errorf("failed to wait for %q: %w", ptr, err)
+			}
+
+			res = nil
+		}
+
+		ok, err := condFn(res)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for %q: %w", ptr, err)
+		}
+
+		if ok {
+			return res, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to wait for %q: %w", ptr, ctx.Err())
+		case <-subscription.NotifyCh():
+		}
+	}
+}
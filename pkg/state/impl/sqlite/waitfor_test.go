@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestWaitFor(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		res := conformance.NewPathResource("ns1", "a")
+		ptr := resource.NewMetadata("ns1", conformance.PathResourceType, "a", resource.VersionUndefined)
+
+		errCh := make(chan error, 1)
+
+		go func() {
+			errCh <- func() error {
+				if err := st.Create(ctx, res); err != nil {
+					return err
+				}
+
+				res.Metadata().Labels().Set("ready", "true")
+
+				return st.Update(ctx, res)
+			}()
+		}()
+
+		ready, err := st.WaitFor(ctx, ptr, func(r resource.Resource) (bool, error) {
+			if r == nil {
+				return false, nil
+			}
+
+			_, ok := r.Metadata().Labels().Get("ready")
+
+			return ok, nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+
+		_, ok := ready.Metadata().Labels().Get("ready")
+		assert.True(t, ok)
+
+		// wait for the resource to be destroyed
+		go func() {
+			errCh <- st.Destroy(ctx, ptr)
+		}()
+
+		destroyed, err := st.WaitFor(ctx, ptr, func(r resource.Resource) (bool, error) {
+			return r == nil, nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+		assert.Nil(t, destroyed)
+
+		// errors from the condition are returned
+		errBoom := errors.New("boom")
+
+		_, err = st.WaitFor(ctx, ptr, func(resource.Resource) (bool, error) {
+			return false, errBoom
+		})
+		require.ErrorIs(t, err, errBoom)
+
+		// context cancellation
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		_, err = st.WaitFor(timeoutCtx, ptr, func(r resource.Resource) (bool, error) {
+			return r != nil, nil
+		})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestWaitForReadReplica(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	replica := newSqlitePool(t, "file:"+filepath.Join(dir, "replica.db"))
+
+	// the replica is never refreshed during the test
+	st := newSqliteState(t, "file:"+filepath.Join(dir, "state.db"), sqlite.WithReadReplica(replica, time.Hour))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	res := conformance.NewPathResource("ns1", "a")
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- st.Create(ctx, res)
+	}()
+
+	created, err := st.WaitFor(ctx, res.Metadata(), func(r resource.Resource) (bool, error) {
+		return r != nil, nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	assert.Equal(t, res.Metadata().ID(), created.Metadata().ID())
+}
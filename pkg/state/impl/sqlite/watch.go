@@ -6,14 +6,17 @@ package sqlite
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/siderolabs/gen/channel"
 	"github.com/siderolabs/gen/xslices"
+	"go.uber.org/zap"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 
@@ -21,24 +24,58 @@ import (
 	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/filter"
 )
 
-func encodeBookmark(revision int64) state.Bookmark {
-	return binary.BigEndian.AppendUint64(nil, uint64(revision))
+// watchSends counts the watch sends which blocked on a slow consumer, and the ones which timed out (see WatchSendTimeout).
+var watchSends expvar.Map
+
+func init() {
+	expvar.Publish("sqlite_state_watch_sends", &watchSends)
 }
 
-func decodeBookmark(bookmark state.Bookmark) (int64, error) {
-	if len(bookmark) != 8 {
-		return 0, ErrInvalidWatchBookmark(fmt.Errorf("invalid bookmark length: %d", len(bookmark)))
+// errWatchSendTimeout is returned to watches which consumers didn't receive the events in time.
+var errWatchSendTimeout = errors.New("watch consumer didn't receive the events within the send timeout")
+
+// convertEvent converts the stored event into a state event.
+//
+// If skipOld is set, Old is not decoded for the update events.
+//
+// If the event can't be decoded and UndecodableEvents is set to skip, false is returned.
+// The resync marker (see Import) is converted to an error, which is never skipped.
+func (st *State) convertEvent(
+	resourcePointer resource.Kind, eventID int64, specBefore, specAfter []byte, eventType int, opts state.UnmarshalOptions, skipOld bool,
+) (state.Event, bool) {
+	if eventType == resyncEventType {
+		return state.Event{
+			Type:  state.Errored,
+			Error: ErrResyncRequired(resourcePointer),
+		}, true
 	}
 
-	return int64(binary.BigEndian.Uint64(bookmark)), nil
+	event := st.decodeEvent(resourcePointer, eventID, specBefore, specAfter, eventType, opts, skipOld)
+
+	if event.Type == state.Errored && st.options.UndecodableEvents == UndecodableEventsSkip {
+		skippedEvents.Add(1)
+
+		st.options.Logger.Warn("skipping undecodable event",
+			zap.String("namespace", resourcePointer.Namespace()),
+			zap.String("type", resourcePointer.Type()),
+			zap.Int64("event_id", eventID),
+			zap.Error(event.Error),
+		)
+
+		return event, false
+	}
+
+	return event, true
 }
 
-func (st *State) convertEvent(resourcePointer resource.Kind, eventID int64, specBefore, specAfter []byte, eventType int) state.Event {
+func (st *State) decodeEvent(
+	resourcePointer resource.Kind, eventID int64, specBefore, specAfter []byte, eventType int, opts state.UnmarshalOptions, skipOld bool,
+) state.Event {
 	var event state.Event
 
 	switch eventType {
 	case 1: // Created
-		res, err := st.marshaler.UnmarshalResource(specAfter)
+		res, err := st.unmarshalEventResource(specAfter, opts)
 		if err != nil {
 			return state.Event{
 				Type:  state.Errored,
@@ -49,7 +86,7 @@ func (st *State) convertEvent(resourcePointer resource.Kind, eventID int64, spec
 		event.Type = state.Created
 		event.Resource = res
 	case 2: // Updated
-		res, err := st.marshaler.UnmarshalResource(specAfter)
+		res, err := st.unmarshalEventResource(specAfter, opts)
 		if err != nil {
 			return state.Event{
 				Type:  state.Errored,
@@ -57,7 +94,14 @@ func (st *State) convertEvent(resourcePointer resource.Kind, eventID int64, spec
 			}
 		}
 
-		oldRes, err := st.marshaler.UnmarshalResource(specBefore)
+		event.Type = state.Updated
+		event.Resource = res
+
+		if skipOld {
+			break
+		}
+
+		oldRes, err := st.unmarshalEventResource(specBefore, opts)
 		if err != nil {
 			return state.Event{
 				Type:  state.Errored,
@@ -65,11 +109,9 @@ func (st *State) convertEvent(resourcePointer resource.Kind, eventID int64, spec
 			}
 		}
 
-		event.Type = state.Updated
-		event.Resource = res
 		event.Old = oldRes
 	case 3: // Deleted
-		res, err := st.marshaler.UnmarshalResource(specBefore)
+		res, err := st.unmarshalEventResource(specBefore, opts)
 		if err != nil {
 			return state.Event{
 				Type:  state.Errored,
@@ -79,6 +121,17 @@ func (st *State) convertEvent(resourcePointer resource.Kind, eventID int64, spec
 
 		event.Type = state.Destroyed
 		event.Resource = res
+	case 4: // Custom
+		res, err := st.unmarshalEventResource(specAfter, opts)
+		if err != nil {
+			return state.Event{
+				Type:  state.Errored,
+				Error: fmt.Errorf("unmarshal custom event for watch %q: %w", resourcePointer, err),
+			}
+		}
+
+		event.Type = state.Noop
+		event.Resource = res
 	default:
 		return state.Event{
 			Type:  state.Errored,
@@ -91,12 +144,192 @@ func (st *State) convertEvent(resourcePointer resource.Kind, eventID int64, spec
 	return event
 }
 
+// deliveryAcker is notified about the progress of deliver, it's implemented by sub.Subscription.
+type deliveryAcker interface {
+	Ack(gen uint64)
+	SetBlocked(blocked bool)
+}
+
+// deliver sends items to the channel and acknowledges the notification generation.
+//
+// Items which can be sent without blocking are sent before the acknowledgement, so that
+// with synchronous event delivery they reach the consumer before the mutation returns.
+// If timeout is set, deliver gives up once the consumer doesn't receive an item within it (see WatchSendTimeout).
+func deliver[T any](ctx context.Context, s deliveryAcker, gen uint64, ch chan<- T, timeout time.Duration, items ...T) bool {
+	sent := 0
+
+loop:
+	for _, item := range items {
+		select {
+		case ch <- item:
+			sent++
+		default:
+			break loop
+		}
+	}
+
+	s.Ack(gen)
+
+	if sent == len(items) {
+		return true
+	}
+
+	// the consumer is not keeping up, don't hold mutations waiting for it
+	s.SetBlocked(true)
+	defer s.SetBlocked(false)
+
+	watchSends.Add("blocked", 1)
+
+	for _, item := range items[sent:] {
+		if !sendWithTimeout(ctx, ch, timeout, item) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sendWithTimeout sends the item to the channel, giving up after the timeout (if set).
+func sendWithTimeout[T any](ctx context.Context, ch chan<- T, timeout time.Duration, item T) bool {
+	if timeout <= 0 {
+		return channel.SendWithContext(ctx, ch, item)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case ch <- item:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		watchSends.Add("timed_out", 1)
+
+		return false
+	}
+}
+
+// deliverTimeoutError hands the error over to the consumer which stopped receiving the events (see WatchSendTimeout).
+//
+// The watch goroutine exits, releasing its position in the event log, so the error is sent from a separate goroutine.
+func deliverTimeoutError[T any](ctx context.Context, ch chan<- T, item T) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	go channel.SendWithContext(ctx, ch, item)
+}
+
+// storedEvent is an event read from the events table.
+type storedEvent struct {
+	specBefore        []byte
+	specAfter         []byte
+	eventID           int64
+	eventType         int
+	generationChanged bool
+}
+
+// fetchKindEvents calls fn for the events of the kind after the event ID matching the condition (see watchKind).
+//
+// The ID of the last event read is returned, also if fn fails.
+func (st *State) fetchKindEvents(
+	ctx context.Context, resourceKind resource.Kind, eventID int64, condition string, skipOld bool, fn func(storedEvent) error,
+) (int64, error) {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return eventID, fmt.Errorf("taking connection for watch kind event: %w", err)
+	}
+
+	if st.options.WatchScanShards > 1 {
+		lastEventID, err := st.lastEventID(conn)
+		if err != nil {
+			st.db.Put(conn)
+
+			return eventID, fmt.Errorf("querying last event ID for watch %s: %w", resourceKind, err)
+		}
+
+		if lastEventID-eventID >= int64(st.options.WatchScanShards)*int64(max(st.options.WatchScanShardEvents, 1)) {
+			// the shards take their own connections
+			st.db.Put(conn)
+
+			return st.fetchKindEventsSharded(ctx, resourceKind, eventID, lastEventID, condition, skipOld, fn)
+		}
+	}
+
+	defer st.db.Put(conn)
+
+	err = st.queryKindEvents(conn, resourceKind, eventID, 0, condition, skipOld, func(stored storedEvent) error {
+		eventID = stored.eventID
+
+		return fn(stored)
+	})
+	if err != nil {
+		return eventID, fmt.Errorf("querying events for watch %s: %w", resourceKind, err)
+	}
+
+	return eventID, nil
+}
+
+// queryKindEvents calls fn for the events of the kind in the range (afterEventID, untilEventID] matching the condition,
+// the range is open-ended if untilEventID is zero.
+func (st *State) queryKindEvents(
+	conn *sqlite.Conn, resourceKind resource.Kind, afterEventID, untilEventID int64, condition string, skipOld bool, fn func(storedEvent) error,
+) error {
+	if untilEventID > 0 {
+		condition += ` AND event_id <= $until_event_id`
+	}
+
+	q, err := st.newExplainedQuery(
+		conn,
+		`SELECT event_id, spec_before, spec_after, event_type, generation_changed
+		FROM `+st.options.TablePrefix+`events
+		WHERE event_id > $event_id AND namespace = $namespace AND ($type = '' OR type = $type)`+condition+`
+		ORDER BY event_id ASC`,
+	)
+	if err != nil {
+		return fmt.Errorf("preparing query for watch %s events: %w", resourceKind, err)
+	}
+
+	q = q.
+		BindInt64("$event_id", afterEventID).
+		BindString("$namespace", resourceKind.Namespace()).
+		BindString("$type", resourceKind.Type())
+
+	if untilEventID > 0 {
+		q = q.BindInt64("$until_event_id", untilEventID)
+	}
+
+	return q.QueryAll(
+		func(stmt *sqlite.Stmt) error {
+			stored := storedEvent{
+				eventID:           stmt.GetInt64("event_id"),
+				eventType:         int(stmt.GetInt64("event_type")),
+				generationChanged: stmt.GetInt64("generation_changed") != 0,
+			}
+
+			if stored.eventType != 2 || !skipOld {
+				stored.specBefore = make([]byte, stmt.GetLen("spec_before"))
+				stmt.GetBytes("spec_before", stored.specBefore)
+			}
+
+			stored.specAfter = make([]byte, stmt.GetLen("spec_after"))
+			stmt.GetBytes("spec_after", stored.specAfter)
+
+			return fn(stored)
+		},
+	)
+}
+
 // Watch state of a resource by type.
 //
 // It's fine to watch for a resource which doesn't exist yet.
 // Watch is canceled when context gets canceled.
 // Watch sends initial resource state as the very first event on the channel,
 // and then sends any updates to the resource as events.
+// The bookmark of the initial event points exactly to the initial state, so no update is missed or delivered twice.
+//
+// The resync markers of the resource kind (see Import) are delivered as errors matching IsResyncRequiredError.
 //
 //nolint:gocyclo,gocognit,cyclop,maintidx
 func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- state.Event, opts ...state.WatchOption) error {
@@ -106,17 +339,28 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 		opt(&options)
 	}
 
+	if err := st.checkNamespace(ptr.Namespace()); err != nil {
+		return fmt.Errorf("failed to watch: %w", err)
+	}
+
 	var (
 		initialEvent state.Event
 		eventID      int64
 	)
 
-	sub := st.sub.Subscribe(ptr)
+	skipOld := st.options.SkipOldResource
+
+	sub := st.sub.SubscribeResource(ptr, st.watchSubscribeOptions()...)
+	pos := st.trackWatch(ptr.Namespace(), ptr.Type(), ptr.ID())
+	// the watch doesn't process notifications until the initial events are sent
+	sub.SetBlocked(true)
+
 	watchSetupFailed := true
 
 	defer func() {
 		if watchSetupFailed {
 			sub.Unsubscribe()
+			st.untrackWatch(pos)
 		}
 	}()
 
@@ -138,11 +382,12 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 			return fmt.Errorf("failed to watch %q: %w", ptr, err)
 		}
 
-		// verify that we still have the event in the log
+		// verify that we still have the event in the log;
+		// a bookmark right before an existing event starts the watch with that event (see MutationResult)
 		q, err := sqlitexx.NewQuery(
 			conn,
 			`SELECT 1 FROM `+st.options.TablePrefix+`events
-				  WHERE event_id = $event_id`,
+				  WHERE event_id IN ($event_id, $event_id + 1) LIMIT 1`,
 		)
 		if err != nil {
 			return fmt.Errorf("verifying bookmark for watch %q: %w", ptr, err)
@@ -164,96 +409,70 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 		sub.TriggerNotify()
 	default:
 		// figure out initial state of the watch process
-		err := func() (err error) {
-			defer sqlitex.Transaction(conn)(&err)
-
-			var spec []byte
+		//
+		// the resource and the last event ID are read by a single statement, so they come from the same snapshot:
+		// the updates committed after it are delivered as live events (the subscription is already established)
+		var spec []byte
 
-			q, err := sqlitexx.NewQuery(
-				conn,
-				`SELECT spec
-					FROM `+st.options.TablePrefix+`resources
-					WHERE namespace = $namespace AND type = $type AND id = $id`,
-			)
-			if err != nil {
-				return fmt.Errorf("preparing query for initial resource state for watch %q: %w", ptr, err)
-			}
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`SELECT
+				(SELECT spec FROM `+st.options.TablePrefix+`resources WHERE namespace = $namespace AND type = $type AND id = $id) AS spec,
+				(SELECT coalesce(max(event_id), 0) FROM `+st.options.TablePrefix+`events) AS max_event_id`,
+		)
+		if err != nil {
+			return fmt.Errorf("preparing query for initial resource state for watch %q: %w", ptr, err)
+		}
 
-			err = q.
-				BindString("$namespace", ptr.Namespace()).
-				BindString("$type", ptr.Type()).
-				BindString("$id", ptr.ID()).
-				QueryRow(
-					func(stmt *sqlite.Stmt) error {
+		if err = q.
+			BindString("$namespace", ptr.Namespace()).
+			BindString("$type", ptr.Type()).
+			BindString("$id", ptr.ID()).
+			QueryRow(
+				func(stmt *sqlite.Stmt) error {
+					if !stmt.IsNull("spec") {
 						spec = make([]byte, stmt.GetLen("spec"))
 						stmt.GetBytes("spec", spec)
+					}
 
-						return nil
-					},
-				)
-
-			if err != nil && !errors.Is(err, sqlitexx.ErrNoRows) {
-				return fmt.Errorf("querying initial resource state for watch %q: %w", ptr, err)
-			}
-
-			exists := spec != nil
-
-			if exists {
-				var res resource.Resource
-
-				res, err = st.marshaler.UnmarshalResource(spec)
-				if err != nil {
-					return fmt.Errorf("unmarshal initial resource state for watch %q: %w", ptr, err)
-				}
-
-				initialEvent.Type = state.Created
-				initialEvent.Resource = res
-			} else {
-				initialEvent.Type = state.Destroyed
-				initialEvent.Resource = resource.NewTombstone(
-					resource.NewMetadata(
-						ptr.Namespace(),
-						ptr.Type(),
-						ptr.ID(),
-						resource.VersionUndefined,
-					),
-				)
-			}
-
-			q, err = sqlitexx.NewQuery(
-				conn,
-				`SELECT coalesce(max(event_id), 0) AS max_event_id FROM `+st.options.TablePrefix+`events`,
-			)
-			if err != nil {
-				return fmt.Errorf("preparing query for initial event ID for watch %q: %w", ptr, err)
-			}
+					eventID = stmt.GetInt64("max_event_id")
 
-			err = q.
-				QueryRow(
-					func(stmt *sqlite.Stmt) error {
-						eventID = stmt.GetInt64("max_event_id")
+					return nil
+				},
+			); err != nil {
+			return fmt.Errorf("querying initial resource state for watch %q: %w", ptr, err)
+		}
 
-						return nil
-					},
-				)
+		if spec != nil {
+			res, err := st.unmarshalResource(spec, options.UnmarshalOptions)
 			if err != nil {
-				return fmt.Errorf("querying initial event ID for watch %q: %w", ptr, err)
+				return fmt.Errorf("unmarshal initial resource state for watch %q: %w", ptr, err)
 			}
 
-			initialEvent.Bookmark = encodeBookmark(eventID)
-
-			return nil
-		}()
-		if err != nil {
-			return err
+			initialEvent.Type = state.Created
+			initialEvent.Resource = res
+		} else {
+			initialEvent.Type = state.Destroyed
+			initialEvent.Resource = resource.NewTombstone(
+				resource.NewMetadata(
+					ptr.Namespace(),
+					ptr.Type(),
+					ptr.ID(),
+					resource.VersionUndefined,
+				),
+			)
 		}
+
+		initialEvent.Bookmark = encodeBookmark(eventID)
 	}
 
 	resourceNamespace, resourceType, resourceID := ptr.Namespace(), ptr.Type(), ptr.ID()
+	pos.eventID.Store(eventID)
 	watchSetupFailed = false
 
 	go func() {
 		defer sub.Unsubscribe()
+		defer st.untrackWatch(pos)
 
 		if initialEvent.Resource != nil {
 			if !channel.SendWithContext(ctx, ch, initialEvent) {
@@ -262,6 +481,10 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 			}
 		}
 
+		sub.SetBlocked(false)
+
+		panics := watchPanicHandler{st: st, watch: ptr}
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -269,9 +492,11 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 			case <-sub.NotifyCh():
 			}
 
+			gen := sub.Generation()
+
 			var events []state.Event
 
-			if err := func() error {
+			restart, err := panics.run(func() error {
 				conn, err := st.db.Take(ctx)
 				if err != nil {
 					return fmt.Errorf("taking connection for watch event: %w", err)
@@ -279,11 +504,12 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 
 				defer st.db.Put(conn)
 
-				q, err := sqlitexx.NewQuery(
+				q, err := st.newExplainedQuery(
 					conn,
 					`SELECT event_id, spec_before, spec_after, event_type
 					FROM `+st.options.TablePrefix+`events
-					WHERE event_id > $event_id AND namespace = $namespace AND type = $type AND id = $id
+					WHERE event_id > $event_id AND namespace = $namespace AND type = $type
+						AND (id = $id OR (id = '' AND event_type = $resync_event_type))
 					ORDER BY event_id ASC`,
 				)
 				if err != nil {
@@ -295,20 +521,30 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 					BindString("$namespace", resourceNamespace).
 					BindString("$type", resourceType).
 					BindString("$id", resourceID).
+					BindInt("$resync_event_type", resyncEventType).
 					QueryAll(
 						func(stmt *sqlite.Stmt) error {
-							specBefore := make([]byte, stmt.GetLen("spec_before"))
-							stmt.GetBytes("spec_before", specBefore)
+							newEventID := stmt.GetInt64("event_id")
+							eventType := int(stmt.GetInt64("event_type"))
+
+							var specBefore []byte
+
+							if eventType != 2 || !skipOld {
+								specBefore = make([]byte, stmt.GetLen("spec_before"))
+								stmt.GetBytes("spec_before", specBefore)
+							}
 
 							specAfter := make([]byte, stmt.GetLen("spec_after"))
 							stmt.GetBytes("spec_after", specAfter)
 
-							newEventID := stmt.GetInt64("event_id")
-							eventType := int(stmt.GetInt64("event_type"))
-
 							eventID = newEventID
 
-							event := st.convertEvent(ptr, eventID, specBefore, specAfter, eventType)
+							event, ok := st.convertEvent(ptr, eventID, specBefore, specAfter, eventType, options.UnmarshalOptions, skipOld)
+							if !ok {
+								// skip the event
+								return nil
+							}
+
 							if event.Type == state.Errored {
 								return event.Error
 							}
@@ -323,18 +559,45 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 				}
 
 				return nil
-			}(); err != nil {
-				channel.SendWithContext(ctx, ch, state.Event{
+			})
+			if restart {
+				// fetch the events again after the last delivered one
+				eventID = pos.eventID.Load()
+
+				sub.TriggerNotify()
+
+				continue
+			}
+
+			if err != nil {
+				events = append([]state.Event{
+					{
+						Type:  state.Errored,
+						Error: fmt.Errorf("watching %q: %w", ptr, err),
+					},
+				}, events...)
+			}
+
+			if pos.expired.Load() {
+				// compaction removed some events before we could fetch them
+				deliver(ctx, sub, gen, ch, st.options.WatchSendTimeout, state.Event{
 					Type:  state.Errored,
-					Error: fmt.Errorf("watching %q: %w", ptr, err),
+					Error: fmt.Errorf("watching %q: %w", ptr, errWatchExpired),
 				})
+
+				return
 			}
 
-			for _, event := range events {
-				if !channel.SendWithContext(ctx, ch, event) {
-					// If the context is canceled, we should stop the watch
-					return
-				}
+			pos.eventID.Store(eventID)
+
+			if !deliver(ctx, sub, gen, ch, st.options.WatchSendTimeout, events...) {
+				// the context is canceled, or the consumer is stuck
+				deliverTimeoutError(ctx, ch, state.Event{
+					Type:  state.Errored,
+					Error: fmt.Errorf("watching %q: %w", ptr, errWatchSendTimeout),
+				})
+
+				return
 			}
 		}
 	}()
@@ -343,6 +606,12 @@ func (st *State) Watch(ctx context.Context, ptr resource.Pointer, ch chan<- stat
 }
 
 // WatchKind watches resources of specific kind (namespace and type).
+//
+// If the type of the kind is empty, resources of all types in the namespace are watched.
+//
+// With the bootstrap contents, the resources are listed and the last event ID is captured in the same
+// read transaction, so the bookmark of the Bootstrapped event points exactly to the state of the listed resources:
+// the live events start right after it, none of them is missing or duplicates the bootstrap contents.
 func (st *State) WatchKind(ctx context.Context, resourceKind resource.Kind, ch chan<- state.Event, opts ...state.WatchKindOption) error {
 	return st.watchKind(ctx, resourceKind, ch, nil, "watchKind", opts...)
 }
@@ -360,18 +629,45 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 		opt(&options)
 	}
 
+	ext := takeWatchKindExtensions(&options)
+
+	if err := st.checkNamespace(resourceKind.Namespace()); err != nil {
+		return fmt.Errorf("failed to %s: %w", opName, err)
+	}
+
 	matches := func(res resource.Resource) bool {
-		return options.LabelQueries.Matches(*res.Metadata().Labels()) && options.IDQuery.Matches(*res.Metadata())
+		return options.LabelQueries.Matches(*res.Metadata().Labels()) && options.IDQuery.Matches(*res.Metadata()) && ext.matchesPhase(res)
 	}
 
+	filtered := len(options.LabelQueries) > 0 || options.IDQuery.Regexp != nil || ext.phase != nil
+
+	// Old is required to filter the update events
+	skipOld := (st.options.SkipOldResource || ext.withoutOld) && !filtered
+	eventTypeSQL := ext.eventTypeCondition(filtered) + ext.generationCondition(filtered) + ext.metadataCondition(options.LabelQueries)
+
 	labelQuerySQL := filter.CompileLabelQueries(options.LabelQueries)
 
-	sub := st.sub.Subscribe(resourceKind)
+	if ext.phase != nil {
+		labelQuerySQL = `(` + labelQuerySQL + `) AND phase = ` + strconv.Itoa(int(*ext.phase))
+	}
+
+	subscribeOpts := st.watchSubscribeOptions()
+	if st.fanout != nil {
+		// the events are read by the fan-out reader, which waits for the watch to deliver them instead
+		subscribeOpts = nil
+	}
+
+	sub := st.sub.Subscribe(resourceKind, subscribeOpts...)
+	pos := st.trackWatch(resourceKind.Namespace(), resourceKind.Type(), "")
+	// the watch doesn't process notifications until the initial events are sent
+	sub.SetBlocked(true)
+
 	watchSetupFailed := true
 
 	defer func() {
 		if watchSetupFailed {
 			sub.Unsubscribe()
+			st.untrackWatch(pos)
 		}
 	}()
 
@@ -400,11 +696,12 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 			return fmt.Errorf("failed to %s %q: %w", opName, resourceKind, err)
 		}
 
-		// verify that we still have the event in the log
+		// verify that we still have the event in the log;
+		// a bookmark right before an existing event starts the watch with that event (see MutationResult)
 		q, err := sqlitexx.NewQuery(
 			conn,
 			`SELECT 1 FROM `+st.options.TablePrefix+`events
-		WHERE event_id = $event_id`,
+		WHERE event_id IN ($event_id, $event_id + 1) LIMIT 1`,
 		)
 		if err != nil {
 			return fmt.Errorf("verifying bookmark for watch %q: %w", resourceKind, err)
@@ -424,14 +721,18 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 		sub.TriggerNotify()
 	case options.BootstrapContents:
 		// figure out initial state of the watch process
+		//
+		// the resources and the last event ID must be read in the same read transaction: the writes committed
+		// after the snapshot are delivered as live events (the subscription is already established),
+		// the ones committed before are in the bootstrap contents
 		err := func() (err error) {
 			defer sqlitex.Transaction(conn)(&err)
 
-			q, err := sqlitexx.NewQuery(
+			q, err := st.newExplainedQuery(
 				conn,
 				`SELECT spec
 					FROM `+st.options.TablePrefix+`resources
-					WHERE namespace = $namespace AND type = $type AND `+labelQuerySQL,
+					WHERE `+kindCondition(resourceKind)+` AND `+labelQuerySQL,
 			)
 			if err != nil {
 				return fmt.Errorf("preparing query for initial resource state for watch %q: %w", resourceKind, err)
@@ -439,7 +740,7 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 
 			err = q.
 				BindString("$namespace", resourceKind.Namespace()).
-				BindString("$type", resourceKind.Type()).
+				BindStringIfSet("$type", resourceKind.Type()).
 				QueryAll(
 					func(stmt *sqlite.Stmt) error {
 						spec := make([]byte, stmt.GetLen("spec"))
@@ -447,7 +748,7 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 
 						var res resource.Resource
 
-						res, err = st.marshaler.UnmarshalResource(spec)
+						res, err = st.unmarshalResource(spec, options.UnmarshalOptions)
 						if err != nil {
 							return fmt.Errorf("failed to unmarshal resource of kind %q: %w", resourceKind, err)
 						}
@@ -512,11 +813,26 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 		}
 	}
 
-	resourceNamespace, resourceType := resourceKind.Namespace(), resourceKind.Type()
+	pos.eventID.Store(eventID)
 	watchSetupFailed = false
 
+	// the caller might reuse the metadata once the watch is set up
+	kindMD := resource.NewMetadata(resourceKind.Namespace(), resourceKind.Type(), "", resource.VersionUndefined)
+	resourceKind = &kindMD
+
+	var fs *fanoutSubscriber
+
+	if st.fanout != nil {
+		fs = st.fanout.subscribe(resourceKind, eventID, pos)
+	}
+
 	go func() {
 		defer sub.Unsubscribe()
+		defer st.untrackWatch(pos)
+
+		if fs != nil {
+			defer st.fanout.unsubscribe(fs)
+		}
 
 		if options.BootstrapContents {
 			switch {
@@ -584,125 +900,196 @@ func (st *State) watchKind(ctx context.Context, resourceKind resource.Kind, sing
 			}
 		}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-sub.NotifyCh():
+		sub.SetBlocked(false)
+
+		panics := watchPanicHandler{st: st, watch: resourceKind}
+
+		// handleEvent converts the stored event applying the filters of the watch, false is returned for the skipped events
+		handleEvent := func(stored storedEvent) (state.Event, bool, error) {
+			if !ext.readsStoredEvent(stored.eventType, stored.generationChanged, filtered) {
+				return state.Event{}, false, nil
 			}
 
-			var events []state.Event
+			event, ok := st.convertEvent(resourceKind, stored.eventID, stored.specBefore, stored.specAfter, stored.eventType, options.UnmarshalOptions, skipOld)
+			if !ok {
+				return state.Event{}, false, nil
+			}
 
-			if queryErr := func() error {
-				conn, err := st.db.Take(ctx)
-				if err != nil {
-					return fmt.Errorf("taking connection for watch kind event: %w", err)
+			if event.Type == state.Errored {
+				return state.Event{}, false, event.Error
+			}
+
+			switch event.Type {
+			case state.Created, state.Destroyed, state.Noop:
+				if !matches(event.Resource) {
+					return state.Event{}, false, nil
+				}
+			case state.Updated:
+				if skipOld {
+					// no queries to match
+					break
 				}
 
-				defer st.db.Put(conn)
+				oldMatches := matches(event.Old)
+				newMatches := matches(event.Resource)
 
-				q, err := sqlitexx.NewQuery(
-					conn,
-					`SELECT event_id, spec_before, spec_after, event_type
-					FROM `+st.options.TablePrefix+`events
-					WHERE event_id > $event_id AND namespace = $namespace AND type = $type
-					ORDER BY event_id ASC`,
-				)
-				if err != nil {
-					return fmt.Errorf("preparing query for watch %s events: %w", resourceKind, err)
+				switch {
+				// transform the event if matching fact changes with the update
+				case oldMatches && !newMatches:
+					event.Type = state.Destroyed
+					event.Old = nil
+				case !oldMatches && newMatches:
+					event.Type = state.Created
+					event.Old = nil
+				case newMatches && oldMatches:
+					// passthrough the event
+				default:
+					return state.Event{}, false, nil
 				}
+			case state.Errored, state.Bootstrapped:
+				panic("should never be reached")
+			}
 
-				err = q.
-					BindInt64("$event_id", eventID).
-					BindString("$namespace", resourceNamespace).
-					BindString("$type", resourceType).
-					QueryAll(
-						func(stmt *sqlite.Stmt) error {
-							specBefore := make([]byte, stmt.GetLen("spec_before"))
-							stmt.GetBytes("spec_before", specBefore)
+			if event.Type == state.Updated && !ext.allowsUpdate(stored.generationChanged) {
+				return state.Event{}, false, nil
+			}
 
-							specAfter := make([]byte, stmt.GetLen("spec_after"))
-							stmt.GetBytes("spec_after", specAfter)
+			if !ext.allowsEventType(event.Type) {
+				return state.Event{}, false, nil
+			}
 
-							newEventID := stmt.GetInt64("event_id")
-							eventType := int(stmt.GetInt64("event_type"))
+			return event, true, nil
+		}
 
-							eventID = newEventID
+		// fetchEvents reads the events of the kind after the event ID, returning the ID of the last event read
+		fetchEvents := func(afterEventID int64, fn func(storedEvent) error) (int64, error) {
+			return st.fetchKindEvents(ctx, resourceKind, afterEventID, eventTypeSQL, skipOld, fn)
+		}
 
-							event := st.convertEvent(resourceKind, eventID, specBefore, specAfter, eventType)
-							if event.Type == state.Errored {
-								return event.Error
-							}
+		sendError := func(acker deliveryAcker, gen uint64, err error) {
+			watchErrorEvent := state.Event{
+				Type:  state.Errored,
+				Error: err,
+			}
 
-							switch event.Type {
-							case state.Created, state.Destroyed:
-								if !matches(event.Resource) {
-									// skip the event
-									return nil
-								}
-							case state.Updated:
-								oldMatches := matches(event.Old)
-								newMatches := matches(event.Resource)
-
-								switch {
-								// transform the event if matching fact changes with the update
-								case oldMatches && !newMatches:
-									event.Type = state.Destroyed
-									event.Old = nil
-								case !oldMatches && newMatches:
-									event.Type = state.Created
-									event.Old = nil
-								case newMatches && oldMatches:
-									// passthrough the event
-								default:
-									// skip the event
-									return nil
-								}
-							case state.Errored, state.Bootstrapped, state.Noop:
-								panic("should never be reached")
-							}
+			switch {
+			case singleCh != nil:
+				deliver(ctx, acker, gen, singleCh, st.options.WatchSendTimeout, watchErrorEvent)
+			case aggCh != nil:
+				deliver(ctx, acker, gen, aggCh, st.options.WatchSendTimeout, []state.Event{watchErrorEvent})
+			}
+		}
 
-							events = append(events, event)
+		// sendEvents returns false if the events can't be delivered, and the watch should exit
+		sendEvents := func(acker deliveryAcker, gen uint64, events []state.Event) bool {
+			switch {
+			case aggCh != nil:
+				if !deliver(ctx, acker, gen, aggCh, st.options.WatchSendTimeout, events) {
+					deliverTimeoutError(ctx, aggCh, []state.Event{{
+						Type:  state.Errored,
+						Error: fmt.Errorf("watching %s: %w", resourceKind, errWatchSendTimeout),
+					}})
 
-							return nil
-						},
-					)
-				if err != nil {
-					return fmt.Errorf("querying events for watch %s: %w", resourceKind, err)
+					return false
 				}
+			case singleCh != nil:
+				if !deliver(ctx, acker, gen, singleCh, st.options.WatchSendTimeout, events...) {
+					deliverTimeoutError(ctx, singleCh, state.Event{
+						Type:  state.Errored,
+						Error: fmt.Errorf("watching %s: %w", resourceKind, errWatchSendTimeout),
+					})
 
-				return nil
-			}(); queryErr != nil {
-				watchErrorEvent := state.Event{
-					Type:  state.Errored,
-					Error: queryErr,
+					return false
 				}
+			}
 
-				switch {
-				case singleCh != nil:
-					channel.SendWithContext(ctx, singleCh, watchErrorEvent)
-				case aggCh != nil:
-					channel.SendWithContext(ctx, aggCh, []state.Event{watchErrorEvent})
+			return true
+		}
+
+		if fs != nil {
+			st.fanout.resume(fs, &panics, handleEvent, fetchEvents)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-fs.notifyCh:
 				}
 
+				events, err := fs.takeReady()
+				if err != nil {
+					sendError(fs, 0, err)
+
+					return
+				}
+
+				if !sendEvents(fs, 0, events) {
+					return
+				}
+
+				st.fanout.delivered(fs)
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.NotifyCh():
+			}
+
+			gen := sub.Generation()
+
+			var events []state.Event
+
+			restart, queryErr := panics.run(func() error {
+				var err error
+
+				eventID, err = fetchEvents(eventID, func(stored storedEvent) error {
+					event, ok, err := handleEvent(stored)
+					if err != nil || !ok {
+						return err
+					}
+
+					events = append(events, event)
+
+					return nil
+				})
+
+				return err
+			})
+			if restart {
+				// fetch the events again after the last delivered one
+				eventID = pos.eventID.Load()
+
+				sub.TriggerNotify()
+
+				continue
+			}
+
+			if queryErr != nil {
+				sendError(sub, gen, queryErr)
+
+				return
+			}
+
+			if pos.expired.Load() {
+				// compaction removed some events before we could fetch them
+				sendError(sub, gen, fmt.Errorf("watching %s: %w", resourceKind, errWatchExpired))
+
 				return
 			}
 
+			pos.eventID.Store(eventID)
+
 			if len(events) == 0 {
+				sub.Ack(gen)
+
 				continue
 			}
 
-			switch {
-			case aggCh != nil:
-				if !channel.SendWithContext(ctx, aggCh, events) {
-					return
-				}
-			case singleCh != nil:
-				for _, event := range events {
-					if !channel.SendWithContext(ctx, singleCh, event) {
-						return
-					}
-				}
+			if !sendEvents(sub, gen, events) {
+				return
 			}
 		}
 	}()
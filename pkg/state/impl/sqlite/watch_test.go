@@ -7,14 +7,22 @@ package sqlite_test
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	ctrlconformance "github.com/cosi-project/runtime/pkg/controller/conformance"
+	"github.com/cosi-project/runtime/pkg/resource"
 	"github.com/cosi-project/runtime/pkg/safe"
 	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/siderolabs/gen/xslices"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
 )
 
 func TestWatchKindWithBootstrap(t *testing.T) {
@@ -342,3 +350,579 @@ func TestWatchKindStress(t *testing.T) {
 		}
 	})
 }
+
+func TestWatchSynchronousEventDelivery(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		kindCh := make(chan state.Event, 16)
+		aggCh := make(chan []state.Event, 16)
+		resourceCh := make(chan state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, conformance.NewPathResource("default", "").Metadata(), kindCh))
+		require.NoError(t, s.WatchKindAggregated(ctx, conformance.NewPathResource("default", "").Metadata(), aggCh))
+		require.NoError(t, s.Watch(ctx, conformance.NewPathResource("default", "path-0").Metadata(), resourceCh))
+
+		// initial event for the single resource watch
+		<-resourceCh
+
+		for i := range 10 {
+			require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", fmt.Sprintf("path-%d", i))))
+
+			// no waiting: the events should be already in the channels
+			select {
+			case ev := <-kindCh:
+				assert.Equal(t, state.Created, ev.Type)
+				assert.Equal(t, fmt.Sprintf("path-%d", i), ev.Resource.Metadata().ID())
+			default:
+				t.Fatal("event is not delivered")
+			}
+
+			select {
+			case evs := <-aggCh:
+				require.Len(t, evs, 1)
+				assert.Equal(t, state.Created, evs[0].Type)
+			default:
+				t.Fatal("event is not delivered")
+			}
+		}
+
+		select {
+		case ev := <-resourceCh:
+			assert.Equal(t, state.Created, ev.Type)
+		default:
+			t.Fatal("event is not delivered")
+		}
+
+		assert.Empty(t, resourceCh)
+	}, sqlite.WithSynchronousEventDelivery(true))
+}
+
+func TestWatchNamespace(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+		defer cancel()
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "path-0")))
+		require.NoError(t, s.Create(ctx, ctrlconformance.NewIntResource("default", "int-0", 0)))
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("other", "path-0")))
+
+		kind := resource.NewMetadata("default", "", "", resource.VersionUndefined)
+
+		list, err := s.List(ctx, kind)
+		require.NoError(t, err)
+		assert.Equal(t,
+			[]string{conformance.PathResourceType + "/path-0", ctrlconformance.IntResourceType + "/int-0"},
+			xslices.Map(list.Items, func(r resource.Resource) string { return r.Metadata().Type() + "/" + r.Metadata().ID() }),
+		)
+
+		watchCh := make(chan state.Event)
+
+		require.NoError(t, s.WatchKind(ctx, kind, watchCh, state.WithBootstrapContents(true)))
+
+		for _, typ := range []resource.Type{conformance.PathResourceType, ctrlconformance.IntResourceType} {
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			case ev := <-watchCh:
+				assert.Equal(t, state.Created, ev.Type)
+				assert.Equal(t, typ, ev.Resource.Metadata().Type())
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		case ev := <-watchCh:
+			assert.Equal(t, state.Bootstrapped, ev.Type)
+		}
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("other", "path-1")))
+		require.NoError(t, s.Create(ctx, ctrlconformance.NewIntResource("default", "int-1", 1)))
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		case ev := <-watchCh:
+			assert.Equal(t, state.Created, ev.Type)
+			assert.Equal(t, "int-1", ev.Resource.Metadata().ID())
+			assert.IsType(t, &ctrlconformance.IntResource{}, ev.Resource)
+		}
+	})
+}
+
+func TestWatchSkipOldResource(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		res := conformance.NewPathResource("default", "path")
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, s.Create(ctx, res))
+
+		kindCh := make(chan state.Event, 16)
+		filteredCh := make(chan state.Event, 16)
+		resourceCh := make(chan state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, res.Metadata(), kindCh))
+		require.NoError(t, s.WatchKind(ctx, res.Metadata(), filteredCh, state.WatchWithLabelQuery(resource.LabelExists("app"))))
+		require.NoError(t, s.Watch(ctx, res.Metadata(), resourceCh))
+
+		// initial event for the single resource watch
+		<-resourceCh
+
+		res.Metadata().Annotations().Set("updated", "true")
+
+		require.NoError(t, s.Update(ctx, res))
+
+		receive := func(ch <-chan state.Event) state.Event {
+			select {
+			case ev := <-ch:
+				require.Equal(t, state.Updated, ev.Type)
+
+				return ev
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+
+				return state.Event{}
+			}
+		}
+
+		assert.Nil(t, receive(kindCh).Old)
+		assert.Nil(t, receive(resourceCh).Old)
+
+		// the filtering watch still needs the previous version
+		filtered := receive(filteredCh)
+		require.NotNil(t, filtered.Old)
+		_, updated := filtered.Old.Metadata().Annotations().Get("updated")
+		assert.False(t, updated)
+	}, sqlite.WithSkipOldResource(true))
+}
+
+func TestWatchKindWithoutOld(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		res := conformance.NewPathResource("default", "path")
+
+		require.NoError(t, s.Create(ctx, res))
+
+		withoutOldCh := make(chan state.Event, 16)
+		withOldCh := make(chan state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, res.Metadata(), withoutOldCh, sqlite.WithoutOld()))
+		require.NoError(t, s.WatchKind(ctx, res.Metadata(), withOldCh))
+
+		res.Metadata().Annotations().Set("updated", "true")
+
+		require.NoError(t, s.Update(ctx, res))
+
+		for ch, hasOld := range map[chan state.Event]bool{withoutOldCh: false, withOldCh: true} {
+			select {
+			case ev := <-ch:
+				require.Equal(t, state.Updated, ev.Type)
+				assert.Equal(t, hasOld, ev.Old != nil)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+	})
+}
+
+func TestWatchKindEventTypes(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		lifecycleCh := make(chan state.Event, 16)
+		filteredCh := make(chan state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, kind, lifecycleCh, sqlite.WithEventTypes(state.Created, state.Destroyed)))
+		require.NoError(t, s.WatchKind(ctx, kind, filteredCh,
+			sqlite.WithEventTypes(state.Created), state.WatchWithLabelQuery(resource.LabelExists("app"))))
+
+		res := conformance.NewPathResource("default", "path")
+
+		require.NoError(t, s.Create(ctx, res))
+
+		// the update makes the resource match the label query
+		res.Metadata().Labels().Set("app", "foo")
+
+		require.NoError(t, s.Update(ctx, res))
+		require.NoError(t, s.Destroy(ctx, res.Metadata()))
+
+		receive := func(ch <-chan state.Event) state.Event {
+			select {
+			case ev := <-ch:
+				return ev
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+
+				return state.Event{}
+			}
+		}
+
+		assert.Equal(t, state.Created, receive(lifecycleCh).Type)
+		assert.Equal(t, state.Destroyed, receive(lifecycleCh).Type)
+
+		ev := receive(filteredCh)
+		assert.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, "foo", ev.Resource.Metadata().Labels().Raw()["app"])
+
+		// no more events
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "sentinel")))
+
+		assert.Equal(t, "sentinel", receive(lifecycleCh).Resource.Metadata().ID())
+		assert.Empty(t, filteredCh)
+	})
+}
+
+func TestWatchKindPhase(t *testing.T) {
+	t.Parallel()
+
+	var unmarshaled atomic.Int64
+
+	withSqliteMarshaler(t, countingMarshaler{unmarshaled: &unmarshaled}, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		newResource := func(id string, phase resource.Phase, labels ...string) *conformance.PathResource {
+			res := conformance.NewPathResource("default", id)
+			res.Metadata().SetPhase(phase)
+
+			for i := 0; i+1 < len(labels); i += 2 {
+				res.Metadata().Labels().Set(labels[i], labels[i+1])
+			}
+
+			return res
+		}
+
+		require.NoError(t, st.Create(ctx, newResource("tearing", resource.PhaseTearingDown)))
+		require.NoError(t, st.Create(ctx, newResource("running", resource.PhaseRunning)))
+
+		phaseCh := make(chan state.Event, 16)
+		filteredCh := make(chan state.Event, 16)
+
+		require.NoError(t, st.WatchKind(ctx, kind, phaseCh, sqlite.WithPhase(resource.PhaseTearingDown), state.WithBootstrapContents(true)))
+		require.NoError(t, st.WatchKind(ctx, kind, filteredCh, sqlite.WithPhase(resource.PhaseRunning), state.WatchWithLabelQuery(resource.LabelEqual("app", "foo"))))
+
+		receive := func(ch <-chan state.Event) state.Event {
+			select {
+			case ev := <-ch:
+				return ev
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+
+				return state.Event{}
+			}
+		}
+
+		// the bootstrap contents only include the resources in the phase
+		ev := receive(phaseCh)
+		assert.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, "tearing", ev.Resource.Metadata().ID())
+		assert.Equal(t, state.Bootstrapped, receive(phaseCh).Type)
+
+		unmarshaled.Store(0)
+
+		res := newResource("1", resource.PhaseRunning)
+		require.NoError(t, st.Create(ctx, res))
+
+		for i := 2; i < 10; i++ {
+			require.NoError(t, st.Create(ctx, newResource(strconv.Itoa(i), resource.PhaseRunning, "app", "bar")))
+		}
+
+		require.NoError(t, st.Create(ctx, newResource("matching", resource.PhaseRunning, "app", "foo")))
+		require.NoError(t, st.Create(ctx, newResource("tearing2", resource.PhaseTearingDown, "app", "foo")))
+
+		assert.Equal(t, "tearing2", receive(phaseCh).Resource.Metadata().ID())
+		assert.Equal(t, "matching", receive(filteredCh).Resource.Metadata().ID())
+
+		// the events of the other resources are filtered out without unmarshaling them
+		assert.EqualValues(t, 2, unmarshaled.Load())
+
+		// the update moving the resource into the phase is delivered as created
+		res.Metadata().SetPhase(resource.PhaseTearingDown)
+		require.NoError(t, st.Update(ctx, res))
+
+		ev = receive(phaseCh)
+		assert.Equal(t, state.Created, ev.Type)
+		assert.Equal(t, "1", ev.Resource.Metadata().ID())
+
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		ev = receive(phaseCh)
+		assert.Equal(t, state.Destroyed, ev.Type)
+		assert.Equal(t, "1", ev.Resource.Metadata().ID())
+
+		assert.Empty(t, filteredCh)
+	})
+}
+
+// TestWatchKindBootstrapRace verifies that no event is lost or duplicated between the bootstrap contents
+// and the live events, while the resources are modified concurrently with the watch setup.
+func TestWatchKindBootstrapRace(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		writerCtx, stopWriter := context.WithCancel(ctx)
+		writerDone := make(chan struct{})
+
+		go func() {
+			defer close(writerDone)
+
+			for i := 0; writerCtx.Err() == nil; i++ {
+				res := conformance.NewPathResource("default", strconv.Itoa(i%5))
+
+				if !assert.NoError(t, s.Create(ctx, res)) {
+					return
+				}
+
+				res.Metadata().Annotations().Set("updated", "true")
+
+				if !assert.NoError(t, s.Update(ctx, res)) {
+					return
+				}
+
+				if !assert.NoError(t, s.Destroy(ctx, res.Metadata())) {
+					return
+				}
+			}
+		}()
+
+		type watchModel struct {
+			versions map[resource.ID]uint64
+			mu       sync.Mutex
+		}
+
+		var (
+			models []*watchModel
+			wg     sync.WaitGroup
+		)
+
+		for range 20 {
+			model := &watchModel{versions: map[resource.ID]uint64{}}
+			models = append(models, model)
+
+			ch := make(chan state.Event)
+
+			require.NoError(t, s.WatchKind(ctx, kind, ch, state.WithBootstrapContents(true)))
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					var ev state.Event
+
+					select {
+					case <-ctx.Done():
+						return
+					case ev = <-ch:
+					}
+
+					model.mu.Lock()
+
+					switch ev.Type {
+					case state.Created:
+						id := ev.Resource.Metadata().ID()
+
+						_, exists := model.versions[id]
+						assert.False(t, exists, "duplicate create of %q", id)
+
+						model.versions[id] = ev.Resource.Metadata().Version().Value()
+					case state.Updated:
+						id := ev.Resource.Metadata().ID()
+
+						version, exists := model.versions[id]
+						assert.True(t, exists, "update of unknown %q", id)
+						assert.Greater(t, ev.Resource.Metadata().Version().Value(), version, "duplicate update of %q", id)
+
+						model.versions[id] = ev.Resource.Metadata().Version().Value()
+					case state.Destroyed:
+						id := ev.Resource.Metadata().ID()
+
+						_, exists := model.versions[id]
+						assert.True(t, exists, "destroy of unknown %q", id)
+
+						delete(model.versions, id)
+					case state.Errored:
+						assert.NoError(t, ev.Error)
+					case state.Bootstrapped, state.Noop:
+					}
+
+					model.mu.Unlock()
+				}
+			}()
+
+			time.Sleep(time.Millisecond)
+		}
+
+		stopWriter()
+		<-writerDone
+
+		items, err := s.List(ctx, kind)
+		require.NoError(t, err)
+
+		expected := map[resource.ID]uint64{}
+
+		for _, item := range items.Items {
+			expected[item.Metadata().ID()] = item.Metadata().Version().Value()
+		}
+
+		for _, model := range models {
+			assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+				model.mu.Lock()
+				defer model.mu.Unlock()
+
+				assert.Equal(collect, expected, model.versions)
+			}, 5*time.Second, time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+// TestWatchInitialStateRace verifies that the updates landing during the Watch setup are neither lost
+// nor duplicated with the initial resource state.
+func TestWatchInitialStateRace(t *testing.T) {
+	t.Parallel()
+
+	withSqlite(t, func(s state.State) {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		res := conformance.NewPathResource("default", "path")
+
+		require.NoError(t, s.Create(ctx, res))
+
+		writerCtx, stopWriter := context.WithCancel(ctx)
+		writerDone := make(chan struct{})
+
+		go func() {
+			defer close(writerDone)
+
+			for i := 0; writerCtx.Err() == nil; i++ {
+				res.Metadata().Annotations().Set("counter", strconv.Itoa(i))
+
+				if !assert.NoError(t, s.Update(ctx, res)) {
+					return
+				}
+			}
+		}()
+
+		var (
+			versions []*atomic.Uint64
+			wg       sync.WaitGroup
+		)
+
+		for range 20 {
+			version := &atomic.Uint64{}
+			versions = append(versions, version)
+
+			ch := make(chan state.Event)
+
+			require.NoError(t, s.Watch(ctx, res.Metadata(), ch))
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					var ev state.Event
+
+					select {
+					case <-ctx.Done():
+						return
+					case ev = <-ch:
+					}
+
+					if !assert.Contains(t, []state.EventType{state.Created, state.Updated}, ev.Type, "unexpected event: %v", ev.Error) {
+						return
+					}
+
+					current := version.Load()
+
+					if current == 0 {
+						assert.Equal(t, state.Created, ev.Type, "the initial event should be Created")
+					} else {
+						assert.Equal(t, current+1, ev.Resource.Metadata().Version().Value(), "an update was lost or duplicated")
+					}
+
+					version.Store(ev.Resource.Metadata().Version().Value())
+				}
+			}()
+
+			time.Sleep(time.Millisecond)
+		}
+
+		stopWriter()
+		<-writerDone
+
+		for _, version := range versions {
+			assert.Eventually(t, func() bool {
+				return version.Load() == res.Metadata().Version().Value()
+			}, 5*time.Second, time.Millisecond)
+		}
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+func TestWatchSendTimeout(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		// nobody receives from the channel
+		ch := make(chan state.Event)
+
+		require.NoError(t, st.WatchKind(ctx, kind, ch))
+		require.NoError(t, st.Watch(ctx, conformance.NewPathResource("default", "path").Metadata(), make(chan state.Event, 2)))
+
+		assert.Equal(t, 2, st.Stats().Watches)
+
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("default", "path")))
+
+		// the stuck watch releases its position, the resource watch has enough buffer
+		require.Eventually(t, func() bool {
+			return st.Stats().Watches == 1
+		}, time.Second, time.Millisecond)
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Errored, ev.Type)
+			assert.ErrorContains(t, ev.Error, "send timeout")
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}, sqlite.WithWatchSendTimeout(50*time.Millisecond))
+}
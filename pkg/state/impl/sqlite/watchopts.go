@@ -0,0 +1,226 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"weak"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite/internal/filter"
+)
+
+// watchKindExtensions are the WatchKind options specific to this package.
+type watchKindExtensions struct {
+	phase             *resource.Phase
+	eventTypes        []state.EventType
+	withoutOld        bool
+	generationChanges bool
+}
+
+// pendingWatchKindExtensions holds the extensions set by the options of this package
+// until WatchKind picks them up, keyed by the options they were applied to.
+//
+// state.WatchKindOptions can't be extended, so the options store the extensions on the side;
+// if the options are applied by some other state, the entries are dropped when the options are garbage collected.
+var pendingWatchKindExtensions sync.Map // map[weak.Pointer[state.WatchKindOptions]]*watchKindExtensions
+
+func watchKindExtension(fn func(ext *watchKindExtensions)) state.WatchKindOption {
+	return func(opts *state.WatchKindOptions) {
+		key := weak.Make(opts)
+
+		ext, loaded := pendingWatchKindExtensions.LoadOrStore(key, &watchKindExtensions{})
+		if !loaded {
+			runtime.AddCleanup(opts, func(key weak.Pointer[state.WatchKindOptions]) {
+				pendingWatchKindExtensions.Delete(key)
+			}, key)
+		}
+
+		fn(ext.(*watchKindExtensions)) //nolint:forcetypeassert,errcheck
+	}
+}
+
+// takeWatchKindExtensions returns the extensions applied to the options.
+func takeWatchKindExtensions(opts *state.WatchKindOptions) watchKindExtensions {
+	ext, ok := pendingWatchKindExtensions.LoadAndDelete(weak.Make(opts))
+	if !ok {
+		return watchKindExtensions{}
+	}
+
+	return *ext.(*watchKindExtensions) //nolint:forcetypeassert,errcheck
+}
+
+// WithoutOld makes WatchKind deliver the update events without the previous version of the resource.
+//
+// This is the per-watch variant of WithSkipOldResource: Event.Old is nil, and the stored previous version
+// is neither read nor unmarshaled, unless the watch has label or ID queries, which need it for filtering.
+// The option has no effect on other state implementations.
+func WithoutOld() state.WatchKindOption {
+	return watchKindExtension(func(ext *watchKindExtensions) {
+		ext.withoutOld = true
+	})
+}
+
+// WithEventTypes makes WatchKind deliver only the events of the given types (e.g. only Created and Destroyed).
+//
+// The filter is compiled into the events query, so the events of other types are not even read.
+// It applies to the events from the event log: the bootstrap contents, the Bootstrapped marker
+// and the errors (including the resync markers written by Import) are always delivered. With label or ID queries, an update which makes the resource
+// (not) match the queries is delivered as Created (Destroyed), and it is filtered by that type.
+// The option has no effect on other state implementations.
+func WithEventTypes(types ...state.EventType) state.WatchKindOption {
+	return watchKindExtension(func(ext *watchKindExtensions) {
+		ext.eventTypes = append(ext.eventTypes, types...)
+	})
+}
+
+// WithGenerationChanges makes WatchKind skip the update events which don't change the resource spec.
+//
+// Only the updates bumping the generation (see GetGeneration) are delivered, so the controllers reconciling
+// the spec are not woken up by the metadata-only updates (e.g. labels, finalizers or phase changes).
+// The filter is compiled into the events query. With label or ID queries, a metadata-only update
+// which makes the resource (not) match the queries is still delivered as Created (Destroyed).
+// The option has no effect on other state implementations.
+func WithGenerationChanges() state.WatchKindOption {
+	return watchKindExtension(func(ext *watchKindExtensions) {
+		ext.generationChanges = true
+	})
+}
+
+// WithPhase makes WatchKind deliver only the events of the resources in the phase.
+//
+// It works like the label queries: the bootstrap contents only include the resources in the phase,
+// and an update moving the resource into (out of) the phase is delivered as Created (Destroyed).
+// The filter is compiled into the events query (see also the label queries), so the events of the resources
+// in other phases are not unmarshaled. The option has no effect on other state implementations.
+func WithPhase(phase resource.Phase) state.WatchKindOption {
+	return watchKindExtension(func(ext *watchKindExtensions) {
+		ext.phase = &phase
+	})
+}
+
+// matchesPhase returns true if the resource passes the phase filter.
+func (ext *watchKindExtensions) matchesPhase(res resource.Resource) bool {
+	return ext.phase == nil || res.Metadata().Phase() == *ext.phase
+}
+
+// metadataCondition returns the SQL condition on the metadata columns of the events for the label queries
+// and the phase filter, or an empty string.
+//
+// The event is read if the resource matches the filters after the event (before it for the deletes),
+// or before the update, as the updates changing the match are delivered as Created or Destroyed.
+// The custom events, the resync markers, and the events written before the metadata columns were added
+// have no phase, so they are always read.
+func (ext *watchKindExtensions) metadataCondition(labelQueries resource.LabelQueries) string {
+	if len(labelQueries) == 0 && ext.phase == nil {
+		return ""
+	}
+
+	after := filter.CompileLabelQueriesOn(labelQueries, "labels")
+	before := filter.CompileLabelQueriesOn(labelQueries, "labels_before")
+
+	if ext.phase != nil {
+		phase := strconv.Itoa(int(*ext.phase))
+
+		after = `(` + after + `) AND phase = ` + phase
+		before = `(` + before + `) AND phase_before = ` + phase
+	}
+
+	return ` AND (phase IS NULL OR (` + after + `) OR (event_type = 2 AND ` + before + `))`
+}
+
+// storedEventTypes maps the event types to the event_type values stored in the events table.
+var storedEventTypes = map[state.EventType]int{
+	state.Created:   1,
+	state.Updated:   2,
+	state.Destroyed: 3,
+	state.Noop:      4,
+}
+
+// eventTypeCondition returns the SQL condition on the event_type column for the event types filter, or an empty string.
+//
+// If the watch has label or ID queries, the updates might be turned into Created and Destroyed events,
+// so they are read for these types as well.
+func (ext *watchKindExtensions) eventTypeCondition(filtered bool) string {
+	stored := ext.readEventTypes(filtered)
+	if stored == nil {
+		return ""
+	}
+
+	values := make([]string, 0, len(stored))
+
+	for _, v := range stored {
+		values = append(values, strconv.Itoa(v))
+	}
+
+	return ` AND event_type IN (` + strings.Join(values, ", ") + `)`
+}
+
+// readEventTypes returns the stored event types read for the event types filter, or nil if all of them are read.
+func (ext *watchKindExtensions) readEventTypes(filtered bool) []int {
+	if len(ext.eventTypes) == 0 {
+		return nil
+	}
+
+	// the resync markers are always delivered
+	stored := []int{resyncEventType}
+
+	for _, typ := range ext.eventTypes {
+		if v, ok := storedEventTypes[typ]; ok {
+			stored = append(stored, v)
+		}
+
+		if filtered && (typ == state.Created || typ == state.Destroyed) {
+			stored = append(stored, storedEventTypes[state.Updated])
+		}
+	}
+
+	slices.Sort(stored)
+
+	return slices.Compact(stored)
+}
+
+// generationCondition returns the SQL condition on the generation_changed column for the generation changes filter, or an empty string.
+//
+// If the watch has label or ID queries, the metadata-only updates might be turned into Created and Destroyed events,
+// so they are read and filtered after the conversion.
+func (ext *watchKindExtensions) generationCondition(filtered bool) string {
+	if !ext.generationChanges || filtered {
+		return ""
+	}
+
+	return ` AND (event_type != 2 OR generation_changed = 1)`
+}
+
+// readsStoredEvent returns true if the stored event passes the conditions of eventTypeCondition and generationCondition.
+//
+// It filters the events read without these conditions (see FanoutWorkers) before they are decoded.
+func (ext *watchKindExtensions) readsStoredEvent(eventType int, generationChanged, filtered bool) bool {
+	if stored := ext.readEventTypes(filtered); stored != nil && !slices.Contains(stored, eventType) {
+		return false
+	}
+
+	if ext.generationChanges && !filtered && eventType == storedEventTypes[state.Updated] && !generationChanged {
+		return false
+	}
+
+	return true
+}
+
+// allowsUpdate returns true if the update event passes the generation changes filter.
+func (ext *watchKindExtensions) allowsUpdate(generationChanged bool) bool {
+	return !ext.generationChanges || generationChanged
+}
+
+// allowsEventType returns true if the event of the type passes the event types filter.
+func (ext *watchKindExtensions) allowsEventType(typ state.EventType) bool {
+	return len(ext.eventTypes) == 0 || slices.Contains(ext.eventTypes, typ)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/siderolabs/gen/panicsafe"
+	"go.uber.org/zap"
+)
+
+// watchPanics counts the panics recovered while fetching the watch events.
+var watchPanics expvar.Int
+
+func init() {
+	expvar.Publish("sqlite_state_watch_panics", &watchPanics)
+}
+
+// watchPanicHandler recovers the panics while fetching the watch events, see WatchPanicRestarts.
+type watchPanicHandler struct {
+	st       *State
+	watch    any // resource.Pointer or resource.Kind
+	restarts int
+}
+
+// run calls fetch converting a panic into an error matching panicsafe.IsPanic.
+//
+// If the watch can still be restarted, the panic is logged instead, and restart is true:
+// the caller should fetch the events again starting after the last delivered event.
+func (h *watchPanicHandler) run(fetch func() error) (restart bool, err error) {
+	err = panicsafe.RunErrF(fetch)()
+	if err == nil {
+		h.restarts = 0
+
+		return false, nil
+	}
+
+	if !panicsafe.IsPanic(err) {
+		return false, err
+	}
+
+	watchPanics.Add(1)
+
+	if h.restarts >= h.st.options.WatchPanicRestarts {
+		return false, err
+	}
+
+	h.restarts++
+
+	h.st.options.Logger.Error("watch panicked, restarting",
+		zap.String("watch", fmt.Sprint(h.watch)),
+		zap.Int("restart", h.restarts),
+		zap.Error(err),
+	)
+
+	return true, nil
+}
@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/cosi-project/runtime/pkg/state/impl/store"
+	"github.com/siderolabs/gen/panicsafe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+// panickingMarshaler panics on the unmarshal while the counter is positive.
+type panickingMarshaler struct {
+	store.ProtobufMarshaler
+
+	panics *atomic.Int32
+}
+
+func (m panickingMarshaler) UnmarshalResource(b []byte) (resource.Resource, error) { //nolint:ireturn
+	if m.panics.Add(-1) >= 0 {
+		panic("unmarshal exploded")
+	}
+
+	return m.ProtobufMarshaler.UnmarshalResource(b)
+}
+
+func TestWatchPanic(t *testing.T) {
+	t.Parallel()
+
+	var panics atomic.Int32
+
+	withSqliteMarshaler(t, panickingMarshaler{panics: &panics}, func(s *sqlite.State) {
+		ctx := t.Context()
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+		ptr := conformance.NewPathResource("default", "path").Metadata()
+
+		kindCh := make(chan state.Event, 16)
+		watchCh := make(chan state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, kind, kindCh))
+		require.NoError(t, s.Watch(ctx, ptr, watchCh))
+
+		// the initial event of the resource watch
+		<-watchCh
+
+		panics.Store(2)
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "path")))
+
+		for _, ch := range []chan state.Event{kindCh, watchCh} {
+			select {
+			case ev := <-ch:
+				require.Equal(t, state.Errored, ev.Type)
+				assert.True(t, panicsafe.IsPanic(ev.Error), "unexpected error: %v", ev.Error)
+				assert.ErrorContains(t, ev.Error, "unmarshal exploded")
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for event")
+			}
+		}
+
+		// the resource watch survives the panic
+		require.NoError(t, s.Destroy(ctx, ptr))
+
+		select {
+		case ev := <-watchCh:
+			assert.Equal(t, state.Destroyed, ev.Type)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	})
+}
+
+func TestWatchPanicRestarts(t *testing.T) {
+	t.Parallel()
+
+	var panics atomic.Int32
+
+	withSqliteMarshaler(t, panickingMarshaler{panics: &panics}, func(s *sqlite.State) {
+		ctx := t.Context()
+
+		kind := conformance.NewPathResource("default", "").Metadata()
+
+		ch := make(chan state.Event, 16)
+
+		require.NoError(t, s.WatchKind(ctx, kind, ch))
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "first")))
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Created, ev.Type)
+			assert.Equal(t, "first", ev.Resource.Metadata().ID())
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// the watch restarts from the last delivered event, so the events are neither lost nor duplicated
+		panics.Store(2)
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "second")))
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Created, ev.Type, "unexpected event: %v", ev.Error)
+			assert.Equal(t, "second", ev.Resource.Metadata().ID())
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// the restarts are exhausted
+		panics.Store(3)
+
+		require.NoError(t, s.Create(ctx, conformance.NewPathResource("default", "third")))
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, state.Errored, ev.Type)
+			assert.True(t, panicsafe.IsPanic(ev.Error))
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}, sqlite.WithWatchPanicRestarts(2))
+}
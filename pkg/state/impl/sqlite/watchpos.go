@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// watchPosition tracks the last event ID consumed by an active watch.
+//
+// Compaction never deletes events the watch hasn't consumed yet, unless
+// the watch falls behind more than CompactMaxWatchHold; in that case
+// the watch is marked as expired and terminated with an error.
+type watchPosition struct {
+	namespace resource.Namespace
+	typ       resource.Type
+	id        resource.ID // empty for kind watches
+
+	eventID atomic.Int64
+	expired atomic.Bool
+}
+
+// errWatchExpired is returned to watches which fell behind compaction.
+var errWatchExpired = ErrInvalidWatchBookmark(errors.New("watch fell behind compaction"))
+
+// trackWatch registers a new watch position.
+//
+// The position starts at zero which holds back compaction completely
+// until the watch setup is done.
+func (st *State) trackWatch(namespace resource.Namespace, typ resource.Type, id resource.ID) *watchPosition {
+	pos := &watchPosition{
+		namespace: namespace,
+		typ:       typ,
+		id:        id,
+	}
+
+	st.watchesMu.Lock()
+	st.watches[pos] = struct{}{}
+	st.watchesMu.Unlock()
+
+	return pos
+}
+
+func (st *State) untrackWatch(pos *watchPosition) {
+	st.watchesMu.Lock()
+	delete(st.watches, pos)
+	st.watchesMu.Unlock()
+}
+
+// protectWatches lowers the compaction cutoff event ID so that events not yet consumed by active watches are kept.
+func (st *State) protectWatches(conn *sqlite.Conn, cutoffEventID int64) (int64, error) {
+	st.watchesMu.Lock()
+
+	positions := make([]*watchPosition, 0, len(st.watches))
+
+	for pos := range st.watches {
+		positions = append(positions, pos)
+	}
+
+	st.watchesMu.Unlock()
+
+	holdCutoff := time.Now().Add(-st.options.CompactMaxWatchHold).Unix()
+
+	for _, pos := range positions {
+		eventID := pos.eventID.Load()
+
+		if eventID+1 >= cutoffEventID {
+			continue
+		}
+
+		// find the first event the watch is interested in, but hasn't consumed yet
+		var (
+			nextEventID, nextEventTimestamp int64
+		)
+
+		q, err := sqlitexx.NewQuery(
+			conn,
+			`SELECT event_id, event_timestamp FROM `+st.options.TablePrefix+`events
+			WHERE event_id > $event_id AND event_id < $cutoff AND namespace = $namespace AND ($type = '' OR type = $type) AND ($id = '' OR id = $id)
+			ORDER BY event_id ASC LIMIT 1`,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("preparing query for watch position: %w", err)
+		}
+
+		if err = q.
+			BindInt64("$event_id", eventID).
+			BindInt64("$cutoff", cutoffEventID).
+			BindString("$namespace", pos.namespace).
+			BindString("$type", pos.typ).
+			BindString("$id", pos.id).
+			QueryRow(
+				func(stmt *sqlite.Stmt) error {
+					nextEventID = stmt.GetInt64("event_id")
+					nextEventTimestamp = stmt.GetInt64("event_timestamp")
+
+					return nil
+				},
+			); err != nil {
+			if errors.Is(err, sqlitexx.ErrNoRows) {
+				// nothing to consume below the cutoff
+				continue
+			}
+
+			return 0, fmt.Errorf("failed to get watch position: %w", err)
+		}
+
+		if st.options.CompactMaxWatchHold > 0 && nextEventTimestamp < holdCutoff {
+			// the watch is too far behind, it will be terminated
+			pos.expired.Store(true)
+
+			continue
+		}
+
+		cutoffEventID = nextEventID
+	}
+
+	return cutoffEventID, nil
+}
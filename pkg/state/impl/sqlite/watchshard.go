@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+)
+
+// eventShard is the result of the scan of the events in a range of event IDs, see fetchKindEventsSharded.
+type eventShard struct {
+	err    error
+	done   chan struct{}
+	events []storedEvent
+}
+
+// fetchKindEventsSharded is fetchKindEvents splitting the events up to the last event ID into WatchScanShards ranges,
+// which are read concurrently, each on its own connection.
+//
+// The ranges are passed to fn in order as soon as each range and the ones before it are read,
+// so the events are delivered in the same order as with a single scan.
+// The events up to the last event ID are committed (there is a single writer), so the ranges see all of them.
+func (st *State) fetchKindEventsSharded(
+	ctx context.Context, resourceKind resource.Kind, eventID, lastEventID int64, condition string, skipOld bool, fn func(storedEvent) error,
+) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	// stop the scans if fn fails before they finish, and wait for them to exit
+	defer wg.Wait()
+	defer cancel()
+
+	shards := make([]*eventShard, st.options.WatchScanShards)
+	shardSize := (lastEventID - eventID + int64(len(shards)) - 1) / int64(len(shards))
+
+	for i := range shards {
+		shard := &eventShard{done: make(chan struct{})}
+		shards[i] = shard
+
+		after := eventID + int64(i)*shardSize
+		until := min(after+shardSize, lastEventID)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer close(shard.done)
+
+			shard.err = st.scanEventShard(ctx, resourceKind, after, until, condition, skipOld, shard)
+		}()
+	}
+
+	for _, shard := range shards {
+		select {
+		case <-ctx.Done():
+			return eventID, ctx.Err()
+		case <-shard.done:
+		}
+
+		if shard.err != nil {
+			return eventID, fmt.Errorf("querying events for watch %s: %w", resourceKind, shard.err)
+		}
+
+		for _, stored := range shard.events {
+			eventID = stored.eventID
+
+			if err := fn(stored); err != nil {
+				return eventID, fmt.Errorf("querying events for watch %s: %w", resourceKind, err)
+			}
+		}
+
+		// the events are delivered, so they can be garbage collected
+		shard.events = nil
+	}
+
+	return eventID, nil
+}
+
+func (st *State) scanEventShard(
+	ctx context.Context, resourceKind resource.Kind, after, until int64, condition string, skipOld bool, shard *eventShard,
+) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for watch kind event shard: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	return st.queryKindEvents(conn, resourceKind, after, until, condition, skipOld, func(stored storedEvent) error {
+		shard.events = append(shard.events, stored)
+
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestWatchScanShards(t *testing.T) {
+	t.Parallel()
+
+	var counter sqlite.StatementCounter
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		for i := range 100 {
+			ns := "ns1"
+			if i%3 == 0 {
+				ns = "ns2"
+			}
+
+			require.NoError(t, st.Create(ctx, conformance.NewPathResource(ns, strconv.Itoa(i))))
+		}
+
+		bounds, err := st.EventBounds(ctx)
+		require.NoError(t, err)
+
+		counter.Reset()
+
+		// the watch starts 99 events behind, so the scan is split
+		ch := make(chan state.Event, 100)
+		require.NoError(t, st.WatchKind(ctx, conformance.NewPathResource("ns1", "").Metadata(), ch, state.WithKindStartFromBookmark(bounds.Oldest)))
+
+		var ids []string
+
+		for len(ids) < 66 {
+			select {
+			case ev := <-ch:
+				require.Equal(t, state.Created, ev.Type, "%v", ev.Error)
+
+				ids = append(ids, ev.Resource.Metadata().ID())
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for events, got %d", len(ids))
+			}
+		}
+
+		// the events are delivered in order
+		for i, id := range ids {
+			assert.Equal(t, strconv.Itoa(i+1+i/2), id)
+		}
+
+		var shardScans int
+
+		for stmt, count := range counter.Statements() {
+			if strings.Contains(stmt, "$until_event_id") {
+				shardScans += count
+			}
+		}
+
+		assert.Equal(t, 4, shardScans)
+
+		// the next writes are read with a single scan
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "new")))
+
+		select {
+		case ev := <-ch:
+			assert.Equal(t, "new", ev.Resource.Metadata().ID())
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}, sqlite.WithWatchScanShards(4), sqlite.WithWatchScanShardEvents(10), sqlite.WithStatementCounter(&counter))
+}
@@ -0,0 +1,180 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/siderolabs/gen/panicsafe"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookMaxAttempts    = 5
+	webhookInitialBackoff = 100 * time.Millisecond
+	webhookMaxBackoff     = 10 * time.Second
+	webhookTimeout        = 10 * time.Second
+)
+
+var webhookStats expvar.Map
+
+func init() {
+	expvar.Publish("sqlite_state_webhooks", &webhookStats)
+}
+
+// WebhookFilter decides whether the event should be posted to the webhook.
+type WebhookFilter func(state.Event) bool
+
+// Webhook is an HTTP endpoint notified about the events of the configured resource kinds.
+type Webhook struct {
+	// Filter, if set, selects the events to post.
+	Filter WebhookFilter
+
+	// URL is the endpoint to post the events to.
+	URL string
+
+	// Kinds are the resource kinds to watch.
+	Kinds []resource.Kind
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+}
+
+// startWebhooks starts watches for the configured webhooks.
+//
+// The watches are re-established after errors (e.g. a watch falling behind the compaction),
+// and the changes missed meanwhile are delivered as reconciled by ResilientWatchKind.
+func (st *State) startWebhooks() error {
+	for _, webhook := range st.options.Webhooks {
+		for _, kind := range webhook.Kinds {
+			ch := make(chan state.Event)
+
+			if err := ResilientWatchKind(st.compactionCtx, st, kind, ch,
+				WithRestartBackoff(webhookInitialBackoff, webhookMaxBackoff),
+				WithRestartHandler(func(err error) {
+					webhookStats.Add("restarted", 1)
+
+					st.options.Logger.Warn("webhook watch restarted", zap.String("url", webhook.URL), zap.Error(err))
+				}),
+			); err != nil {
+				return fmt.Errorf("failed to watch %q for webhook %q: %w", kind, webhook.URL, err)
+			}
+
+			st.wg.Add(1)
+
+			go st.runWebhook(webhook, ch)
+		}
+	}
+
+	return nil
+}
+
+func (st *State) runWebhook(webhook Webhook, ch <-chan state.Event) {
+	defer st.wg.Done()
+
+	// the resources existing before the webhook is started are not posted
+	bootstrapped := false
+
+	for {
+		var event state.Event
+
+		select {
+		case <-st.shutdown:
+			return
+		case event = <-ch:
+		}
+
+		switch event.Type {
+		case state.Errored:
+			// the resilient watch reports the errors via the restart handler
+			continue
+		case state.Bootstrapped:
+			bootstrapped = true
+
+			continue
+		case state.Created, state.Updated, state.Destroyed, state.Noop:
+		}
+
+		if !bootstrapped || event.Resource == nil || (webhook.Filter != nil && !webhook.Filter(event)) {
+			continue
+		}
+
+		if err := panicsafe.RunErrF(func() error {
+			return st.postWebhook(st.compactionCtx, webhook.URL, event)
+		})(); err != nil {
+			webhookStats.Add("failed", 1)
+
+			st.options.Logger.Error("failed to post event to webhook", zap.String("url", webhook.URL), zap.Error(err))
+
+			continue
+		}
+
+		webhookStats.Add("delivered", 1)
+	}
+}
+
+// postWebhook posts the event to the webhook, retrying with exponential backoff.
+func (st *State) postWebhook(ctx context.Context, url string, event state.Event) error {
+	body, err := st.MarshalEventJSON(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err = postWebhookOnce(ctx, url, body)
+		if err == nil {
+			return nil
+		}
+
+		if attempt == webhookMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		st.options.Logger.Debug("retrying webhook", zap.String("url", url), zap.Int("attempt", attempt), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, webhookMaxBackoff)
+	}
+}
+
+func postWebhookOnce(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		requests int
+		received []map[string]any
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+
+		// the first delivery fails, and should be retried
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		var event map[string]any
+
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		received = append(received, event)
+	}))
+	t.Cleanup(srv.Close)
+
+	st := newSqliteState(t, "file:"+filepath.Join(t.TempDir(), "state.db"),
+		sqlite.WithWebhook(srv.URL,
+			[]resource.Kind{conformance.NewPathResource("ns1", "").Metadata()},
+			func(ev state.Event) bool {
+				return ev.Resource.Metadata().ID() != "skip"
+			},
+		),
+	)
+
+	ctx := t.Context()
+
+	res := conformance.NewPathResource("ns1", "a")
+
+	require.NoError(t, st.Create(ctx, res))
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "skip")))
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns2", "other")))
+
+	res.Metadata().Labels().Set("key", "value")
+	require.NoError(t, st.Update(ctx, res))
+
+	require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Len(collect, received, 3)
+
+		for i, eventType := range []string{"created", "updated", "destroyed"} {
+			assert.Equal(collect, eventType, received[i]["event"])
+			assert.Equal(collect, "ns1", received[i]["namespace"])
+			assert.Equal(collect, "a", received[i]["id"])
+		}
+
+		assert.Equal(collect, map[string]any{"key": "value"}, received[1]["labels"])
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebhookWatchRestart(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		received = map[string]string{}
+	)
+
+	var (
+		started     = make(chan struct{})
+		startedOnce sync.Once
+		release     = make(chan struct{})
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startedOnce.Do(func() { close(started) })
+
+		// the deliveries are stuck until the watch falls behind the compaction
+		<-release
+
+		var event map[string]any
+
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		received[event["id"].(string)] = event["event"].(string) //nolint:forcetypeassert,errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	var once sync.Once
+
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+
+	st := newSqliteState(t, "file:"+filepath.Join(t.TempDir(), "state.db"),
+		sqlite.WithWebhook(srv.URL, []resource.Kind{conformance.NewPathResource("ns1", "").Metadata()}, nil),
+		sqlite.WithCompactKeepEvents(10),
+		sqlite.WithCompactMinAge(-time.Minute),
+		sqlite.WithCompactionInterval(0),
+		sqlite.WithCompactMaxWatchHold(time.Nanosecond),
+		sqlite.WithSynchronousEventDelivery(true),
+		sqlite.WithLogger(zap.New(core)),
+	)
+
+	ctx := t.Context()
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "0")))
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the delivery")
+	}
+
+	// the watch is stuck delivering the first event, so the next events stay unconsumed
+	for i := 1; i < 20; i++ {
+		require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", strconv.Itoa(i))))
+	}
+
+	// events are stored with second precision
+	time.Sleep(1100 * time.Millisecond)
+
+	// the watch holds back the compaction, so the compaction fails it
+	result, err := st.Compact(ctx)
+	require.NoError(t, err)
+	assert.Positive(t, result.EventsCompacted)
+
+	once.Do(func() { close(release) })
+
+	require.NoError(t, st.Create(ctx, conformance.NewPathResource("ns1", "after")))
+
+	// the watch is re-established, and the compacted events are delivered as well
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Len(collect, received, 21)
+		assert.Equal(collect, "created", received["after"])
+		assert.Equal(collect, "created", received["19"])
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Positive(t, logs.FilterMessage("webhook watch restarted").Len())
+}
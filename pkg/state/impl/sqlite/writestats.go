@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+
+	"github.com/cosi-project/state-sqlite/pkg/sqlitexx"
+)
+
+// bytesWritten holds the estimated number of bytes written per operation type.
+//
+// For each operation (create, update, destroy, append_event), the following keys are maintained:
+//
+//   - <op>_count: number of operations
+//   - <op>_db_bytes: estimated bytes written to the main database file (on checkpoint)
+//   - <op>_wal_bytes: estimated bytes written to the WAL file
+var bytesWritten = new(expvar.Map)
+
+func init() {
+	expvar.Publish("sqlite_state_bytes_written", bytesWritten)
+}
+
+// walFrameHeaderSize is the size of the header of each WAL frame.
+const walFrameHeaderSize = 24
+
+// loadPageSize reads the database page size used to estimate the bytes written.
+func (st *State) loadPageSize(ctx context.Context) error {
+	conn, err := st.db.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("taking connection for page size: %w", err)
+	}
+
+	defer st.db.Put(conn)
+
+	q, err := sqlitexx.NewQuery(conn, `SELECT page_size FROM pragma_page_size()`)
+	if err != nil {
+		return fmt.Errorf("preparing query for page size: %w", err)
+	}
+
+	if err = q.QueryRow(
+		func(stmt *sqlite.Stmt) error {
+			st.pageSize = stmt.GetInt64("page_size")
+
+			return nil
+		},
+	); err != nil {
+		return fmt.Errorf("failed to get page size: %w", err)
+	}
+
+	return nil
+}
+
+// recordWrite updates the write amplification metrics for the operation.
+//
+// SQLite writes whole pages: the estimate assumes that the transaction rewrites the pages holding
+// rowBytes plus one page per modified b-tree. Each page is appended to the WAL first (with a frame header),
+// and later copied into the main database file by the checkpoint.
+func (st *State) recordWrite(op string, rowBytes int64, btrees int64) {
+	if st.pageSize <= 0 {
+		return
+	}
+
+	pages := (rowBytes+st.pageSize-1)/st.pageSize + btrees
+
+	bytesWritten.Add(op+"_count", 1)
+	bytesWritten.Add(op+"_db_bytes", pages*st.pageSize)
+	bytesWritten.Add(op+"_wal_bytes", pages*(st.pageSize+walFrameHeaderSize))
+}
@@ -0,0 +1,46 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlite_test
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/state/conformance"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosi-project/state-sqlite/pkg/state/impl/sqlite"
+)
+
+func bytesWritten(key string) int64 {
+	v := expvar.Get("sqlite_state_bytes_written").(*expvar.Map).Get(key) //nolint:forcetypeassert
+
+	if v == nil {
+		return 0
+	}
+
+	return v.(*expvar.Int).Value() //nolint:forcetypeassert
+}
+
+func TestBytesWritten(t *testing.T) {
+	t.Parallel()
+
+	withSqliteCore(t, func(st *sqlite.State) {
+		ctx := t.Context()
+
+		createBefore, createWALBefore := bytesWritten("create_db_bytes"), bytesWritten("create_wal_bytes")
+		destroyBefore := bytesWritten("destroy_db_bytes")
+
+		res := conformance.NewPathResource("ns1", "a")
+		require.NoError(t, st.Create(ctx, res))
+		require.NoError(t, st.Destroy(ctx, res.Metadata()))
+
+		// other tests run in parallel, so only check that the counters grow
+		assert.Greater(t, bytesWritten("create_db_bytes"), createBefore)
+		assert.Greater(t, bytesWritten("create_wal_bytes"), createWALBefore)
+		assert.Greater(t, bytesWritten("destroy_db_bytes"), destroyBefore)
+	})
+}